@@ -0,0 +1,66 @@
+package pmigrate
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/s3"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//Links with a connection setup time at or above this are considered slow by
+// the "auto" compression mode, which then favors ratio (zstd) over speed (lz4)
+const autoSlowLinkRTT = 2 * time.Millisecond
+
+//isSlowLink guesses if a destination is across a slow network link based on how
+// long it took to establish
+func isSlowLink(dstWtr io.Writer, setupTime time.Duration) bool {
+	if _, isObject := dstWtr.(*s3.Writer); isObject {
+		return true //Smaller snapshots upload faster and cost less to keep
+	}
+	conn, isConn := dstWtr.(net.Conn)
+	if !isConn {
+		return false //Files, pipes and stdout
+	}
+	if _, isUnix := conn.RemoteAddr().(*net.UnixAddr); isUnix {
+		return false
+	}
+	return setupTime >= autoSlowLinkRTT
+}
+
+//getCompressStep returns the compression step of the requested algorithm. A
+// level of 0 selects the algorithm's default, and dictPath optionally provides
+// a zstd dictionary (see -train-dict) which pthaw must find by name in its
+// -dictdir.
+func getCompressStep(compress string, level int, dictPath string, slowLink bool) (transpenc.Step, error) {
+	if strings.ToLower(compress) == "auto" {
+		if compress = "lz4"; slowLink {
+			compress = "zstd"
+		}
+	}
+	step := transpenc.Step{Codec: compress, Opts: transpenc.EncodeOptions{Level: level, DictPath: dictPath}}
+	if compress == "" || strings.ToLower(compress) == "none" {
+		if dictPath != "" {
+			return step, errs.New("Compression dictionaries require zstd compression")
+		}
+		return step, nil
+	}
+	if err := checkCodecKind(compress, transpenc.CodecCompression); err != nil {
+		return step, errs.Append(err, "Unknown compression method: %q, please use none, %s or auto.", compress, strings.Join(transpenc.Codecs(transpenc.CodecCompression), ", "))
+	}
+	return step, nil
+}
+
+//checkCodecKind verifies codec is a registered codec of kind
+func checkCodecKind(codec string, kind transpenc.CodecKind) error {
+	registered, name, found := transpenc.LookupCodec(codec)
+	if !found {
+		return errs.New("No codec: %q is registered", codec)
+	} else if registered.Kind != kind {
+		return errs.New("Codec: %s is for %s, not %s", name, registered.Kind, kind)
+	}
+	return nil
+}
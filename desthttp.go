@@ -0,0 +1,144 @@
+package pmigrate
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/endpoint"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//maxHTTPReply bounds how much of a response body is kept to explain a failure
+const maxHTTPReply = 4096
+
+//isHTTPDest reports if dest is an http:// or https:// URL
+func isHTTPDest(dest string) bool {
+	lower := strings.ToLower(dest)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+//httpDest streams a snapshot as the body of a single chunked request. The
+// transport encoding is sent in the request's headers, so the request is only
+// started once it is known (see start). Close waits for the response, which
+// must have a 2xx status.
+type httpDest struct {
+	client *http.Client
+	req    *http.Request
+	body   *io.PipeWriter
+	result chan error
+}
+
+//newHTTPDest prepares an opts.Method (POST or PUT) request to the URL ep,
+// authenticated by a bearer token if one is given
+func newHTTPDest(ep *endpoint.Endpoint, opts endpoint.Options) (io.WriteCloser, error) {
+	method := strings.ToUpper(opts.Method)
+	if method != http.MethodPost && method != http.MethodPut {
+		return nil, errs.New("HTTP destinations are sent with POST or PUT, not: %q", method)
+	}
+	tlsCfg, err := tlscfg.ClientConfig(opts.TLS)
+	if err != nil {
+		return nil, errs.Append(err, "Could not configure TLS")
+	}
+	bodyRdr, bodyWtr := io.Pipe()
+	req, err := http.NewRequest(method, ep.String(), bodyRdr)
+	if err != nil {
+		return nil, errs.Append(err, "Invalid HTTP destination: %q", ep)
+	}
+	req.ContentLength = -1 //Chunked, the length is not known in advance
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.Token)
+	}
+	return &httpDest{
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext:     (&net.Dialer{Timeout: opts.Timeout}).DialContext,
+			TLSClientConfig: tlsCfg,
+		}},
+		req:  req,
+		body: bodyWtr,
+	}, nil
+}
+
+//start sends the request with transpEnc in its headers, the body follows as
+// it is written
+func (this *httpDest) start(transpEnc transpenc.TranportEncoding) error {
+	if this.result != nil {
+		return errs.New("HTTP request to: %s was already started", this.req.URL.Redacted())
+	}
+	if err := transpEnc.WriteHTTPHeader(this.req.Header); err != nil {
+		return err
+	}
+	this.result = make(chan error, 1)
+	go func() {
+		resp, err := this.client.Do(this.req)
+		if err != nil {
+			err = errs.Append(err, "HTTP request to: %s failed", this.req.URL.Redacted())
+			this.body.CloseWithError(err) //Unblock the writer
+			this.result <- err
+			return
+		}
+		defer resp.Body.Close()
+		reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPReply))
+		if resp.StatusCode/100 != 2 {
+			err = errs.New("HTTP destination: %s responded: %s; %s", this.req.URL.Redacted(), resp.Status, strings.TrimSpace(string(reply)))
+			this.body.CloseWithError(err)
+		}
+		this.result <- err
+	}()
+	return nil
+}
+
+func (this *httpDest) Write(buf []byte) (int, error) {
+	if this.result == nil {
+		return 0, errs.New("HTTP request to: %s has not been started", this.req.URL.Redacted())
+	}
+	n, err := this.body.Write(buf)
+	if err != nil { //The request ended early, its outcome explains why
+		if result := <-this.result; result != nil {
+			err = result
+		}
+		this.result <- err
+	}
+	return n, err
+}
+
+//Close ends the request body and returns the outcome of the request
+func (this *httpDest) Close() error {
+	if this.result == nil {
+		return nil
+	}
+	this.body.Close()
+	err := <-this.result
+	this.result <- err //Later calls see the same outcome
+	return err
+}
+
+//Abort ends the request without completing its body, so the destination does
+// not receive a truncated snapshot as a complete one
+func (this *httpDest) Abort() error {
+	this.body.CloseWithError(errs.New("Snapshot was aborted"))
+	return nil
+}
+
+//ReadTokenFile reads the HTTP bearer token kept in the file at path, tokens are
+// best not taken on the command line where other users could see them
+func ReadTokenFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errs.Append(err, "Could not read HTTP bearer token file: %s", path)
+	}
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", errs.New("HTTP bearer token file: %s is empty", path)
+	}
+	return token, nil
+}
@@ -0,0 +1,29 @@
+package pmigrate
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/migration"
+)
+
+//awaitRestore completes the stream, then waits up to timeout (0 for no limit)
+// for the destination to report the restored process running
+func (this *destStream) awaitRestore(timeout time.Duration) error {
+	if err := this.finish(); err != nil {
+		return errs.Append(err, "Could not complete transmission of process state")
+	}
+	conn, isConn := this.dstWriter.(net.Conn)
+	if !isConn {
+		return errs.New("Two-phase migration requires a tcp, udp, tls or unix socket destination")
+	}
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	return migration.AwaitRunning(conn, func(status migration.Status) {
+		log.Printf("Destination reports the process state %s", status)
+	})
+}
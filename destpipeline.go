@@ -0,0 +1,272 @@
+package pmigrate
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/iotimeout"
+	"github.com/tarndt/pmigrate/lib/progress"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+	"github.com/tarndt/pmigrate/lib/resume"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//Delays between attempts to reconnect a resumable transfer
+const (
+	resumeMinDelay = 250 * time.Millisecond
+	resumeMaxDelay = 8 * time.Second
+)
+
+//destOptions collects everything needed to open an encoded destination stream
+type destOptions struct {
+	dest                      string
+	dialTimeout, writeTimeout time.Duration
+	tlsOpts                   tlscfg.Options
+	httpMethod, httpToken     string
+	identity, knownHosts      string
+	encrypt                   string
+	compress, compressDict    string
+	compressLevel             int
+	checksum                  string
+	resumeTimeout             time.Duration
+	pid                       int    //Of the target, described in repository catalogs
+	name                      string //Of the target if it is not running, as when merging
+	dedup                     bool   //Write chunked snapshots to repositories
+	parent                    string //Resolved reference to the parent of incremental snapshots
+	parentPages               pwriter.PageIndex
+	pageAlign                 bool              //Write page aligned snapshots
+	limiter                   *progress.Limiter //Of the bytes sent, shared by all streams
+	meter                     *progress.Meter
+	ctx                       context.Context //Optional: Interrupts the streams once done
+}
+
+//destStream is one connection (or file) with its compression, encryption and
+// checksums
+type destStream struct {
+	dstWriter     io.WriteCloser
+	dstEncoder    io.WriteCloser
+	outStrm       *bufio.Writer
+	finished      bool
+	ackTimeout    time.Duration
+	stopInterrupt func() bool //Unregisters interrupt from the context of the stream
+}
+
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errs.Append(err, "Could not read entropy source to generate a session ID")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+//openDestStream connects to opts.dest and writes transpEnc, after the
+// encryption and compression details have been recorded in it, ahead of data
+func openDestStream(opts destOptions, transpEnc transpenc.TranportEncoding) (*destStream, error) {
+	var (
+		this = new(destStream)
+		err  error
+	)
+	dialStart := time.Now()
+	if opts.identity != "" && isHTTPDest(opts.dest) {
+		return nil, errs.New("HTTP destinations can not take part in a key exchange, use https and -http-token instead of -identity")
+	}
+	if this.dstWriter, err = getDestWriter(opts); err != nil {
+		return nil, errs.Append(err, "Could not create process state destination")
+	}
+	if opts.ctx != nil {
+		this.stopInterrupt = context.AfterFunc(opts.ctx, this.interrupt)
+	}
+	slowLink := isSlowLink(this.dstWriter, time.Since(dialStart))
+
+	var sessionKey []byte
+	if opts.identity != "" {
+		session, err := getDestSession(this.dstWriter, opts.dest, opts.identity, opts.knownHosts, opts.dialTimeout)
+		if err != nil {
+			this.abort()
+			return nil, errs.Append(err, "Could not authenticate process state destination")
+		}
+		sessionKey = session.SendKey
+	}
+
+	var timeoutWtr io.Writer
+	if opts.writeTimeout > 0 {
+		timeoutWtr = iotimeout.WrapWriteTimeout(this.dstWriter, opts.writeTimeout)
+	} else {
+		timeoutWtr = this.dstWriter
+	}
+
+	//Throughput is measured and limited in bytes sent, after compression
+	wireWtr := opts.limiter.Writer(opts.meter.Writer(timeoutWtr))
+
+	steps, err := getEncodeSteps(opts, sessionKey, slowLink)
+	if err != nil {
+		this.abort()
+		return nil, err
+	}
+	if this.dstEncoder, err = transpenc.NewEncoder(wireWtr, steps, &transpEnc); err != nil {
+		this.abort()
+		return nil, errs.Append(err, "Could not create process state encoder")
+	}
+	this.outStrm = bufio.NewWriter(this.dstEncoder)
+	this.ackTimeout = opts.resumeTimeout
+
+	transpEnc.PageAligned = opts.pageAlign
+	if httpDst, isHTTP := this.dstWriter.(*httpDest); isHTTP {
+		err = httpDst.start(transpEnc) //Sent in the request headers
+	} else {
+		err = transpEnc.Write(this.dstWriter)
+	}
+	if err != nil {
+		this.abort()
+		return nil, errs.Append(err, "Could not write transport encoding")
+	}
+	return this, nil
+}
+
+//getEncodeSteps returns the codecs a stream is encoded with in the order they
+// apply: compression, encryption and then checksums
+func getEncodeSteps(opts destOptions, sessionKey []byte, slowLink bool) ([]transpenc.Step, error) {
+	compressStep, err := getCompressStep(opts.compress, opts.compressLevel, opts.compressDict, slowLink)
+	if err != nil {
+		return nil, errs.Append(err, "Could not create process state compressor")
+	}
+	encryptStep, err := getEncryptStep(opts.encrypt, sessionKey)
+	if err != nil {
+		return nil, errs.Append(err, "Could not create process state encryptor")
+	}
+	checksumStep, err := getChecksumStep(opts.checksum)
+	if err != nil {
+		return nil, errs.Append(err, "Could not create process state checksums")
+	}
+	return []transpenc.Step{compressStep, encryptStep, checksumStep}, nil
+}
+
+//openResumableStream opens a resumable stream and returns how many memory
+// spans the destination already holds
+func openResumableStream(opts destOptions, transpEnc transpenc.TranportEncoding) (*destStream, int, error) {
+	transpEnc.Resumable = true
+	this, err := openDestStream(opts, transpEnc)
+	if err != nil {
+		return nil, 0, err
+	}
+	held, err := this.readAck()
+	if err != nil {
+		this.Close()
+		return nil, 0, err
+	}
+	return this, held, nil
+}
+
+func (this *destStream) Write(buf []byte) (int, error) {
+	return this.outStrm.Write(buf)
+}
+
+//Finish flushes all buffered and compressed data, finalizes the encryption and
+// waits for the destination to acknowledge how many memory spans it holds
+func (this *destStream) Finish() (int, error) {
+	if err := this.finish(); err != nil {
+		return 0, err
+	}
+	return this.readAck()
+}
+
+func (this *destStream) finish() error {
+	if this.finished {
+		return nil
+	}
+	this.finished = true
+	err := this.outStrm.Flush()
+	if closeErr := this.dstEncoder.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (this *destStream) readAck() (int, error) {
+	conn, isConn := this.dstWriter.(net.Conn)
+	if !isConn {
+		return 0, errs.New("Resumable transfers require a tcp, udp, tls or unix socket destination")
+	}
+	if this.ackTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(this.ackTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	return resume.ReadAck(conn)
+}
+
+//Close flushes all buffered and compressed data, finalizes the encryption and
+// closes the destination
+func (this *destStream) Close() error {
+	this.stopInterrupting()
+	err := this.finish()
+	if closeErr := this.dstWriter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//abort closes the destination, discarding what it received where possible
+func (this *destStream) abort() {
+	this.stopInterrupting()
+	if aborter, canAbort := this.dstWriter.(interface{ Abort() error }); canAbort {
+		aborter.Abort()
+	}
+	this.dstWriter.Close()
+}
+
+//interrupt unblocks reads and writes of the destination that are stuck, such
+// as on a hung connection, it may be called from any goroutine
+func (this *destStream) interrupt() {
+	switch dst := this.dstWriter.(type) {
+	case net.Conn:
+		dst.SetDeadline(time.Now())
+	case *httpDest:
+		dst.Abort()
+	}
+}
+
+func (this *destStream) stopInterrupting() {
+	if this.stopInterrupt != nil {
+		this.stopInterrupt()
+	}
+}
+
+//resumeDialer hands out first, then after each failure keeps reconnecting with
+// an increasing delay until opts.resumeTimeout has passed or opts.ctx is done
+func resumeDialer(opts destOptions, transpEnc transpenc.TranportEncoding, first *destStream, firstHeld int) pwriter.ResumeDialer {
+	return func(lastErr error) (pwriter.ResumableStream, int, error) {
+		if lastErr == nil {
+			return first, firstHeld, nil
+		} else if opts.ctx != nil && opts.ctx.Err() != nil {
+			return nil, 0, opts.ctx.Err()
+		}
+		log.Printf("Transfer interrupted, reconnecting; Details:\n\t%s", lastErr)
+
+		deadline := time.Now().Add(opts.resumeTimeout)
+		for delay := resumeMinDelay; ; delay *= 2 {
+			if opts.ctx != nil && opts.ctx.Err() != nil {
+				return nil, 0, opts.ctx.Err()
+			}
+			stream, held, err := openResumableStream(opts, transpEnc)
+			if err == nil {
+				log.Printf("Transfer resumed, destination holds %d memory spans", held)
+				return stream, held, nil
+			}
+			if delay > resumeMaxDelay {
+				delay = resumeMaxDelay
+			}
+			if time.Now().Add(delay).After(deadline) {
+				return nil, 0, errs.Append(err, "Gave up reconnecting after %s", opts.resumeTimeout)
+			}
+			time.Sleep(delay)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package pmigrate
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/tarndt/pmigrate/lib/endpoint"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/s3"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func newNopWriteCloser(wtr io.Writer) io.WriteCloser {
+	return nopCloser{wtr}
+}
+
+func init() {
+	//Schemes named by other packages, whose constructors are implemented here
+	endpoint.SetConstructors(strings.TrimSuffix(prepo.Scheme, ":"), openRepoSnapshot, createRepoSnapshot)
+	endpoint.SetConstructors(strings.TrimSuffix(s3.Scheme, "://"), openObject, createObject)
+	endpoint.SetConstructors(endpoint.HTTP, pullHTTP, newHTTPDest)
+	endpoint.SetConstructors(endpoint.HTTPS, pullHTTP, newHTTPDest)
+}
+
+//getDestWriter opens opts.dest with the constructor of its scheme
+func getDestWriter(opts destOptions) (io.WriteCloser, error) {
+	ep, err := endpoint.Parse(opts.dest)
+	if err != nil {
+		return nil, err
+	}
+	return ep.Create(endpoint.Options{
+		NetOptions: endpoint.NetOptions{Timeout: opts.dialTimeout, TLS: opts.tlsOpts},
+		Token:      opts.httpToken,
+		Method:     opts.httpMethod,
+		Name:       opts.name,
+		PID:        opts.pid,
+		Parent:     opts.parent,
+	})
+}
+
+//createObject starts a streaming upload to the s3://bucket/key object storage
+// destination, which only appears once the snapshot is complete
+func createObject(ep *endpoint.Endpoint, opts endpoint.Options) (io.WriteCloser, error) {
+	bucket, key, err := s3.ParseURL(ep.String())
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := s3.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	wtr, err := client.Create(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return wtr, nil
+}
+
+//normalizeDest checks dest and rewrites the URL forms of stdout and files to
+// their plain ones, which the checks of files, directories and stdout expect
+func normalizeDest(dest string) (string, error) {
+	ep, err := endpoint.Parse(dest)
+	if err != nil {
+		return "", err
+	}
+	switch ep.Scheme {
+	case endpoint.Stdio:
+		return "stdout", nil
+	case endpoint.File:
+		return ep.Path, nil
+	}
+	return dest, nil
+}
+
+// getDestPeerName returns the name used to look up a destination in the known
+// hosts file: the host for network destinations or the path for Unix sockets
+func getDestPeerName(dest string) string {
+	ep, err := endpoint.Parse(dest)
+	if err != nil {
+		return dest
+	} else if ep.Host != "" {
+		return ep.Host
+	}
+	return ep.Path
+}
+
+//isSocketDest reports if dest is a connection oriented socket
+func isSocketDest(dest string) bool {
+	ep, err := endpoint.Parse(dest)
+	return err == nil && ep.Connected()
+}
+
+//AbsDestination checks dest and makes it absolute if it is a snapshot file or
+// directory path, for a process that may run elsewhere to write to, such as
+// with a WatchRequest
+func AbsDestination(dest string) (string, error) {
+	dest, err := normalizeDest(dest)
+	if err != nil || dest == "stdout" || isSocketDest(dest) || prepo.IsRepo(dest) || s3.IsURL(dest) || isHTTPDest(dest) {
+		return dest, err
+	}
+	return filepath.Abs(dest)
+}
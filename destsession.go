@@ -0,0 +1,38 @@
+package pmigrate
+
+import (
+	"net"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/peerauth"
+)
+
+func getDestSession(dstWtr interface{}, dest, identityPath, knownHostsPath string, timeout time.Duration) (*peerauth.Session, error) {
+	conn, isConn := dstWtr.(net.Conn)
+	if !isConn {
+		return nil, errs.New("Peer authentication requires a tcp, udp, tls or unix socket destination")
+	}
+	if knownHostsPath == "" {
+		return nil, errs.New("A known hosts file must be provided to authenticate the destination")
+	}
+
+	identity, err := peerauth.LoadIdentity(identityPath)
+	if err != nil {
+		return nil, err
+	}
+	knownHosts, err := peerauth.LoadTrustedKeys(knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	session, err := peerauth.Client(conn, identity, knownHosts, getDestPeerName(dest))
+	if err != nil {
+		return nil, errs.Append(err, "Handshake with destination failed")
+	}
+	return session, nil
+}
@@ -0,0 +1,35 @@
+package pmigrate
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/pdict"
+)
+
+//TrainDictionary samples the memory of the process with pid and returns a
+// zstd dictionary suited to compressing snapshots of it (see
+// Destination.CompressDict), and how many pages it was trained on
+func TrainDictionary(ctx context.Context, pid int) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rdr, err := attach(ctx, pid)
+	if err != nil {
+		return nil, 0, err
+	}
+	samples, err := pdict.SamplePages(rdr, pdict.DefaultMaxSampleBytes)
+	rdr.Close() //Let the target continue while we train
+	if err != nil {
+		return nil, 0, &TargetError{PID: pid, Name: rdr.GetName(), Err: errs.Append(err, "Could not sample memory")}
+	}
+
+	dict, err := pdict.Train(samples, pdict.DefaultMaxDictSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dict, len(samples), nil
+}
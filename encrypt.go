@@ -0,0 +1,61 @@
+package pmigrate
+
+import (
+	"log"
+	"strings"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//getEncryptStep returns the encryption step of encrypt, which is none or
+// <ALGO>:<PATH TO KEY>, or with a session key only the algorithm
+func getEncryptStep(encrypt string, sessionKey []byte) (transpenc.Step, error) {
+	if sessionKey != nil {
+		return getSessionEncryptStep(encrypt, sessionKey)
+	}
+	if encrypt == "" || strings.ToLower(encrypt) == "none" {
+		return transpenc.Step{}, nil
+	}
+
+	parts := strings.Split(encrypt, ":")
+	if len(parts) != 2 {
+		return transpenc.Step{}, errs.New("Encryption parameter must be in the form <ALGO>:<PATH TO KEY>.")
+	}
+	algo, keypath := strings.ToUpper(parts[0]), parts[1]
+	if err := checkCodecKind(algo, transpenc.CodecEncryption); err != nil {
+		return transpenc.Step{}, errs.Append(err, "Encyption algorithm unknown, valid options are AES-GCM, CHACHA20-POLY1305 (recomended), the deprecated AES-CFB, AES-CTR & AES-OFB, and any others registered: %s", strings.Join(transpenc.Codecs(transpenc.CodecEncryption), ", "))
+	}
+	if (transpenc.EncryptionParams{EncryptAlgo: algo}).IsDeprecated() {
+		log.Printf("Warning: Encryption algorithm %s is deprecated as it does not authenticate data, use AES-GCM or CHACHA20-POLY1305 instead.", algo)
+	}
+	return transpenc.Step{Codec: algo, Opts: transpenc.EncodeOptions{KeyPath: keypath}}, nil
+}
+
+//getSessionEncryptStep protects the stream with a key negotiated by the peer
+// handshake, by default using ChaCha20-Poly1305
+func getSessionEncryptStep(encrypt string, sessionKey []byte) (transpenc.Step, error) {
+	algo := strings.ToUpper(encrypt)
+	switch {
+	case algo == "" || algo == "NONE":
+		algo = transpenc.EncryptChaCha20Poly1305
+	case strings.ContainsRune(algo, ':'):
+		return transpenc.Step{}, errs.New("Encryption key files can not be combined with peer authentication, specify only the algorithm.")
+	}
+
+	if !(transpenc.EncryptionParams{EncryptAlgo: algo}).IsAuthenticated() {
+		return transpenc.Step{}, errs.New("Peer authenticated sessions require AES-GCM or CHACHA20-POLY1305, not: %q", algo)
+	}
+	return transpenc.Step{Codec: algo, Opts: transpenc.EncodeOptions{SessionKey: sessionKey}}, nil
+}
+
+//getChecksumStep returns the step of the integrity codec checksum, if any
+func getChecksumStep(checksum string) (transpenc.Step, error) {
+	if checksum == "" || strings.ToLower(checksum) == "none" {
+		return transpenc.Step{}, nil
+	}
+	if err := checkCodecKind(checksum, transpenc.CodecIntegrity); err != nil {
+		return transpenc.Step{}, errs.Append(err, "Unknown checksum: %q, please use none or %s.", checksum, strings.Join(transpenc.Codecs(transpenc.CodecIntegrity), ", "))
+	}
+	return transpenc.Step{Codec: checksum}, nil
+}
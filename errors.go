@@ -0,0 +1,173 @@
+package pmigrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//cause returns the error of ctx in place of err once ctx is done, as it is why
+// err occurred
+func cause(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+//OptionsError reports options that are invalid or can not be combined, nothing
+// was attempted
+type OptionsError struct {
+	Msg string
+}
+
+func optionsError(format string, args ...interface{}) *OptionsError {
+	return &OptionsError{Msg: fmt.Sprintf(format, args...)}
+}
+
+func (this *OptionsError) Error() string {
+	return this.Msg
+}
+
+//TargetError reports the process being checkpointed could not be found,
+// attached to or captured. The process is left running unless it was halted.
+type TargetError struct {
+	PID  int
+	Name string //Invocation command, if it was attached to
+	Err  error
+}
+
+func (this *TargetError) Error() string {
+	if this.Name != "" {
+		return fmt.Sprintf("Could not capture state of target process with PID: %d and invocation command: %q; %s", this.PID, this.Name, this.Err)
+	}
+	return fmt.Sprintf("Could not capture state of target process with PID: %d; %s", this.PID, this.Err)
+}
+
+func (this *TargetError) Unwrap() error {
+	return this.Err
+}
+
+//DestinationError reports a snapshot could not be written to a destination
+type DestinationError struct {
+	Dest string
+	Err  error
+}
+
+func (this *DestinationError) Error() string {
+	return fmt.Sprintf("Could not write process state to destination: %s; %s", this.Dest, this.Err)
+}
+
+func (this *DestinationError) Unwrap() error {
+	return this.Err
+}
+
+//MigrationError reports a destination did not restore the process of a
+// two-phase migration, the target process was resumed instead of halted
+type MigrationError struct {
+	Dest string
+	PID  int //Of the target process, still running
+	Err  error
+}
+
+func (this *MigrationError) Error() string {
+	return fmt.Sprintf("Destination: %s did not restore the process, target process with PID: %d was resumed; %s", this.Dest, this.PID, this.Err)
+}
+
+func (this *MigrationError) Unwrap() error {
+	return this.Err
+}
+
+//SourceError reports a snapshot could not be received or decoded from a source
+type SourceError struct {
+	Src string
+	Err error
+}
+
+func (this *SourceError) Error() string {
+	return fmt.Sprintf("Could not receive process state from source: %s; %s", this.Src, this.Err)
+}
+
+func (this *SourceError) Unwrap() error {
+	return this.Err
+}
+
+//LoadError reports a received snapshot could not be restored as a process
+type LoadError struct {
+	Name string //Invocation command of the snapshot
+	Err  error
+}
+
+func (this *LoadError) Error() string {
+	return fmt.Sprintf("Could not restore process %q from its snapshot; %s", this.Name, this.Err)
+}
+
+func (this *LoadError) Unwrap() error {
+	return this.Err
+}
+
+//targetProvider records whether the process it provides the state of failed,
+// telling failures to capture it apart from those of its destinations
+type targetProvider struct {
+	lib.StateProvider
+	lock   sync.Mutex //Spans may be read by several goroutines
+	failed bool
+}
+
+func newTargetProvider(provider lib.StateProvider) *targetProvider {
+	return &targetProvider{StateProvider: provider}
+}
+
+func (this *targetProvider) GetRegisters() (*syscall.PtraceRegs, error) {
+	regs, err := this.StateProvider.GetRegisters()
+	return regs, this.fail(err)
+}
+
+func (this *targetProvider) GetMemoryMeta() (pmaps.ProcMap, error) {
+	spans, err := this.StateProvider.GetMemoryMeta()
+	return spans, this.fail(err)
+}
+
+func (this *targetProvider) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	span, err := this.StateProvider.GetMemorySpan(metadata)
+	if err != nil {
+		return span, this.fail(err)
+	}
+	span.ReadCloser = &targetSpan{ReadCloser: span.ReadCloser, target: this}
+	return span, nil
+}
+
+func (this *targetProvider) fail(err error) error {
+	if err != nil && err != io.EOF {
+		this.lock.Lock()
+		this.failed = true
+		this.lock.Unlock()
+	}
+	return err
+}
+
+//consumeError returns err of writing the target to dest as a *TargetError if
+// the target failed, otherwise as a *DestinationError
+func (this *targetProvider) consumeError(ctx context.Context, dest string, err error) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.failed {
+		return &TargetError{PID: this.GetPID(), Name: this.GetName(), Err: err}
+	}
+	return &DestinationError{Dest: dest, Err: cause(ctx, err)}
+}
+
+type targetSpan struct {
+	io.ReadCloser
+	target *targetProvider
+}
+
+func (this *targetSpan) Read(buf []byte) (int, error) {
+	n, err := this.ReadCloser.Read(buf)
+	return n, this.target.fail(err)
+}
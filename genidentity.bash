@@ -0,0 +1,9 @@
+#!/bin/bash
+set -eu
+
+#Generates an Ed25519 identity for pfrez/pthaw -identity, and its public key
+# line for the peer's -known-hosts/-authorized-keys file
+NAME="${1:-identity}"
+openssl genpkey -algorithm ed25519 -out "./$NAME.pem"
+echo "ed25519 `openssl pkey -in ./$NAME.pem -pubout -outform DER | tail -c 32 | base64` $NAME@`hostname`" > "./$NAME.pub"
+cat "./$NAME.pub"
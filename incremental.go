@@ -0,0 +1,116 @@
+package pmigrate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//resolveParent turns a -parent snapshot into the reference recorded in
+// incremental snapshots, which must still find it wherever they are restored:
+// files by their absolute path and repository snapshots by their ID
+func resolveParent(ref string) (string, error) {
+	if !prepo.IsRepo(ref) {
+		path, err := filepath.Abs(ref)
+		if err != nil {
+			return "", errs.Append(err, "Could not resolve parent snapshot path: %s", ref)
+		}
+		if _, err = os.Stat(path); err != nil {
+			return "", errs.Append(err, "Could not find parent snapshot: %s", path)
+		}
+		return path, nil
+	}
+	dir, snapRef, err := prepo.ParseTarget(ref)
+	if err != nil {
+		return "", err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return "", errs.Append(err, "Could not resolve repository path: %s", dir)
+	}
+	repo, err := prepo.Open(dir)
+	if err != nil {
+		return "", err
+	}
+	snap, err := repo.Find(snapRef)
+	if err != nil {
+		return "", err
+	}
+	return prepo.Scheme + dir + "@" + snap.ID, nil
+}
+
+//indexParent reads the parent snapshot, and its own parents, to find which
+// memory pages of the target changed since
+func indexParent(ref string, decodeOpts preader.DecodeOptions) (pwriter.PageIndex, error) {
+	parent, err := preader.OpenSnapshot(ref, decodeOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+	return pwriter.IndexPages(parent)
+}
+
+//repoParentID returns the ID of a parent snapshot stored in the repository in
+// dir, or "" if it is stored elsewhere
+func repoParentID(parent, dir string) string {
+	if !prepo.IsRepo(parent) {
+		return ""
+	}
+	parentDir, id, err := prepo.ParseTarget(parent)
+	if err != nil {
+		return ""
+	}
+	if dir, err = filepath.Abs(dir); err != nil || dir != parentDir {
+		return ""
+	}
+	return id
+}
+
+//Merge flattens src, an incremental snapshot file or repo:dirpath@ref, and the
+// chain of parents it depends on into a standalone snapshot written to dest,
+// with the connection settings of opts and its Decode options to read src. It
+// returns where the snapshot was written, for repositories including its ID.
+// Errors are *OptionsError, *SourceError or *DestinationError, wrapping that of
+// ctx if it is done before the snapshot is written.
+func Merge(ctx context.Context, src string, dest Destination, opts CheckpointOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	snapshot, err := preader.OpenSnapshot(src, opts.Decode)
+	if err != nil {
+		return "", &SourceError{Src: src, Err: err}
+	}
+	defer snapshot.Close()
+	opts.name = snapshot.GetName()
+	destOpts, err := opts.destOptions(dest, snapshot.GetPID())
+	if err != nil {
+		return "", err
+	}
+	destOpts.ctx = ctx
+
+	stream, err := openDestStream(destOpts, transpenc.TranportEncoding{})
+	if err != nil {
+		return "", &DestinationError{Dest: destOpts.dest, Err: err}
+	}
+	wtr := pwriter.NewProcSnapshotWriter(stream)
+	if destOpts.pageAlign {
+		wtr = pwriter.NewAlignedSnapshotWriter(stream)
+	}
+	if err = lib.ConsumeContext(ctx, wtr, snapshot); err == nil {
+		err = stream.finish()
+	}
+	if err != nil {
+		stream.abort()
+		return "", &DestinationError{Dest: destOpts.dest, Err: cause(ctx, err)}
+	}
+	if err = stream.Close(); err != nil {
+		return "", &DestinationError{Dest: destOpts.dest, Err: err}
+	}
+	return describeDest(destOpts.dest, stream), nil
+}
@@ -0,0 +1,59 @@
+//Package ptest provides process state held in memory, for the tests of the
+// packages that capture, write and read it
+package ptest
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pfiles"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//Rip is the instruction pointer of the registers of every MemProvider
+const Rip = 0x1234
+
+//MemProvider is a lib.StateProvider of a process with PID 42 named "test"
+type MemProvider struct {
+	Meta pmaps.ProcMap
+	Data map[uint64][]byte //By start address, spans missing from it are zeros
+}
+
+//NewMemProvider returns a provider of the memory spans of lines, each in the
+// format of /proc/<pid>/maps and filled as by Add
+func NewMemProvider(t testing.TB, lines ...string) *MemProvider {
+	provider := &MemProvider{Data: make(map[uint64][]byte)}
+	for _, line := range lines {
+		provider.Add(t, line)
+	}
+	return provider
+}
+
+//Add adds a memory span filled with a byte distinct to it
+func (this *MemProvider) Add(t testing.TB, line string) {
+	entry, err := pmaps.ParseEntry(strings.NewReader(line))
+	if err != nil {
+		t.Fatalf("Could not parse test entry: %q; Details: %s", line, err)
+	}
+	this.Meta = append(this.Meta, entry)
+	this.Data[entry.MemStart] = bytes.Repeat([]byte{byte(len(this.Meta))}, int(entry.Len()))
+}
+
+func (this *MemProvider) GetName() string { return "test" }
+func (this *MemProvider) GetPID() int     { return 42 }
+func (this *MemProvider) GetRegisters() (*syscall.PtraceRegs, error) {
+	return &syscall.PtraceRegs{Rip: Rip}, nil
+}
+func (this *MemProvider) GetMemoryMeta() (pmaps.ProcMap, error) { return this.Meta, nil }
+func (this *MemProvider) GetFiles() []pfiles.FileEntry          { return nil }
+func (this *MemProvider) Close() error                          { return nil }
+func (this *MemProvider) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	data, has := this.Data[metadata.MemStart]
+	if !has {
+		data = make([]byte, metadata.Len())
+	}
+	return lib.NewMemSpanBytes(metadata, data), nil
+}
@@ -0,0 +1,89 @@
+package aeadstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/tarndt/errs"
+)
+
+/* Stream layout: the plaintext is cut into chunks of at most ChunkSize bytes,
+ * each sealed independently and prefixed with a 4 byte little-endian header:
+ *
+ *	[ciphertext length | finalFlag][ciphertext + tag]
+ *
+ * The header is authenticated as additional data and the nonce of every chunk
+ * is: prefix (7 bytes) | chunk counter (4 bytes, big-endian) | final (1 byte).
+ * Reordering, dropping or replaying chunks therefore fails authentication, and
+ * a stream that ends without a chunk marked final is reported as truncated.
+ */
+
+const (
+	DefaultChunkSize = 64 * 1024
+	MaxChunkSize     = 1<<31 - 1 - 64 //Must leave room for the final flag and AEAD overhead
+
+	NoncePrefixSize = 7
+	nonceSize       = 12
+	headerSize      = 4
+	finalFlag       = uint32(1) << 31
+)
+
+var (
+	ErrTruncated        = errors.New("Encrypted stream ended before its final chunk, it may have been truncated")
+	ErrChunkTooLarge    = errors.New("Encrypted chunk length exceeds the negotiated chunk size")
+	ErrCounterExhausted = errors.New("Encrypted stream exceeded the maximum number of chunks")
+)
+
+//NewAEAD constructs the AEAD for one of the algorithm names recorded in
+// transpenc.EncryptionParams.EncryptAlgo
+func NewAEAD(algo string, key []byte) (cipher.AEAD, error) {
+	switch algo {
+	case "AES-GCM":
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errs.Append(err, "Could not create AES cipher")
+		}
+		return cipher.NewGCM(block)
+	case "CHACHA20-POLY1305":
+		if len(key) != chacha20poly1305.KeySize {
+			return nil, errs.New("ChaCha20-Poly1305 requires a %d byte key, provided key has %d bytes", chacha20poly1305.KeySize, len(key))
+		}
+		return chacha20poly1305.New(key)
+	}
+	return nil, errs.New("Unknown AEAD algorithm: %q, use AES-GCM or CHACHA20-POLY1305", algo)
+}
+
+type chunkNonce [nonceSize]byte
+
+func newChunkNonce(prefix []byte) (chunkNonce, error) {
+	var nonce chunkNonce
+	if len(prefix) != NoncePrefixSize {
+		return nonce, errs.New("Nonce prefix has: %d bytes, rather than the required: %d bytes.", len(prefix), NoncePrefixSize)
+	}
+	copy(nonce[:], prefix)
+	return nonce, nil
+}
+
+func (this *chunkNonce) set(counter uint32, final bool) []byte {
+	binary.BigEndian.PutUint32(this[NoncePrefixSize:], counter)
+	if final {
+		this[nonceSize-1] = 1
+	} else {
+		this[nonceSize-1] = 0
+	}
+	return this[:]
+}
+
+func checkAEAD(aead cipher.AEAD, chunkSize int) error {
+	if aead.NonceSize() != nonceSize {
+		return errs.New("AEAD nonce size is: %d bytes, only %d byte nonces are supported", aead.NonceSize(), nonceSize)
+	}
+	if chunkSize <= 0 || chunkSize > MaxChunkSize {
+		return errs.New("Chunk size: %d, is outside of the valid range 1-%d", chunkSize, MaxChunkSize)
+	}
+	return nil
+}
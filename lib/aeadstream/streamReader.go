@@ -0,0 +1,98 @@
+package aeadstream
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/tarndt/errs"
+)
+
+type streamReader struct {
+	aead    cipher.AEAD
+	nonce   chunkNonce
+	counter uint64
+	src     io.Reader
+
+	maxSealed int
+	sealed    []byte
+	plain     []byte //Authenticated plaintext not yet returned to the caller
+	final     bool
+	err       error
+}
+
+//NewReader returns a reader that authenticates and decrypts a stream produced by
+// a writer from NewWriter. Data is only returned once the chunk containing it
+// has been authenticated, and a stream missing its final chunk yields
+// ErrTruncated rather than io.EOF.
+func NewReader(src io.Reader, aead cipher.AEAD, noncePrefix []byte, chunkSize int) (io.Reader, error) {
+	if err := checkAEAD(aead, chunkSize); err != nil {
+		return nil, err
+	}
+	nonce, err := newChunkNonce(noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		aead:      aead,
+		nonce:     nonce,
+		src:       src,
+		maxSealed: chunkSize + aead.Overhead(),
+	}, nil
+}
+
+func (this *streamReader) Read(buf []byte) (int, error) {
+	for len(this.plain) == 0 {
+		if this.err != nil {
+			return 0, this.err
+		}
+		if this.final {
+			this.err = io.EOF
+			continue
+		}
+		this.err = this.readChunk()
+	}
+	n := copy(buf, this.plain)
+	this.plain = this.plain[n:]
+	return n, nil
+}
+
+func (this *streamReader) readChunk() error {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(this.src, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return errs.Append(err, "Could not read encrypted chunk header: %d", this.counter)
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	final := length&finalFlag != 0
+	length &^= finalFlag
+	if int(length) > this.maxSealed {
+		return ErrChunkTooLarge
+	}
+	if this.counter > math.MaxUint32 {
+		return ErrCounterExhausted
+	}
+
+	if cap(this.sealed) < int(length) {
+		this.sealed = make([]byte, length)
+	}
+	this.sealed = this.sealed[:length]
+	if _, err := io.ReadFull(this.src, this.sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return errs.Append(err, "Could not read encrypted chunk: %d", this.counter)
+	}
+
+	nonce := this.nonce.set(uint32(this.counter), final)
+	plain, err := this.aead.Open(this.sealed[:0], nonce, this.sealed, header[:])
+	if err != nil {
+		return errs.Append(err, "Encrypted chunk: %d failed authentication", this.counter)
+	}
+	this.plain, this.final = plain, final
+	this.counter++
+	return nil
+}
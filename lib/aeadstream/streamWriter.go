@@ -0,0 +1,90 @@
+package aeadstream
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/tarndt/errs"
+)
+
+type streamWriter struct {
+	aead    cipher.AEAD
+	nonce   chunkNonce
+	counter uint64
+	dst     io.Writer
+
+	plain, sealed []byte
+	closed        bool
+}
+
+//NewWriter returns a writer that seals everything written to it as a sequence
+// of authenticated chunks. Close must be called to emit the final chunk, it does
+// not close dst.
+func NewWriter(dst io.Writer, aead cipher.AEAD, noncePrefix []byte, chunkSize int) (io.WriteCloser, error) {
+	if err := checkAEAD(aead, chunkSize); err != nil {
+		return nil, err
+	}
+	nonce, err := newChunkNonce(noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{
+		aead:   aead,
+		nonce:  nonce,
+		dst:    dst,
+		plain:  make([]byte, 0, chunkSize),
+		sealed: make([]byte, headerSize, headerSize+chunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (this *streamWriter) Write(buf []byte) (int, error) {
+	if this.closed {
+		return 0, errs.New("Write to closed encrypted stream")
+	}
+	written := 0
+	for len(buf) > 0 {
+		if len(this.plain) == cap(this.plain) {
+			if err := this.flushChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(this.plain[len(this.plain):cap(this.plain)], buf)
+		this.plain = this.plain[:len(this.plain)+n]
+		buf = buf[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (this *streamWriter) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	return this.flushChunk(true)
+}
+
+func (this *streamWriter) flushChunk(final bool) error {
+	if this.counter > math.MaxUint32 {
+		return ErrCounterExhausted
+	}
+	length := uint32(len(this.plain) + this.aead.Overhead())
+	if final {
+		length |= finalFlag
+	}
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[:], length)
+	copy(this.sealed, header[:])
+
+	nonce := this.nonce.set(uint32(this.counter), final)
+	this.sealed = this.aead.Seal(this.sealed[:headerSize], nonce, this.plain, header[:])
+	if _, err := this.dst.Write(this.sealed); err != nil {
+		return errs.Append(err, "Could not write encrypted chunk: %d", this.counter)
+	}
+
+	this.plain = this.plain[:0]
+	this.counter++
+	return nil
+}
@@ -0,0 +1,99 @@
+package aeadstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+const testChunkSize = 1000
+
+func sealTestStream(t *testing.T, algo string, plain []byte) (sealed, key, noncePrefix []byte) {
+	key, noncePrefix = make([]byte, 32), make([]byte, NoncePrefixSize)
+	rand.Read(key)
+	rand.Read(noncePrefix)
+
+	aead, err := NewAEAD(algo, key)
+	if err != nil {
+		t.Fatalf("NewAEAD(%q) returned: %s", algo, err)
+	}
+	var buf bytes.Buffer
+	wtr, err := NewWriter(&buf, aead, noncePrefix, testChunkSize)
+	if err != nil {
+		t.Fatalf("NewWriter returned: %s", err)
+	}
+	if _, err = wtr.Write(plain); err != nil {
+		t.Fatalf("Write returned: %s", err)
+	}
+	if err = wtr.Close(); err != nil {
+		t.Fatalf("Close returned: %s", err)
+	}
+	return buf.Bytes(), key, noncePrefix
+}
+
+func openTestStream(t *testing.T, algo string, sealed, key, noncePrefix []byte) ([]byte, error) {
+	aead, err := NewAEAD(algo, key)
+	if err != nil {
+		t.Fatalf("NewAEAD(%q) returned: %s", algo, err)
+	}
+	rdr, err := NewReader(bytes.NewReader(sealed), aead, noncePrefix, testChunkSize)
+	if err != nil {
+		t.Fatalf("NewReader returned: %s", err)
+	}
+	return ioutil.ReadAll(rdr)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, algo := range []string{"AES-GCM", "CHACHA20-POLY1305"} {
+		for _, size := range []int{0, 1, testChunkSize, 10*testChunkSize + 7} {
+			plain := make([]byte, size)
+			rand.Read(plain)
+			sealed, key, noncePrefix := sealTestStream(t, algo, plain)
+			result, err := openTestStream(t, algo, sealed, key, noncePrefix)
+			if err != nil {
+				t.Fatalf("%s: Unexpected error decrypting %d bytes: %s", algo, size, err)
+			}
+			if !bytes.Equal(plain, result) {
+				t.Fatalf("%s: Decrypted %d bytes did not match the original plaintext", algo, size)
+			}
+		}
+	}
+}
+
+func TestTamperDetected(t *testing.T) {
+	plain := make([]byte, 5*testChunkSize)
+	sealed, key, noncePrefix := sealTestStream(t, "AES-GCM", plain)
+
+	sealed[2*testChunkSize] ^= 0x01
+	if _, err := openTestStream(t, "AES-GCM", sealed, key, noncePrefix); err == nil {
+		t.Fatalf("A flipped ciphertext bit was not detected")
+	}
+}
+
+func TestTruncationDetected(t *testing.T) {
+	plain := make([]byte, 5*testChunkSize)
+	sealed, key, noncePrefix := sealTestStream(t, "CHACHA20-POLY1305", plain)
+
+	//Cut the stream exactly on a chunk boundary so only the final marker is missing
+	chunkLen := headerSize + testChunkSize + 16
+	if _, err := openTestStream(t, "CHACHA20-POLY1305", sealed[:3*chunkLen], key, noncePrefix); err != ErrTruncated {
+		t.Fatalf("Truncated stream returned: %v, rather than: %v", err, ErrTruncated)
+	}
+}
+
+func TestReorderDetected(t *testing.T) {
+	plain := make([]byte, 3*testChunkSize)
+	for i := range plain {
+		plain[i] = byte(i / testChunkSize)
+	}
+	sealed, key, noncePrefix := sealTestStream(t, "AES-GCM", plain)
+
+	chunkLen := headerSize + testChunkSize + 16
+	swapped := append([]byte{}, sealed[chunkLen:2*chunkLen]...)
+	swapped = append(swapped, sealed[:chunkLen]...)
+	swapped = append(swapped, sealed[2*chunkLen:]...)
+	if _, err := openTestStream(t, "AES-GCM", swapped, key, noncePrefix); err == nil {
+		t.Fatalf("Reordered chunks were not detected")
+	}
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"io"
+
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//ContextStateProvider is a StateProvider whose memory spans can be read until
+// a context is done
+type ContextStateProvider interface {
+	StateProvider
+	GetMemorySpanContext(ctx context.Context, metadata pmaps.Entry) (MemSpan, error)
+}
+
+//ContextStateConsumer is a StateConsumer that stops consuming once a context
+// is done, releasing whatever it started (such as a loader)
+type ContextStateConsumer interface {
+	StateConsumer
+	ConsumeContext(ctx context.Context, provider StateProvider) error
+}
+
+//ConsumeContext has consumer consume provider until ctx is done. Consumers
+// that are not ContextStateConsumers are stopped at the next read from
+// provider, so a consumer stuck writing must be unblocked by its destination
+// (such as a connection closed on ctx). Consumers that fail once ctx is done
+// return the error of ctx.
+func ConsumeContext(ctx context.Context, consumer StateConsumer, provider StateProvider) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	if ctxConsumer, isCtxConsumer := consumer.(ContextStateConsumer); isCtxConsumer {
+		err = ctxConsumer.ConsumeContext(ctx, provider)
+	} else {
+		err = consumer.Consume(WithContext(ctx, provider))
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+//WithContext returns provider failing every read with the error of ctx once it
+// is done, including those of memory spans already handed out
+func WithContext(ctx context.Context, provider StateProvider) StateProvider {
+	if ctx.Done() == nil { //Never done
+		return provider
+	}
+	if streamer, isStreamer := provider.(SpanStreamer); isStreamer {
+		return &ctxStreamer{ctxProvider: ctxProvider{StateProvider: provider, ctx: ctx}, streamer: streamer}
+	}
+	return &ctxProvider{StateProvider: provider, ctx: ctx}
+}
+
+type ctxProvider struct {
+	StateProvider
+	ctx context.Context
+}
+
+func (this *ctxProvider) GetMemoryMeta() (pmaps.ProcMap, error) {
+	if err := this.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return this.StateProvider.GetMemoryMeta()
+}
+
+func (this *ctxProvider) GetMemorySpan(metadata pmaps.Entry) (MemSpan, error) {
+	return this.GetMemorySpanContext(this.ctx, metadata)
+}
+
+func (this *ctxProvider) GetMemorySpanContext(ctx context.Context, metadata pmaps.Entry) (MemSpan, error) {
+	if err := ctx.Err(); err != nil {
+		return MemSpan{}, err
+	}
+	var (
+		span MemSpan
+		err  error
+	)
+	if ctxProvider, isCtxProvider := this.StateProvider.(ContextStateProvider); isCtxProvider {
+		span, err = ctxProvider.GetMemorySpanContext(ctx, metadata)
+	} else {
+		span, err = this.StateProvider.GetMemorySpan(metadata)
+	}
+	if err != nil {
+		return span, err
+	}
+	span.ReadCloser = &ctxReader{ReadCloser: span.ReadCloser, ctx: ctx}
+	return span, nil
+}
+
+//ctxStreamer is the ctxProvider of a SpanStreamer
+type ctxStreamer struct {
+	ctxProvider
+	streamer SpanStreamer
+}
+
+func (this *ctxStreamer) NextMemorySpan() (MemSpan, error) {
+	if err := this.ctx.Err(); err != nil {
+		return MemSpan{}, err
+	}
+	span, err := this.streamer.NextMemorySpan()
+	if err != nil {
+		return span, err
+	}
+	span.ReadCloser = &ctxReader{ReadCloser: span.ReadCloser, ctx: this.ctx}
+	return span, nil
+}
+
+//ctxReader fails reads once ctx is done
+type ctxReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (this *ctxReader) Read(buf []byte) (int, error) {
+	if err := this.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return this.ReadCloser.Read(buf)
+}
@@ -0,0 +1,199 @@
+//Package endpoint parses the sources and destinations of pfrez and pthaw, and
+// opens them. Endpoints are written as URLs:
+//
+//	tcp://host:port?nodelay=0     tls://[::1]:9000     udp://:9000
+//	unix:///run/pthaw.sock        file:///var/tmp/x.snap
+//	-                             (stdin or stdout)
+//
+//The older scheme:arguments forms (tcp:host:port, tcp:port, unix:socketpath)
+// remain accepted, as do bare file paths and the stdin & stdout names. Only the
+// part after the first colon is an address, so socket paths may contain colons
+// and host:port addresses may be bracketed IPv6 literals (tcp:[::1]:9000).
+// Listening endpoints may leave the host out to listen on all addresses.
+//
+//Which schemes exist, how they are addressed, what options they take and how
+// they are opened is kept in a registry (see Register), which other packages
+// add their schemes to.
+package endpoint
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tarndt/errs"
+)
+
+//Endpoint is a parsed source or destination
+type Endpoint struct {
+	Scheme  string //Registered name of the scheme, lower case
+	Host    string //Of network endpoints, empty to listen on all addresses
+	Port    string
+	Path    string     //Of path addressed endpoints, and everything after the scheme of opaque ones
+	Options url.Values //Query parameters of the URL form, valid for the scheme
+	raw     string
+	scheme  *Scheme
+}
+
+//Parse parses an endpoint in any of the accepted forms
+func Parse(str string) (*Endpoint, error) {
+	raw := str
+	str = strings.TrimSpace(str)
+	switch str {
+	case "", "-", "stdin", "stdout":
+		return &Endpoint{Scheme: Stdio, raw: raw, scheme: mustLookup(Stdio)}, nil
+	}
+
+	if sep := strings.Index(str, "://"); sep > 0 {
+		if scheme, isKnown := lookup(str[:sep]); isKnown {
+			return parseURL(str, raw, scheme)
+		}
+		return nil, errs.New("Unknown endpoint scheme: %q in: %q, use one of: %s", str[:sep], raw, strings.Join(Names(), ", "))
+	}
+	if sep := strings.IndexByte(str, ':'); sep > 0 {
+		if scheme, isKnown := lookup(str[:sep]); isKnown {
+			return parseShort(str[sep+1:], raw, scheme)
+		}
+	}
+	return &Endpoint{Scheme: File, Path: str, raw: raw, scheme: mustLookup(File)}, nil
+}
+
+//parseURL parses the scheme://address[?options] form
+func parseURL(str, raw string, scheme *Scheme) (*Endpoint, error) {
+	this := &Endpoint{Scheme: scheme.Name, raw: raw, scheme: scheme}
+	if scheme.Addressing == AddrOpaque { //Parsed by the package that registered it
+		this.Path = str[len(scheme.Name)+len("://"):]
+		return this, nil
+	}
+	u, err := url.Parse(str)
+	if err != nil {
+		return nil, errs.Append(err, "Invalid endpoint: %q", raw)
+	}
+	switch scheme.Addressing {
+	case AddrHostPort:
+		if u.Path != "" && u.Path != "/" {
+			return nil, errs.New("Endpoint: %q must be in the form: %s://host:port, without a path", raw, scheme.Name)
+		}
+		if err = this.setHostPort(u.Host); err != nil {
+			return nil, err
+		}
+	case AddrPath:
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, errs.New("Endpoint: %q must be in the form: %s:///absolute/path (or %s:path)", raw, scheme.Name, scheme.Name)
+		}
+		this.Path = u.Path
+	default:
+		return nil, errs.New("Endpoint: %q can not be written as a URL", raw)
+	}
+	if this.Options = u.Query(); len(this.Options) > 0 {
+		if err = scheme.checkOptions(this.Options); err != nil {
+			return nil, errs.Append(err, "Invalid options of endpoint: %q", raw)
+		}
+	}
+	return this, nil
+}
+
+//parseShort parses the scheme:address form
+func parseShort(addr, raw string, scheme *Scheme) (*Endpoint, error) {
+	this := &Endpoint{Scheme: scheme.Name, raw: raw, scheme: scheme}
+	switch scheme.Addressing {
+	case AddrHostPort:
+		if !strings.ContainsRune(addr, ':') { //Just a port to listen on
+			addr = ":" + addr
+		}
+		if err := this.setHostPort(strings.TrimSpace(addr)); err != nil {
+			return nil, err
+		}
+	case AddrPath, AddrOpaque:
+		this.Path = addr
+	default:
+		return nil, errs.New("Endpoint: %q takes no address", raw)
+	}
+	return this, nil
+}
+
+func (this *Endpoint) setHostPort(hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return errs.Append(err, "Endpoint: %q must be in the form: %s://host:port (IPv6 hosts in brackets: [::1])", this.raw, this.Scheme)
+	} else if port == "" {
+		return errs.New("Endpoint: %q lacks a port", this.raw)
+	}
+	this.Host, this.Port = host, port
+	return nil
+}
+
+//String returns the endpoint as it was given
+func (this *Endpoint) String() string {
+	return this.raw
+}
+
+//Addr returns the host:port of network endpoints, or the path of others
+func (this *Endpoint) Addr() string {
+	if this.scheme.Addressing == AddrHostPort {
+		return net.JoinHostPort(this.Host, this.Port)
+	}
+	return this.Path
+}
+
+//Connected reports if the endpoint is a connection oriented socket, over which
+// a reply can be sent (acknowledgements, restore progress, key exchanges)
+func (this *Endpoint) Connected() bool {
+	return this.scheme.Connected
+}
+
+//Bool returns a boolean option, or def if it was not given
+func (this *Endpoint) Bool(name string, def bool) bool {
+	if value := this.Options.Get(name); value != "" {
+		result, _ := strconv.ParseBool(value) //Checked by Parse
+		return result
+	}
+	return def
+}
+
+//Duration returns a duration option, or def if it was not given
+func (this *Endpoint) Duration(name string, def time.Duration) time.Duration {
+	if value := this.Options.Get(name); value != "" {
+		result, _ := time.ParseDuration(value) //Checked by Parse
+		return result
+	}
+	return def
+}
+
+//Dial connects to a network endpoint
+func (this *Endpoint) Dial(opts NetOptions) (net.Conn, error) {
+	if this.scheme.Dial == nil {
+		return nil, errs.New("Endpoint: %q can not be connected to, it is not a %s socket", this.raw, strings.Join(socketNames(), ", "))
+	} else if this.scheme.Addressing == AddrHostPort && this.Host == "" {
+		return nil, errs.New("Endpoint: %q lacks a host to connect to", this.raw)
+	}
+	return this.scheme.Dial(this, opts)
+}
+
+//Listen listens on a network endpoint
+func (this *Endpoint) Listen(opts NetOptions) (net.Listener, error) {
+	if this.scheme.Listen == nil {
+		return nil, errs.New("Endpoint: %q can not be listened on, it is not a %s socket", this.raw, strings.Join(socketNames(), ", "))
+	}
+	return this.scheme.Listen(this, opts)
+}
+
+//Open opens the endpoint as a source, until ctx is done
+func (this *Endpoint) Open(ctx context.Context, opts Options) (io.ReadCloser, error) {
+	if this.scheme.Open == nil {
+		return nil, errs.New("Endpoint: %q can not be opened as a source", this.raw)
+	}
+	return this.scheme.Open(ctx, this, opts)
+}
+
+//Create opens the endpoint as a destination
+func (this *Endpoint) Create(opts Options) (io.WriteCloser, error) {
+	if this.scheme.Create == nil {
+		return nil, errs.New("Endpoint: %q can not be written to", this.raw)
+	}
+	return this.scheme.Create(this, opts)
+}
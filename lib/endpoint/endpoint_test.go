@@ -0,0 +1,193 @@
+package endpoint
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tarndt/errs"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		str                      string
+		scheme, host, port, path string
+	}{
+		{"", Stdio, "", "", ""},
+		{"-", Stdio, "", "", ""},
+		{"stdout", Stdio, "", "", ""},
+		{"demo.snap", File, "", "", "demo.snap"},
+		{"./odd:name.snap", File, "", "", "./odd:name.snap"},
+		{"file:///var/tmp/x.snap", File, "", "", "/var/tmp/x.snap"},
+		{"file:rel.snap", File, "", "", "rel.snap"},
+		{"tcp://host:9000", TCP, "host", "9000", ""},
+		{"TCP://host:9000/", TCP, "host", "9000", ""},
+		{"tcp://[::1]:9000?nodelay=0", TCP, "::1", "9000", ""},
+		{"tls://:9000", TLS, "", "9000", ""},
+		{"udp://10.0.0.7:7000", UDP, "10.0.0.7", "7000", ""},
+		{"unix:///run/p.sock", Unix, "", "", "/run/p.sock"},
+		{"tcp:host:9000", TCP, "host", "9000", ""},
+		{"tcp:9000", TCP, "", "9000", ""},
+		{"tcp:[::1]:9000", TCP, "::1", "9000", ""},
+		{"unix:/run/a:b.sock", Unix, "", "", "/run/a:b.sock"},
+		{"https://example.com/x.snap", HTTPS, "", "", "example.com/x.snap"},
+	} {
+		ep, err := Parse(test.str)
+		if err != nil {
+			t.Fatalf("Could not parse: %q: %s", test.str, err)
+		}
+		if ep.Scheme != test.scheme || ep.Host != test.host || ep.Port != test.port || ep.Path != test.path {
+			t.Fatalf("Parsed: %q as %+v", test.str, ep)
+		}
+		if ep.String() != test.str {
+			t.Fatalf("String of: %q is: %q", test.str, ep.String())
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, str := range []string{
+		"ftp://host/x",
+		"tcp://host",
+		"tcp://host:",
+		"tcp://::1:9000",
+		"tcp://host:9000/path",
+		"tcp://host:9000?nodelay=maybe",
+		"tcp://host:9000?linger=1",
+		"tcp://host:9000?nodelay=1&nodelay=0",
+		"udp://host:9000?nodelay=1",
+		"unix://remote/run/p.sock",
+	} {
+		if ep, err := Parse(str); err == nil {
+			t.Fatalf("Parsed invalid endpoint: %q as %+v", str, ep)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	ep, err := Parse("tls://host:9000?nodelay=false&keepalive=15s&servername=other")
+	if err != nil {
+		t.Fatalf("Could not parse: %s", err)
+	}
+	if ep.Bool("nodelay", true) {
+		t.Fatalf("nodelay option was not read")
+	} else if ep.Duration("keepalive", 0) != 15*time.Second {
+		t.Fatalf("keepalive option was not read")
+	} else if ep.Options.Get("servername") != "other" {
+		t.Fatalf("servername option was not read")
+	} else if ep.Duration("missing", time.Minute) != time.Minute {
+		t.Fatalf("Default of missing option was not returned")
+	}
+	if ep, _ = Parse("tcp:host:9000"); !ep.Bool("nodelay", true) {
+		t.Fatalf("Default of missing option was not returned")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register(Scheme{Name: "testopaque", Addressing: AddrOpaque})
+	ep, err := Parse("testopaque:/some/where@ref")
+	if err != nil || ep.Scheme != "testopaque" || ep.Path != "/some/where@ref" {
+		t.Fatalf("Registered scheme was not parsed: %+v, %v", ep, err)
+	} else if ep.Connected() {
+		t.Fatalf("Opaque scheme is not connected")
+	}
+	if _, err = ep.Dial(NetOptions{}); err == nil {
+		t.Fatalf("Dialed a scheme without a dialer")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Registering a scheme twice did not panic")
+		}
+	}()
+	Register(Scheme{Name: "TESTOPAQUE"})
+}
+
+func TestOpenCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.snap")
+	ep, err := Parse("file://" + path)
+	if err != nil {
+		t.Fatalf("Could not parse: %s", err)
+	}
+	wtr, err := ep.Create(Options{})
+	if err != nil {
+		t.Fatalf("Could not create: %s", err)
+	}
+	wtr.Write([]byte("hello"))
+	wtr.Close()
+	rdr, err := ep.Open(context.Background(), Options{})
+	if err != nil {
+		t.Fatalf("Could not open: %s", err)
+	}
+	got, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("Read: %q, %v from file endpoint", got, err)
+	}
+
+	Register(Scheme{Name: "testconstructed", Addressing: AddrOpaque})
+	if ep, err = Parse("testconstructed:there"); err != nil {
+		t.Fatalf("Could not parse: %s", err)
+	} else if _, err = ep.Create(Options{}); err == nil {
+		t.Fatalf("Created an endpoint of a scheme without constructors")
+	}
+	SetConstructors("testconstructed", nil, func(ep *Endpoint, opts Options) (io.WriteCloser, error) {
+		return nopWriteCloser{}, errs.New("Created: %s for: %s", ep.Path, opts.Name)
+	})
+	if _, err = ep.Create(Options{Name: "test"}); err == nil || !strings.Contains(err.Error(), "Created: there for: test") {
+		t.Fatalf("Constructor set on a registered scheme was not used: %v", err)
+	} else if _, err = ep.Open(context.Background(), Options{}); err == nil {
+		t.Fatalf("Opened an endpoint of a scheme that can not be a source")
+	}
+}
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(buf []byte) (int, error) { return len(buf), nil }
+func (nopWriteCloser) Close() error                  { return nil }
+
+func TestDialListen(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "[::1]"} {
+		listenEp, err := Parse("tcp://" + addr + ":0?nodelay=1")
+		if err != nil {
+			t.Fatalf("Could not parse: %s", err)
+		}
+		listener, err := listenEp.Listen(NetOptions{})
+		if err != nil {
+			if addr == "[::1]" {
+				t.Logf("Skipping IPv6, listen failed: %s", err)
+				continue
+			}
+			t.Fatalf("Could not listen: %s", err)
+		}
+		defer listener.Close()
+
+		dialEp, err := Parse("tcp://" + listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Could not parse: %s", err)
+		}
+		if !dialEp.Connected() {
+			t.Fatalf("tcp endpoints are connected")
+		}
+		go func() {
+			conn, err := dialEp.Dial(NetOptions{Timeout: time.Second})
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Could not accept: %s", err)
+		}
+		got, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(got) != "hello" {
+			t.Fatalf("Read: %q, %v over: %s", got, err, listener.Addr())
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/rudp"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+)
+
+func dialTCP(ep *Endpoint, opts NetOptions) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: opts.Timeout, KeepAlive: ep.Duration("keepalive", 0)}
+	conn, err := dialer.Dial("tcp", ep.Addr())
+	if err != nil {
+		return nil, errs.Append(err, "TCP connection to: %s failed", ep.Addr())
+	}
+	applyTCPOptions(ep, conn)
+	return conn, nil
+}
+
+func listenTCP(ep *Endpoint, opts NetOptions) (net.Listener, error) {
+	cfg := net.ListenConfig{KeepAlive: ep.Duration("keepalive", 0)}
+	listener, err := cfg.Listen(context.Background(), "tcp", ep.Addr())
+	if err != nil {
+		return nil, errs.Append(err, "Listen: tcp/%s failed", ep.Addr())
+	}
+	return tcpListener{Listener: listener, ep: ep}, nil
+}
+
+//tcpListener applies the endpoint's options to accepted connections
+type tcpListener struct {
+	net.Listener
+	ep *Endpoint
+}
+
+func (this tcpListener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err == nil {
+		applyTCPOptions(this.ep, conn)
+	}
+	return conn, err
+}
+
+//applyTCPOptions sets the options of TCP connections that can only be set once
+// connected. Nagle's algorithm is disabled unless nodelay=0 is given.
+func applyTCPOptions(ep *Endpoint, conn net.Conn) {
+	if tcpConn, isTCP := conn.(*net.TCPConn); isTCP {
+		tcpConn.SetNoDelay(ep.Bool("nodelay", true))
+	}
+}
+
+//dialTLS verifies the server against the servername option, -tls-server-name
+// or the host, in that order of preference
+func dialTLS(ep *Endpoint, opts NetOptions) (net.Conn, error) {
+	if serverName := ep.Options.Get("servername"); serverName != "" {
+		opts.TLS.ServerName = serverName
+	} else if opts.TLS.ServerName == "" {
+		opts.TLS.ServerName = ep.Host
+	}
+	cfg, err := tlscfg.ClientConfig(opts.TLS)
+	if err != nil {
+		return nil, errs.Append(err, "Could not configure TLS")
+	}
+	conn, err := dialTCP(ep, opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if opts.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(opts.Timeout))
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errs.Append(err, "TLS connection to: %s failed", ep.Addr())
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func listenTLS(ep *Endpoint, opts NetOptions) (net.Listener, error) {
+	cfg, err := tlscfg.ServerConfig(opts.TLS)
+	if err != nil {
+		return nil, errs.Append(err, "Could not configure TLS")
+	}
+	listener, err := listenTCP(ep, opts)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, cfg), nil
+}
+
+//UDP endpoints carry reliable streams over datagrams (see lib/rudp)
+func dialUDP(ep *Endpoint, opts NetOptions) (net.Conn, error) {
+	conn, err := rudp.Dial(ep.Addr(), opts.Timeout)
+	if err != nil {
+		return nil, errs.Append(err, "UDP connection to: %s failed", ep.Addr())
+	}
+	return conn, nil
+}
+
+func listenUDP(ep *Endpoint, opts NetOptions) (net.Listener, error) {
+	listener, err := rudp.Listen(ep.Addr())
+	if err != nil {
+		return nil, errs.Append(err, "Listen: udp/%s failed", ep.Addr())
+	}
+	return listener, nil
+}
+
+func dialUnix(ep *Endpoint, opts NetOptions) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", ep.Path, opts.Timeout)
+	if err != nil {
+		return nil, errs.Append(err, "Unix socket connection to: %s failed", ep.Path)
+	}
+	return conn, nil
+}
+
+func listenUnix(ep *Endpoint, opts NetOptions) (net.Listener, error) {
+	listener, err := net.Listen("unix", ep.Path)
+	if err != nil {
+		return nil, errs.Append(err, "Listen: unix/%s failed", ep.Path)
+	}
+	return listener, nil
+}
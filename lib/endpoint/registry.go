@@ -0,0 +1,240 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+)
+
+//Names of the built-in schemes
+const (
+	Stdio = "stdio"
+	File  = "file"
+	TCP   = "tcp"
+	TLS   = "tls"
+	UDP   = "udp"
+	Unix  = "unix"
+	HTTP  = "http"
+	HTTPS = "https"
+)
+
+//Addressing is how endpoints of a scheme are addressed
+type Addressing int
+
+const (
+	AddrNone     Addressing = iota //Nothing follows the scheme
+	AddrHostPort                   //host:port
+	AddrPath                       //A file system path
+	AddrOpaque                     //Parsed by the package that registered the scheme
+)
+
+//OptionKind is the type of the value of an option
+type OptionKind int
+
+const (
+	OptString OptionKind = iota
+	OptBool
+	OptDuration
+)
+
+//NetOptions configure the dialing and listening of network endpoints
+type NetOptions struct {
+	Timeout time.Duration //Of dialing, 0 for the system default
+	TLS     tlscfg.Options
+}
+
+//Options configure the opening of endpoints as sources and destinations
+type Options struct {
+	NetOptions
+	Token  string //Bearer token http(s) endpoints are requested with
+	Method string //Of requests to http(s) destinations, POST or PUT
+	//Describe the snapshot to destinations that catalogue them
+	Name   string //Invocation command of the process
+	PID    int
+	Parent string //Reference to the snapshot an incremental one builds on
+}
+
+//OpenFunc opens an endpoint as a source, until ctx is done
+type OpenFunc func(ctx context.Context, ep *Endpoint, opts Options) (io.ReadCloser, error)
+
+//CreateFunc opens an endpoint as a destination
+type CreateFunc func(ep *Endpoint, opts Options) (io.WriteCloser, error)
+
+//Scheme describes a kind of endpoint
+type Scheme struct {
+	Name       string
+	Addressing Addressing
+	Connected  bool                  //Connection oriented sockets
+	Options    map[string]OptionKind //Accepted by the URL form
+	//Dial and Listen open network endpoints, nil for other schemes
+	Dial   func(ep *Endpoint, opts NetOptions) (net.Conn, error)
+	Listen func(ep *Endpoint, opts NetOptions) (net.Listener, error)
+	//Open and Create open endpoints as a source and as a destination, nil if
+	// the scheme can not be one. Sources of sockets are accepted from their
+	// Listener instead.
+	Open   OpenFunc
+	Create CreateFunc
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]*Scheme)
+)
+
+//Register adds a scheme, it panics if the name is taken as it is called on
+// initialization
+func Register(scheme Scheme) {
+	scheme.Name = strings.ToLower(scheme.Name)
+	if scheme.Name == "" || strings.ContainsAny(scheme.Name, ":/") {
+		panic(fmt.Sprintf("Invalid endpoint scheme name: %q", scheme.Name))
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, isTaken := registry[scheme.Name]; isTaken {
+		panic(fmt.Sprintf("Endpoint scheme: %q is already registered", scheme.Name))
+	}
+	registry[scheme.Name] = &scheme
+}
+
+//SetConstructors sets the Open and Create constructors of the registered scheme
+// name, for schemes implemented by another package than the one that named
+// them. It panics if the scheme is unknown as it is called on initialization.
+func SetConstructors(name string, open OpenFunc, create CreateFunc) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	scheme, isKnown := registry[strings.ToLower(name)]
+	if !isKnown {
+		panic(fmt.Sprintf("Endpoint scheme: %q is not registered", name))
+	}
+	scheme.Open, scheme.Create = open, create
+}
+
+//Lookup returns the registered scheme of name
+func Lookup(name string) (Scheme, bool) {
+	scheme, isKnown := lookup(name)
+	if !isKnown {
+		return Scheme{}, false
+	}
+	return *scheme, true
+}
+
+func lookup(name string) (*Scheme, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	scheme, isKnown := registry[strings.ToLower(strings.TrimSpace(name))]
+	return scheme, isKnown
+}
+
+func mustLookup(name string) *Scheme {
+	scheme, _ := lookup(name)
+	return scheme
+}
+
+//Names returns the names of the registered schemes in order
+func Names() []string {
+	return names(func(*Scheme) bool { return true })
+}
+
+func socketNames() []string {
+	return names(func(scheme *Scheme) bool { return scheme.Dial != nil })
+}
+
+func names(include func(*Scheme) bool) []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	var result []string
+	for name, scheme := range registry {
+		if include(scheme) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+//checkOptions reports options the scheme does not take, or values of the wrong type
+func (this *Scheme) checkOptions(options url.Values) error {
+	for name, values := range options {
+		kind, isKnown := this.Options[name]
+		if !isKnown {
+			var valid []string
+			for name := range this.Options {
+				valid = append(valid, name)
+			}
+			sort.Strings(valid)
+			if len(valid) == 0 {
+				return errs.New("%s endpoints take no options, not: %q", this.Name, name)
+			}
+			return errs.New("Unknown %s endpoint option: %q, use one of: %s", this.Name, name, strings.Join(valid, ", "))
+		} else if len(values) != 1 {
+			return errs.New("Endpoint option: %q is given %d times", name, len(values))
+		}
+		var err error
+		switch kind {
+		case OptBool:
+			_, err = strconv.ParseBool(values[0])
+		case OptDuration:
+			_, err = time.ParseDuration(values[0])
+		}
+		if err != nil {
+			return errs.Append(err, "Invalid value of endpoint option: %q", name)
+		}
+	}
+	return nil
+}
+
+func init() {
+	tcpOptions := map[string]OptionKind{"nodelay": OptBool, "keepalive": OptDuration}
+	tlsOptions := map[string]OptionKind{"nodelay": OptBool, "keepalive": OptDuration, "servername": OptString}
+	for _, scheme := range []Scheme{
+		{Name: Stdio, Addressing: AddrNone, Open: openStdin, Create: createStdout},
+		{Name: File, Addressing: AddrPath, Open: openFile, Create: createFile},
+		{Name: TCP, Addressing: AddrHostPort, Connected: true, Options: tcpOptions, Dial: dialTCP, Listen: listenTCP, Create: createSocket},
+		{Name: TLS, Addressing: AddrHostPort, Connected: true, Options: tlsOptions, Dial: dialTLS, Listen: listenTLS, Create: createSocket},
+		{Name: UDP, Addressing: AddrHostPort, Connected: true, Dial: dialUDP, Listen: listenUDP, Create: createSocket},
+		{Name: Unix, Addressing: AddrPath, Connected: true, Dial: dialUnix, Listen: listenUnix, Create: createSocket},
+		{Name: HTTP, Addressing: AddrOpaque},
+		{Name: HTTPS, Addressing: AddrOpaque},
+	} {
+		Register(scheme)
+	}
+}
+
+func openStdin(ctx context.Context, ep *Endpoint, opts Options) (io.ReadCloser, error) {
+	return os.Stdin, nil
+}
+
+func createStdout(ep *Endpoint, opts Options) (io.WriteCloser, error) {
+	return os.Stdout, nil
+}
+
+func openFile(ctx context.Context, ep *Endpoint, opts Options) (io.ReadCloser, error) {
+	file, err := os.Open(ep.Path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func createFile(ep *Endpoint, opts Options) (io.WriteCloser, error) {
+	file, err := os.Create(ep.Path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func createSocket(ep *Endpoint, opts Options) (io.WriteCloser, error) {
+	return ep.Dial(opts.NetOptions)
+}
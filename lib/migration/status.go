@@ -0,0 +1,113 @@
+//Package migration implements the control channel of two-phase migrations, over
+// which the destination reports the progress of a restore back to the source so
+// the source process is only halted once its replacement is running.
+package migration
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/tarndt/errs"
+)
+
+//Status is a milestone of a restore reported by the destination
+type Status byte
+
+const (
+	StatusReceived Status = 'R' //The complete snapshot has been read
+	StatusLoaded   Status = 'L' //Memory is loaded, execution has not started
+	StatusRunning  Status = 'X' //The restored process has been resumed
+	StatusFailed   Status = 'F' //The restore failed, a detail message follows
+)
+
+func (this Status) String() string {
+	switch this {
+	case StatusReceived:
+		return "received"
+	case StatusLoaded:
+		return "loaded"
+	case StatusRunning:
+		return "running"
+	case StatusFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+//Status reports are sent back over the connection (outside of any compression
+// or encryption) that carried the first stream of a snapshot, each is the
+// magic, the status and a length prefixed detail message.
+const (
+	statusMagic  = uint32(0x50535431) //"PST1"
+	maxDetailLen = 4096
+)
+
+//WriteStatus reports status to the source, detail explains failures
+func WriteStatus(dst io.Writer, status Status, detail string) error {
+	if len(detail) > maxDetailLen {
+		detail = detail[:maxDetailLen]
+	}
+	buf := make([]byte, 7, 7+len(detail))
+	binary.BigEndian.PutUint32(buf[:4], statusMagic)
+	buf[4] = byte(status)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(detail)))
+	if _, err := dst.Write(append(buf, detail...)); err != nil {
+		return errs.Append(err, "Could not write restore status: %s", status)
+	}
+	return nil
+}
+
+//ReadStatus reads the next status report and its detail message
+func ReadStatus(src io.Reader) (Status, string, error) {
+	var buf [7]byte
+	if _, err := io.ReadFull(src, buf[:]); err != nil {
+		return 0, "", errs.Append(err, "Could not read restore status")
+	}
+	if binary.BigEndian.Uint32(buf[:4]) != statusMagic {
+		return 0, "", errs.New("Destination sent an invalid restore status, is it a version of pthaw that supports two-phase migration?")
+	}
+	detailLen := binary.BigEndian.Uint16(buf[5:])
+	if detailLen > maxDetailLen {
+		return 0, "", errs.New("Destination sent an implausibly long restore status detail: %d bytes", detailLen)
+	}
+	detail := make([]byte, detailLen)
+	if _, err := io.ReadFull(src, detail); err != nil {
+		return 0, "", errs.Append(err, "Could not read restore status detail")
+	}
+
+	status := Status(buf[4])
+	switch status {
+	case StatusReceived, StatusLoaded, StatusRunning, StatusFailed:
+		return status, string(detail), nil
+	}
+	return 0, "", errs.New("Destination sent an unknown restore status: %d", buf[4])
+}
+
+//AwaitRunning reads status reports until the destination reports the restored
+// process running, calling progress (if not nil) for each one. A failure report
+// or anything out of order is returned as an error.
+func AwaitRunning(src io.Reader, progress func(Status)) error {
+	for expected := StatusReceived; ; {
+		status, detail, err := ReadStatus(src)
+		if err != nil {
+			return err
+		}
+		if status == StatusFailed {
+			return errs.New("Destination failed to restore the process: %s", detail)
+		} else if status != expected {
+			return errs.New("Destination reported the restore %s while %s was expected", status, expected)
+		}
+		if progress != nil {
+			progress(status)
+		}
+
+		switch status {
+		case StatusReceived:
+			expected = StatusLoaded
+		case StatusLoaded:
+			expected = StatusRunning
+		case StatusRunning:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package migration
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAwaitRunning(t *testing.T) {
+	var buf bytes.Buffer
+	for _, status := range []Status{StatusReceived, StatusLoaded, StatusRunning} {
+		if err := WriteStatus(&buf, status, ""); err != nil {
+			t.Fatalf("WriteStatus returned: %s", err)
+		}
+	}
+	var seen []Status
+	if err := AwaitRunning(&buf, func(status Status) { seen = append(seen, status) }); err != nil {
+		t.Fatalf("AwaitRunning returned: %s", err)
+	} else if len(seen) != 3 {
+		t.Fatalf("Expected 3 progress reports, not: %v", seen)
+	}
+}
+
+func TestAwaitRunningFailures(t *testing.T) {
+	var buf bytes.Buffer
+	WriteStatus(&buf, StatusReceived, "")
+	WriteStatus(&buf, StatusFailed, "loader exploded")
+	if err := AwaitRunning(&buf, nil); err == nil || !strings.Contains(err.Error(), "loader exploded") {
+		t.Fatalf("Expected the failure detail, not: %v", err)
+	}
+
+	buf.Reset()
+	WriteStatus(&buf, StatusRunning, "")
+	if err := AwaitRunning(&buf, nil); err == nil {
+		t.Fatalf("Running before received was accepted")
+	}
+
+	//A connection closed early must not count as success
+	buf.Reset()
+	WriteStatus(&buf, StatusReceived, "")
+	if err := AwaitRunning(&buf, nil); err == nil {
+		t.Fatalf("Truncated status reports were accepted")
+	}
+}
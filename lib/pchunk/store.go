@@ -0,0 +1,185 @@
+//Package pchunk implements a content addressed store of memory pages (chunks),
+// shared by the snapshots that reference them.
+//
+//Chunks are kept in <dir>/<first two hex digits>/<hex SHA-256 digest>. The
+// store does not track which snapshots reference a chunk, its owner (such as a
+// prepo repository) derives reference counts and removes unreferenced chunks.
+package pchunk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+)
+
+//Ensure Store implements ChunkSink and ChunkSource
+var (
+	_ lib.ChunkSink   = new(Store)
+	_ lib.ChunkSource = new(Store)
+)
+
+const (
+	//HashSize is the size of a chunk's digest
+	HashSize = sha256.Size
+	tempExt  = ".tmp"
+)
+
+//Hash is the SHA-256 digest of a chunk, which is also its address
+type Hash [HashSize]byte
+
+//Sum returns the address of data
+func Sum(data []byte) Hash {
+	return sha256.Sum256(data)
+}
+
+func (this Hash) String() string {
+	return hex.EncodeToString(this[:])
+}
+
+//ParseHash parses the hex form of a Hash
+func ParseHash(str string) (Hash, error) {
+	var hash Hash
+	if len(str) != 2*HashSize {
+		return hash, errs.New("Invalid chunk hash: %q", str)
+	}
+	_, err := hex.Decode(hash[:], []byte(str))
+	if err != nil {
+		return hash, errs.Append(err, "Invalid chunk hash: %q", str)
+	}
+	return hash, nil
+}
+
+//Store keeps chunks in a directory, it is safe for concurrent use by several
+// processes
+type Store struct {
+	dir string
+}
+
+//Open opens the store in dir, creating it if it does not exist yet
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errs.Append(err, "Could not create chunk store: %s", dir)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (this *Store) path(hash Hash) string {
+	str := hash.String()
+	return filepath.Join(this.dir, str[:2], str)
+}
+
+//Put stores data under hash unless the store already holds it, and reports if
+// it was added. A chunk that is already held has its modification time
+// refreshed, as it is used again.
+func (this *Store) Put(hash Hash, data []byte) (bool, error) {
+	path := this.path(hash)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, errs.Append(err, "Could not create chunk directory: %s", filepath.Dir(path))
+	}
+	//Writers racing to add the same chunk each use their own temporary file
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return false, errs.Append(err, "Could not read entropy source to name a chunk")
+	}
+	temp := path + "." + hex.EncodeToString(suffix) + tempExt
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		os.Remove(temp)
+		return false, errs.Append(err, "Could not write chunk: %s", hash)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return false, errs.Append(err, "Could not store chunk: %s", hash)
+	}
+	return true, nil
+}
+
+//Get returns the chunk stored under hash, after verifying its content
+func (this *Store) Get(hash Hash) ([]byte, error) {
+	data, err := ioutil.ReadFile(this.path(hash))
+	if err != nil {
+		return nil, errs.Append(err, "Could not read chunk: %s", hash)
+	}
+	if sum := Sum(data); !bytes.Equal(sum[:], hash[:]) {
+		return nil, errs.New("Chunk: %s is corrupt, its content hashes to: %s", hash, sum)
+	}
+	return data, nil
+}
+
+//PutChunk implements lib.ChunkSink
+func (this *Store) PutChunk(hash [HashSize]byte, data []byte) error {
+	_, err := this.Put(hash, data)
+	return err
+}
+
+//GetChunk implements lib.ChunkSource
+func (this *Store) GetChunk(hash [HashSize]byte) ([]byte, error) {
+	return this.Get(hash)
+}
+
+//Remove deletes a chunk
+func (this *Store) Remove(hash Hash) error {
+	if err := os.Remove(this.path(hash)); err != nil && !os.IsNotExist(err) {
+		return errs.Append(err, "Could not remove chunk: %s", hash)
+	}
+	return nil
+}
+
+//Walk calls fn for every chunk in the store
+func (this *Store) Walk(fn func(hash Hash, info os.FileInfo) error) error {
+	return this.walk(func(name, path string, info os.FileInfo) error {
+		hash, err := ParseHash(name)
+		if err != nil {
+			return nil
+		}
+		return fn(hash, info)
+	})
+}
+
+//RemoveTemps deletes the temporary files of writes interrupted at least minAge ago
+func (this *Store) RemoveTemps(minAge time.Duration) error {
+	return this.walk(func(name, path string, info os.FileInfo) error {
+		if filepath.Ext(name) != tempExt || time.Since(info.ModTime()) < minAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errs.Append(err, "Could not remove: %s", path)
+		}
+		return nil
+	})
+}
+
+func (this *Store) walk(fn func(name, path string, info os.FileInfo) error) error {
+	dirs, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		return errs.Append(err, "Could not list chunk store: %s", this.dir)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		dirPath := filepath.Join(this.dir, dir.Name())
+		infos, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return errs.Append(err, "Could not list chunk directory: %s", dirPath)
+		}
+		for _, info := range infos {
+			if err = fn(info.Name(), filepath.Join(dirPath, info.Name()), info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
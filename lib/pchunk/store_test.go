@@ -0,0 +1,74 @@
+package pchunk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pchunk")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Could not open chunk store: %s", err)
+	}
+
+	page := bytes.Repeat([]byte{7}, 4096)
+	hash := Sum(page)
+	if added, err := store.Put(hash, page); err != nil || !added {
+		t.Fatalf("Put of a new chunk returned %t, %v", added, err)
+	}
+	if added, err := store.Put(hash, page); err != nil || added {
+		t.Fatalf("Put of a held chunk returned %t, %v", added, err)
+	}
+	if data, err := store.Get(hash); err != nil || !bytes.Equal(data, page) {
+		t.Fatalf("Get returned a different chunk; error: %v", err)
+	}
+	if parsed, err := ParseHash(hash.String()); err != nil || parsed != hash {
+		t.Fatalf("Hash did not survive its string form: %v", err)
+	}
+
+	var walked []Hash
+	store.Walk(func(hash Hash, info os.FileInfo) error {
+		walked = append(walked, hash)
+		return nil
+	})
+	if len(walked) != 1 || walked[0] != hash {
+		t.Fatalf("Walk found %v, expected only %s", walked, hash)
+	}
+
+	//Corruption is detected
+	if err = ioutil.WriteFile(store.path(hash), page[1:], 0600); err != nil {
+		t.Fatalf("Could not corrupt chunk: %s", err)
+	}
+	if _, err = store.Get(hash); err == nil {
+		t.Fatalf("Get returned a corrupt chunk")
+	}
+	if err = store.Remove(hash); err != nil {
+		t.Fatalf("Could not remove chunk: %s", err)
+	}
+	if _, err = store.Get(hash); err == nil {
+		t.Fatalf("Get returned a removed chunk")
+	}
+
+	//Temporary files are removed once old enough
+	temp := filepath.Join(filepath.Dir(store.path(hash)), hash.String()+".0123"+tempExt)
+	if err = ioutil.WriteFile(temp, page, 0600); err != nil {
+		t.Fatalf("Could not create temporary file: %s", err)
+	}
+	store.RemoveTemps(time.Hour)
+	if _, err = os.Stat(temp); err != nil {
+		t.Fatalf("A recent temporary file was removed")
+	}
+	store.RemoveTemps(0)
+	if _, err = os.Stat(temp); !os.IsNotExist(err) {
+		t.Fatalf("A stale temporary file was kept")
+	}
+}
@@ -0,0 +1,88 @@
+package pdict
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+)
+
+const (
+	PageSize = 4096
+
+	DefaultMaxSampleBytes = 64 * 1024 * 1024
+	DefaultMaxDictSize    = 112 * 1024
+)
+
+var zeroPage = make([]byte, PageSize)
+
+//SamplePages collects up to maxBytes of distinct, non-zero pages from the memory
+// of provider, such as libc data or Go runtime structures, for use as zstd
+// dictionary training samples. Spans, or what remains of them, that can not be
+// read are skipped.
+func SamplePages(provider lib.StateProvider, maxBytes int) ([][]byte, error) {
+	spans, err := provider.GetMemoryMeta()
+	if err != nil {
+		return nil, errs.Append(err, "Could not get memory metadata")
+	}
+
+	var (
+		samples [][]byte
+		total   int
+		seen    = make(map[[sha256.Size]byte]struct{}, 1024)
+		page    = make([]byte, PageSize)
+	)
+	for _, spanMeta := range spans {
+		if total >= maxBytes {
+			break
+		}
+		if spanMeta.Perms.Cvalue()&0x1 == 0 || spanMeta.FileInfo.Path() == "[vsyscall]" {
+			continue //Unreadable
+		}
+		span, err := provider.GetMemorySpan(spanMeta)
+		if err != nil {
+			continue
+		}
+		//Read a page at a time, only as much of the span as is still wanted
+		for total < maxBytes {
+			if _, err := io.ReadFull(span, page); err != nil {
+				break
+			}
+			if bytes.Equal(page, zeroPage) {
+				continue
+			}
+			sum := sha256.Sum256(page)
+			if _, isDup := seen[sum]; isDup {
+				continue
+			}
+			seen[sum] = struct{}{}
+			samples = append(samples, append([]byte(nil), page...))
+			total += PageSize
+		}
+		span.Close()
+	}
+	if len(samples) == 0 {
+		return nil, errs.New("No readable non-zero pages were found to sample")
+	}
+	return samples, nil
+}
+
+//Train builds a zstd dictionary of at most maxDictSize bytes from samples
+func Train(samples [][]byte, maxDictSize int) ([]byte, error) {
+	dictBytes, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxDictSize,
+		HashBytes:   6,
+		Output:      ioutil.Discard,
+		ZstdLevel:   zstd.SpeedBestCompression,
+	})
+	if err != nil {
+		return nil, errs.Append(err, "Could not build zstd dictionary from %d samples", len(samples))
+	}
+	return dictBytes, nil
+}
@@ -0,0 +1,71 @@
+package pdict
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/tarndt/pmigrate/internal/ptest"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//meteredProvider counts the bytes of memory spans read from it
+type meteredProvider struct {
+	*ptest.MemProvider
+	read int
+}
+
+func (this *meteredProvider) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	span, err := this.MemProvider.GetMemorySpan(metadata)
+	span.ReadCloser = &meteredSpan{ReadCloser: span.ReadCloser, provider: this}
+	return span, err
+}
+
+type meteredSpan struct {
+	io.ReadCloser
+	provider *meteredProvider
+}
+
+func (this *meteredSpan) Read(buf []byte) (int, error) {
+	n, err := this.ReadCloser.Read(buf)
+	this.provider.read += n
+	return n, err
+}
+
+func TestSamplePages(t *testing.T) {
+	page := func(fill byte) []byte { return bytes.Repeat([]byte{fill}, PageSize) }
+
+	provider := ptest.NewMemProvider(t,
+		"1000-5000 rw-p 00000000 00:00 0",
+		"8000-9000 ---p 00000000 00:00 0",
+		"a000-c000 r--p 00000000 00:00 0",
+	)
+	provider.Data = map[uint64][]byte{
+		0x1000: bytes.Join([][]byte{page(1), page(0), page(2), page(1)}, nil),
+		0x8000: page(3),
+		0xa000: bytes.Join([][]byte{page(2), page(4)}, nil),
+	}
+
+	samples, err := SamplePages(provider, DefaultMaxSampleBytes)
+	if err != nil {
+		t.Fatalf("SamplePages returned: %s", err)
+	}
+	//Zero, duplicate and unreadable pages are skipped
+	expected := [][]byte{page(1), page(2), page(4)}
+	if len(samples) != len(expected) {
+		t.Fatalf("Expected %d samples, but %d were returned", len(expected), len(samples))
+	}
+	for i := range expected {
+		if !bytes.Equal(samples[i], expected[i]) {
+			t.Fatalf("Sample %d did not contain the expected page", i)
+		}
+	}
+
+	metered := &meteredProvider{MemProvider: provider}
+	if samples, err = SamplePages(metered, PageSize); err != nil || len(samples) != 1 {
+		t.Fatalf("Sample limit was not respected; %d samples were returned, error: %v", len(samples), err)
+	} else if metered.read != PageSize {
+		t.Fatalf("Sampling a page read %d bytes of memory spans", metered.read)
+	}
+}
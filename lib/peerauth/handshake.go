@@ -0,0 +1,185 @@
+package peerauth
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/tarndt/errs"
+)
+
+/* Handshake (the pfrez side is the client, pthaw the server):
+ *
+ *	C -> S: magic | client ephemeral X25519 key
+ *	S -> C: server identity key | server ephemeral X25519 key | server signature
+ *	C -> S: client identity key | client signature
+ *	S -> C: accepted (1) or rejected (0)
+ *
+ * Both signatures cover a transcript hash of the ephemeral keys and identities
+ * so neither side can be impersonated or have its ephemeral key substituted.
+ * Per-direction session keys are derived with HKDF-SHA256 from the X25519
+ * shared secret salted with the transcript.
+ */
+
+const (
+	magic          = "PMIGRATE-HS1"
+	SessionKeySize = 32
+
+	respAccepted = 1
+	respRejected = 0
+)
+
+var (
+	ErrUntrustedPeer = errors.New("Peer identity key is not trusted")
+	ErrRejected      = errors.New("Peer rejected our identity key")
+	ErrBadSignature  = errors.New("Peer handshake signature is invalid")
+)
+
+//Session holds the result of a successful handshake
+type Session struct {
+	//SendKey protects data we send, RecvKey data we receive
+	SendKey, RecvKey []byte
+	PeerKey          ed25519.PublicKey
+}
+
+//Client performs the initiating side of the handshake over conn. peerName is
+// matched against host restrictions in knownHosts.
+func Client(conn io.ReadWriter, identity ed25519.PrivateKey, knownHosts TrustedKeys, peerName string) (*Session, error) {
+	ephKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errs.Append(err, "Could not generate ephemeral key")
+	}
+	if _, err = conn.Write(append([]byte(magic), ephKey.PublicKey().Bytes()...)); err != nil {
+		return nil, errs.Append(err, "Could not send handshake hello")
+	}
+
+	//Server identity
+	serverMsg := make([]byte, ed25519.PublicKeySize+32+ed25519.SignatureSize)
+	if _, err = io.ReadFull(conn, serverMsg); err != nil {
+		return nil, errs.Append(err, "Could not read server handshake response")
+	}
+	serverID := ed25519.PublicKey(serverMsg[:ed25519.PublicKeySize])
+	serverEph := serverMsg[ed25519.PublicKeySize : ed25519.PublicKeySize+32]
+	serverSig := serverMsg[ed25519.PublicKeySize+32:]
+
+	transcript := transcriptHash(ephKey.PublicKey().Bytes(), serverEph, serverID)
+	if !ed25519.Verify(serverID, signedMsg("server", transcript, nil), serverSig) {
+		return nil, ErrBadSignature
+	}
+	if !knownHosts.IsTrusted(serverID, peerName) {
+		return nil, errs.Append(ErrUntrustedPeer, "Server key: %s is not trusted for: %q", Fingerprint(serverID), peerName)
+	}
+
+	//Our identity
+	clientID := identity.Public().(ed25519.PublicKey)
+	clientMsg := append([]byte{}, clientID...)
+	clientMsg = append(clientMsg, ed25519.Sign(identity, signedMsg("client", transcript, clientID))...)
+	if _, err = conn.Write(clientMsg); err != nil {
+		return nil, errs.Append(err, "Could not send client identity")
+	}
+	resp := []byte{respRejected}
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, errs.Append(err, "Could not read handshake result")
+	} else if resp[0] != respAccepted {
+		return nil, ErrRejected
+	}
+
+	c2s, s2c, err := deriveKeys(ephKey, serverEph, transcript, clientID)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{SendKey: c2s, RecvKey: s2c, PeerKey: serverID}, nil
+}
+
+//Server performs the accepting side of the handshake over conn, only clients
+// listed in authorizedKeys are accepted.
+func Server(conn io.ReadWriter, identity ed25519.PrivateKey, authorizedKeys TrustedKeys) (*Session, error) {
+	hello := make([]byte, len(magic)+32)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, errs.Append(err, "Could not read handshake hello")
+	} else if string(hello[:len(magic)]) != magic {
+		return nil, errs.New("Peer did not start a handshake, is it configured with an identity?")
+	}
+	clientEph := hello[len(magic):]
+
+	ephKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errs.Append(err, "Could not generate ephemeral key")
+	}
+	serverID := identity.Public().(ed25519.PublicKey)
+	transcript := transcriptHash(clientEph, ephKey.PublicKey().Bytes(), serverID)
+
+	serverMsg := append([]byte{}, serverID...)
+	serverMsg = append(serverMsg, ephKey.PublicKey().Bytes()...)
+	serverMsg = append(serverMsg, ed25519.Sign(identity, signedMsg("server", transcript, nil))...)
+	if _, err = conn.Write(serverMsg); err != nil {
+		return nil, errs.Append(err, "Could not send server handshake response")
+	}
+
+	clientMsg := make([]byte, ed25519.PublicKeySize+ed25519.SignatureSize)
+	if _, err = io.ReadFull(conn, clientMsg); err != nil {
+		return nil, errs.Append(err, "Could not read client identity")
+	}
+	clientID := ed25519.PublicKey(clientMsg[:ed25519.PublicKeySize])
+	clientSig := clientMsg[ed25519.PublicKeySize:]
+
+	verdictErr := error(nil)
+	if !ed25519.Verify(clientID, signedMsg("client", transcript, clientID), clientSig) {
+		verdictErr = ErrBadSignature
+	} else if !authorizedKeys.IsTrusted(clientID, "") {
+		verdictErr = errs.Append(ErrUntrustedPeer, "Client key: %s is not authorized", Fingerprint(clientID))
+	}
+	verdict := []byte{respAccepted}
+	if verdictErr != nil {
+		verdict[0] = respRejected
+	}
+	if _, err = conn.Write(verdict); err != nil {
+		return nil, errs.Append(err, "Could not send handshake result")
+	}
+	if verdictErr != nil {
+		return nil, verdictErr
+	}
+
+	c2s, s2c, err := deriveKeys(ephKey, clientEph, transcript, clientID)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{SendKey: s2c, RecvKey: c2s, PeerKey: clientID}, nil
+}
+
+func transcriptHash(clientEph, serverEph []byte, serverID ed25519.PublicKey) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(magic))
+	hash.Write(clientEph)
+	hash.Write(serverEph)
+	hash.Write(serverID)
+	return hash.Sum(nil)
+}
+
+func signedMsg(role string, transcript []byte, identity ed25519.PublicKey) []byte {
+	msg := append([]byte(magic+" "+role+" "), transcript...)
+	return append(msg, identity...)
+}
+
+func deriveKeys(ephKey *ecdh.PrivateKey, peerEph, transcript []byte, clientID ed25519.PublicKey) (c2s, s2c []byte, err error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peerEph)
+	if err != nil {
+		return nil, nil, errs.Append(err, "Peer ephemeral key is invalid")
+	}
+	shared, err := ephKey.ECDH(peerKey)
+	if err != nil {
+		return nil, nil, errs.Append(err, "X25519 key agreement failed")
+	}
+	salt := append(append([]byte{}, transcript...), clientID...)
+	if c2s, err = hkdf.Key(sha256.New, shared, salt, "pmigrate client to server", SessionKeySize); err != nil {
+		return nil, nil, errs.Append(err, "Could not derive session key")
+	}
+	if s2c, err = hkdf.Key(sha256.New, shared, salt, "pmigrate server to client", SessionKeySize); err != nil {
+		return nil, nil, errs.Append(err, "Could not derive session key")
+	}
+	return c2s, s2c, nil
+}
@@ -0,0 +1,94 @@
+package peerauth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+type handshakeResult struct {
+	session *Session
+	err     error
+}
+
+func runHandshake(t *testing.T, clientKey, serverKey ed25519.PrivateKey, knownHosts, authorizedKeys TrustedKeys, peerName string) (client, server handshakeResult) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	serverCh := make(chan handshakeResult, 1)
+	go func() {
+		session, err := Server(serverConn, serverKey, authorizedKeys)
+		if err != nil {
+			serverConn.Close() //Unblock a client waiting on a response that won't come
+		}
+		serverCh <- handshakeResult{session, err}
+	}()
+	session, err := Client(clientConn, clientKey, knownHosts, peerName)
+	if err != nil {
+		clientConn.Close()
+	}
+	return handshakeResult{session, err}, <-serverCh
+}
+
+func mustGenKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func mustParseKeys(t *testing.T, lines ...string) TrustedKeys {
+	keys, err := ParseTrustedKeys(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("ParseTrustedKeys returned: %s", err)
+	}
+	return keys
+}
+
+func TestHandshake(t *testing.T) {
+	clientPub, clientKey := mustGenKey(t)
+	serverPub, serverKey := mustGenKey(t)
+	knownHosts := mustParseKeys(t, "# comment", "", "thawhost,10.0.0.1 "+FormatPublicKey(serverPub)+" server")
+	authorizedKeys := mustParseKeys(t, FormatPublicKey(clientPub)+" frez@host")
+
+	client, server := runHandshake(t, clientKey, serverKey, knownHosts, authorizedKeys, "thawhost")
+	if client.err != nil || server.err != nil {
+		t.Fatalf("Unexpected handshake failure; client: %v, server: %v", client.err, server.err)
+	}
+	if !bytes.Equal(client.session.SendKey, server.session.RecvKey) || !bytes.Equal(client.session.RecvKey, server.session.SendKey) {
+		t.Fatalf("Client and server derived different session keys")
+	}
+	if bytes.Equal(client.session.SendKey, client.session.RecvKey) {
+		t.Fatalf("Both directions share the same session key")
+	}
+	if !client.session.PeerKey.Equal(serverPub) || !server.session.PeerKey.Equal(clientPub) {
+		t.Fatalf("Session peer keys do not match the peers' identities")
+	}
+}
+
+func TestHandshakeUntrusted(t *testing.T) {
+	clientPub, clientKey := mustGenKey(t)
+	serverPub, serverKey := mustGenKey(t)
+	otherPub, _ := mustGenKey(t)
+
+	//Server not trusted by client
+	client, _ := runHandshake(t, clientKey, serverKey, mustParseKeys(t, FormatPublicKey(otherPub)), mustParseKeys(t, FormatPublicKey(clientPub)), "thawhost")
+	if client.err == nil {
+		t.Fatalf("Client accepted an unknown server key")
+	}
+	//Server trusted, but only for a different host name
+	client, _ = runHandshake(t, clientKey, serverKey, mustParseKeys(t, "otherhost "+FormatPublicKey(serverPub)), mustParseKeys(t, FormatPublicKey(clientPub)), "thawhost")
+	if client.err == nil {
+		t.Fatalf("Client accepted a server key restricted to another host")
+	}
+	//Client not authorized by server
+	client, server := runHandshake(t, clientKey, serverKey, mustParseKeys(t, FormatPublicKey(serverPub)), mustParseKeys(t, FormatPublicKey(otherPub)), "thawhost")
+	if server.err == nil || client.err != ErrRejected {
+		t.Fatalf("Unauthorized client was not rejected; client: %v, server: %v", client.err, server.err)
+	}
+}
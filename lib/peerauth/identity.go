@@ -0,0 +1,134 @@
+package peerauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/tarndt/errs"
+)
+
+const keyType = "ed25519"
+
+//LoadIdentity reads a PEM encoded (PKCS #8) Ed25519 private key, such as one
+// produced by: openssl genpkey -algorithm ed25519
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errs.Append(err, "Could not read identity key file: %s", path)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errs.New("Identity key file: %s, does not contain a PEM encoded private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errs.Append(err, "Could not parse identity key file: %s", path)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errs.New("Identity key file: %s, contains a %T rather than an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+//FormatPublicKey renders a public key as it should appear in a known-hosts or
+// authorized-keys file
+func FormatPublicKey(key ed25519.PublicKey) string {
+	return keyType + " " + base64.StdEncoding.EncodeToString(key)
+}
+
+//Fingerprint returns a short human readable digest of a public key
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+type trustedKey struct {
+	hosts []string //Empty means the key is trusted for any peer
+	key   ed25519.PublicKey
+}
+
+//TrustedKeys is the parsed content of a known-hosts (pfrez) or authorized-keys
+// (pthaw) file. Each line has the form:
+//
+//	[host1,host2,...] ed25519 <base64 public key> [comment]
+//
+// Blank lines and lines starting with '#' are ignored.
+type TrustedKeys []trustedKey
+
+func LoadTrustedKeys(path string) (TrustedKeys, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, errs.Append(err, "Could not open trusted keys file: %s", path)
+	}
+	defer fin.Close()
+
+	keys, err := ParseTrustedKeys(fin)
+	if err != nil {
+		return nil, errs.Append(err, "Could not parse trusted keys file: %s", path)
+	}
+	return keys, nil
+}
+
+func ParseTrustedKeys(rdr io.Reader) (TrustedKeys, error) {
+	var keys TrustedKeys
+	scnr, lineNum := bufio.NewScanner(rdr), 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var entry trustedKey
+		if fields[0] != keyType {
+			entry.hosts = strings.Split(fields[0], ",")
+			fields = fields[1:]
+		}
+		if len(fields) < 2 || fields[0] != keyType {
+			return nil, errs.New("Line %d: expected: [hosts] %s <base64 key> [comment]", lineNum, keyType)
+		}
+		rawKey, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, errs.Append(err, "Line %d: could not base64 decode public key", lineNum)
+		} else if len(rawKey) != ed25519.PublicKeySize {
+			return nil, errs.New("Line %d: public key has %d bytes rather than %d", lineNum, len(rawKey), ed25519.PublicKeySize)
+		}
+		entry.key = ed25519.PublicKey(rawKey)
+		keys = append(keys, entry)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, errs.Append(err, "Could not read trusted keys")
+	}
+	return keys, nil
+}
+
+//IsTrusted reports if key is listed, and if the listing is restricted to
+// specific hosts, that peerName is one of them. An empty peerName only matches
+// unrestricted entries.
+func (this TrustedKeys) IsTrusted(key ed25519.PublicKey, peerName string) bool {
+	for _, entry := range this {
+		if !bytes.Equal(entry.key, key) {
+			continue
+		}
+		if len(entry.hosts) == 0 {
+			return true
+		}
+		for _, host := range entry.hosts {
+			if host == peerName {
+				return true
+			}
+		}
+	}
+	return false
+}
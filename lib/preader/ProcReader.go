@@ -2,9 +2,13 @@ package preader
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"unicode"
 
@@ -15,8 +19,11 @@ import (
 	"github.com/tarndt/pmigrate/lib/ptrace"
 )
 
-//Ensure ProcReader implements StateProvider
-var _ lib.StateProvider = new(ProcReader)
+//Ensure ProcReader implements ContextStateProvider
+var _ lib.ContextStateProvider = new(ProcReader)
+
+//ErrExited is returned by WaitFrozen when the target exits while resumed
+var ErrExited = errors.New("Target process exited")
 
 type ProcReader struct {
 	name             string
@@ -24,15 +31,42 @@ type ProcReader struct {
 	mapFile, memFile *os.File
 	backingFileCache map[string]*os.File
 	openFiles        []pfiles.FileEntry
+	freezes          int32 //Requested by Freeze but not yet seen by WaitFrozen
+}
+
+//GetProcName returns the invocation command of the process with pid, as
+// recorded in its snapshots
+func GetProcName(pid int) (string, error) {
+	nameBytes, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", errs.Append(err, "Could not read process command line.")
+	}
+	return string(bytes.TrimFunc(nameBytes, func(c rune) bool { return unicode.IsSpace(c) || c == 0 })), nil
+}
+
+//NewProcReaderContext is NewProcReader unless ctx is done, attaching is not
+// abandoned midway, but a target attached once ctx is done is detached again
+func NewProcReaderContext(ctx context.Context, process *os.Process) (*ProcReader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	this, err := NewProcReader(process)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		this.Close()
+		return nil, err
+	}
+	return this, nil
 }
 
 func NewProcReader(process *os.Process) (*ProcReader, error) {
 	//Get process name
-	nameBytes, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", process.Pid))
+	name, err := GetProcName(process.Pid)
 	if err != nil {
-		return nil, errs.Append(err, "Could not read process command line.")
+		return nil, err
 	}
-	nameBytes = bytes.TrimFunc(nameBytes, func(c rune) bool { return unicode.IsSpace(c) || c == 0 })
 
 	//Attach to target
 	tracedProcess, err := ptrace.AttachAndWait(process)
@@ -61,7 +95,7 @@ func NewProcReader(process *os.Process) (*ProcReader, error) {
 	}
 
 	return &ProcReader{
-		name:             string(nameBytes),
+		name:             name,
 		process:          tracedProcess,
 		mapFile:          mapFile,
 		memFile:          memFile,
@@ -85,7 +119,11 @@ func (this *ProcReader) GetRegisters() (*syscall.PtraceRegs, error) {
 //Read and parse virtual memory mappings
 func (this *ProcReader) GetMemoryMeta() (pmaps.ProcMap, error) {
 	var mappings pmaps.ProcMap
-	var err error
+	//Mappings change while the target runs between captures
+	_, err := this.mapFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, errs.Append(err, "Could not rewind file: %s", this.mapFile.Name())
+	}
 	if mappings, err = mappings.ParseAppend(this.mapFile); err != nil {
 		return nil, errs.Append(err, "Could not parse file: %s, containing target process %d's virtual memory mappings: %s; Details: %s", this.mapFile.Name(), this.process.Pid)
 	}
@@ -102,10 +140,79 @@ func (this *ProcReader) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error)
 	return lib.NewMemSpanReader(metadata, buf), nil
 }
 
+//GetMemorySpanContext reads a memory span unless ctx is done, the span is read
+// in full before it is returned
+func (this *ProcReader) GetMemorySpanContext(ctx context.Context, metadata pmaps.Entry) (lib.MemSpan, error) {
+	if err := ctx.Err(); err != nil {
+		return lib.MemSpan{}, err
+	}
+	return this.GetMemorySpan(metadata)
+}
+
 func (this *ProcReader) GetFiles() []pfiles.FileEntry {
 	return this.openFiles
 }
 
+//Resume lets the target run again while staying attached, so it can be
+// captured again after Freeze and WaitFrozen
+func (this *ProcReader) Resume() error {
+	if err := this.process.Continue(ptrace.NoSignal); err != nil {
+		return errs.Append(err, "Could not resume target process %d", this.process.Pid)
+	}
+	return nil
+}
+
+//Freeze asks a resumed target to stop, unlike the other methods it may be
+// called from any goroutine. The target is stopped once WaitFrozen returns.
+func (this *ProcReader) Freeze() error {
+	atomic.AddInt32(&this.freezes, 1)
+	if err := this.process.Interrupt(); err != nil {
+		atomic.AddInt32(&this.freezes, -1)
+		return errs.Append(err, "Could not stop target process %d", this.process.Pid)
+	}
+	return nil
+}
+
+//WaitFrozen blocks while the target runs, passing on any signals it receives,
+// until a Freeze takes effect. It then refreshes the open files for the next
+// capture. ErrExited is returned if the target exits instead.
+func (this *ProcReader) WaitFrozen() error {
+	for {
+		status, err := this.process.WaitStatus()
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err != nil:
+			return errs.Append(err, "Could not wait for target process %d", this.process.Pid)
+		case status.Exited() || status.Signaled():
+			return ErrExited
+		case !status.Stopped():
+			continue
+		case status.StopSignal() == syscall.SIGSTOP && this.takeFreeze():
+			if this.openFiles, err = pfiles.GetOpenFiles(this.process.Pid); err != nil {
+				return errs.Append(err, "Could not get a list of open files for target process %d", this.process.Pid)
+			}
+			return nil
+		}
+		//Stopped for a signal meant for the target
+		if err = this.process.Continue(status.StopSignal()); err != nil {
+			return errs.Append(err, "Could not deliver signal %s to target process %d", status.StopSignal(), this.process.Pid)
+		}
+	}
+}
+
+func (this *ProcReader) takeFreeze() bool {
+	for {
+		pending := atomic.LoadInt32(&this.freezes)
+		if pending < 1 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&this.freezes, pending, pending-1) {
+			return true
+		}
+	}
+}
+
 func (this *ProcReader) Close() error {
 	this.mapFile.Close()
 	this.memFile.Close()
@@ -0,0 +1,133 @@
+package preader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//ErrNotIndexable is returned by NewProcSnapIndex for snapshots that can only be
+// read as a stream
+var ErrNotIndexable = errors.New("Snapshot can not be indexed")
+
+//Ensure ProcSnapIndex implements StateProvider
+var _ lib.StateProvider = new(ProcSnapIndex)
+
+//ProcSnapIndex reads a snapshot stored in a file in place. Only its header and
+// the metadata of its memory spans are read up front, recording where the data
+// of each span lies in the file, which GetMemorySpan then reads from the file.
+// Only complete snapshots (neither chunked nor incremental) stored without
+// transforms (compression, encryption or checksums) can be indexed.
+type ProcSnapIndex struct {
+	*ProcSnapReader //Header and the metadata of the spans
+	file            io.ReaderAt
+	offsets         map[uint64]int64 //Memory span start address -> file offset of its data
+	mapFile         *os.File         //file, if its spans may be mapped
+}
+
+//NewProcSnapIndex indexes the snapshot in file whose stream begins at offset
+// (after its transport encoding) and ends at size, checking it as
+// NewProcSnapReaderLimits does. Snapshots that can not be indexed return
+// ErrNotIndexable.
+func NewProcSnapIndex(limits Limits, file io.ReaderAt, offset, size int64) (*ProcSnapIndex, error) {
+	scan := &fileScanner{file: file, size: size}
+	scan.seek(offset)
+	snapshot := newSnapReader(limits, nil)
+	if err := snapshot.readHeader(scan.rdr); err != nil {
+		return nil, err
+	} else if snapshot.version != formatVersion && snapshot.version != alignedFormatVersion {
+		return nil, errs.Append(ErrNotIndexable, "Snapshot format version: %d references memory pages stored elsewhere", snapshot.version)
+	}
+
+	this := &ProcSnapIndex{
+		ProcSnapReader: snapshot,
+		file:           file,
+		offsets:        make(map[uint64]int64, 31),
+	}
+	var buf bytes.Buffer
+	for {
+		metadata, more, err := this.readSpanMeta(scan.rdr, &buf)
+		if err != nil {
+			return nil, err
+		} else if !more {
+			break
+		}
+		dataOffset, length := scan.offset(), int64(metadata.Len())
+		if length > size-dataOffset {
+			return nil, errs.New("Snapshot ends %d bytes into the %d bytes of memory span: %x-%x", size-dataOffset, length, metadata.MemStart, metadata.MemEnd)
+		}
+		this.memMeta = append(this.memMeta, metadata)
+		this.offsets[metadata.MemStart] = dataOffset
+		scan.seek(dataOffset + length)
+	}
+
+	sort.Slice(this.memMeta, func(i, j int) bool { return this.memMeta[i].MemStart < this.memMeta[j].MemStart })
+	if err := checkOverlaps(this.memMeta); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+//MapFrom has GetMemorySpan describe where the data of spans starting on a page
+// boundary of the file lies in it (see lib.FileMapping), file being the one
+// indexed. Only page aligned snapshots (see pwriter.NewAlignedSnapshotWriter)
+// following a page aligned transport encoding have such spans.
+func (this *ProcSnapIndex) MapFrom(file *os.File) {
+	this.mapFile = file
+}
+
+func (this *ProcSnapIndex) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	offset, isPresent := this.offsets[metadata.MemStart]
+	if !isPresent {
+		return lib.MemSpan{}, errs.New("Memory span at start address: %d, does not exist", metadata.MemStart)
+	}
+	span := lib.NewMemSpanReader(metadata, io.NewSectionReader(this.file, offset, int64(metadata.Len())))
+	if this.mapFile != nil && offset%pageSize == 0 {
+		span.Mapping = lib.FileMapping{File: this.mapFile, Offset: offset}
+	}
+	return span, nil
+}
+
+//fileScanner reads a file from any offset, knowing the offset of what it has
+// read so far
+type fileScanner struct {
+	file  io.ReaderAt
+	size  int64
+	start int64 //Of the section being read
+	count countingReader
+	rdr   *bufio.Reader
+}
+
+//seek starts reading the file from offset
+func (this *fileScanner) seek(offset int64) {
+	this.start = offset
+	this.count = countingReader{Reader: io.NewSectionReader(this.file, offset, this.size-offset)}
+	if this.rdr == nil {
+		this.rdr = bufio.NewReader(&this.count)
+	} else {
+		this.rdr.Reset(&this.count)
+	}
+}
+
+//offset returns the offset in the file of the next byte to be read
+func (this *fileScanner) offset() int64 {
+	return this.start + this.count.read - int64(this.rdr.Buffered())
+}
+
+type countingReader struct {
+	io.Reader
+	read int64
+}
+
+func (this *countingReader) Read(buf []byte) (int, error) {
+	n, err := this.Reader.Read(buf)
+	this.read += int64(n)
+	return n, err
+}
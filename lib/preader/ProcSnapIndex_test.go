@@ -0,0 +1,103 @@
+package preader
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProcSnapIndex(t *testing.T) {
+	const offset = 7 //Stands in for the transport encoding
+	snap := validSnapshot()
+	snap.spans[1].meta = "400000-402000 r-xp 00000000 08:01 1234 /bin/test"
+	snap.spans[1].len = 0x2000
+	file := append(bytes.Repeat([]byte{0xFF}, offset), snap.bytes()...)
+	//Distinct data at the end of the second span
+	spanEnd := bytes.LastIndex(file, []byte("/bin/test")) + len("/bin/test") + 0x2000
+	copy(file[spanEnd-4:], "last")
+
+	snapshot, err := NewProcSnapIndex(Limits{}, bytes.NewReader(file), offset, int64(len(file)))
+	if err != nil {
+		t.Fatalf("Could not index valid snapshot; Details: %s", err)
+	}
+	memMeta, _ := snapshot.GetMemoryMeta()
+	if len(memMeta) != 3 || memMeta[1].MemStart != 0x400000 || snapshot.GetName() != "/bin/test" {
+		t.Fatalf("Snapshot was not indexed as written: %d spans, name: %q", len(memMeta), snapshot.GetName())
+	}
+	span, err := snapshot.GetMemorySpan(memMeta[1])
+	if err != nil {
+		t.Fatalf("Could not get indexed span; Details: %s", err)
+	}
+	data, _ := ioutil.ReadAll(span)
+	if len(data) != 0x2000 || data[0] != 0xAB || string(data[len(data)-4:]) != "last" {
+		t.Fatalf("Indexed span read: %d bytes ending: %q", len(data), data[len(data)-4:])
+	}
+
+	snapshot.MapFrom(tempFile(t, file))
+	if span, _ = snapshot.GetMemorySpan(memMeta[1]); span.Mapping.File != nil {
+		t.Fatalf("Span of an unaligned snapshot can be mapped from offset: %d", span.Mapping.Offset)
+	}
+
+	if _, err = NewProcSnapIndex(Limits{}, bytes.NewReader(file), offset, int64(len(file))-0x1001); err == nil || !strings.Contains(err.Error(), "Snapshot ends") {
+		t.Fatalf("Truncated snapshot was indexed: %v", err)
+	}
+	snap.version = incrementalFormatVersion
+	file = snap.bytes()
+	if _, err = NewProcSnapIndex(Limits{}, bytes.NewReader(file), 0, int64(len(file))); !errors.Is(err, ErrNotIndexable) {
+		t.Fatalf("Incremental snapshot returned: %v, expected: %s", err, ErrNotIndexable)
+	}
+}
+
+func TestProcSnapIndexAligned(t *testing.T) {
+	snap := validSnapshot()
+	snap.version = alignedFormatVersion
+	file := append(bytes.Repeat([]byte{' '}, pageSize), snap.bytes()...) //Stands in for a page aligned transport encoding
+	mapFile := tempFile(t, file)
+
+	snapshot, err := NewProcSnapIndex(Limits{}, mapFile, pageSize, int64(len(file)))
+	if err != nil {
+		t.Fatalf("Could not index valid aligned snapshot; Details: %s", err)
+	}
+	snapshot.MapFrom(mapFile)
+	memMeta, _ := snapshot.GetMemoryMeta()
+	for _, metadata := range memMeta {
+		span, err := snapshot.GetMemorySpan(metadata)
+		if err != nil {
+			t.Fatalf("Could not get indexed span; Details: %s", err)
+		}
+		mapping := span.Mapping
+		if mapping.File != mapFile || mapping.Offset%pageSize != 0 {
+			t.Fatalf("Span %s of an aligned snapshot can not be mapped: %+v", metadata, mapping)
+		}
+		data, _ := ioutil.ReadAll(span)
+		if !bytes.Equal(data, file[mapping.Offset:mapping.Offset+int64(metadata.Len())]) || !bytes.Equal(data, bytes.Repeat([]byte{0xAB}, len(data))) {
+			t.Fatalf("Span %s read differs from the data it maps", metadata)
+		}
+	}
+
+	//Streamed the padding is skipped
+	streamed, err := readSnapshot(snap.bytes(), Limits{})
+	if err != nil {
+		t.Fatalf("Could not read valid aligned snapshot; Details: %s", err)
+	} else if memMeta, _ = streamed.GetMemoryMeta(); len(memMeta) != len(snap.spans) {
+		t.Fatalf("Aligned snapshot was read with %d of %d spans", len(memMeta), len(snap.spans))
+	}
+}
+
+//tempFile returns a file holding data, removed once the test ends
+func tempFile(t *testing.T, data []byte) *os.File {
+	path := filepath.Join(t.TempDir(), "test.snap")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Could not write test snapshot; Details: %s", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open test snapshot; Details: %s", err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
@@ -2,9 +2,14 @@ package preader
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"sort"
+	"sync"
 	"syscall"
 
 	"github.com/tarndt/errs"
@@ -13,17 +18,43 @@ import (
 	"github.com/tarndt/pmigrate/lib/pmaps"
 )
 
-const formatVersion = uint16(1)
+const (
+	formatVersion = uint16(1)
+	//chunkedFormatVersion snapshots reference memory pages in a chunk store
+	chunkedFormatVersion = uint16(2)
+	chunkHashSize        = 32
+	//incrementalFormatVersion snapshots record only the memory pages that changed
+	// since their parent snapshot, page by page
+	incrementalFormatVersion = uint16(3)
+	//alignedFormatVersion snapshots pad the data of each memory span to start on
+	// a page boundary
+	alignedFormatVersion = uint16(4)
+	pageSize             = 4096
+	pageFromParent       = byte(0)
+	pageData             = byte(1)
+)
 
 //Ensure ProcSnapReader implements StateProvider
 var _ lib.StateProvider = new(ProcSnapReader)
 
-type flexReader interface {
+//FlexReader is the kind of stream snapshots are read from, such as *bufio.Reader
+type FlexReader interface {
 	io.Reader
 	io.ByteReader
 }
 
+//ParentOpener opens the parent snapshot an incremental snapshot refers to
+type ParentOpener func(ref string) (*ProcSnapReader, error)
+
 type ProcSnapReader struct {
+	lock      sync.Mutex
+	limits    Limits
+	spans     int    //Read so far, bounded by limits
+	memory    uint64 //Bytes of memory spans read so far, bounded by limits
+	version   uint16
+	chunks    lib.ChunkSource
+	parentRef string
+	parent    *ProcSnapReader //Only while reading an incremental snapshot
 	name      string
 	pid       uint64
 	regs      syscall.PtraceRegs
@@ -32,109 +63,370 @@ type ProcSnapReader struct {
 	openFiles []pfiles.FileEntry
 }
 
-func NewProcSnapReader(inStrm flexReader) (*ProcSnapReader, error) {
-	const readFailMsg = "Could not read %q from process snapshot stream"
+const readFailMsg = "Could not read %q from process snapshot stream"
+
+func NewProcSnapReader(inStrm FlexReader) (*ProcSnapReader, error) {
+	return NewProcSnapReaderStreams(inStrm)
+}
+
+//NewProcSnapReaderStreams reads a snapshot that was split across several
+// streams by pwriter.ParallelSnapshotWriter. The first stream must be the one
+// carrying the snapshot header, the memory spans of all streams are read
+// concurrently and ordered by address.
+func NewProcSnapReaderStreams(inStrms ...FlexReader) (*ProcSnapReader, error) {
+	return NewProcSnapReaderChunks(nil, inStrms...)
+}
+
+//NewProcSnapReaderChunks reads a snapshot as NewProcSnapReaderStreams does,
+// resolving the memory pages of chunked snapshots (see
+// pwriter.NewChunkedSnapshotWriter) from chunks, which may be nil otherwise
+func NewProcSnapReaderChunks(chunks lib.ChunkSource, inStrms ...FlexReader) (*ProcSnapReader, error) {
+	return NewProcSnapReaderChain(chunks, nil, inStrms...)
+}
+
+//NewProcSnapReaderChain reads a snapshot as NewProcSnapReaderChunks does,
+// overlaying incremental snapshots (see pwriter.NewIncrementalSnapshotWriter)
+// onto their parent, which parents opens. The result is a complete snapshot
+// that no longer depends on its parent.
+func NewProcSnapReaderChain(chunks lib.ChunkSource, parents ParentOpener, inStrms ...FlexReader) (*ProcSnapReader, error) {
+	return NewProcSnapReaderLimits(Limits{}, chunks, parents, inStrms...)
+}
+
+//NewProcSnapReaderLimits reads a snapshot as NewProcSnapReaderChain does, failing
+// once it exceeds limits. Every snapshot is checked to be well formed: memory
+// spans must be page aligned ranges of the user address space that do not
+// overlap, and no length in it may exceed limits.
+func NewProcSnapReaderLimits(limits Limits, chunks lib.ChunkSource, parents ParentOpener, inStrms ...FlexReader) (*ProcSnapReader, error) {
+	this, err := openSnapReader(limits, chunks, parents, inStrms)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { this.parent = nil }()
+
+	errCh := make(chan error, len(inStrms))
+	for _, inStrm := range inStrms {
+		go func(inStrm FlexReader) {
+			errCh <- this.readSpans(inStrm)
+		}(inStrm)
+	}
+	var firstErr error
+	for range inStrms {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(this.memMeta, func(i, j int) bool { return this.memMeta[i].MemStart < this.memMeta[j].MemStart })
+	if err := checkOverlaps(this.memMeta); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+//openSnapReader reads the snapshot header from the first of inStrms and opens
+// the parent of an incremental snapshot, leaving the memory spans to be read
+func openSnapReader(limits Limits, chunks lib.ChunkSource, parents ParentOpener, inStrms []FlexReader) (*ProcSnapReader, error) {
+	if len(inStrms) < 1 {
+		return nil, errs.New("At least one snapshot stream is required")
+	}
+	this := newSnapReader(limits, chunks)
+	if err := this.readHeader(inStrms[0]); err != nil {
+		return nil, err
+	}
+	if this.version == incrementalFormatVersion {
+		if parents == nil {
+			return nil, errs.New("Snapshot is incremental to parent snapshot: %s, but no parent snapshots can be opened", this.parentRef)
+		}
+		var err error
+		if this.parent, err = parents(this.parentRef); err != nil {
+			return nil, errs.Append(err, "Could not open parent snapshot: %s", this.parentRef)
+		}
+	}
+	return this, nil
+}
 
-	this := &ProcSnapReader{
+//newSnapReader returns a reader of a snapshot whose header is yet to be read
+func newSnapReader(limits Limits, chunks lib.ChunkSource) *ProcSnapReader {
+	return &ProcSnapReader{
+		limits:  limits.withDefaults(),
+		chunks:  chunks,
 		memData: make(map[uint64]lib.MemSpan, 31),
 	}
+}
 
+func (this *ProcSnapReader) readHeader(inStrm FlexReader) error {
 	//Format version
-	var fmtVer uint16
-	err := binary.Read(inStrm, binary.LittleEndian, &fmtVer)
+	err := binary.Read(inStrm, binary.LittleEndian, &this.version)
 	if err != nil {
-		return nil, errs.Append(err, readFailMsg, "format version")
-	} else if fmtVer < formatVersion {
-		return nil, errs.New("Unsupported format version, snapshot was version %d, and this tool only understands up to: %d", fmtVer, formatVersion)
+		return errs.Append(err, readFailMsg, "format version")
+	} else if this.version < formatVersion || this.version > alignedFormatVersion {
+		return errs.New("Unsupported format version, snapshot was version %d, and this tool only understands up to: %d", this.version, alignedFormatVersion)
 	}
 
 	//PID
-	if err := binary.Read(inStrm, binary.LittleEndian, &this.pid); err != nil {
-		return nil, errs.Append(err, readFailMsg, "PID")
+	if err = binary.Read(inStrm, binary.LittleEndian, &this.pid); err != nil {
+		return errs.Append(err, readFailMsg, "PID")
 	}
 
 	//Name
-	if this.name, err = getStr(inStrm); err != nil {
-		return nil, errs.Append(err, readFailMsg, "process name")
+	if this.name, err = getStr(inStrm, this.limits.MaxStringLen); err != nil {
+		return errs.Append(err, readFailMsg, "process name")
 	}
 
 	//Registers
 	if err = binary.Read(inStrm, binary.LittleEndian, &this.regs); err != nil {
-		return nil, errs.Append(err, readFailMsg, "registers")
+		return errs.Append(err, readFailMsg, "registers")
 	}
 
 	//Open files
 	var temp uint64
 	if temp, err = binary.ReadUvarint(inStrm); err != nil {
-		return nil, errs.Append(err, readFailMsg, "open files record count")
+		return errs.Append(err, readFailMsg, "open files record count")
+	}
+	if temp > uint64(this.limits.MaxFiles) {
+		return errs.New("Snapshot has: %d open files, more than the limit of %d", temp, this.limits.MaxFiles)
 	}
 	openFileCount := int(temp)
 	this.openFiles = make([]pfiles.FileEntry, openFileCount)
+	handles := make(map[int]bool, openFileCount)
 	for i := 0; i < openFileCount; i++ {
 		entry := &this.openFiles[i]
 		//File handle
 		if temp, err = binary.ReadUvarint(inStrm); err != nil {
-			return nil, errs.Append(err, readFailMsg, "open file handle number")
+			return errs.Append(err, readFailMsg, "open file handle number")
+		} else if temp > math.MaxInt32 {
+			return errs.New("Open file handle: %d is not a valid file descriptor", temp)
 		}
 		entry.FileHandle = int(temp)
+		if handles[entry.FileHandle] {
+			return errs.New("Open file handle: %d appears more than once", temp)
+		}
+		handles[entry.FileHandle] = true
 		//File path
-		if entry.Path, err = getStr(inStrm); err != nil {
-			return nil, errs.Append(err, readFailMsg, "open file path")
+		if entry.Path, err = getStr(inStrm, this.limits.MaxStringLen); err != nil {
+			return errs.Append(err, readFailMsg, "open file path")
 		}
 		//File type/mode
 		if temp, err = binary.ReadUvarint(inStrm); err != nil {
-			return nil, errs.Append(err, readFailMsg, "open file type/mode")
+			return errs.Append(err, readFailMsg, "open file type/mode")
 		}
 		entry.Type = os.FileMode(temp)
 		//File position
 		if temp, err = binary.ReadUvarint(inStrm); err != nil {
-			return nil, errs.Append(err, readFailMsg, "open file handle number")
+			return errs.Append(err, readFailMsg, "open file position")
+		} else if temp > math.MaxInt64 {
+			return errs.New("Open file position: %d is out of range", temp)
 		}
 		entry.Pos = int(temp)
 		//File flags
 		if temp, err = binary.ReadUvarint(inStrm); err != nil {
-			return nil, errs.Append(err, readFailMsg, "open file handle number")
+			return errs.Append(err, readFailMsg, "open file flags")
+		} else if temp > math.MaxInt32 {
+			return errs.New("Open file flags: %x are out of range", temp)
 		}
 		entry.Flags = int(temp)
 	}
 
-	//Read meta-data/data memory span pairs
+	//Parent of an incremental snapshot
+	if this.version == incrementalFormatVersion {
+		if this.parentRef, err = getStr(inStrm, this.limits.MaxStringLen); err != nil {
+			return errs.Append(err, readFailMsg, "parent reference")
+		}
+	}
+	return nil
+}
+
+//readSpans reads meta-data/data memory span pairs until the end of spans
+// marker or the end of inStrm
+func (this *ProcSnapReader) readSpans(inStrm FlexReader) error {
 	var buf bytes.Buffer
 	for {
-		buf.Reset()
-		if err = getStrBuf(inStrm, &buf); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, errs.Append(err, readFailMsg, "span metadata")
+		metadata, more, err := this.readSpanMeta(inStrm, &buf)
+		if err != nil || !more {
+			return err
 		}
-		var metadata pmaps.Entry
-		metadata, err = pmaps.ParseEntry(&buf)
+		data, err := readSpanData(metadata.Len(), func(data []byte, offset uint64) error {
+			return this.fillSpan(inStrm, metadata, data, offset)
+		})
 		if err != nil {
-			return nil, errs.Append(err, "Could not parse span metadata")
-		}
-		data := make([]byte, metadata.Len())
-		if _, err = io.ReadFull(inStrm, data); err != nil {
-			return nil, errs.Append(err, readFailMsg, "span data")
+			return err
 		}
 		this.addMemSpan(metadata, data)
 	}
-	return this, nil
 }
 
-func getStrBuf(rdr flexReader, buf *bytes.Buffer) error {
+//readSpanMeta reads the metadata of the next memory span from inStrm, checks it
+// and accounts for it against the limits, leaving inStrm at the span's data. It
+// returns false at the end of spans marker or the end of inStrm.
+func (this *ProcSnapReader) readSpanMeta(inStrm FlexReader, buf *bytes.Buffer) (pmaps.Entry, bool, error) {
+	buf.Reset()
+	if err := getStrBuf(inStrm, buf, this.limits.MaxStringLen); err != nil {
+		if err == io.EOF {
+			return pmaps.Entry{}, false, nil
+		}
+		return pmaps.Entry{}, false, errs.Append(err, readFailMsg, "span metadata")
+	} else if buf.Len() == 0 { //End of spans marker
+		return pmaps.Entry{}, false, nil
+	}
+	metadata, err := pmaps.ParseEntry(buf)
+	if err != nil {
+		return metadata, false, errs.Append(err, "Could not parse span metadata")
+	} else if err = checkSpan(metadata); err != nil {
+		return metadata, false, err
+	} else if err = this.reserveSpan(metadata); err != nil {
+		return metadata, false, err
+	}
+	if this.version == alignedFormatVersion {
+		var padLen uint16
+		if err = binary.Read(inStrm, binary.LittleEndian, &padLen); err != nil {
+			return metadata, false, errs.Append(err, readFailMsg, "span padding length")
+		} else if padLen >= pageSize {
+			return metadata, false, errs.New("Span padding of: %d bytes is not less than a page", padLen)
+		}
+		if _, err = io.CopyN(ioutil.Discard, inStrm, int64(padLen)); err != nil {
+			return metadata, false, errs.Append(err, readFailMsg, "span padding")
+		}
+	}
+	return metadata, true, nil
+}
+
+//fillSpan reads the data of the memory span described by metadata from inStrm
+// into data, which holds the span from offset on. Offsets are page multiples.
+func (this *ProcSnapReader) fillSpan(inStrm FlexReader, metadata pmaps.Entry, data []byte, offset uint64) error {
+	switch this.version {
+	case chunkedFormatVersion:
+		return this.readChunks(inStrm, data)
+	case incrementalFormatVersion:
+		return this.readPages(inStrm, metadata.MemStart+offset, data)
+	}
+	if _, err := io.ReadFull(inStrm, data); err != nil {
+		return errs.Append(err, readFailMsg, "span data")
+	}
+	return nil
+}
+
+//readChunks fills data with the chunks whose digests follow in inStrm
+func (this *ProcSnapReader) readChunks(inStrm FlexReader, data []byte) error {
+	if this.chunks == nil {
+		return errs.New("Snapshot references memory pages in a chunk store, but none was provided")
+	}
+	var hash [chunkHashSize]byte
+	for filled := 0; filled < len(data); {
+		if _, err := io.ReadFull(inStrm, hash[:]); err != nil {
+			return errs.Append(err, readFailMsg, "span chunk reference")
+		}
+		chunk, err := this.chunks.GetChunk(hash)
+		if err != nil {
+			return errs.Append(err, "Could not resolve memory page")
+		} else if len(chunk) == 0 || len(chunk) > len(data)-filled {
+			return errs.New("Memory page of %d bytes does not fit the %d bytes remaining in its span", len(chunk), len(data)-filled)
+		}
+		filled += copy(data[filled:], chunk)
+	}
+	return nil
+}
+
+//readPages fills data, the memory from start on, with the page records that
+// follow in inStrm, taking unchanged pages from the parent snapshot
+func (this *ProcSnapReader) readPages(inStrm FlexReader, start uint64, data []byte) error {
+	for offset := 0; offset < len(data); offset += pageSize {
+		page := data[offset:]
+		if len(page) > pageSize {
+			page = page[:pageSize]
+		}
+		record, err := inStrm.ReadByte()
+		if err != nil {
+			return errs.Append(err, readFailMsg, "span page record")
+		}
+		switch record {
+		case pageData:
+			if _, err = io.ReadFull(inStrm, page); err != nil {
+				return errs.Append(err, readFailMsg, "span data")
+			}
+		case pageFromParent:
+			var hash [sha256.Size]byte
+			if _, err = io.ReadFull(inStrm, hash[:]); err != nil {
+				return errs.Append(err, readFailMsg, "span parent page reference")
+			}
+			addr := start + uint64(offset)
+			parentPage := this.parent.getMemory(addr, len(page))
+			if parentPage == nil || sha256.Sum256(parentPage) != hash {
+				return errs.New("Memory page at: %x differs from the one in parent snapshot: %s this snapshot was taken against", addr, this.parentRef)
+			}
+			copy(page, parentPage)
+		default:
+			return errs.New("Unknown span page record: %d", record)
+		}
+	}
+	return nil
+}
+
+//getMemory returns the length bytes of memory at addr, or nil if the snapshot
+// does not hold all of them
+func (this *ProcSnapReader) getMemory(addr uint64, length int) []byte {
+	i := sort.Search(len(this.memMeta), func(i int) bool { return this.memMeta[i].MemEnd > addr })
+	if i == len(this.memMeta) || this.memMeta[i].MemStart > addr || addr+uint64(length) > this.memMeta[i].MemEnd {
+		return nil
+	}
+	span, isPresent := this.memData[this.memMeta[i].MemStart]
+	if !isPresent {
+		return nil
+	}
+	offset := addr - this.memMeta[i].MemStart
+	return span.ReadCloser.(memSpan).data[offset : offset+uint64(length)]
+}
+
+//ScanHeader consumes a snapshot header from inStrm without retaining it
+func ScanHeader(inStrm FlexReader) error {
+	return (&ProcSnapReader{limits: Limits{}.withDefaults()}).readHeader(inStrm)
+}
+
+//ScanSpan consumes one memory span record from inStrm without retaining its
+// data. It returns true once the end of spans marker has been consumed, and
+// io.EOF if inStrm ended cleanly without one.
+func ScanSpan(inStrm FlexReader) (bool, error) {
+	var buf bytes.Buffer
+	if err := getStrBuf(inStrm, &buf, DefaultLimits.MaxStringLen); err != nil {
+		if err == io.EOF {
+			return false, err
+		}
+		return false, errs.Append(err, readFailMsg, "span metadata")
+	} else if buf.Len() == 0 {
+		return true, nil
+	}
+	metadata, err := pmaps.ParseEntry(&buf)
+	if err != nil {
+		return false, errs.Append(err, "Could not parse span metadata")
+	} else if err = checkSpan(metadata); err != nil {
+		return false, err
+	}
+	if _, err = io.CopyN(ioutil.Discard, inStrm, int64(metadata.Len())); err != nil {
+		return false, errs.Append(err, readFailMsg, "span data")
+	}
+	return false, nil
+}
+
+//getStrBuf reads a length prefixed string of at most maxLen bytes into buf
+func getStrBuf(rdr FlexReader, buf *bytes.Buffer, maxLen int) error {
 	strLen, err := binary.ReadUvarint(rdr)
 	if err != nil {
 		return err
+	} else if strLen > uint64(maxLen) {
+		return errs.New("String of: %d bytes exceeds the limit of %d", strLen, maxLen)
 	}
 	buf.Grow(int(strLen))
-	_, err = io.CopyN(buf, rdr, int64(strLen))
+	if _, err = io.CopyN(buf, rdr, int64(strLen)); err == io.EOF {
+		err = io.ErrUnexpectedEOF //The length was read, the string must follow
+	}
 	return err
 }
 
-func getStr(rdr flexReader) (string, error) {
+func getStr(rdr FlexReader, maxLen int) (string, error) {
 	var buf bytes.Buffer
-	err := getStrBuf(rdr, &buf)
+	err := getStrBuf(rdr, &buf, maxLen)
 	return buf.String(), err
 }
 
@@ -161,6 +453,12 @@ func (this *ProcSnapReader) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, er
 	return lib.MemSpan{}, errs.New("Memory span at start address: %d, does not exist", metadata.MemStart)
 }
 
+//GetParentRef returns the parent snapshot an incremental snapshot was overlaid
+// onto, or "" if the snapshot was complete
+func (this *ProcSnapReader) GetParentRef() string {
+	return this.parentRef
+}
+
 func (this *ProcSnapReader) GetFiles() []pfiles.FileEntry {
 	return this.openFiles
 }
@@ -170,11 +468,14 @@ func (this *ProcSnapReader) Close() error {
 }
 
 func (this *ProcSnapReader) addMemSpan(metadata pmaps.Entry, data []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	this.memMeta = append(this.memMeta, metadata)
 	memStart := metadata.MemStart
 	spanRdr := memSpan{
 		memStart: memStart,
 		memData:  this.memData,
+		data:     data,
 		Reader:   bytes.NewReader(data),
 	}
 	span := lib.NewMemSpan(metadata, spanRdr)
@@ -184,6 +485,7 @@ func (this *ProcSnapReader) addMemSpan(metadata pmaps.Entry, data []byte) {
 type memSpan struct {
 	memStart uint64
 	memData  map[uint64]lib.MemSpan
+	data     []byte
 	io.Reader
 }
 
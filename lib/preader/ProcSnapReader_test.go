@@ -0,0 +1,207 @@
+package preader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/tarndt/errs"
+)
+
+type testFile struct {
+	handle uint64
+	path   string
+}
+
+type testSpan struct {
+	meta string
+	len  int //Bytes of data following the metadata
+}
+
+//testSnapshot builds a snapshot stream by hand, so it may be malformed in ways
+// pwriter never writes
+type testSnapshot struct {
+	version uint16
+	name    string
+	files   []testFile
+	spans   []testSpan
+	end     bool //End of spans marker
+}
+
+func (this testSnapshot) bytes() []byte {
+	var buf bytes.Buffer
+	putUvarint := func(value uint64) {
+		var varint [binary.MaxVarintLen64]byte
+		buf.Write(varint[:binary.PutUvarint(varint[:], value)])
+	}
+	putStr := func(str string) {
+		putUvarint(uint64(len(str)))
+		buf.WriteString(str)
+	}
+
+	binary.Write(&buf, binary.LittleEndian, this.version)
+	binary.Write(&buf, binary.LittleEndian, uint64(1234))
+	putStr(this.name)
+	binary.Write(&buf, binary.LittleEndian, syscall.PtraceRegs{Rip: 0x1000})
+	putUvarint(uint64(len(this.files)))
+	for _, file := range this.files {
+		putUvarint(file.handle)
+		putStr(file.path)
+		putUvarint(0) //Type/mode
+		putUvarint(0) //Position
+		putUvarint(0) //Flags
+	}
+	for _, span := range this.spans {
+		putStr(span.meta)
+		if this.version == alignedFormatVersion {
+			padLen := (pageSize - (buf.Len()+2)%pageSize) % pageSize
+			binary.Write(&buf, binary.LittleEndian, uint16(padLen))
+			buf.Write(make([]byte, padLen))
+		}
+		buf.Write(bytes.Repeat([]byte{0xAB}, span.len))
+	}
+	if this.end {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func validSnapshot() testSnapshot {
+	return testSnapshot{
+		version: formatVersion,
+		name:    "/bin/test",
+		files:   []testFile{{0, "/dev/null"}, {1, "/dev/null"}},
+		spans: []testSpan{
+			{"1000-3000 rw-p 00000000 00:00 0", 0x2000},
+			{"400000-401000 r-xp 00000000 08:01 1234 /bin/test", 0x1000},
+			{"ffffffffff600000-ffffffffff601000 r-xp 00000000 00:00 0 [vsyscall]", 0x1000},
+		},
+		end: true,
+	}
+}
+
+func readSnapshot(data []byte, limits Limits) (*ProcSnapReader, error) {
+	parents := func(ref string) (*ProcSnapReader, error) { return nil, errs.New("No parent: %s", ref) }
+	return NewProcSnapReaderLimits(limits, nil, parents, bufio.NewReader(bytes.NewReader(data)))
+}
+
+func TestProcSnapReaderValid(t *testing.T) {
+	snapshot, err := readSnapshot(validSnapshot().bytes(), Limits{})
+	if err != nil {
+		t.Fatalf("Could not read valid snapshot; Details: %s", err)
+	}
+	memMeta, _ := snapshot.GetMemoryMeta()
+	if len(memMeta) != 3 || memMeta[0].MemStart != 0x1000 || len(snapshot.GetFiles()) != 2 || snapshot.GetName() != "/bin/test" {
+		t.Fatalf("Snapshot was not read as written: %d spans, %d files, name: %q", len(memMeta), len(snapshot.GetFiles()), snapshot.GetName())
+	}
+}
+
+func TestProcSnapReaderRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*testSnapshot)
+		limits   Limits
+		expected string //In the error
+	}{
+		{"newer version", func(snap *testSnapshot) { snap.version = alignedFormatVersion + 1 }, Limits{}, "Unsupported format version"},
+		{"version 0", func(snap *testSnapshot) { snap.version = 0 }, Limits{}, "Unsupported format version"},
+		{"long name", func(snap *testSnapshot) { snap.name = strings.Repeat("x", 100) }, Limits{MaxStringLen: 99}, "exceeds the limit"},
+		{"too many files", func(snap *testSnapshot) {}, Limits{MaxFiles: 1}, "more than the limit"},
+		{"duplicate file", func(snap *testSnapshot) { snap.files[1].handle = 0 }, Limits{}, "more than once"},
+		{"invalid file handle", func(snap *testSnapshot) { snap.files[1].handle = 1 << 40 }, Limits{}, "not a valid file descriptor"},
+		{"unaligned span", func(snap *testSnapshot) { snap.spans[0] = testSpan{"1000-2800 rw-p 00000000 00:00 0", 0x1800} }, Limits{}, "not page aligned"},
+		{"empty span", func(snap *testSnapshot) { snap.spans[0] = testSpan{"1000-1000 rw-p 00000000 00:00 0", 0} }, Limits{}, "is empty"},
+		{"kernel span", func(snap *testSnapshot) {
+			snap.spans[0] = testSpan{"ffff888000000000-ffff888000001000 rw-p 00000000 00:00 0", 0x1000}
+		}, Limits{}, "outside the user address space"},
+		{"fake vsyscall", func(snap *testSnapshot) {
+			snap.spans[0] = testSpan{"ffffffffff600000-ffffffffff601000 rw-p 00000000 00:00 0 [heap]", 0x1000}
+		}, Limits{}, "outside the user address space"},
+		{"overlapping spans", func(snap *testSnapshot) {
+			snap.spans = append(snap.spans, testSpan{"2000-4000 rw-p 00000000 00:00 0", 0x2000})
+		}, Limits{}, "overlaps"},
+		{"duplicate spans", func(snap *testSnapshot) { snap.spans = append(snap.spans, snap.spans[0]) }, Limits{}, "overlaps"},
+		{"too many spans", func(snap *testSnapshot) {}, Limits{MaxSpans: 2}, "more than the limit"},
+		{"too much memory", func(snap *testSnapshot) {}, Limits{MaxMemory: 0x3000}, "exceeds the limit"},
+		{"truncated span", func(snap *testSnapshot) { snap.spans[1].len = 10; snap.spans = snap.spans[:2]; snap.end = false }, Limits{}, "span data"},
+	}
+	for _, test := range tests {
+		snap := validSnapshot()
+		test.modify(&snap)
+		if _, err := readSnapshot(snap.bytes(), test.limits); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Snapshot with %s returned: %v, expected an error containing: %q", test.name, err, test.expected)
+		}
+	}
+}
+
+//TestProcSnapReaderClaimedSpan reads a span claiming far more memory than its
+// stream holds, which must fail without allocating what it claims
+func TestProcSnapReaderClaimedSpan(t *testing.T) {
+	snap := validSnapshot()
+	snap.spans = []testSpan{{"10000000-50000000 rw-p 00000000 00:00 0", 0x1000}}
+	snap.end = false
+	_, err := readSnapshot(snap.bytes(), Limits{MaxMemory: 1 << 40})
+	if err == nil || !strings.Contains(err.Error(), "span data") {
+		t.Fatalf("Snapshot with a span larger than its stream returned: %v", err)
+	}
+
+	//Spans larger than the first allocation step are read in full
+	snap.spans = []testSpan{{"10000000-12800000 rw-p 00000000 00:00 0", 0x2800000}}
+	snap.end = true
+	snapshot, err := readSnapshot(snap.bytes(), Limits{})
+	if err != nil {
+		t.Fatalf("Could not read snapshot with a large span; Details: %s", err)
+	}
+	memMeta, _ := snapshot.GetMemoryMeta()
+	span, err := snapshot.GetMemorySpan(memMeta[0])
+	if err != nil {
+		t.Fatalf("Could not get large span; Details: %s", err)
+	}
+	data, _ := ioutil.ReadAll(span)
+	if len(data) != 0x2800000 || data[len(data)-1] != 0xAB {
+		t.Fatalf("Large span read: %d bytes, expected: %d", len(data), 0x2800000)
+	}
+}
+
+func FuzzProcSnapReader(f *testing.F) {
+	f.Add(validSnapshot().bytes())
+	incremental := validSnapshot()
+	incremental.version = incrementalFormatVersion
+	f.Add(incremental.bytes())
+	f.Add(testSnapshot{version: formatVersion}.bytes())
+
+	limits := Limits{MaxMemory: 64 << 20, MaxSpans: 64, MaxFiles: 64, MaxStringLen: 4096}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		snapshot, err := readSnapshot(data, limits)
+		if err != nil {
+			return
+		}
+		memMeta, _ := snapshot.GetMemoryMeta()
+		if err = checkOverlaps(memMeta); err != nil {
+			t.Fatalf("Snapshot was read with overlapping spans; Details: %s", err)
+		}
+		for _, metadata := range memMeta {
+			if err = checkSpan(metadata); err != nil {
+				t.Fatalf("Snapshot was read with an invalid span; Details: %s", err)
+			}
+		}
+	})
+}
+
+func FuzzScanSpan(f *testing.F) {
+	snap := validSnapshot()
+	snap.version, snap.name, snap.files = 0, "", nil
+	f.Add(snap.bytes()[2+8+1+binary.Size(syscall.PtraceRegs{})+1:])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rdr := bufio.NewReader(bytes.NewReader(data))
+		for i := 0; i < 64; i++ {
+			if end, err := ScanSpan(rdr); end || err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package preader
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//spanBlockSize is how much of a streamed memory span is decoded at a time
+const spanBlockSize = 1 << 20
+
+//Ensure ProcSnapStream implements SpanStreamer
+var _ lib.SpanStreamer = new(ProcSnapStream)
+
+//ProcSnapStream reads a snapshot as it arrives. Once its header is read, each
+// memory span is handed out by NextMemorySpan and decoded from the stream as it
+// is read, rather than every span being held in memory as ProcSnapReader does.
+// Spans are checked as ProcSnapReader checks them, each before it is handed
+// out. The parents of incremental snapshots are still read in full.
+type ProcSnapStream struct {
+	*ProcSnapReader //Header, and the metadata of the spans read so far
+	results         chan spanResult
+	quit            chan struct{}
+	closeOnce       sync.Once
+	streams         int   //Still being read
+	err             error //That ended the snapshot, io.EOF if complete
+	onEnd           func()
+}
+
+type spanResult struct {
+	span lib.MemSpan
+	err  error //io.EOF once a stream has no more spans
+}
+
+//NewProcSnapStream reads the header of a snapshot as NewProcSnapReaderLimits
+// does, leaving its memory spans to be read with NextMemorySpan. The memory
+// spans of snapshots split across several streams are handed out as they
+// arrive on any of them.
+func NewProcSnapStream(limits Limits, chunks lib.ChunkSource, parents ParentOpener, inStrms ...FlexReader) (*ProcSnapStream, error) {
+	snapshot, err := openSnapReader(limits, chunks, parents, inStrms)
+	if err != nil {
+		return nil, err
+	}
+	this := &ProcSnapStream{
+		ProcSnapReader: snapshot,
+		results:        make(chan spanResult),
+		quit:           make(chan struct{}),
+		streams:        len(inStrms),
+	}
+	for _, inStrm := range inStrms {
+		go this.stream(inStrm)
+	}
+	return this, nil
+}
+
+//SetEndFunc registers fn to be called once every memory span has been read
+func (this *ProcSnapStream) SetEndFunc(fn func()) {
+	this.onEnd = fn
+}
+
+//NextMemorySpan returns the next memory span to arrive, which must be closed
+// before the next is asked for, or io.EOF once every span was read
+func (this *ProcSnapStream) NextMemorySpan() (lib.MemSpan, error) {
+	for this.err == nil {
+		if this.streams == 0 {
+			this.err, this.parent = io.EOF, nil
+			if this.onEnd != nil {
+				this.onEnd()
+			}
+			break
+		}
+		select {
+		case result := <-this.results:
+			if result.err == io.EOF {
+				this.streams--
+			} else if result.err != nil {
+				this.err = result.err
+			} else {
+				return result.span, nil
+			}
+		case <-this.quit:
+			this.err = errs.New("Snapshot stream was closed")
+		}
+	}
+	return lib.MemSpan{}, this.err
+}
+
+func (this *ProcSnapStream) GetMemoryMeta() (pmaps.ProcMap, error) {
+	return nil, lib.ErrStreamedSpans
+}
+
+func (this *ProcSnapStream) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	return lib.MemSpan{}, lib.ErrStreamedSpans
+}
+
+//Close stops reading the snapshot, the streams it was read from are left to
+// the caller to close
+func (this *ProcSnapStream) Close() error {
+	this.closeOnce.Do(func() { close(this.quit) })
+	return nil
+}
+
+//stream hands out the memory spans of inStrm one at a time, each is decoded as
+// it is read, so the next is only read once it has been closed
+func (this *ProcSnapStream) stream(inStrm FlexReader) {
+	var (
+		buf   bytes.Buffer
+		block = make([]byte, spanBlockSize)
+	)
+	for {
+		metadata, more, err := this.readSpanMeta(inStrm, &buf)
+		if err == nil && more {
+			err = this.insertSpan(metadata)
+		}
+		if err != nil || !more {
+			if err == nil {
+				err = io.EOF
+			}
+			this.send(spanResult{err: err})
+			return
+		}
+
+		spanRdr := &spanStream{
+			snapshot: this,
+			inStrm:   inStrm,
+			metadata: metadata,
+			block:    block,
+			closed:   make(chan struct{}),
+		}
+		if !this.send(spanResult{span: lib.NewMemSpan(metadata, spanRdr)}) {
+			return
+		}
+		select {
+		case <-spanRdr.closed:
+		case <-this.quit:
+			return
+		}
+		//Whatever was not read must still be consumed to reach the next span
+		if err = spanRdr.drain(); err != nil {
+			this.send(spanResult{err: err})
+			return
+		}
+	}
+}
+
+//send hands result to NextMemorySpan, false if the snapshot was closed first
+func (this *ProcSnapStream) send(result spanResult) bool {
+	select {
+	case this.results <- result:
+		return true
+	case <-this.quit:
+		return false
+	}
+}
+
+//spanStream decodes a memory span from its stream a block at a time as it is
+// read
+type spanStream struct {
+	snapshot  *ProcSnapStream
+	inStrm    FlexReader
+	metadata  pmaps.Entry
+	block     []byte //Shared by the spans of inStrm
+	left      []byte //Of block, decoded but not read yet
+	offset    uint64 //Into the span of what has been decoded
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (this *spanStream) Read(buf []byte) (int, error) {
+	if len(this.left) == 0 {
+		if err := this.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, this.left)
+	this.left = this.left[n:]
+	return n, nil
+}
+
+//next decodes the next block of the span, io.EOF once all of it has been
+func (this *spanStream) next() error {
+	if this.err != nil {
+		return this.err
+	}
+	length := this.metadata.Len()
+	if this.offset == length {
+		return io.EOF
+	}
+	size := length - this.offset
+	if size > uint64(len(this.block)) {
+		size = uint64(len(this.block))
+	}
+	if this.err = this.snapshot.fillSpan(this.inStrm, this.metadata, this.block[:size], this.offset); this.err != nil {
+		return this.err
+	}
+	this.left, this.offset = this.block[:size], this.offset+size
+	return nil
+}
+
+//drain decodes what remains of the span unread
+func (this *spanStream) drain() error {
+	for {
+		if err := this.next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//Close lets the span's stream move on to the next span
+func (this *spanStream) Close() error {
+	this.closeOnce.Do(func() { close(this.closed) })
+	return nil
+}
@@ -0,0 +1,132 @@
+package preader
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+)
+
+func streamSnapshot(limits Limits, streams ...[]byte) (*ProcSnapStream, error) {
+	parents := func(ref string) (*ProcSnapReader, error) { return nil, errs.New("No parent: %s", ref) }
+	inStrms := make([]FlexReader, len(streams))
+	for i, stream := range streams {
+		inStrms[i] = bufio.NewReader(bytes.NewReader(stream))
+	}
+	return NewProcSnapStream(limits, nil, parents, inStrms...)
+}
+
+func TestProcSnapStream(t *testing.T) {
+	snap := validSnapshot()
+	snap.spans = append(snap.spans, testSpan{"10000000-10300000 rw-p 00000000 00:00 0", 0x300000}) //Several blocks
+	snapshot, err := streamSnapshot(Limits{}, snap.bytes())
+	if err != nil {
+		t.Fatalf("Could not read valid snapshot header; Details: %s", err)
+	} else if snapshot.GetName() != "/bin/test" || len(snapshot.GetFiles()) != 2 {
+		t.Fatalf("Snapshot header was not read as written: name: %q, %d files", snapshot.GetName(), len(snapshot.GetFiles()))
+	}
+	if _, err = snapshot.GetMemoryMeta(); err != lib.ErrStreamedSpans {
+		t.Fatalf("Streamed snapshot returned: %v for its memory metadata, expected: %s", err, lib.ErrStreamedSpans)
+	}
+	var ended bool
+	snapshot.SetEndFunc(func() { ended = true })
+
+	var i int
+	err = lib.ForEachMemorySpan(snapshot, func(span lib.MemSpan) error {
+		if span.Metadata.MemStart != 0x1000 && i == 0 {
+			t.Fatalf("First span streamed starts at: %x, expected: 1000", span.Metadata.MemStart)
+		}
+		if i%2 == 1 { //Spans left unread are skipped
+			i++
+			return nil
+		}
+		data, err := ioutil.ReadAll(span)
+		if err != nil {
+			return err
+		} else if uint64(len(data)) != span.Metadata.Len() || !bytes.Equal(data, bytes.Repeat([]byte{0xAB}, len(data))) {
+			t.Fatalf("Span %s streamed %d bytes that differ from the %d written", span.Metadata, len(data), span.Metadata.Len())
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not stream memory spans; Details: %s", err)
+	} else if i != len(snap.spans) || !ended {
+		t.Fatalf("Streamed %d of %d memory spans (ended: %t)", i, len(snap.spans), ended)
+	}
+	if _, err = snapshot.NextMemorySpan(); err != io.EOF {
+		t.Fatalf("Finished snapshot stream returned: %v, expected EOF", err)
+	}
+}
+
+func TestProcSnapStreamParallel(t *testing.T) {
+	header := validSnapshot()
+	header.spans = header.spans[:1]
+	header.end = true
+	second := testSnapshot{spans: []testSpan{{"20000-40000 rw-p 00000000 00:00 0", 0x20000}}, end: true}
+	secondBytes := second.bytes()
+	secondBytes = secondBytes[len(testSnapshot{}.bytes()):] //Only the spans
+
+	snapshot, err := streamSnapshot(Limits{}, header.bytes(), secondBytes)
+	if err != nil {
+		t.Fatalf("Could not read valid snapshot header; Details: %s", err)
+	}
+	var memory uint64
+	err = lib.ForEachMemorySpan(snapshot, func(span lib.MemSpan) error {
+		n, err := io.Copy(ioutil.Discard, span)
+		memory += uint64(n)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Could not stream memory spans of parallel streams; Details: %s", err)
+	} else if memory != 0x22000 {
+		t.Fatalf("Streamed: %x bytes of memory, expected: 22000", memory)
+	}
+}
+
+func TestProcSnapStreamRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*testSnapshot)
+		limits   Limits
+		expected string //In the error
+	}{
+		{"overlapping spans", func(snap *testSnapshot) {
+			snap.spans = append(snap.spans, testSpan{"2000-4000 rw-p 00000000 00:00 0", 0x2000})
+		}, Limits{}, "overlaps"},
+		{"too much memory", func(snap *testSnapshot) {}, Limits{MaxMemory: 0x3000}, "exceeds the limit"},
+		{"truncated span", func(snap *testSnapshot) { snap.spans[1].len = 10; snap.spans = snap.spans[:2]; snap.end = false }, Limits{}, "span data"},
+	}
+	for _, test := range tests {
+		snap := validSnapshot()
+		test.modify(&snap)
+		snapshot, err := streamSnapshot(test.limits, snap.bytes())
+		if err == nil {
+			err = lib.ForEachMemorySpan(snapshot, func(span lib.MemSpan) error {
+				_, err := io.Copy(ioutil.Discard, span)
+				return err
+			})
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Streamed snapshot with %s returned: %v, expected an error containing: %q", test.name, err, test.expected)
+		}
+	}
+
+	//Closing stops the snapshot mid stream
+	snapshot, err := streamSnapshot(Limits{}, validSnapshot().bytes())
+	if err != nil {
+		t.Fatalf("Could not read valid snapshot header; Details: %s", err)
+	}
+	if _, err = snapshot.NextMemorySpan(); err != nil {
+		t.Fatalf("Could not get first memory span; Details: %s", err)
+	}
+	snapshot.Close()
+	if _, err = snapshot.NextMemorySpan(); err == nil || err == io.EOF {
+		t.Fatalf("Closed snapshot stream returned: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package preader
+
+import (
+	"math"
+	"sort"
+	"syscall"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+const (
+	//userSpaceEnd is where the user address space of x86-64 ends with 5-level
+	// paging, with 4-level paging it ends at 1<<47 - pageSize
+	userSpaceEnd = uint64(1<<56 - pageSize)
+	//vsyscallStart is the fixed address of the legacy [vsyscall] page, the only
+	// mapping above the user address space a process has
+	vsyscallStart = uint64(0xffffffffff600000)
+	//spanAllocStep bounds how much memory is allocated for a span ahead of its
+	// data arriving
+	spanAllocStep = 16 << 20
+)
+
+//Limits bound the resources reading a snapshot may take, as snapshots may come
+// from untrusted sources. Fields left 0 take the value in DefaultLimits.
+type Limits struct {
+	MaxMemory    uint64 //Total bytes of memory spans, the host's RAM and swap by default
+	MaxSpans     int    //Memory spans (mappings)
+	MaxFiles     int    //Open file records
+	MaxStringLen int    //Of the process name, file paths, parent reference and span metadata
+}
+
+//DefaultLimits are generous for any process Linux runs by default, whose
+// mappings are bounded by vm.max_map_count and open files by fs.nr_open
+var DefaultLimits = Limits{
+	MaxSpans:     1 << 17,
+	MaxFiles:     1 << 20,
+	MaxStringLen: 1 << 16,
+}
+
+//withDefaults returns the limits with unset fields taken from DefaultLimits
+func (this Limits) withDefaults() Limits {
+	if this.MaxMemory == 0 {
+		if this.MaxMemory = DefaultLimits.MaxMemory; this.MaxMemory == 0 {
+			this.MaxMemory = hostMemory()
+		}
+	}
+	if this.MaxSpans == 0 {
+		this.MaxSpans = DefaultLimits.MaxSpans
+	}
+	if this.MaxFiles == 0 {
+		this.MaxFiles = DefaultLimits.MaxFiles
+	}
+	if this.MaxStringLen == 0 {
+		this.MaxStringLen = DefaultLimits.MaxStringLen
+	}
+	return this
+}
+
+//hostMemory returns the RAM and swap of the host, which no process restored on
+// it can exceed
+func hostMemory() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return math.MaxUint64
+	}
+	return (info.Totalram + info.Totalswap) * uint64(info.Unit)
+}
+
+//checkSpan verifies a memory span is a page aligned range of the user address
+// space (or the [vsyscall] page)
+func checkSpan(metadata pmaps.Entry) error {
+	start, end := metadata.MemStart, metadata.MemEnd
+	switch {
+	case start%pageSize != 0 || end%pageSize != 0:
+		return errs.New("Memory span: %x-%x is not page aligned", start, end)
+	case start >= end:
+		return errs.New("Memory span: %x-%x is empty", start, end)
+	case end > userSpaceEnd && !(start == vsyscallStart && end == vsyscallStart+pageSize && metadata.FileInfo.Path() == "[vsyscall]"):
+		return errs.New("Memory span: %x-%x is outside the user address space", start, end)
+	}
+	return nil
+}
+
+//checkOverlaps verifies the memory spans, sorted by address, do not overlap
+func checkOverlaps(memMeta pmaps.ProcMap) error {
+	for i := 1; i < len(memMeta); i++ {
+		if prev := memMeta[i-1]; memMeta[i].MemStart < prev.MemEnd {
+			return errs.New("Memory span: %x-%x overlaps memory span: %x-%x", memMeta[i].MemStart, memMeta[i].MemEnd, prev.MemStart, prev.MemEnd)
+		}
+	}
+	return nil
+}
+
+//insertSpan adds metadata to the memory spans read so far, kept sorted by
+// address, failing if it overlaps one of them
+func (this *ProcSnapReader) insertSpan(metadata pmaps.Entry) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	i := sort.Search(len(this.memMeta), func(i int) bool { return this.memMeta[i].MemStart >= metadata.MemStart })
+	for _, j := range []int{i - 1, i} {
+		if j >= 0 && j < len(this.memMeta) && this.memMeta[j].MemStart < metadata.MemEnd && metadata.MemStart < this.memMeta[j].MemEnd {
+			return errs.New("Memory span: %x-%x overlaps memory span: %x-%x", metadata.MemStart, metadata.MemEnd, this.memMeta[j].MemStart, this.memMeta[j].MemEnd)
+		}
+	}
+	this.memMeta = append(this.memMeta, pmaps.Entry{})
+	copy(this.memMeta[i+1:], this.memMeta[i:])
+	this.memMeta[i] = metadata
+	return nil
+}
+
+//reserveSpan accounts for a span about to be read, failing if it would exceed
+// the limits
+func (this *ProcSnapReader) reserveSpan(metadata pmaps.Entry) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.spans >= this.limits.MaxSpans {
+		return errs.New("Snapshot has more than the limit of %d memory spans", this.limits.MaxSpans)
+	}
+	length := metadata.Len()
+	if length > this.limits.MaxMemory-this.memory {
+		return errs.New("Snapshot memory exceeds the limit of %d bytes", this.limits.MaxMemory)
+	}
+	this.spans++
+	this.memory += length
+	return nil
+}
+
+//readSpanData returns the length bytes of a span, which fill reads at offset
+// into data. The data is read in steps the buffer grows by as they arrive, so
+// a span claiming more memory than its stream holds can not exhaust memory.
+// Steps are page multiples.
+func readSpanData(length uint64, fill func(data []byte, offset uint64) error) ([]byte, error) {
+	size := length
+	if size > spanAllocStep {
+		size = spanAllocStep
+	}
+	data := make([]byte, size)
+	for read := uint64(0); ; {
+		if err := fill(data[read:], read); err != nil {
+			return nil, err
+		}
+		if read = uint64(len(data)); read == length {
+			return data, nil
+		}
+		if size = 2 * read; size > length {
+			size = length
+		}
+		grown := make([]byte, size)
+		copy(grown, data)
+		data = grown
+	}
+}
@@ -0,0 +1,108 @@
+package preader
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//maxChainLength bounds how many parents an incremental snapshot may have, which
+// also stops a chain that refers back to itself
+const maxChainLength = 256
+
+//DecodeOptions locates what is needed to decode stored snapshots
+type DecodeOptions struct {
+	KeyDir  string //Directory of the key files encrypted snapshots name
+	DictDir string //Directory of the zstd dictionaries compressed snapshots name
+	Limits  Limits //Bound each snapshot read, see NewProcSnapReaderLimits
+}
+
+//OpenSnapshot reads the snapshot stored at ref: a snapshot file written by pfrez
+// or a repo:/path[@ref] repository snapshot. Chunked snapshots resolve their
+// memory pages from their repository, and incremental snapshots are overlaid
+// onto their parents, which are opened the same way.
+func OpenSnapshot(ref string, opts DecodeOptions) (*ProcSnapReader, error) {
+	return opts.openSnapshot(ref, 0)
+}
+
+//Parents returns a ParentOpener that opens parents as OpenSnapshot does
+func (this DecodeOptions) Parents() ParentOpener {
+	return this.parents(0)
+}
+
+func (this DecodeOptions) parents(depth int) ParentOpener {
+	return func(ref string) (*ProcSnapReader, error) {
+		if depth >= maxChainLength {
+			return nil, errs.New("Snapshot has more than %d parents", maxChainLength)
+		}
+		return this.openSnapshot(ref, depth+1)
+	}
+}
+
+func (this DecodeOptions) openSnapshot(ref string, depth int) (*ProcSnapReader, error) {
+	var (
+		file   *os.File
+		chunks lib.ChunkSource
+		err    error
+	)
+	if prepo.IsRepo(ref) {
+		file, chunks, err = openRepoSnapshot(ref)
+	} else if file, err = os.Open(ref); err != nil {
+		err = errs.Append(err, "Could not open snapshot: %s", ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	inStrm, err := this.decode(file)
+	if err != nil {
+		return nil, errs.Append(err, "Could not decode snapshot: %s", ref)
+	}
+	return NewProcSnapReaderLimits(this.Limits, chunks, this.parents(depth), inStrm)
+}
+
+//decode reads the transport encoding of a stored snapshot and returns a reader
+// of the decoded snapshot stream
+func (this DecodeOptions) decode(srcRdr io.Reader) (*bufio.Reader, error) {
+	inStrm := bufio.NewReader(srcRdr)
+	var transpEnc transpenc.TranportEncoding
+	if err := transpenc.ReadTranportEncoding(inStrm, &transpEnc); err != nil {
+		return nil, err
+	} else if transpEnc.StreamCount > 1 {
+		return nil, errs.New("Snapshots split across %d streams can not be stored", transpEnc.StreamCount)
+	}
+	decoder, err := transpenc.NewDecoder(inStrm, transpEnc, transpenc.DecodeOptions{KeyDir: this.KeyDir, DictDir: this.DictDir})
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(decoder), nil
+}
+
+//openRepoSnapshot opens a repository snapshot, and for chunked snapshots the
+// repository's chunk store
+func openRepoSnapshot(ref string) (*os.File, lib.ChunkSource, error) {
+	dir, snapRef, err := prepo.ParseTarget(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, err := prepo.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, snap, err := repo.OpenSnapshot(snapRef)
+	if err != nil || snap.Chunks == 0 {
+		return file, nil, err
+	}
+	chunks, err := repo.Chunks()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, chunks, nil
+}
@@ -0,0 +1,222 @@
+package prepo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pchunk"
+)
+
+const (
+	chunkDirName = "chunks"
+	refsDirName  = "refs"
+	refsExt      = ".refs"
+)
+
+//GCResult describes what GC removed
+type GCResult struct {
+	Files      []string //Names of snapshot and reference files
+	Chunks     int
+	ChunkBytes int64
+}
+
+//Stats describes the storage a repository uses
+type Stats struct {
+	Snapshots     int
+	SnapshotBytes int64 //Snapshot files, for chunked snapshots only their page references
+	Chunks        int   //Distinct memory pages in the chunk store
+	ChunkBytes    int64
+	References    int //Page references of all chunked snapshots, ChunkBytes would be about this many pages without deduplication
+}
+
+//Chunks returns the repository's chunk store, which chunked snapshots resolve
+// their memory pages from
+func (this *Repo) Chunks() (*pchunk.Store, error) {
+	return pchunk.Open(filepath.Join(this.dir, chunkDirName))
+}
+
+func (this *Repo) refsPath(id string) string {
+	return filepath.Join(this.dir, refsDirName, id+refsExt)
+}
+
+//readRefs returns the chunks snapshot id references
+func (this *Repo) readRefs(id string) ([]pchunk.Hash, error) {
+	data, err := ioutil.ReadFile(this.refsPath(id))
+	if err != nil {
+		return nil, errs.Append(err, "Could not read chunk references of snapshot: %s", id)
+	} else if len(data)%pchunk.HashSize != 0 {
+		return nil, errs.New("Chunk references of snapshot: %s are truncated", id)
+	}
+	refs := make([]pchunk.Hash, len(data)/pchunk.HashSize)
+	for i := range refs {
+		copy(refs[i][:], data[i*pchunk.HashSize:])
+	}
+	return refs, nil
+}
+
+//RefCounts returns how many snapshots reference each chunk
+func (this *Repo) RefCounts() (map[pchunk.Hash]int, error) {
+	snaps, err := this.List()
+	if err != nil {
+		return nil, err
+	}
+	return this.refCounts(snaps)
+}
+
+func (this *Repo) refCounts(snaps []Snapshot) (map[pchunk.Hash]int, error) {
+	counts := make(map[pchunk.Hash]int)
+	for _, snap := range snaps {
+		if snap.Chunks == 0 {
+			continue
+		}
+		refs, err := this.readRefs(snap.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range refs {
+			counts[hash]++
+		}
+	}
+	return counts, nil
+}
+
+//verifyChunks checks every chunk snapshot id references is intact
+func (this *Repo) verifyChunks(id string) error {
+	refs, err := this.readRefs(id)
+	if err != nil {
+		return err
+	}
+	store, err := this.Chunks()
+	if err != nil {
+		return err
+	}
+	for _, hash := range refs {
+		if _, err = store.Get(hash); err != nil {
+			return errs.Append(err, "Snapshot: %s references a missing or corrupt chunk", id)
+		}
+	}
+	return nil
+}
+
+//gcChunks removes reference files of snapshots that are not in cat, and the
+// chunks no remaining snapshot references. Anything modified within minAge may
+// belong to a snapshot still being written and is kept.
+func (this *Repo) gcChunks(cat catalog, minAge time.Duration, result *GCResult) error {
+	refsDir := filepath.Join(this.dir, refsDirName)
+	infos, err := ioutil.ReadDir(refsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errs.Append(err, "Could not list reference directory: %s", refsDir)
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if cat.find(strings.TrimSuffix(name, refsExt)) != nil || time.Since(info.ModTime()) < minAge {
+			continue
+		}
+		if err = os.Remove(filepath.Join(refsDir, name)); err != nil {
+			return errs.Append(err, "Could not remove: %s", name)
+		}
+		result.Files = append(result.Files, name)
+	}
+
+	counts, err := this.refCounts(cat.Snapshots)
+	if err != nil {
+		return err
+	}
+	store, err := this.Chunks()
+	if err != nil {
+		return err
+	}
+	if err = store.RemoveTemps(minAge); err != nil {
+		return err
+	}
+	return store.Walk(func(hash pchunk.Hash, info os.FileInfo) error {
+		if counts[hash] > 0 || time.Since(info.ModTime()) < minAge {
+			return nil
+		}
+		if err := store.Remove(hash); err != nil {
+			return err
+		}
+		result.Chunks++
+		result.ChunkBytes += info.Size()
+		return nil
+	})
+}
+
+//Stats returns the storage the repository uses
+func (this *Repo) Stats() (Stats, error) {
+	var stats Stats
+	snaps, err := this.List()
+	if err != nil {
+		return stats, err
+	}
+	stats.Snapshots = len(snaps)
+	for _, snap := range snaps {
+		stats.SnapshotBytes += snap.Size
+		stats.References += snap.Chunks
+	}
+	store, err := this.Chunks()
+	if err != nil {
+		return stats, err
+	}
+	err = store.Walk(func(hash pchunk.Hash, info os.FileInfo) error {
+		stats.Chunks++
+		stats.ChunkBytes += info.Size()
+		return nil
+	})
+	return stats, err
+}
+
+//chunkRecorder puts chunks in the repository's store and records which ones a
+// snapshot references
+type chunkRecorder struct {
+	store *pchunk.Store
+	lock  sync.Mutex
+	refs  map[pchunk.Hash]struct{}
+}
+
+//Ensure chunkRecorder implements ChunkSink
+var _ lib.ChunkSink = new(chunkRecorder)
+
+func (this *chunkRecorder) PutChunk(hash [pchunk.HashSize]byte, data []byte) error {
+	if _, err := this.store.Put(hash, data); err != nil {
+		return err
+	}
+	this.lock.Lock()
+	this.refs[hash] = struct{}{}
+	this.lock.Unlock()
+	return nil
+}
+
+//writeRefs records the chunks referenced by snapshot id
+func (this *chunkRecorder) writeRefs(repo *Repo, id string) error {
+	refs := make([]pchunk.Hash, 0, len(this.refs))
+	for hash := range this.refs {
+		refs = append(refs, hash)
+	}
+	sort.Slice(refs, func(i, j int) bool { return bytes.Compare(refs[i][:], refs[j][:]) < 0 })
+	data := make([]byte, 0, len(refs)*pchunk.HashSize)
+	for _, hash := range refs {
+		data = append(data, hash[:]...)
+	}
+
+	if err := os.MkdirAll(filepath.Join(repo.dir, refsDirName), 0700); err != nil {
+		return errs.Append(err, "Could not create reference directory")
+	}
+	path := repo.refsPath(id)
+	if err := writeFileSync(path+partialExt, data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+partialExt, path); err != nil {
+		os.Remove(path + partialExt)
+		return errs.Append(err, "Could not store chunk references of snapshot: %s", id)
+	}
+	return nil
+}
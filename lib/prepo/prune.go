@@ -0,0 +1,93 @@
+package prepo
+
+import (
+	"strings"
+	"time"
+)
+
+//Filter selects snapshots, fields left empty match any snapshot
+type Filter struct {
+	Name          string //Substring of the invocation command
+	Tag           string
+	Host          string
+	OrigPID       int
+	Since, Before time.Time //Creation time bounds
+}
+
+//Match reports if snap passes the filter
+func (this Filter) Match(snap Snapshot) bool {
+	switch {
+	case this.Name != "" && !strings.Contains(snap.Name, this.Name):
+	case this.Tag != "" && !snap.HasTag(this.Tag):
+	case this.Host != "" && snap.Host != this.Host:
+	case this.OrigPID != 0 && snap.OrigPID != this.OrigPID:
+	case !this.Since.IsZero() && snap.Created.Before(this.Since):
+	case !this.Before.IsZero() && !snap.Created.Before(this.Before):
+	default:
+		return true
+	}
+	return false
+}
+
+//Search returns the snapshots that pass filter, oldest first
+func (this *Repo) Search(filter Filter) ([]Snapshot, error) {
+	snaps, err := this.List()
+	if err != nil {
+		return nil, err
+	}
+	matched := snaps[:0]
+	for _, snap := range snaps {
+		if filter.Match(snap) {
+			matched = append(matched, snap)
+		}
+	}
+	return matched, nil
+}
+
+//PrunePolicy selects the snapshots Prune removes
+type PrunePolicy struct {
+	Filter               //Only snapshots passing it are considered
+	Keep   int           //Keep the newest this many, 0 does not limit the count
+	MaxAge time.Duration //Remove those older than this, 0 does not limit the age
+}
+
+//Prune removes the snapshots that policy selects, except those kept snapshots
+// build on, and returns them
+func (this *Repo) Prune(policy PrunePolicy, now time.Time) ([]Snapshot, error) {
+	snaps, err := this.Search(policy.Filter)
+	if err != nil {
+		return nil, err
+	}
+	all, err := this.List()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string]bool)
+	for i, snap := range snaps {
+		if (policy.Keep > 0 && i < len(snaps)-policy.Keep) || (policy.MaxAge > 0 && now.Sub(snap.Created) > policy.MaxAge) {
+			expired[snap.ID] = true
+		}
+	}
+	//Spare the ancestors of every snapshot that stays, newest first so the whole
+	// chain is spared
+	for i := len(all) - 1; i >= 0; i-- {
+		if !expired[all[i].ID] && all[i].Parent != "" {
+			delete(expired, all[i].Parent)
+		}
+	}
+
+	var (
+		removed []Snapshot
+		ids     []string
+	)
+	for _, snap := range snaps {
+		if expired[snap.ID] {
+			removed, ids = append(removed, snap), append(ids, snap.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return removed, this.Remove(ids...)
+}
@@ -0,0 +1,465 @@
+//Package prepo implements a snapshot repository: a directory of snapshot files
+// and a catalog describing each of them.
+//
+//Layout:
+//	catalog.json                catalog of every complete snapshot
+//	snapshots/<id>.snapshot     snapshot files, exactly as pfrez wrote them
+//	snapshots/<id>.snapshot.partial  snapshots still being written
+//	chunks/<xx>/<hash>          memory pages of chunked snapshots, see pchunk
+//	refs/<id>.refs              hashes of the chunks a chunked snapshot references
+//	.lock                       serializes catalog updates between processes
+//	.writers.lock               held shared by writers, so GC waits for them
+package prepo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/endpoint"
+)
+
+//Scheme prefixes repository destinations and sources: repo:/path[@ref]
+const Scheme = "repo:"
+
+func init() {
+	endpoint.Register(endpoint.Scheme{Name: strings.TrimSuffix(Scheme, ":"), Addressing: endpoint.AddrOpaque})
+}
+
+const (
+	catalogName     = "catalog.json"
+	catalogVersion  = 1
+	snapshotDirName = "snapshots"
+	snapshotExt     = ".snapshot"
+	partialExt      = ".partial"
+	lockName        = ".lock"
+	writersLockName = ".writers.lock"
+	idStamp         = "20060102T150405Z"
+)
+
+//Snapshot is the catalog entry of one snapshot
+type Snapshot struct {
+	ID      string
+	Name    string `json:",omitempty"` //Invocation command of the process
+	OrigPID int    `json:",omitempty"` //PID of the process when captured
+	Host    string `json:",omitempty"`
+	Kernel  string `json:",omitempty"` //Kernel release of Host
+	Created time.Time
+	Size    int64    //Bytes, as stored (compressed and encrypted)
+	Digest  string   //Hex SHA-256 of the snapshot file
+	Tags    []string `json:",omitempty"`
+	Parent  string   `json:",omitempty"` //ID of the snapshot this one builds on
+	Chunks  int      `json:",omitempty"` //Distinct chunks a chunked snapshot references
+}
+
+//HasTag reports if the snapshot carries tag
+func (this Snapshot) HasTag(tag string) bool {
+	for _, t := range this.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type catalog struct {
+	Version   int
+	Snapshots []Snapshot
+}
+
+//Repo is a snapshot repository, it is safe for concurrent use by several
+// processes
+type Repo struct {
+	dir string
+}
+
+//IsRepo reports if target (a destination or source) names a repository
+func IsRepo(target string) bool {
+	return strings.HasPrefix(target, Scheme)
+}
+
+//ParseTarget splits a repo:/path[@ref] destination or source into the
+// repository directory and the reference, which is empty if not given
+func ParseTarget(target string) (dir, ref string, err error) {
+	if !IsRepo(target) {
+		return "", "", errs.New("Repository targets must be in the form: %s/path[@ref], not: %q", Scheme, target)
+	}
+	dir = strings.TrimPrefix(target, Scheme)
+	if at := strings.LastIndexByte(dir, '@'); at >= 0 {
+		dir, ref = dir[:at], dir[at+1:]
+	}
+	if dir == "" {
+		return "", "", errs.New("Repository target: %q lacks a directory", target)
+	}
+	return dir, ref, nil
+}
+
+//Open opens the existing repository in dir
+func Open(dir string) (*Repo, error) {
+	if info, err := os.Stat(filepath.Join(dir, snapshotDirName)); err != nil || !info.IsDir() {
+		return nil, errs.New("Directory: %s is not a snapshot repository", dir)
+	}
+	return &Repo{dir: dir}, nil
+}
+
+//Init opens the repository in dir, creating it if it does not exist yet
+func Init(dir string) (*Repo, error) {
+	if err := os.MkdirAll(filepath.Join(dir, snapshotDirName), 0700); err != nil {
+		return nil, errs.Append(err, "Could not create snapshot repository: %s", dir)
+	}
+	return Open(dir)
+}
+
+//Dir returns the repository's directory
+func (this *Repo) Dir() string {
+	return this.dir
+}
+
+//Path returns the file of snapshot id
+func (this *Repo) Path(id string) string {
+	return filepath.Join(this.dir, snapshotDirName, id+snapshotExt)
+}
+
+//List returns every snapshot in the catalog, oldest first
+func (this *Repo) List() ([]Snapshot, error) {
+	var snaps []Snapshot
+	err := this.locked(syscall.LOCK_SH, func() error {
+		cat, err := this.load()
+		snaps = cat.Snapshots
+		return err
+	})
+	return snaps, err
+}
+
+//Find resolves ref to a snapshot: an ID, a tag (the newest snapshot carrying
+// it) or empty or "latest" for the newest snapshot
+func (this *Repo) Find(ref string) (Snapshot, error) {
+	snaps, err := this.List()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if ref == "" || ref == "latest" || snaps[i].ID == ref || snaps[i].HasTag(ref) {
+			return snaps[i], nil
+		}
+	}
+	if ref == "" {
+		return Snapshot{}, errs.New("Repository: %s holds no snapshots", this.dir)
+	}
+	return Snapshot{}, errs.New("Repository: %s holds no snapshot with ID or tag: %q", this.dir, ref)
+}
+
+//OpenSnapshot opens the snapshot ref resolves to for reading
+func (this *Repo) OpenSnapshot(ref string) (*os.File, Snapshot, error) {
+	snap, err := this.Find(ref)
+	if err != nil {
+		return nil, Snapshot{}, err
+	}
+	file, err := os.Open(this.Path(snap.ID))
+	if err != nil {
+		return nil, Snapshot{}, errs.Append(err, "Could not open snapshot: %s", snap.ID)
+	}
+	return file, snap, nil
+}
+
+//Tag adds and removes tags of snapshot id
+func (this *Repo) Tag(id string, add, remove []string) error {
+	for _, tag := range add {
+		if err := validTag(tag); err != nil {
+			return err
+		}
+	}
+	return this.update(func(cat *catalog) error {
+		snap := cat.find(id)
+		if snap == nil {
+			return errs.New("Repository: %s holds no snapshot with ID: %q", this.dir, id)
+		}
+		tags := snap.Tags[:0:0]
+		for _, tag := range snap.Tags {
+			if !contains(remove, tag) && !contains(add, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		snap.Tags = append(tags, add...)
+		sort.Strings(snap.Tags)
+		return nil
+	})
+}
+
+//Verify checks the file of snapshot id still has the size and digest recorded
+// in the catalog, and that the chunks of a chunked snapshot are intact
+func (this *Repo) Verify(id string) error {
+	snap, err := this.Find(id)
+	if err != nil {
+		return err
+	} else if snap.ID != id {
+		return errs.New("Repository: %s holds no snapshot with ID: %q", this.dir, id)
+	}
+	file, err := os.Open(this.Path(id))
+	if err != nil {
+		return errs.Append(err, "Could not open snapshot: %s", id)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	switch {
+	case err != nil:
+		return errs.Append(err, "Could not read snapshot: %s", id)
+	case size != snap.Size:
+		return errs.New("Snapshot: %s is %d bytes, the catalog records %d", id, size, snap.Size)
+	case hex.EncodeToString(hash.Sum(nil)) != snap.Digest:
+		return errs.New("Snapshot: %s does not match the digest the catalog records", id)
+	case snap.Chunks > 0:
+		return this.verifyChunks(id)
+	}
+	return nil
+}
+
+//Remove deletes snapshots from the catalog and their files. Snapshots others
+// build on can not be removed without them.
+func (this *Repo) Remove(ids ...string) error {
+	err := this.update(func(cat *catalog) error {
+		removing := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			if cat.find(id) == nil {
+				return errs.New("Repository: %s holds no snapshot with ID: %q", this.dir, id)
+			}
+			removing[id] = true
+		}
+		kept := cat.Snapshots[:0]
+		for _, snap := range cat.Snapshots {
+			if removing[snap.Parent] && !removing[snap.ID] {
+				return errs.New("Snapshot: %s can not be removed, snapshot: %s builds on it", snap.Parent, snap.ID)
+			}
+			if !removing[snap.ID] {
+				kept = append(kept, snap)
+			}
+		}
+		cat.Snapshots = kept
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	//Files left behind if this fails are collected by GC
+	for _, id := range ids {
+		if err = os.Remove(this.Path(id)); err != nil && !os.IsNotExist(err) {
+			return errs.Append(err, "Could not remove snapshot: %s", id)
+		}
+		if err = os.Remove(this.refsPath(id)); err != nil && !os.IsNotExist(err) {
+			return errs.Append(err, "Could not remove chunk references of snapshot: %s", id)
+		}
+	}
+	return nil
+}
+
+//GC removes snapshot files the catalog does not refer to: those of removed
+// snapshots and partial files of writes that never completed. Chunks no
+// catalogued snapshot references are removed too. GC waits for the snapshots
+// being written to complete, partial files and chunks younger than minAge are
+// kept regardless.
+func (this *Repo) GC(minAge time.Duration) (GCResult, error) {
+	var result GCResult
+	//Snapshots being written may reuse chunks they haven't referenced yet. The
+	// writers lock is always taken before the catalog's.
+	writers, err := this.lock(writersLockName, syscall.LOCK_EX)
+	if err != nil {
+		return result, err
+	}
+	defer writers.Close()
+	err = this.locked(syscall.LOCK_EX, func() error {
+		cat, err := this.load()
+		if err != nil {
+			return err
+		}
+		snapDir := filepath.Join(this.dir, snapshotDirName)
+		infos, err := ioutil.ReadDir(snapDir)
+		if err != nil {
+			return errs.Append(err, "Could not list snapshot directory: %s", snapDir)
+		}
+		for _, info := range infos {
+			name := info.Name()
+			switch {
+			case strings.HasSuffix(name, snapshotExt) && cat.find(strings.TrimSuffix(name, snapshotExt)) != nil:
+				continue
+			case strings.HasSuffix(name, partialExt) && time.Since(info.ModTime()) < minAge:
+				continue
+			}
+			if err = os.Remove(filepath.Join(snapDir, name)); err != nil {
+				return errs.Append(err, "Could not remove: %s", name)
+			}
+			result.Files = append(result.Files, name)
+		}
+		return this.gcChunks(cat, minAge, &result)
+	})
+	return result, err
+}
+
+//add records a completely written snapshot in the catalog. commit puts its
+// files in place while the catalog is locked, before the snapshot is recorded.
+func (this *Repo) add(snap Snapshot, commit func() error) error {
+	return this.update(func(cat *catalog) error {
+		if snap.Parent != "" && cat.find(snap.Parent) == nil {
+			return errs.New("Parent snapshot: %s is not in repository: %s", snap.Parent, this.dir)
+		}
+		if err := commit(); err != nil {
+			return err
+		}
+		cat.Snapshots = append(cat.Snapshots, snap)
+		sort.SliceStable(cat.Snapshots, func(i, j int) bool {
+			return cat.Snapshots[i].Created.Before(cat.Snapshots[j].Created)
+		})
+		return nil
+	})
+}
+
+//update applies fn to the catalog and saves it, unless fn fails
+func (this *Repo) update(fn func(cat *catalog) error) error {
+	return this.locked(syscall.LOCK_EX, func() error {
+		cat, err := this.load()
+		if err != nil {
+			return err
+		}
+		if err = fn(&cat); err != nil {
+			return err
+		}
+		return this.save(cat)
+	})
+}
+
+func (this *Repo) locked(how int, fn func() error) error {
+	lockFile, err := this.lock(lockName, how)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	return fn()
+}
+
+//lock takes the lock file name of the repository, closing the file returned
+// releases it
+func (this *Repo) lock(name string, how int) (*os.File, error) {
+	path := filepath.Join(this.dir, name)
+	lockFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errs.Append(err, "Could not open repository lock: %s", path)
+	}
+	for {
+		if err = syscall.Flock(int(lockFile.Fd()), how); err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		lockFile.Close()
+		return nil, errs.Append(err, "Could not lock repository: %s", this.dir)
+	}
+	return lockFile, nil
+}
+
+func (this *Repo) load() (catalog, error) {
+	path := filepath.Join(this.dir, catalogName)
+	cat := catalog{Version: catalogVersion}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cat, nil
+	} else if err != nil {
+		return cat, errs.Append(err, "Could not read repository catalog: %s", path)
+	}
+	if err = json.Unmarshal(data, &cat); err != nil {
+		return cat, errs.Append(err, "Could not parse repository catalog: %s", path)
+	} else if cat.Version > catalogVersion {
+		return cat, errs.New("Repository catalog: %s is version %d, this build supports up to %d", path, cat.Version, catalogVersion)
+	}
+	return cat, nil
+}
+
+//save replaces the catalog atomically
+func (this *Repo) save(cat catalog) error {
+	path := filepath.Join(this.dir, catalogName)
+	data, err := json.MarshalIndent(cat, "", "\t")
+	if err != nil {
+		return errs.Append(err, "Could not encode repository catalog")
+	}
+	if err = writeFileSync(path+partialExt, data); err != nil {
+		return err
+	}
+	if err = os.Rename(path+partialExt, path); err != nil {
+		return errs.Append(err, "Could not replace repository catalog: %s", path)
+	}
+	return syncDir(this.dir)
+}
+
+func (this *catalog) find(id string) *Snapshot {
+	for i := range this.Snapshots {
+		if this.Snapshots[i].ID == id {
+			return &this.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+//newID returns a unique ID that sorts chronologically
+func newID(created time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errs.Append(err, "Could not read entropy source to generate a snapshot ID")
+	}
+	return created.UTC().Format(idStamp) + "-" + hex.EncodeToString(suffix), nil
+}
+
+//validTag rejects tags that can not be told apart from IDs or references
+func validTag(tag string) error {
+	if tag == "" || tag == "latest" || strings.ContainsAny(tag, "@,/ \t\n") {
+		return errs.New("Invalid tag: %q, tags can not be empty, \"latest\" or contain '@', ',', '/' or spaces", tag)
+	}
+	return nil
+}
+
+func contains(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errs.Append(err, "Could not create: %s", path)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errs.Append(err, "Could not write: %s", path)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return errs.Append(err, "Could not open directory: %s", dir)
+	}
+	defer dirFile.Close()
+	if err = dirFile.Sync(); err != nil {
+		return errs.Append(err, "Could not sync directory: %s", dir)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package prepo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tarndt/pmigrate/lib/pchunk"
+)
+
+func newTestRepo(t *testing.T) *Repo {
+	dir, err := ioutil.TempDir("", "prepo")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if _, err = Open(dir); err == nil {
+		t.Fatalf("Opened a directory that is not a repository")
+	}
+	repo, err := Init(dir)
+	if err != nil {
+		t.Fatalf("Could not open repository: %s", err)
+	}
+	return repo
+}
+
+func writeSnapshot(t *testing.T, repo *Repo, snap Snapshot, data string) string {
+	wtr, err := repo.Create(snap)
+	if err != nil {
+		t.Fatalf("Could not create snapshot: %s", err)
+	}
+	if _, err = wtr.Write([]byte(data)); err != nil {
+		t.Fatalf("Could not write snapshot: %s", err)
+	}
+	if err = wtr.Close(); err != nil {
+		t.Fatalf("Could not complete snapshot: %s", err)
+	}
+	return wtr.ID()
+}
+
+func TestParseTarget(t *testing.T) {
+	for target, want := range map[string][2]string{
+		"repo:/var/snaps":          {"/var/snaps", ""},
+		"repo:/var/snaps@nightly":  {"/var/snaps", "nightly"},
+		"repo:relative/dir@latest": {"relative/dir", "latest"},
+	} {
+		dir, ref, err := ParseTarget(target)
+		if err != nil || dir != want[0] || ref != want[1] {
+			t.Fatalf("ParseTarget(%q) = %q, %q, %v; expected %q, %q", target, dir, ref, err, want[0], want[1])
+		}
+	}
+	for _, target := range []string{"/var/snaps", "repo:", "repo:@tag"} {
+		if _, _, err := ParseTarget(target); err == nil {
+			t.Fatalf("ParseTarget(%q) succeeded", target)
+		}
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	repo := newTestRepo(t)
+	start := time.Now().Add(-time.Hour)
+	first := writeSnapshot(t, repo, Snapshot{Name: "./worker -n 1", OrigPID: 10, Created: start, Tags: []string{"nightly"}}, "first")
+	second := writeSnapshot(t, repo, Snapshot{Name: "./server", OrigPID: 20, Created: start.Add(time.Minute)}, "second!")
+
+	//An abandoned write is neither listed nor kept by GC
+	aborted, err := repo.Create(Snapshot{Name: "./aborted"})
+	if err != nil {
+		t.Fatalf("Could not create snapshot: %s", err)
+	}
+	aborted.Write([]byte("partial"))
+	if err = aborted.Abort(); err != nil {
+		t.Fatalf("Could not abort snapshot: %s", err)
+	}
+
+	snaps, err := repo.List()
+	if err != nil {
+		t.Fatalf("Could not list snapshots: %s", err)
+	} else if len(snaps) != 2 || snaps[0].ID != first || snaps[1].ID != second {
+		t.Fatalf("Listed %+v, expected snapshots %s then %s", snaps, first, second)
+	} else if snaps[1].Size != int64(len("second!")) || snaps[1].Digest == "" || snaps[1].Host == "" || snaps[1].Kernel == "" {
+		t.Fatalf("Snapshot was not described completely: %+v", snaps[1])
+	}
+
+	for ref, want := range map[string]string{"": second, "latest": second, "nightly": first, first: first} {
+		if snap, err := repo.Find(ref); err != nil || snap.ID != want {
+			t.Fatalf("Find(%q) = %s, %v; expected %s", ref, snap.ID, err, want)
+		}
+	}
+	if _, err = repo.Find("missing"); err == nil {
+		t.Fatalf("Found a snapshot for an unknown reference")
+	}
+
+	if err = repo.Tag(second, []string{"nightly", "keep"}, nil); err != nil {
+		t.Fatalf("Could not tag snapshot: %s", err)
+	}
+	if err = repo.Tag(first, nil, []string{"nightly"}); err != nil {
+		t.Fatalf("Could not untag snapshot: %s", err)
+	}
+	if snap, _ := repo.Find("nightly"); snap.ID != second {
+		t.Fatalf("Tag nightly did not move to %s", second)
+	}
+	if err = repo.Tag(second, []string{"bad tag"}, nil); err == nil {
+		t.Fatalf("Accepted a tag containing a space")
+	}
+
+	matched, err := repo.Search(Filter{Name: "worker"})
+	if err != nil || len(matched) != 1 || matched[0].ID != first {
+		t.Fatalf("Search by name returned %+v, %v", matched, err)
+	}
+	matched, err = repo.Search(Filter{Since: start.Add(time.Second)})
+	if err != nil || len(matched) != 1 || matched[0].ID != second {
+		t.Fatalf("Search by time returned %+v, %v", matched, err)
+	}
+
+	file, snap, err := repo.OpenSnapshot("keep")
+	if err != nil {
+		t.Fatalf("Could not open snapshot: %s", err)
+	}
+	data, _ := ioutil.ReadAll(file)
+	file.Close()
+	if snap.ID != second || string(data) != "second!" {
+		t.Fatalf("Opened snapshot %s containing %q", snap.ID, data)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	repo := newTestRepo(t)
+	id := writeSnapshot(t, repo, Snapshot{Name: "./job"}, "snapshot data")
+	if err := repo.Verify(id); err != nil {
+		t.Fatalf("Intact snapshot failed verification: %s", err)
+	}
+	if err := ioutil.WriteFile(repo.Path(id), []byte("snapshot dada"), 0600); err != nil {
+		t.Fatalf("Could not corrupt snapshot: %s", err)
+	}
+	if err := repo.Verify(id); err == nil {
+		t.Fatalf("Corrupted snapshot passed verification")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	repo := newTestRepo(t)
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		snap := Snapshot{Name: "./job", Created: now.Add(time.Duration(i-5) * time.Hour)}
+		if i == 4 { //The newest builds on the oldest
+			snap.Parent = ids[0]
+		}
+		ids = append(ids, writeSnapshot(t, repo, snap, "data"))
+	}
+	other := writeSnapshot(t, repo, Snapshot{Name: "./other", Created: now.Add(-10 * time.Hour)}, "data")
+
+	removed, err := repo.Prune(PrunePolicy{Filter: Filter{Name: "job"}, Keep: 2}, now)
+	if err != nil {
+		t.Fatalf("Could not prune: %s", err)
+	} else if len(removed) != 2 || removed[0].ID != ids[1] || removed[1].ID != ids[2] {
+		t.Fatalf("Pruned %+v, expected %s and %s (%s is a parent)", removed, ids[1], ids[2], ids[0])
+	}
+	if _, err = os.Stat(repo.Path(ids[1])); !os.IsNotExist(err) {
+		t.Fatalf("File of pruned snapshot remains")
+	}
+
+	removed, err = repo.Prune(PrunePolicy{MaxAge: 3 * time.Hour}, now)
+	if err != nil {
+		t.Fatalf("Could not prune: %s", err)
+	} else if len(removed) != 1 || removed[0].ID != other {
+		t.Fatalf("Pruned %+v, expected only %s", removed, other)
+	}
+	if err = repo.Remove(ids[0]); err == nil {
+		t.Fatalf("Removed a snapshot another builds on")
+	}
+}
+
+func TestGC(t *testing.T) {
+	repo := newTestRepo(t)
+	id := writeSnapshot(t, repo, Snapshot{Name: "./job"}, "data")
+	snapDir := filepath.Join(repo.Dir(), snapshotDirName)
+	for _, name := range []string{"orphan" + snapshotExt, "stale" + snapshotExt + partialExt} {
+		if err := ioutil.WriteFile(filepath.Join(snapDir, name), nil, 0600); err != nil {
+			t.Fatalf("Could not create %s: %s", name, err)
+		}
+	}
+	if result, err := repo.GC(time.Hour); err != nil || len(result.Files) != 1 {
+		t.Fatalf("GC removed %v, %v; expected only the orphan", result.Files, err)
+	}
+	if result, err := repo.GC(0); err != nil || len(result.Files) != 1 {
+		t.Fatalf("GC removed %v, %v; expected the stale partial file", result.Files, err)
+	}
+	if err := repo.Verify(id); err != nil {
+		t.Fatalf("GC damaged a catalogued snapshot: %s", err)
+	}
+
+	//Snapshots are only put in place once they can be catalogued
+	wtr, err := repo.Create(Snapshot{Name: "./job", Parent: "missing"})
+	if err != nil {
+		t.Fatalf("Could not create snapshot: %s", err)
+	}
+	if err = wtr.Close(); err == nil {
+		t.Fatalf("Snapshot with a missing parent was catalogued")
+	}
+	if infos, err := ioutil.ReadDir(snapDir); err != nil || len(infos) != 1 {
+		t.Fatalf("Uncatalogued snapshot files were left: %v, %v", infos, err)
+	}
+}
+
+func TestGCWaitsForWriters(t *testing.T) {
+	repo := newTestRepo(t)
+	wtr, err := repo.Create(Snapshot{Name: "./job"})
+	if err != nil {
+		t.Fatalf("Could not create snapshot: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := repo.GC(0)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("GC did not wait for the snapshot being written: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err = wtr.Close(); err != nil {
+		t.Fatalf("Could not complete snapshot: %s", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("GC failed: %s", err)
+	}
+	if err = repo.Verify(wtr.ID()); err != nil {
+		t.Fatalf("GC damaged the snapshot written: %s", err)
+	}
+}
+
+//writeChunkedSnapshot writes a snapshot referencing a chunk for each page
+func writeChunkedSnapshot(t *testing.T, repo *Repo, pages ...string) string {
+	wtr, err := repo.Create(Snapshot{Name: "./job"})
+	if err != nil {
+		t.Fatalf("Could not create snapshot: %s", err)
+	}
+	sink, err := wtr.Chunks()
+	if err != nil {
+		t.Fatalf("Could not open chunk store: %s", err)
+	}
+	for _, page := range pages {
+		hash := pchunk.Sum([]byte(page))
+		if err = sink.PutChunk(hash, []byte(page)); err != nil {
+			t.Fatalf("Could not put chunk: %s", err)
+		}
+		wtr.Write(hash[:])
+	}
+	if err = wtr.Close(); err != nil {
+		t.Fatalf("Could not complete snapshot: %s", err)
+	}
+	return wtr.ID()
+}
+
+func TestChunks(t *testing.T) {
+	repo := newTestRepo(t)
+	first := writeChunkedSnapshot(t, repo, "shared", "first", "first")
+	second := writeChunkedSnapshot(t, repo, "shared", "second")
+
+	counts, err := repo.RefCounts()
+	if err != nil {
+		t.Fatalf("Could not count references: %s", err)
+	}
+	if len(counts) != 3 || counts[pchunk.Sum([]byte("shared"))] != 2 || counts[pchunk.Sum([]byte("first"))] != 1 {
+		t.Fatalf("Unexpected reference counts: %v", counts)
+	}
+	if stats, err := repo.Stats(); err != nil || stats.Chunks != 3 || stats.References != 4 {
+		t.Fatalf("Stats returned %+v, %v; expected 3 chunks and 4 references", stats, err)
+	}
+	if err = repo.Verify(first); err != nil {
+		t.Fatalf("Verification of a chunked snapshot failed: %s", err)
+	}
+
+	//Only chunks no snapshot references are collected
+	if err = repo.Remove(first); err != nil {
+		t.Fatalf("Could not remove snapshot: %s", err)
+	}
+	result, err := repo.GC(0)
+	if err != nil || result.Chunks != 1 || len(result.Files) != 0 {
+		t.Fatalf("GC returned %+v, %v; expected to remove the chunk only the removed snapshot referenced", result, err)
+	}
+	if err = repo.Verify(second); err != nil {
+		t.Fatalf("GC damaged a snapshot's chunks: %s", err)
+	}
+
+	//A missing chunk fails verification
+	store, _ := repo.Chunks()
+	store.Remove(pchunk.Sum([]byte("shared")))
+	if err = repo.Verify(second); err == nil {
+		t.Fatalf("Verified a snapshot missing a chunk")
+	}
+}
@@ -0,0 +1,168 @@
+package prepo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pchunk"
+)
+
+//Writer writes a new snapshot into the repository, it only appears in the
+// catalog once the Writer is closed
+type Writer struct {
+	repo    *Repo
+	snap    Snapshot
+	file    *os.File
+	hash    hash.Hash
+	partial string
+	chunks  *chunkRecorder
+	writing *os.File //Holds the writers lock shared, GC waits until it's released
+}
+
+//Create starts writing a snapshot described by snap. Its ID, size and digest
+// are set by the repository, as are its creation time, host and kernel if left
+// empty.
+func (this *Repo) Create(snap Snapshot) (*Writer, error) {
+	for _, tag := range snap.Tags {
+		if err := validTag(tag); err != nil {
+			return nil, err
+		}
+	}
+	if snap.Created.IsZero() {
+		snap.Created = time.Now()
+	}
+	snap.Created = snap.Created.UTC()
+	if snap.Host == "" {
+		snap.Host, _ = os.Hostname()
+	}
+	if snap.Kernel == "" {
+		snap.Kernel = kernelRelease()
+	}
+	var err error
+	if snap.ID, err = newID(snap.Created); err != nil {
+		return nil, err
+	}
+
+	writing, err := this.lock(writersLockName, syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	partial := this.Path(snap.ID) + partialExt
+	file, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		writing.Close()
+		return nil, errs.Append(err, "Could not create snapshot: %s", partial)
+	}
+	return &Writer{
+		repo:    this,
+		snap:    snap,
+		file:    file,
+		hash:    sha256.New(),
+		partial: partial,
+		writing: writing,
+	}, nil
+}
+
+//Chunks returns a sink that stores memory pages in the repository's chunk
+// store on behalf of the snapshot, making it a chunked snapshot (see
+// pwriter.NewChunkedSnapshotWriter)
+func (this *Writer) Chunks() (lib.ChunkSink, error) {
+	if this.chunks == nil {
+		store, err := this.repo.Chunks()
+		if err != nil {
+			return nil, err
+		}
+		this.chunks = &chunkRecorder{store: store, refs: make(map[pchunk.Hash]struct{})}
+	}
+	return this.chunks, nil
+}
+
+//ID returns the ID the snapshot will have in the catalog
+func (this *Writer) ID() string {
+	return this.snap.ID
+}
+
+func (this *Writer) Write(buf []byte) (int, error) {
+	n, err := this.file.Write(buf)
+	this.hash.Write(buf[:n])
+	this.snap.Size += int64(n)
+	return n, err
+}
+
+//Close completes the snapshot and adds it to the catalog
+func (this *Writer) Close() error {
+	if this.file == nil {
+		return nil
+	}
+	defer this.writing.Close()
+	err := this.file.Sync()
+	if closeErr := this.file.Close(); err == nil {
+		err = closeErr
+	}
+	this.file = nil
+	if err != nil {
+		os.Remove(this.partial)
+		return errs.Append(err, "Could not complete snapshot: %s", this.snap.ID)
+	}
+
+	this.snap.Digest = hex.EncodeToString(this.hash.Sum(nil))
+	if this.chunks != nil {
+		this.snap.Chunks = len(this.chunks.refs)
+	}
+	//The files are put in place under the catalog's lock, so GC never sees them
+	// without the snapshot catalogued
+	err = this.repo.add(this.snap, func() error {
+		if this.chunks != nil {
+			//References are recorded before the snapshot, so a chunked snapshot is
+			// never without them
+			if err := this.chunks.writeRefs(this.repo, this.snap.ID); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(this.partial, this.repo.Path(this.snap.ID)); err != nil {
+			return errs.Append(err, "Could not complete snapshot: %s", this.snap.ID)
+		}
+		return syncDir(filepath.Dir(this.partial))
+	})
+	if err != nil {
+		os.Remove(this.partial)
+		os.Remove(this.repo.Path(this.snap.ID))
+		os.Remove(this.repo.refsPath(this.snap.ID))
+		return err
+	}
+	return nil
+}
+
+//Abort discards the snapshot instead of completing it, chunks it stored are
+// left for GC as other snapshots may share them
+func (this *Writer) Abort() error {
+	if this.file == nil {
+		return nil
+	}
+	this.file.Close()
+	this.file = nil
+	this.writing.Close()
+	return os.Remove(this.partial)
+}
+
+func kernelRelease() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return ""
+	}
+	release := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return string(release)
+}
@@ -0,0 +1,154 @@
+package progress
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarndt/errs"
+)
+
+//Limiter throttles transfers to a rate by a token bucket, shared by all the
+// streams it wraps so parallel streams together keep to the rate
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64 //Bytes per second
+	burst  float64 //Most bytes allowed through at once after being idle
+	tokens float64 //Negative while writers are waiting
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+//minBurst lets small rates through in reasonably sized writes
+const minBurst = 32 << 10
+
+//NewLimiter limits transfers to bytesPerSec, allowing bursts of a tenth of a
+// second's worth
+func NewLimiter(bytesPerSec int64) *Limiter {
+	burst := float64(bytesPerSec) / 10
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &Limiter{rate: float64(bytesPerSec), burst: burst, tokens: burst, last: time.Now(), now: time.Now, sleep: time.Sleep}
+}
+
+//Rate returns the limit in bytes per second
+func (this *Limiter) Rate() int64 {
+	return int64(this.rate)
+}
+
+//Wait blocks until n bytes may pass. Writers reserve their bytes in turn, so
+// waits are served in order and larger writes than the burst are allowed.
+func (this *Limiter) Wait(n int) {
+	this.lock.Lock()
+	now := this.now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+	this.tokens -= float64(n)
+	var delay time.Duration
+	if this.tokens < 0 {
+		delay = time.Duration(-this.tokens / this.rate * float64(time.Second))
+	}
+	this.lock.Unlock()
+	if delay > 0 {
+		this.sleep(delay)
+	}
+}
+
+//Writer throttles writes to dst, nil limiters pass dst through
+func (this *Limiter) Writer(dst io.Writer) io.Writer {
+	if this == nil {
+		return dst
+	}
+	return &limitedWriter{Writer: dst, limiter: this}
+}
+
+type limitedWriter struct {
+	io.Writer
+	limiter *Limiter
+}
+
+//Write passes buf in pieces of at most the burst size, so the stream keeps a
+// steady pace rather than stalling for large writes
+func (this *limitedWriter) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		piece := buf
+		if len(piece) > int(this.limiter.burst) {
+			piece = piece[:int(this.limiter.burst)]
+		}
+		this.limiter.Wait(len(piece))
+		n, err := this.Writer.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+//Reader throttles reads from src, nil limiters pass src through
+func (this *Limiter) Reader(src io.Reader) io.Reader {
+	if this == nil {
+		return src
+	}
+	return &limitedReader{Reader: src, limiter: this}
+}
+
+type limitedReader struct {
+	io.Reader
+	limiter *Limiter
+}
+
+//Read counts the bytes received against the limit before the next read, a
+// slow reader in turn slows the sender down
+func (this *limitedReader) Read(buf []byte) (int, error) {
+	if len(buf) > int(this.limiter.burst) {
+		buf = buf[:int(this.limiter.burst)]
+	}
+	n, err := this.Reader.Read(buf)
+	this.limiter.Wait(n)
+	return n, err
+}
+
+//rateUnits are the multipliers of the suffixes ParseRate accepts, bits are
+// converted to bytes
+var rateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kbit", 1e3 / 8}, {"mbit", 1e6 / 8}, {"gbit", 1e9 / 8}, {"bit", 1.0 / 8},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"b", 1},
+}
+
+//ParseRate parses a rate in bytes per second, with an optional unit of bytes
+// (KiB, MB, M...) or bits (Kbit, Mbit, Gbit) and optional "/s": 50MiB, 100Mbit/s
+func ParseRate(str string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(str))
+	value = strings.TrimSpace(strings.TrimSuffix(value, "/s"))
+	scale := 1.0
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, scale = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.scale
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errs.New("Invalid rate: %q, use bytes per second with an optional unit such as: 50MiB or 100Mbit", str)
+	}
+	rate := int64(number * scale)
+	if rate < 1 {
+		return 0, errs.New("Rate: %q must be at least 1 byte per second", str)
+	}
+	return rate, nil
+}
@@ -0,0 +1,230 @@
+//Package progress measures transfers as they happen, so pfrez and pthaw can
+// report bytes moved, throughput, memory spans done and time remaining, and
+// throttles them so a migration does not saturate a shared link.
+package progress
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//Meter counts the bytes and memory spans of one transfer, it is safe to use
+// from the goroutines of parallel streams
+type Meter struct {
+	bytes      int64 //Accessed atomically, first for alignment on 32 bit platforms
+	totalBytes int64 //Accessed atomically, 0 when not known in advance
+	lock       sync.Mutex
+	phase      string
+	start      time.Time
+	phaseStart time.Time
+	spans      int
+	totalSpans int
+	mem        uint64 //Bytes of the memory spans done
+	totalMem   uint64
+}
+
+//NewMeter starts measuring a transfer in phase, such as "send"
+func NewMeter(phase string) *Meter {
+	now := time.Now()
+	return &Meter{phase: phase, start: now, phaseStart: now}
+}
+
+//SetPhase names what the transfer is doing now, such as "receive" then "load",
+// the time remaining is estimated from the pace of the current phase
+func (this *Meter) SetPhase(phase string) {
+	this.lock.Lock()
+	this.phase, this.phaseStart = phase, time.Now()
+	this.lock.Unlock()
+}
+
+//SetTotalBytes sets how many bytes the transfer will move, where known in
+// advance (such as the size of a source file)
+func (this *Meter) SetTotalBytes(total int64) {
+	atomic.StoreInt64(&this.totalBytes, total)
+}
+
+//AddBytes counts n bytes moved
+func (this *Meter) AddBytes(n int) {
+	atomic.AddInt64(&this.bytes, int64(n))
+}
+
+//setSpans sets the memory spans to be transferred, and restarts their count
+func (this *Meter) setSpans(spans pmaps.ProcMap) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.spans, this.totalSpans, this.mem, this.totalMem = 0, len(spans), 0, 0
+	for _, span := range spans {
+		this.totalMem += span.Len()
+	}
+}
+
+func (this *Meter) spanDone(span pmaps.Entry) {
+	this.lock.Lock()
+	this.spans++
+	this.mem += span.Len()
+	this.lock.Unlock()
+}
+
+//Stats is the state of a transfer at one moment
+type Stats struct {
+	Phase      string        `json:"phase"`
+	Elapsed    time.Duration `json:"-"`
+	InPhase    time.Duration `json:"-"` //Elapsed since the phase began
+	Bytes      int64         `json:"bytes"`
+	TotalBytes int64         `json:"total_bytes,omitempty"`
+	Spans      int           `json:"spans"`
+	TotalSpans int           `json:"total_spans"`
+	Mem        uint64        `json:"mem_bytes"`
+	TotalMem   uint64        `json:"total_mem_bytes"`
+}
+
+//Stats returns the current state of the transfer
+func (this *Meter) Stats() Stats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return Stats{
+		Phase:      this.phase,
+		Elapsed:    time.Since(this.start),
+		InPhase:    time.Since(this.phaseStart),
+		Bytes:      atomic.LoadInt64(&this.bytes),
+		TotalBytes: atomic.LoadInt64(&this.totalBytes),
+		Spans:      this.spans,
+		TotalSpans: this.totalSpans,
+		Mem:        this.mem,
+		TotalMem:   this.totalMem,
+	}
+}
+
+//Fraction returns how much of the transfer is done, from the memory spans if
+// they are known or else the bytes, and false if neither total is known
+func (this Stats) Fraction() (float64, bool) {
+	switch {
+	case this.TotalMem > 0:
+		return float64(this.Mem) / float64(this.TotalMem), true
+	case this.TotalSpans > 0:
+		return float64(this.Spans) / float64(this.TotalSpans), true
+	case this.TotalBytes > 0:
+		return float64(this.Bytes) / float64(this.TotalBytes), true
+	}
+	return 0, false
+}
+
+//ETA estimates the time remaining from the pace of the phase, false if unknown
+func (this Stats) ETA() (time.Duration, bool) {
+	done, known := this.Fraction()
+	if !known || done <= 0 {
+		return 0, false
+	} else if done >= 1 {
+		return 0, true
+	}
+	return time.Duration(float64(this.InPhase) * (1 - done) / done), true
+}
+
+//Writer counts the bytes written to dst, nil meters pass dst through
+func (this *Meter) Writer(dst io.Writer) io.Writer {
+	if this == nil {
+		return dst
+	}
+	return &meteredWriter{Writer: dst, meter: this}
+}
+
+type meteredWriter struct {
+	io.Writer
+	meter *Meter
+}
+
+func (this *meteredWriter) Write(buf []byte) (int, error) {
+	n, err := this.Writer.Write(buf)
+	this.meter.AddBytes(n)
+	return n, err
+}
+
+//Reader counts the bytes read from src, nil meters pass src through
+func (this *Meter) Reader(src io.Reader) io.Reader {
+	if this == nil {
+		return src
+	}
+	return &meteredReader{Reader: src, meter: this}
+}
+
+type meteredReader struct {
+	io.Reader
+	meter *Meter
+}
+
+func (this *meteredReader) Read(buf []byte) (int, error) {
+	n, err := this.Reader.Read(buf)
+	this.meter.AddBytes(n)
+	return n, err
+}
+
+//Provider counts the memory spans provider hands out as they are closed, the
+// totals are those of its GetMemoryMeta, and unknown for lib.SpanStreamers. Nil
+// meters pass provider through.
+func (this *Meter) Provider(provider lib.StateProvider) lib.StateProvider {
+	if this == nil {
+		return provider
+	}
+	if streamer, isStreamer := provider.(lib.SpanStreamer); isStreamer {
+		return &meteredStreamer{meteredProvider: meteredProvider{StateProvider: provider, meter: this}, streamer: streamer}
+	}
+	return &meteredProvider{StateProvider: provider, meter: this}
+}
+
+type meteredProvider struct {
+	lib.StateProvider
+	meter *Meter
+}
+
+func (this *meteredProvider) GetMemoryMeta() (pmaps.ProcMap, error) {
+	spans, err := this.StateProvider.GetMemoryMeta()
+	if err == nil {
+		this.meter.setSpans(spans)
+	}
+	return spans, err
+}
+
+func (this *meteredProvider) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	span, err := this.StateProvider.GetMemorySpan(metadata)
+	if err != nil {
+		return span, err
+	}
+	span.ReadCloser = &meteredSpan{ReadCloser: span.ReadCloser, meter: this.meter, metadata: metadata}
+	return span, nil
+}
+
+//meteredStreamer is the meteredProvider of a lib.SpanStreamer
+type meteredStreamer struct {
+	meteredProvider
+	streamer lib.SpanStreamer
+}
+
+func (this *meteredStreamer) NextMemorySpan() (lib.MemSpan, error) {
+	span, err := this.streamer.NextMemorySpan()
+	if err != nil {
+		return span, err
+	}
+	span.ReadCloser = &meteredSpan{ReadCloser: span.ReadCloser, meter: this.meter, metadata: span.Metadata}
+	return span, nil
+}
+
+//meteredSpan counts its span done once, when closed after being written
+type meteredSpan struct {
+	io.ReadCloser
+	meter    *Meter
+	metadata pmaps.Entry
+	closed   bool
+}
+
+func (this *meteredSpan) Close() error {
+	if !this.closed {
+		this.closed = true
+		this.meter.spanDone(this.metadata)
+	}
+	return this.ReadCloser.Close()
+}
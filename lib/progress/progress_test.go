@@ -0,0 +1,226 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tarndt/pmigrate/internal/ptest"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+func TestMeter(t *testing.T) {
+	meter := NewMeter("send")
+	provider := meter.Provider(&ptest.MemProvider{Meta: pmaps.ProcMap{
+		{MemStart: 0x1000, MemEnd: 0x2000},
+		{MemStart: 0x4000, MemEnd: 0x7000},
+	}})
+	meta, err := provider.GetMemoryMeta()
+	if err != nil {
+		t.Fatalf("Could not get memory meta: %s", err)
+	}
+	if _, known := meter.Stats().ETA(); known {
+		t.Fatalf("ETA is known before any progress")
+	}
+
+	wtr := meter.Writer(ioutil.Discard)
+	for i, entry := range meta {
+		span, err := provider.GetMemorySpan(entry)
+		if err != nil {
+			t.Fatalf("Could not get memory span: %s", err)
+		}
+		io.Copy(wtr, span)
+		span.Close()
+		span.Close() //Counted once
+
+		stats := meter.Stats()
+		if stats.Spans != i+1 || stats.TotalSpans != 2 || stats.TotalMem != 0x4000 {
+			t.Fatalf("Spans counted wrong: %+v", stats)
+		}
+	}
+	stats := meter.Stats()
+	if stats.Bytes != 0x4000 || stats.Mem != 0x4000 {
+		t.Fatalf("Bytes counted wrong: %+v", stats)
+	}
+	if done, _ := stats.Fraction(); done != 1 {
+		t.Fatalf("Complete transfer is: %f done", done)
+	}
+	if eta, known := stats.ETA(); !known || eta != 0 {
+		t.Fatalf("ETA of complete transfer is: %s", eta)
+	}
+
+	rdrMeter := NewMeter("receive")
+	rdrMeter.SetTotalBytes(1000)
+	io.Copy(ioutil.Discard, rdrMeter.Reader(strings.NewReader(strings.Repeat("x", 250))))
+	if done, known := rdrMeter.Stats().Fraction(); !known || done != 0.25 {
+		t.Fatalf("Byte fraction is: %f, %t", done, known)
+	}
+}
+
+//streamProvider hands out the memory spans of MemProvider as a lib.SpanStreamer
+type streamProvider struct {
+	ptest.MemProvider
+}
+
+func (this *streamProvider) NextMemorySpan() (lib.MemSpan, error) {
+	if len(this.Meta) == 0 {
+		return lib.MemSpan{}, io.EOF
+	}
+	metadata := this.Meta[0]
+	this.Meta = this.Meta[1:]
+	return this.GetMemorySpan(metadata)
+}
+
+func TestMeterStreamed(t *testing.T) {
+	meter := NewMeter("load")
+	provider := meter.Provider(&streamProvider{ptest.MemProvider{Meta: pmaps.ProcMap{
+		{MemStart: 0x1000, MemEnd: 0x2000},
+		{MemStart: 0x4000, MemEnd: 0x7000},
+	}}})
+	if _, isStreamer := provider.(lib.SpanStreamer); !isStreamer {
+		t.Fatalf("Metered stream is not a SpanStreamer")
+	}
+	err := lib.ForEachMemorySpan(provider, func(span lib.MemSpan) error {
+		_, err := io.Copy(ioutil.Discard, span)
+		return err
+	})
+	if stats := meter.Stats(); err != nil || stats.Spans != 2 || stats.Mem != 0x4000 || stats.TotalSpans != 0 {
+		t.Fatalf("Streamed spans counted wrong: %+v, %v", stats, err)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for str, expected := range map[string]int64{
+		"1000":      1000,
+		"64k":       64 << 10,
+		"50MiB":     50 << 20,
+		"50 MiB/s":  50 << 20,
+		"1.5M":      3 << 19,
+		"2MB":       2e6,
+		"100Mbit":   100e6 / 8,
+		"1gbit/s":   1e9 / 8,
+		"8000bit/s": 1000,
+		"1GiB":      1 << 30,
+	} {
+		if rate, err := ParseRate(str); err != nil || rate != expected {
+			t.Fatalf("Parsed: %q as: %d, %v; expected: %d", str, rate, err, expected)
+		}
+	}
+	for _, str := range []string{"", "fast", "-5M", "0", "1bit", "10 Mbps"} {
+		if rate, err := ParseRate(str); err == nil {
+			t.Fatalf("Parsed invalid rate: %q as: %d", str, rate)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	//The burst of 320 KiB/s is 32 KiB, so writes are 32 KiB pieces each owing
+	// exactly 100ms
+	limiter := NewLimiter(320 << 10)
+	clock := time.Unix(0, 0)
+	var slept []time.Duration
+	limiter.last, limiter.now = clock, func() time.Time { return clock }
+	limiter.sleep = func(d time.Duration) { slept, clock = append(slept, d), clock.Add(d) }
+
+	var buf bytes.Buffer
+	data := make([]byte, 4*minBurst)
+	if n, err := limiter.Writer(&buf).Write(data); err != nil || n != len(data) {
+		t.Fatalf("Wrote: %d, %v", n, err)
+	}
+	if buf.Len() != len(data) {
+		t.Fatalf("Received: %d bytes of: %d", buf.Len(), len(data))
+	}
+	//The first piece is the initial burst, the rest wait their turn
+	expected := []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}
+	if !reflect.DeepEqual(slept, expected) {
+		t.Fatalf("Waited: %v to write 128 KiB at 320 KiB/s, expected: %v", slept, expected)
+	}
+
+	//Idling refills no more than the burst
+	clock, slept = clock.Add(10*time.Second), nil
+	limiter.Wait(minBurst)
+	limiter.Wait(minBurst)
+	if expected = expected[:1]; !reflect.DeepEqual(slept, expected) {
+		t.Fatalf("Waited: %v after idling, expected: %v", slept, expected)
+	}
+
+	var nilLimiter *Limiter
+	if nilLimiter.Writer(&buf) != &buf {
+		t.Fatalf("Nil limiter did not pass the writer through")
+	}
+}
+
+func TestLimiterRealTime(t *testing.T) {
+	limiter := NewLimiter(256 << 10)
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, limiter.Reader(bytes.NewReader(make([]byte, 128<<10))))
+	if err != nil || n != 128<<10 {
+		t.Fatalf("Read: %d, %v", n, err)
+	}
+	//The initial 32 KiB burst passes at once, the remaining 96 KiB take 375ms
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Reading 128 KiB at 256 KiB/s took: %s", elapsed)
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	meter := NewMeter("send")
+	meter.setSpans(pmaps.ProcMap{{MemStart: 0, MemEnd: 100}, {MemStart: 100, MemEnd: 400}})
+	meter.spanDone(pmaps.Entry{MemStart: 0, MemEnd: 100})
+	meter.AddBytes(2048)
+
+	var out bytes.Buffer
+	reporter := Report(meter, &out, FormatJSON, time.Hour)
+	reporter.Stop()
+	reporter.Stop()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single final report, got: %q", out.String())
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &report); err != nil {
+		t.Fatalf("Report is not JSON: %s", err)
+	}
+	for name, expected := range map[string]interface{}{
+		"phase": "send", "bytes": 2048.0, "spans": 1.0, "total_spans": 2.0, "mem_bytes": 100.0, "total_mem_bytes": 400.0, "done": true,
+	} {
+		if report[name] != expected {
+			t.Fatalf("Report field: %q is: %v, expected: %v", name, report[name], expected)
+		}
+	}
+	if Report(meter, &out, FormatNone, 0) != nil {
+		t.Fatalf("FormatNone started a reporter")
+	}
+}
+
+func TestReportTTY(t *testing.T) {
+	meter := NewMeter("send")
+	meter.setSpans(pmaps.ProcMap{{MemStart: 0, MemEnd: 100}, {MemStart: 100, MemEnd: 200}})
+	meter.spanDone(pmaps.Entry{MemStart: 0, MemEnd: 100})
+	meter.AddBytes(3 << 20)
+
+	var out bytes.Buffer
+	reporter := &Reporter{meter: meter, out: &out, format: FormatTTY, rate: -1}
+	reporter.write(meter.Stats(), false)
+	line := out.String()
+	for _, expected := range []string{"\rsend [", " 50%", "3.0 MiB", "spans 1/2", "ETA "} {
+		if !strings.Contains(line, expected) {
+			t.Fatalf("Progress bar: %q lacks: %q", line, expected)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if str := FormatBytes(n); str != expected {
+			t.Fatalf("Formatted: %d as: %q, expected: %q", n, str, expected)
+		}
+	}
+}
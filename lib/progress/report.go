@@ -0,0 +1,202 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarndt/errs"
+)
+
+//Format is how progress is reported
+type Format int
+
+const (
+	FormatNone Format = iota
+	FormatTTY         //A progress bar redrawn in place on a terminal
+	FormatJSON        //A JSON object per line, for other programs to read
+)
+
+//DefaultInterval between reports
+const DefaultInterval = time.Second
+
+//ParseFormat parses the -progress flag: none, tty or json
+func ParseFormat(str string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "", "none":
+		return FormatNone, nil
+	case "tty":
+		return FormatTTY, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatNone, errs.New("Unknown progress format: %q, use one of: none, tty, json", str)
+}
+
+//barWidth is the number of characters of the TTY progress bar
+const barWidth = 24
+
+//rateWeight is the weight of the latest interval in the reported throughput,
+// smoothing it without lagging far behind changes
+const rateWeight = 0.3
+
+//Reporter writes the progress of a meter at an interval until stopped
+type Reporter struct {
+	meter  *Meter
+	out    io.Writer
+	format Format
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	//Throughput over recent intervals, in bytes per second
+	rate      float64
+	lastBytes int64
+	lastTime  time.Duration
+}
+
+//Report starts reporting meter to out in format every interval, nil is
+// returned for FormatNone and may be stopped all the same
+func Report(meter *Meter, out io.Writer, format Format, interval time.Duration) *Reporter {
+	if format == FormatNone {
+		return nil
+	}
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	this := &Reporter{meter: meter, out: out, format: format, stop: make(chan struct{}), done: make(chan struct{}), rate: -1}
+	go this.run(interval)
+	return this
+}
+
+func (this *Reporter) run(interval time.Duration) {
+	defer close(this.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.write(this.meter.Stats(), false)
+		case <-this.stop:
+			this.write(this.meter.Stats(), true)
+			return
+		}
+	}
+}
+
+//Stop writes a final report, ending the TTY progress bar's line
+func (this *Reporter) Stop() {
+	if this == nil {
+		return
+	}
+	this.once.Do(func() {
+		close(this.stop)
+		<-this.done
+	})
+}
+
+//write reports stats, the final report gives the average throughput
+func (this *Reporter) write(stats Stats, final bool) {
+	if final {
+		this.rate = 0
+		if stats.Elapsed > 0 {
+			this.rate = float64(stats.Bytes) / stats.Elapsed.Seconds()
+		}
+	} else if interval := stats.Elapsed - this.lastTime; interval > 0 {
+		current := float64(stats.Bytes-this.lastBytes) / interval.Seconds()
+		if this.rate < 0 {
+			this.rate = current
+		} else {
+			this.rate = rateWeight*current + (1-rateWeight)*this.rate
+		}
+	}
+	this.lastBytes, this.lastTime = stats.Bytes, stats.Elapsed
+
+	if this.format == FormatJSON {
+		this.writeJSON(stats, final)
+	} else {
+		this.writeTTY(stats, final)
+	}
+}
+
+//jsonReport is a line of FormatJSON
+type jsonReport struct {
+	Time time.Time `json:"time"`
+	Stats
+	ElapsedSecs float64  `json:"elapsed_secs"`
+	Rate        float64  `json:"bytes_per_sec"`
+	ETASecs     *float64 `json:"eta_secs,omitempty"`
+	Done        bool     `json:"done"`
+}
+
+func (this *Reporter) writeJSON(stats Stats, final bool) {
+	report := jsonReport{
+		Time:        time.Now().UTC(),
+		Stats:       stats,
+		ElapsedSecs: stats.Elapsed.Seconds(),
+		Rate:        this.rate,
+		Done:        final,
+	}
+	if eta, known := stats.ETA(); known && !final {
+		secs := eta.Seconds()
+		report.ETASecs = &secs
+	}
+	line, _ := json.Marshal(report)
+	this.out.Write(append(line, '\n'))
+}
+
+//writeTTY redraws the progress bar in place, such as:
+//	send [##########··············]  42%  1.2 GiB  85.3 MiB/s  spans 120/300  ETA 0:12
+func (this *Reporter) writeTTY(stats Stats, final bool) {
+	var line strings.Builder
+	line.WriteString("\r" + stats.Phase)
+	if done, known := stats.Fraction(); known {
+		if final && done < 1 && stats.TotalMem == 0 && stats.TotalSpans == 0 {
+			done = 1 //The byte total was an estimate
+		}
+		filled := int(done * barWidth)
+		if filled > barWidth {
+			filled = barWidth
+		}
+		fmt.Fprintf(&line, " [%s%s] %3.0f%%", strings.Repeat("#", filled), strings.Repeat("·", barWidth-filled), done*100)
+	}
+	fmt.Fprintf(&line, "  %s  %s/s", FormatBytes(stats.Bytes), FormatBytes(int64(this.rate)))
+	if stats.TotalSpans > 0 {
+		fmt.Fprintf(&line, "  spans %d/%d", stats.Spans, stats.TotalSpans)
+	} else if stats.Spans > 0 { //Streamed, the total is not known
+		fmt.Fprintf(&line, "  spans %d", stats.Spans)
+	}
+	if final {
+		fmt.Fprintf(&line, "  in %s\x1b[K\n", formatClock(stats.Elapsed))
+	} else if eta, known := stats.ETA(); known {
+		fmt.Fprintf(&line, "  ETA %s\x1b[K", formatClock(eta))
+	} else {
+		line.WriteString("\x1b[K")
+	}
+	io.WriteString(this.out, line.String())
+}
+
+//FormatBytes formats n with a binary unit, such as 1.5 MiB
+func FormatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, units[unit])
+}
+
+//formatClock formats d as [h:]m:ss
+func formatClock(d time.Duration) string {
+	secs := int64(d.Round(time.Second) / time.Second)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
@@ -1,6 +1,7 @@
 package psupervisor
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"syscall"
@@ -22,6 +23,7 @@ type ProcSupervisor struct {
 
 	oldPID               uint64
 	fileHandleFixupTable map[int]int
+	onResumed            func()
 }
 
 const verboseDebug = false
@@ -43,8 +45,24 @@ func (this *ProcSupervisor) Resume() error {
 	return nil
 }
 
+//OnResumed sets fn to be called once the process has resumed execution, when
+// it first stops at a syscall
+func (this *ProcSupervisor) OnResumed(fn func()) {
+	this.onResumed = fn
+}
+
 //TODO supervise: getpid
 func (this *ProcSupervisor) ResumeAndSupervise() error {
+	return this.ResumeAndSuperviseContext(context.Background())
+}
+
+//ResumeAndSuperviseContext supervises the process until it exits or ctx is
+// done, then it is detached from and keeps running unsupervised. Only the
+// process is signalled from another thread, ptrace requests stay on this one.
+func (this *ProcSupervisor) ResumeAndSuperviseContext(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { this.process.Interrupt() })
+	defer stop()
+
 	//Supervise forever
 	var (
 		err             error
@@ -59,9 +77,19 @@ func (this *ProcSupervisor) ResumeAndSupervise() error {
 
 	for {
 		enteringSyscall, err = this.process.ContUntilSyscall(ptrace.NoSignal)
-		if err != nil {
+		if err != nil && ctx.Err() != nil {
+			//Stopped by the interrupt, detaching resumes it without the SIGSTOP
+			if detachErr := this.process.Detach(); detachErr != nil {
+				return errs.Append(detachErr, "Could not detach from process once supervision was cancelled")
+			}
+			return ctx.Err()
+		} else if err != nil {
 			return errs.Append(err, "Failure waiting for next syscall, count: %d, kill: %v", syscallCount, this.process.Kill())
 		}
+		if this.onResumed != nil {
+			this.onResumed()
+			this.onResumed = nil
+		}
 		if enteringSyscall {
 			syscallCount++
 			if err = this.process.GetRegistersInPlace(&registers); err != nil {
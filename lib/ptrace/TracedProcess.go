@@ -74,6 +74,13 @@ func (this *TracedProcess) Continue(signal syscall.Signal) error {
 	return syscall.PtraceCont(this.Pid, int(signal))
 }
 
+//Interrupt asks a continued process to stop by sending its main thread SIGSTOP,
+// it is safe to call from any thread. The tracer then sees a SIGSTOP stop which
+// it should suppress by continuing with NoSignal.
+func (this *TracedProcess) Interrupt() error {
+	return syscall.Tgkill(this.Pid, this.Pid, syscall.SIGSTOP)
+}
+
 func (this *TracedProcess) SingleStep() error {
 	return syscall.PtraceSingleStep(this.Pid)
 }
@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"syscall"
 	"testing"
 )
 
@@ -41,6 +43,27 @@ func TestGetRegisters(t *testing.T) {
 	}
 }
 
+func TestInterrupt(t *testing.T) {
+	runtime.LockOSThread() //Several requests are made, all must come from the tracer thread
+	tracedProcess := startProcessAttach(t, sleepCmd, "5")
+	defer tracedProcess.Kill()
+	if err := tracedProcess.Continue(NoSignal); err != nil {
+		t.Fatalf("TracedProcess.Continue() returned: %s", err)
+	}
+	if err := tracedProcess.Interrupt(); err != nil {
+		t.Fatalf("TracedProcess.Interrupt() returned: %s", err)
+	}
+	status, err := tracedProcess.WaitStatus()
+	if err != nil {
+		t.Fatalf("TracedProcess.WaitStatus() returned: %s", err)
+	} else if !status.Stopped() || status.StopSignal() != syscall.SIGSTOP {
+		t.Fatalf("Expected a SIGSTOP stop, not status: %X", status)
+	}
+	if _, err = tracedProcess.GetRegisters(); err != nil {
+		t.Fatalf("TracedProcess.GetRegisters() of interrupted process returned: %s", err)
+	}
+}
+
 func TestSyscall(t *testing.T) {
 	//TODO
 	// 1. Call hostname, get hostname
@@ -30,11 +30,6 @@ func (this *DebugConsumer) Consume(provider lib.StateProvider) error {
 	if err != nil {
 		return errs.Append(err, "Could not get registers")
 	}
-	spans, err := provider.GetMemoryMeta()
-	if err != nil {
-		return errs.Append(err, "Could not get memory metadata")
-	}
-
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "Process Name: %s\nProcess Identifer (PID): %d\n", provider.GetName(), provider.GetPID())
 
@@ -50,19 +45,19 @@ func (this *DebugConsumer) Consume(provider lib.StateProvider) error {
 	buf.Truncate(buf.Len() - 1)
 
 	buf.WriteString("\n\nMemory Map Metadata & Content MD5 hashes:\n")
-	hash := md5.New()
-	for i, spanMeta := range spans {
-		fmt.Fprintf(&buf, " %d Meta: %s\n", i, spanMeta)
-		span, err := provider.GetMemorySpan(spanMeta)
-		if err != nil {
-			return errs.Append(err, "Could not get memory span")
-		}
+	hash, i := md5.New(), 0
+	err = lib.ForEachMemorySpan(provider, func(span lib.MemSpan) error {
+		fmt.Fprintf(&buf, " %d Meta: %s\n", i, span.Metadata)
 		hash.Reset()
-		if _, err = io.Copy(hash, span.ReadCloser); err != nil {
+		if _, err := io.Copy(hash, span.ReadCloser); err != nil {
 			return errs.Append(err, "Could not read memory span data")
 		}
-		span.Close()
 		fmt.Fprintf(&buf, " %d Hash: %s\n", i, strings.ToUpper(hex.EncodeToString(hash.Sum(nil))))
+		i++
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	buf.WriteString("\nOpen File Handles:\n")
@@ -0,0 +1,107 @@
+package pwriter
+
+import (
+	"io"
+	"sync"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+)
+
+//Ensure ParallelSnapshotWriter implements StateConsumer
+var _ lib.StateConsumer = new(ParallelSnapshotWriter)
+
+//ParallelSnapshotWriter splits a snapshot across several destinations so each
+// can be compressed, encrypted and transmitted concurrently. The first
+// destination receives the snapshot header, memory spans are spread over all of
+// them and are reassembled by address (see preader.NewProcSnapReaderStreams).
+type ParallelSnapshotWriter struct {
+	dsts []io.Writer
+}
+
+func NewParallelSnapshotWriter(dsts []io.Writer) *ParallelSnapshotWriter {
+	return &ParallelSnapshotWriter{
+		dsts: dsts,
+	}
+}
+
+func (this *ParallelSnapshotWriter) Consume(provider lib.StateProvider) error {
+	if len(this.dsts) < 1 {
+		return errs.New("At least one destination is required")
+	}
+	memSpans, err := provider.GetMemoryMeta()
+	if err != nil {
+		return errs.Append(err, readFailMsg, "memory meta data")
+	}
+	if err = writeHeader(this.dsts[0], provider, formatVersion); err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+		queues   = make([]chan lib.MemSpan, len(this.dsts))
+		assigned = make([]uint64, len(this.dsts)) //Bytes handed to each worker
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	//Workers each own a destination, reading spans is left to this goroutine as
+	// providers are not safe for concurrent use
+	for i, dst := range this.dsts {
+		queues[i] = make(chan lib.MemSpan, 1)
+		wg.Add(1)
+		go func(dst io.Writer, queue chan lib.MemSpan) {
+			defer wg.Done()
+			for span := range queue {
+				err := writeSpan(dst, span)
+				span.Close()
+				if err != nil {
+					fail(err)
+				}
+			}
+		}(dst, queues[i])
+	}
+
+produce:
+	for _, entry := range memSpans {
+		span, err := provider.GetMemorySpan(entry)
+		if err != nil {
+			fail(errs.Append(err, readFailMsg, "memory span"))
+			break
+		}
+		//Balance by bytes rather than span count, spans vary greatly in size
+		least := 0
+		for i := range assigned {
+			if assigned[i] < assigned[least] {
+				least = i
+			}
+		}
+		assigned[least] += entry.Len()
+		select {
+		case queues[least] <- span:
+		case <-failed:
+			span.Close()
+			break produce
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (this *ParallelSnapshotWriter) DebugInfo() string {
+	return ""
+}
+
+func (this *ParallelSnapshotWriter) Close() error {
+	return nil
+}
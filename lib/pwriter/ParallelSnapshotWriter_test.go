@@ -0,0 +1,70 @@
+package pwriter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/tarndt/pmigrate/internal/ptest"
+	"github.com/tarndt/pmigrate/lib/preader"
+)
+
+func TestParallelSnapshotRoundTrip(t *testing.T) {
+	provider := ptest.NewMemProvider(t,
+		"1000-9000 rw-p 00000000 00:00 0",
+		"a000-b000 r--p 00000000 00:00 0",
+		"c000-e000 rw-p 00000000 00:00 0",
+		"f000-10000 r-xp 00000000 00:00 0",
+	)
+
+	for _, streamCount := range []int{1, 3} {
+		bufs := make([]*bytes.Buffer, streamCount)
+		dsts := make([]io.Writer, streamCount)
+		for i := range bufs {
+			bufs[i] = new(bytes.Buffer)
+			dsts[i] = bufs[i]
+		}
+		if err := NewParallelSnapshotWriter(dsts).Consume(provider); err != nil {
+			t.Fatalf("Writing %d streams failed: %s", streamCount, err)
+		}
+
+		inStrms := make([]preader.FlexReader, streamCount)
+		for i := range bufs {
+			if streamCount > 1 && bufs[i].Len() == 0 {
+				t.Fatalf("Stream %d of %d was not given any data", i, streamCount)
+			}
+			inStrms[i] = bufio.NewReader(bufs[i])
+		}
+		snapshot, err := preader.NewProcSnapReaderStreams(inStrms...)
+		if err != nil {
+			t.Fatalf("Reading %d streams failed: %s", streamCount, err)
+		}
+
+		if snapshot.GetName() != provider.GetName() || snapshot.GetPID() != provider.GetPID() {
+			t.Fatalf("Snapshot header was not preserved: %q/%d", snapshot.GetName(), snapshot.GetPID())
+		}
+		if regs, _ := snapshot.GetRegisters(); regs.Rip != ptest.Rip {
+			t.Fatalf("Snapshot registers were not preserved")
+		}
+		meta, _ := snapshot.GetMemoryMeta()
+		if len(meta) != len(provider.Meta) {
+			t.Fatalf("Expected %d memory spans, but %d were read", len(provider.Meta), len(meta))
+		}
+		for i, entry := range meta {
+			if entry.MemStart != provider.Meta[i].MemStart {
+				t.Fatalf("Memory span %d is out of order: %x", i, entry.MemStart)
+			}
+			span, err := snapshot.GetMemorySpan(entry)
+			if err != nil {
+				t.Fatalf("Could not get memory span %d: %s", i, err)
+			}
+			data, err := ioutil.ReadAll(span)
+			span.Close()
+			if err != nil || !bytes.Equal(data, provider.Data[entry.MemStart]) {
+				t.Fatalf("Memory span %d content was not preserved; error: %v", i, err)
+			}
+		}
+	}
+}
@@ -1,120 +1,370 @@
 package pwriter
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 
 	"github.com/tarndt/errs"
 	"github.com/tarndt/pmigrate/lib"
 )
 
-const formatVersion = uint16(1)
+const (
+	formatVersion = uint16(1)
+	//chunkedFormatVersion snapshots reference memory pages kept in a chunk store
+	// by their SHA-256 digest, rather than containing them
+	chunkedFormatVersion = uint16(2)
+	//incrementalFormatVersion snapshots record only the memory pages that changed
+	// since their parent snapshot
+	incrementalFormatVersion = uint16(3)
+	//alignedFormatVersion snapshots pad the data of each memory span to start on
+	// a page boundary of the stream, so it can be mapped from the file it is
+	// stored in
+	alignedFormatVersion = uint16(4)
+	//ChunkSize is the size of the memory pages chunked snapshots reference, and
+	// of those incremental snapshots compare
+	ChunkSize = 4096
+)
+
+//Page records of incremental snapshots
+const (
+	pageFromParent = byte(0) //Followed by the SHA-256 digest of the parent's page
+	pageData       = byte(1) //Followed by the page
+)
 
 //Ensure ProcSnapshotWriter implements StateConsumer
 var _ lib.StateConsumer = new(ProcSnapshotWriter)
 
 type ProcSnapshotWriter struct {
-	dst io.Writer
+	dst         io.Writer
+	chunks      lib.ChunkSink
+	parentPages PageIndex
+	parentRef   string
+	pageAlign   bool
 }
 
+//PageIndex holds the SHA-256 digest of each memory page of a snapshot by address
+type PageIndex map[uint64][sha256.Size]byte
+
 func NewProcSnapshotWriter(dst io.Writer) *ProcSnapshotWriter {
 	return &ProcSnapshotWriter{
 		dst: dst,
 	}
 }
 
-func (this *ProcSnapshotWriter) Consume(provider lib.StateProvider) error {
-	const (
-		readFailMsg  = "Could not read %q from process state provider"
-		writeFailMsg = "Could not write %q to output destination"
-	)
+//NewChunkedSnapshotWriter writes snapshots whose memory pages are put in chunks
+// and only referenced by dst, preader.NewProcSnapReaderChunks reads them
+func NewChunkedSnapshotWriter(dst io.Writer, chunks lib.ChunkSink) *ProcSnapshotWriter {
+	return &ProcSnapshotWriter{
+		dst:    dst,
+		chunks: chunks,
+	}
+}
+
+//NewIncrementalSnapshotWriter writes snapshots containing only the memory pages
+// that differ from those IndexPages found in the parent snapshot, which is
+// recorded as parentRef. Readers resolve parentRef to overlay the snapshot onto
+// its parent (see preader.NewProcSnapReaderChain).
+func NewIncrementalSnapshotWriter(dst io.Writer, parentPages PageIndex, parentRef string) *ProcSnapshotWriter {
+	return &ProcSnapshotWriter{
+		dst:         dst,
+		parentPages: parentPages,
+		parentRef:   parentRef,
+	}
+}
 
+//NewAlignedSnapshotWriter writes snapshots whose memory span data starts on page
+// boundaries counted from the start of dst. Stored without transforms after a
+// page aligned transport encoding (see transpenc.TranportEncoding.PageAligned)
+// the data of each span can be mapped from the snapshot file when restoring.
+func NewAlignedSnapshotWriter(dst io.Writer) *ProcSnapshotWriter {
+	return &ProcSnapshotWriter{
+		dst:       dst,
+		pageAlign: true,
+	}
+}
+
+const (
+	readFailMsg  = "Could not read %q from process state provider"
+	writeFailMsg = "Could not write %q to output destination"
+)
+
+func (this *ProcSnapshotWriter) Consume(provider lib.StateProvider) error {
 	//Before we start writing, get a few items that can fail
 	memSpans, err := provider.GetMemoryMeta()
 	if err != nil {
 		return errs.Append(err, readFailMsg, "memory meta data")
 	}
+	version, dst := formatVersion, this.dst
+	if this.chunks != nil {
+		version = chunkedFormatVersion
+	} else if this.parentPages != nil {
+		version = incrementalFormatVersion
+	} else if this.pageAlign {
+		version = alignedFormatVersion
+	}
+	counter := &countingWriter{Writer: this.dst} //Of aligned snapshots
+	if version == alignedFormatVersion {
+		dst = counter
+	}
+	if err = writeHeader(dst, provider, version); err != nil {
+		return err
+	}
+	if version == incrementalFormatVersion {
+		buf := make([]byte, binary.MaxVarintLen64)
+		if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(len(this.parentRef)))]); err != nil {
+			return errs.Append(err, writeFailMsg, "parent reference length")
+		}
+		if _, err = io.WriteString(this.dst, this.parentRef); err != nil {
+			return errs.Append(err, writeFailMsg, "parent reference")
+		}
+	}
+
+	//Write meta-data/data memory span pairs
+	for _, entry := range memSpans {
+		span, err := provider.GetMemorySpan(entry)
+		if err != nil {
+			return errs.Append(err, readFailMsg, "memory span")
+		}
+		if this.chunks != nil {
+			err = writeChunkedSpan(this.dst, span, this.chunks)
+		} else if version == incrementalFormatVersion {
+			err = writeIncrementalSpan(this.dst, span, this.parentPages)
+		} else if version == alignedFormatVersion {
+			err = writeAlignedSpan(counter, span)
+		} else {
+			err = writeSpan(this.dst, span)
+		}
+		if err != nil {
+			return err
+		}
+		span.Close()
+	}
+
+	return nil
+}
+
+//writeHeader writes everything preceding the memory spans
+func writeHeader(dst io.Writer, provider lib.StateProvider, version uint16) error {
 	regs, err := provider.GetRegisters()
 	if err != nil {
 		return errs.Append(err, readFailMsg, "registers")
 	}
 
 	//Format version
-	if err = binary.Write(this.dst, binary.LittleEndian, formatVersion); err != nil {
+	if err = binary.Write(dst, binary.LittleEndian, version); err != nil {
 		return errs.Append(err, writeFailMsg, "format version")
 	}
 
 	//Process PID
-	if err = binary.Write(this.dst, binary.LittleEndian, uint64(provider.GetPID())); err != nil {
+	if err = binary.Write(dst, binary.LittleEndian, uint64(provider.GetPID())); err != nil {
 		return errs.Append(err, writeFailMsg, "PID")
 	}
 
 	//Write name string (with var-bin length prefix)
 	buf := make([]byte, binary.MaxVarintLen64)
 	name := provider.GetName()
-	if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(len(name)))]); err != nil {
-		errs.Append(err, writeFailMsg, "process name length")
+	if _, err = dst.Write(buf[:binary.PutUvarint(buf, uint64(len(name)))]); err != nil {
+		return errs.Append(err, writeFailMsg, "process name length")
 	}
-	if _, err = io.WriteString(this.dst, name); err != nil {
-		errs.Append(err, writeFailMsg, "process name")
+	if _, err = io.WriteString(dst, name); err != nil {
+		return errs.Append(err, writeFailMsg, "process name")
 	}
 
 	//Write registers
-	if err = binary.Write(this.dst, binary.LittleEndian, regs); err != nil {
-		errs.Append(err, writeFailMsg, "registers")
+	if err = binary.Write(dst, binary.LittleEndian, regs); err != nil {
+		return errs.Append(err, writeFailMsg, "registers")
 	}
 
 	//Write open files
 	openFiles := provider.GetFiles()
-	if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(len(openFiles)))]); err != nil {
-		errs.Append(err, writeFailMsg, "open files record count")
+	if _, err = dst.Write(buf[:binary.PutUvarint(buf, uint64(len(openFiles)))]); err != nil {
+		return errs.Append(err, writeFailMsg, "open files record count")
 	}
 	for _, entry := range openFiles {
 		//File handle
-		if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.FileHandle))]); err != nil {
-			errs.Append(err, writeFailMsg, "open file handle number")
+		if _, err = dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.FileHandle))]); err != nil {
+			return errs.Append(err, writeFailMsg, "open file handle number")
 		}
 		//File path length, then value
-		if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(len(entry.Path)))]); err != nil {
-			errs.Append(err, writeFailMsg, "open file path length")
+		if _, err = dst.Write(buf[:binary.PutUvarint(buf, uint64(len(entry.Path)))]); err != nil {
+			return errs.Append(err, writeFailMsg, "open file path length")
 		}
-		if _, err = io.WriteString(this.dst, entry.Path); err != nil {
+		if _, err = io.WriteString(dst, entry.Path); err != nil {
 			return errs.Append(err, writeFailMsg, "open file path value")
 		}
 		//File type/mode
-		if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.Type))]); err != nil {
-			errs.Append(err, writeFailMsg, "open file type/mode")
+		if _, err = dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.Type))]); err != nil {
+			return errs.Append(err, writeFailMsg, "open file type/mode")
 		}
 		//File position
-		if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.Pos))]); err != nil {
-			errs.Append(err, writeFailMsg, "open file position")
+		if _, err = dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.Pos))]); err != nil {
+			return errs.Append(err, writeFailMsg, "open file position")
 		}
 		//File flags
-		if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.Flags))]); err != nil {
-			errs.Append(err, writeFailMsg, "open file position")
+		if _, err = dst.Write(buf[:binary.PutUvarint(buf, uint64(entry.Flags))]); err != nil {
+			return errs.Append(err, writeFailMsg, "open file flags")
 		}
 	}
+	return nil
+}
 
-	//Write meta-data/data memory span pairs
+//writeSpan writes a meta-data/data memory span pair
+func writeSpan(dst io.Writer, span lib.MemSpan) error {
+	if err := writeSpanMeta(dst, span); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, span); err != nil {
+		return errs.Append(err, writeFailMsg, "span data")
+	}
+	return nil
+}
+
+//writeAlignedSpan writes the span's meta-data followed by the length of the
+// padding (uint16) that makes its data start on a page boundary of dst, the
+// padding and then the data
+func writeAlignedSpan(dst *countingWriter, span lib.MemSpan) error {
+	if err := writeSpanMeta(dst, span); err != nil {
+		return err
+	}
+	padLen := (ChunkSize - (dst.written+2)%ChunkSize) % ChunkSize
+	if err := binary.Write(dst, binary.LittleEndian, uint16(padLen)); err != nil {
+		return errs.Append(err, writeFailMsg, "span padding length")
+	}
+	if _, err := dst.Write(make([]byte, padLen)); err != nil {
+		return errs.Append(err, writeFailMsg, "span padding")
+	}
+	if _, err := io.Copy(dst, span); err != nil {
+		return errs.Append(err, writeFailMsg, "span data")
+	}
+	return nil
+}
+
+//countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	written int64
+}
+
+func (this *countingWriter) Write(buf []byte) (int, error) {
+	n, err := this.Writer.Write(buf)
+	this.written += int64(n)
+	return n, err
+}
+
+//writeChunkedSpan puts the span's data in chunks and writes its meta-data
+// followed by the digest of each chunk
+func writeChunkedSpan(dst io.Writer, span lib.MemSpan, chunks lib.ChunkSink) error {
+	if err := writeSpanMeta(dst, span); err != nil {
+		return err
+	}
+	page := make([]byte, ChunkSize)
+	for remaining := span.Metadata.Len(); remaining > 0; {
+		n := ChunkSize
+		if remaining < ChunkSize {
+			n = int(remaining)
+		}
+		if _, err := io.ReadFull(span, page[:n]); err != nil {
+			return errs.Append(err, readFailMsg, "span data")
+		}
+		remaining -= uint64(n)
+		hash := sha256.Sum256(page[:n])
+		if err := chunks.PutChunk(hash, page[:n]); err != nil {
+			return errs.Append(err, "Could not store memory page")
+		}
+		if _, err := dst.Write(hash[:]); err != nil {
+			return errs.Append(err, writeFailMsg, "span chunk reference")
+		}
+	}
+	//Spans must not be longer than their meta-data claims
+	if n, _ := io.Copy(ioutil.Discard, span); n > 0 {
+		return errs.New("Memory span: %q has %d more bytes than its meta-data describes", span.Metadata, n)
+	}
+	return nil
+}
+
+//IndexPages returns the digest of every memory page of provider, the parent of
+// an incremental snapshot
+func IndexPages(provider lib.StateProvider) (PageIndex, error) {
+	memSpans, err := provider.GetMemoryMeta()
+	if err != nil {
+		return nil, errs.Append(err, readFailMsg, "memory meta data")
+	}
+	pages := make(PageIndex)
+	page := make([]byte, ChunkSize)
 	for _, entry := range memSpans {
 		span, err := provider.GetMemorySpan(entry)
 		if err != nil {
-			return errs.Append(err, readFailMsg, "memory span")
+			return nil, errs.Append(err, readFailMsg, "memory span")
+		}
+		for addr := entry.MemStart; addr < entry.MemEnd; addr += ChunkSize {
+			n := ChunkSize
+			if entry.MemEnd-addr < ChunkSize {
+				n = int(entry.MemEnd - addr)
+			}
+			if _, err = io.ReadFull(span, page[:n]); err != nil {
+				span.Close()
+				return nil, errs.Append(err, readFailMsg, "span data")
+			}
+			pages[addr] = sha256.Sum256(page[:n])
+		}
+		span.Close()
+	}
+	return pages, nil
+}
+
+//writeIncrementalSpan writes the span's meta-data followed by a record of each
+// of its pages: those parentPages holds unchanged at the same address are
+// referenced by their digest, the others are written out
+func writeIncrementalSpan(dst io.Writer, span lib.MemSpan, parentPages PageIndex) error {
+	if err := writeSpanMeta(dst, span); err != nil {
+		return err
+	}
+	page := make([]byte, ChunkSize)
+	for addr := span.Metadata.MemStart; addr < span.Metadata.MemEnd; addr += ChunkSize {
+		n := ChunkSize
+		if span.Metadata.MemEnd-addr < ChunkSize {
+			n = int(span.Metadata.MemEnd - addr)
 		}
-		//Write span metadata
-		entryStr := entry.String()
-		if _, err = this.dst.Write(buf[:binary.PutUvarint(buf, uint64(len(entryStr)))]); err != nil {
-			return errs.Append(err, writeFailMsg, "span metadata length")
+		if _, err := io.ReadFull(span, page[:n]); err != nil {
+			return errs.Append(err, readFailMsg, "span data")
 		}
-		if _, err = io.WriteString(this.dst, entryStr); err != nil {
-			return errs.Append(err, writeFailMsg, "span metadata value")
+		hash := sha256.Sum256(page[:n])
+		if parentHash, isPresent := parentPages[addr]; isPresent && parentHash == hash {
+			if _, err := dst.Write(append([]byte{pageFromParent}, hash[:]...)); err != nil {
+				return errs.Append(err, writeFailMsg, "span parent page reference")
+			}
+			continue
 		}
-		if _, err = io.Copy(this.dst, span); err != nil {
+		if _, err := dst.Write([]byte{pageData}); err != nil {
+			return errs.Append(err, writeFailMsg, "span page record")
+		}
+		if _, err := dst.Write(page[:n]); err != nil {
 			return errs.Append(err, writeFailMsg, "span data")
 		}
-		span.Close()
 	}
+	return nil
+}
 
+func writeSpanMeta(dst io.Writer, span lib.MemSpan) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	entryStr := span.Metadata.String()
+	if _, err := dst.Write(buf[:binary.PutUvarint(buf, uint64(len(entryStr)))]); err != nil {
+		return errs.Append(err, writeFailMsg, "span metadata length")
+	}
+	if _, err := io.WriteString(dst, entryStr); err != nil {
+		return errs.Append(err, writeFailMsg, "span metadata value")
+	}
+	return nil
+}
+
+//WriteSpansEnd marks the end of the memory spans, so a reader can tell a
+// complete stream from one that was cut short without waiting for it to close
+func WriteSpansEnd(dst io.Writer) error {
+	if _, err := dst.Write([]byte{0}); err != nil { //A zero length span metadata value
+		return errs.Append(err, writeFailMsg, "end of spans marker")
+	}
 	return nil
 }
 
@@ -0,0 +1,236 @@
+package pwriter
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/internal/ptest"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//memChunks is an in memory chunk store counting how often each chunk was put
+type memChunks struct {
+	chunks map[[32]byte][]byte
+	puts   int
+}
+
+func (this *memChunks) PutChunk(hash [32]byte, data []byte) error {
+	this.puts++
+	if _, isPresent := this.chunks[hash]; !isPresent {
+		this.chunks[hash] = append([]byte(nil), data...)
+	}
+	return nil
+}
+
+func (this *memChunks) GetChunk(hash [32]byte) ([]byte, error) {
+	if data, isPresent := this.chunks[hash]; isPresent {
+		return data, nil
+	}
+	return nil, errs.New("No chunk: %x", hash)
+}
+
+func TestChunkedSnapshotRoundTrip(t *testing.T) {
+	provider := ptest.NewMemProvider(t,
+		"1000-9000 rw-p 00000000 00:00 0",
+		"a000-b000 r--p 00000000 00:00 0",
+		"c000-e000 rw-p 00000000 00:00 0",
+	)
+	//Distinct pages in an otherwise uniform span
+	provider.Data[0x1000][ChunkSize] = 0xFF
+	chunks := &memChunks{chunks: make(map[[32]byte][]byte)}
+
+	var buf bytes.Buffer
+	if err := NewChunkedSnapshotWriter(&buf, chunks).Consume(provider); err != nil {
+		t.Fatalf("Writing chunked snapshot failed: %s", err)
+	}
+	if chunks.puts != 8+1+2 || len(chunks.chunks) != 4 {
+		t.Fatalf("Expected 11 pages to be put as 4 distinct chunks, not %d as %d", chunks.puts, len(chunks.chunks))
+	}
+	if buf.Len() > 11*32+512 {
+		t.Fatalf("Chunked snapshot of %d bytes is not limited to page references", buf.Len())
+	}
+
+	if _, err := preader.NewProcSnapReader(bufio.NewReader(bytes.NewReader(buf.Bytes()))); err == nil {
+		t.Fatalf("Read a chunked snapshot without its chunks")
+	}
+	checkStreamed(t, provider, chunks, nil, buf.Bytes())
+	snapshot, err := preader.NewProcSnapReaderChunks(chunks, bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("Reading chunked snapshot failed: %s", err)
+	}
+	meta, _ := snapshot.GetMemoryMeta()
+	if len(meta) != len(provider.Meta) {
+		t.Fatalf("Expected %d memory spans, but %d were read", len(provider.Meta), len(meta))
+	}
+	for i, entry := range meta {
+		span, err := snapshot.GetMemorySpan(entry)
+		if err != nil {
+			t.Fatalf("Could not get memory span %d: %s", i, err)
+		}
+		data, err := ioutil.ReadAll(span)
+		span.Close()
+		if err != nil || !bytes.Equal(data, provider.Data[entry.MemStart]) {
+			t.Fatalf("Memory span %d content was not preserved; error: %v", i, err)
+		}
+	}
+}
+
+func TestAlignedSnapshotRoundTrip(t *testing.T) {
+	provider := ptest.NewMemProvider(t,
+		"1000-9000 rw-p 00000000 00:00 0",
+		"a000-b000 r--p 00000000 00:00 0",
+		"c000-e000 rw-p 00000000 00:00 0",
+	)
+	var buf bytes.Buffer
+	if err := (transpenc.TranportEncoding{PageAligned: true}).Write(&buf); err != nil {
+		t.Fatalf("Writing transport encoding failed: %s", err)
+	} else if buf.Len()%ChunkSize != 0 {
+		t.Fatalf("Page aligned transport encoding ends at: %d, not on a page boundary", buf.Len())
+	}
+	offset := int64(buf.Len())
+	if err := NewAlignedSnapshotWriter(&buf).Consume(provider); err != nil {
+		t.Fatalf("Writing aligned snapshot failed: %s", err)
+	}
+	checkStreamed(t, provider, nil, nil, buf.Bytes()[offset:])
+
+	path := filepath.Join(t.TempDir(), "test.snap")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("Could not write aligned snapshot: %s", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open aligned snapshot: %s", err)
+	}
+	defer file.Close()
+	snapshot, err := preader.NewProcSnapIndex(preader.Limits{}, file, offset, int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Indexing aligned snapshot failed: %s", err)
+	}
+	snapshot.MapFrom(file)
+	meta, _ := snapshot.GetMemoryMeta()
+	for i, entry := range meta {
+		span, err := snapshot.GetMemorySpan(entry)
+		if err != nil {
+			t.Fatalf("Could not get memory span %d: %s", i, err)
+		}
+		mapping := span.Mapping
+		if mapping.File != file || mapping.Offset%ChunkSize != 0 {
+			t.Fatalf("Memory span %d is not page aligned in the snapshot: %+v", i, mapping)
+		} else if !bytes.Equal(buf.Bytes()[mapping.Offset:mapping.Offset+int64(entry.Len())], provider.Data[entry.MemStart]) {
+			t.Fatalf("Memory span %d content does not lie where it would be mapped from", i)
+		}
+	}
+}
+
+func TestIncrementalSnapshotChain(t *testing.T) {
+	provider := ptest.NewMemProvider(t,
+		"1000-9000 rw-p 00000000 00:00 0",
+		"a000-b000 r--p 00000000 00:00 0",
+	)
+	stored := make(map[string][]byte)
+	var buf bytes.Buffer
+	if err := NewProcSnapshotWriter(&buf).Consume(provider); err != nil {
+		t.Fatalf("Writing base snapshot failed: %s", err)
+	}
+	stored["base"] = append([]byte(nil), buf.Bytes()...)
+	var parents preader.ParentOpener
+	parents = func(ref string) (*preader.ProcSnapReader, error) {
+		data, isPresent := stored[ref]
+		if !isPresent {
+			return nil, errs.New("No snapshot: %s", ref)
+		}
+		return preader.NewProcSnapReaderChain(nil, parents, bufio.NewReader(bytes.NewReader(data)))
+	}
+	//Each incremental changes a page and adds a span
+	for i, ref := range []string{"first", "second"} {
+		parentRef := "base"
+		if i > 0 {
+			parentRef = "first"
+		}
+		parent, err := parents(parentRef)
+		if err != nil {
+			t.Fatalf("Could not read parent snapshot: %s", err)
+		}
+		parentPages, err := IndexPages(parent)
+		if err != nil {
+			t.Fatalf("Could not index parent snapshot: %s", err)
+		}
+		provider.Data[0x1000][(i+2)*ChunkSize] = 0xFF
+		provider.Add(t, []string{"c000-d000 rw-p 00000000 00:00 0", "e000-10000 rw-p 00000000 00:00 0"}[i])
+
+		buf.Reset()
+		if err = NewIncrementalSnapshotWriter(&buf, parentPages, parentRef).Consume(provider); err != nil {
+			t.Fatalf("Writing incremental snapshot failed: %s", err)
+		}
+		//One changed page and the added span, everything else is a reference
+		if maxLen := (i+2)*ChunkSize + 14*33 + 512; buf.Len() > maxLen {
+			t.Fatalf("Incremental snapshot %s of %d bytes holds more than the changed pages", ref, buf.Len())
+		}
+		stored[ref] = append([]byte(nil), buf.Bytes()...)
+	}
+
+	if _, err := preader.NewProcSnapReader(bufio.NewReader(bytes.NewReader(stored["second"]))); err == nil {
+		t.Fatalf("Read an incremental snapshot without its parent")
+	}
+	checkStreamed(t, provider, nil, parents, stored["second"])
+	snapshot, err := preader.NewProcSnapReaderChain(nil, parents, bufio.NewReader(bytes.NewReader(stored["second"])))
+	if err != nil {
+		t.Fatalf("Reading snapshot chain failed: %s", err)
+	}
+	if snapshot.GetParentRef() != "first" {
+		t.Fatalf("Snapshot was overlaid onto: %q rather than its parent", snapshot.GetParentRef())
+	}
+	meta, _ := snapshot.GetMemoryMeta()
+	if len(meta) != len(provider.Meta) {
+		t.Fatalf("Expected %d memory spans, but %d were read", len(provider.Meta), len(meta))
+	}
+	for i, entry := range meta {
+		span, err := snapshot.GetMemorySpan(entry)
+		if err != nil {
+			t.Fatalf("Could not get memory span %d: %s", i, err)
+		}
+		data, err := ioutil.ReadAll(span)
+		span.Close()
+		if err != nil || !bytes.Equal(data, provider.Data[entry.MemStart]) {
+			t.Fatalf("Memory span %d content was not preserved; error: %v", i, err)
+		}
+	}
+
+	//A parent other than the one the snapshot was taken against is refused
+	stored["first"] = stored["base"]
+	if _, err = preader.NewProcSnapReaderChain(nil, parents, bufio.NewReader(bytes.NewReader(stored["second"]))); err == nil {
+		t.Fatalf("Overlaid an incremental snapshot onto the wrong parent")
+	}
+}
+
+//checkStreamed streams the snapshot in data, checking its memory spans are
+// those of provider
+func checkStreamed(t *testing.T, provider *ptest.MemProvider, chunks lib.ChunkSource, parents preader.ParentOpener, data []byte) {
+	snapshot, err := preader.NewProcSnapStream(preader.Limits{}, chunks, parents, bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("Streaming snapshot failed: %s", err)
+	}
+	var spans int
+	err = lib.ForEachMemorySpan(snapshot, func(span lib.MemSpan) error {
+		data, err := ioutil.ReadAll(span)
+		if err != nil {
+			return err
+		} else if !bytes.Equal(data, provider.Data[span.Metadata.MemStart]) {
+			t.Fatalf("Streamed memory span %s content was not preserved", span.Metadata)
+		}
+		spans++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not stream memory spans: %s", err)
+	} else if spans != len(provider.Meta) {
+		t.Fatalf("Expected %d memory spans, but %d were streamed", len(provider.Meta), spans)
+	}
+}
@@ -2,6 +2,7 @@ package pwriter
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"io"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"github.com/tarndt/errs"
 	"github.com/tarndt/pmigrate/lib"
 	"github.com/tarndt/pmigrate/lib/pfiles"
+	"github.com/tarndt/pmigrate/lib/pmaps"
 	"github.com/tarndt/pmigrate/lib/psupervisor"
 	"github.com/tarndt/pmigrate/lib/ptrace"
 )
@@ -20,16 +22,19 @@ const (
 	opMemLoad = 66
 	opExec    = 67
 	opAbort   = 68
+	opMemMap  = 69
+	opClose   = 70
 
 	respStarted   = 97
 	respMemloaded = 98
 	respExecing   = 99
 	respAborting  = 100
 	respFail      = 101
+	respClosed    = 102
 )
 
-//Ensure ProcWriter implements StateConsumer
-var _ lib.StateConsumer = new(ProcWriter)
+//Ensure ProcWriter implements ContextStateConsumer
+var _ lib.ContextStateConsumer = new(ProcWriter)
 
 type StdioSinks struct {
 	Stdin  io.Reader
@@ -45,13 +50,25 @@ func DefaultStdioSinks() StdioSinks {
 	}
 }
 
+//RestorePhase is a milestone reached while ProcWriter restores a process
+type RestorePhase int
+
+const (
+	RestoreLoaded  RestorePhase = iota + 1 //Memory is loaded, execution has not started
+	RestoreRunning                         //Registers are loaded and the process has resumed execution
+)
+
 type ProcWriter struct {
 	loaderPath string
 	stdioSinks StdioSinks
+	onPhase    func(RestorePhase)
+	mapFile    *os.File //Optional: Memory spans are mapped from
 
 	ldr                  *exec.Cmd
 	ldrIn                *bufio.Writer
 	ldrOut               *bufio.Reader
+	ldrPipes             [2]*os.File //Under ldrIn & ldrOut
+	mapFd                int         //Of mapFile in the loader
 	fileHandleFixupTable map[int]int //Old file # -> new file #, used by supervisor to fixup system calls
 }
 
@@ -63,38 +80,74 @@ func NewProcWriterCustStdio(loaderPath string, stdioSinks StdioSinks) *ProcWrite
 	return &ProcWriter{loaderPath: loaderPath, stdioSinks: stdioSinks}
 }
 
+//SetPhaseFunc registers fn to be called as each restore phase is reached, as
+// Consume supervises the restored process until it exits fn is the only way to
+// learn it is running
+func (this *ProcWriter) SetPhaseFunc(fn func(RestorePhase)) {
+	this.onPhase = fn
+}
+
+//SetMapFile passes file, already open, to the loader, which then maps the memory
+// spans whose lib.FileMapping lies in file from it rather than having them
+// copied. The loader closes its copy before the process runs, file is left to
+// the caller to close.
+func (this *ProcWriter) SetMapFile(file *os.File) {
+	this.mapFile = file
+}
+
 func (this *ProcWriter) Consume(provider lib.StateProvider) error {
+	return this.ConsumeContext(context.Background(), provider)
+}
+
+//ConsumeContext restores the process unless ctx is done first, a loader that
+// was started is then killed and reaped, as it is when the restore fails. Once
+// the process runs ctx being done ends its supervision, leaving it running.
+func (this *ProcWriter) ConsumeContext(ctx context.Context, provider lib.StateProvider) error {
+	provider = lib.WithContext(ctx, provider)
 	regs, err := provider.GetRegisters()
 	if err != nil {
 		return errs.Append(err, "Could not get registers")
 	}
-	spans, err := provider.GetMemoryMeta()
-	if err != nil {
-		return errs.Append(err, "Could not get memory metadata")
-	}
 	//Startup external loader
 	if err = this.start(provider.GetFiles()); err != nil {
 		return err
 	}
-	//Send memory mappings to loader
-	for _, spanMeta := range spans {
-		span, err := provider.GetMemorySpan(spanMeta)
-		if err != nil {
-			return errs.Append(err, "Could not get memory span")
-		}
-		if err = this.sendSpan(span); err != nil {
-			return err
-		}
-		span.Close()
+	//Killing the loader unblocks any exchange with it
+	stopKill := context.AfterFunc(ctx, func() { this.ldr.Process.Kill() })
+	if err = this.awaitStart(); err != nil {
+		stopKill()
+		this.teardown()
+		return err
+	}
+	//Send memory mappings to loader, those of snapshots being received as they
+	// arrive
+	err = lib.ForEachMemorySpan(provider, this.sendSpan)
+	if err == nil && this.mapFile != nil {
+		err = this.closeMapFile()
+	}
+	if err != nil {
+		stopKill()
+		this.teardown()
+		return err
 	}
+	this.reportPhase(RestoreLoaded)
 	//Start execution
-	if err = this.run(regs, provider.GetPID()); err != nil {
+	if err = this.run(ctx, stopKill, regs, provider.GetPID()); err != nil {
 		return err
 	}
 	this.abort()
 	return nil
 }
 
+//GetPID returns the PID of the restored process (the loader it replaces), or 0
+// before the loader has been started
+func (this *ProcWriter) GetPID() int {
+	if this.ldr == nil || this.ldr.Process == nil {
+		return 0
+	}
+	return this.ldr.Process.Pid
+}
+
 func (this *ProcWriter) DebugInfo() string {
 	return ""
 }
@@ -106,12 +159,19 @@ func (this *ProcWriter) Close() error {
 func (this *ProcWriter) start(openFiles []pfiles.FileEntry) error {
 	//Start loader
 	var err error
-	if this.ldr, this.ldrIn, this.ldrOut, this.fileHandleFixupTable, err = startLoader(this.loaderPath, openFiles, this.stdioSinks); err != nil {
+	if this.ldr, this.ldrPipes, this.fileHandleFixupTable, this.mapFd, err = startLoader(this.loaderPath, openFiles, this.stdioSinks, this.mapFile); err != nil {
 		return err
 	}
+	this.ldrIn, this.ldrOut = bufio.NewWriter(this.ldrPipes[0]), bufio.NewReader(this.ldrPipes[1])
+	return nil
+}
+
+//awaitStart waits for the started loader to acknowledge it is ready
+func (this *ProcWriter) awaitStart() error {
 	//Send startup ack
-	if err = this.ldrIn.WriteByte(opStart); err != nil {
-		return errs.Append(err, "Could not send command: ", opStart)
+	err := this.ldrIn.WriteByte(opStart)
+	if err != nil {
+		return errs.Append(err, "Could not send command: %d", opStart)
 	}
 	if err = this.ldrIn.Flush(); err != nil {
 		return err
@@ -126,10 +186,13 @@ func (this *ProcWriter) sendSpan(span lib.MemSpan) error {
 	if span.Metadata.FileInfo.Path() == "[vsyscall]" {
 		return nil
 	}
+	if mapping := span.Mapping; mapping.File != nil && mapping.File == this.mapFile {
+		return this.mapSpan(span.Metadata, mapping)
+	}
 	//Send command
 	err := this.ldrIn.WriteByte(opMemLoad)
 	if err != nil {
-		return errs.Append(err, "Could not send command: ", opMemLoad)
+		return errs.Append(err, "Could not send command: %d", opMemLoad)
 	}
 	this.ldrIn.Flush()
 	//Send mmap args
@@ -156,10 +219,68 @@ func (this *ProcWriter) sendSpan(span lib.MemSpan) error {
 	return nil
 }
 
+//mapSpan has the loader map the memory span described by metadata from the
+// file passed to it, rather than the data being copied through the loader pipe
+func (this *ProcWriter) mapSpan(metadata pmaps.Entry, mapping lib.FileMapping) error {
+	//Send command
+	err := this.ldrIn.WriteByte(opMemMap)
+	if err != nil {
+		return errs.Append(err, "Could not send command: %d", opMemMap)
+	}
+	//Send mmap args
+	args := []int64{int64(metadata.MemStart), int64(metadata.Len()), metadata.Perms.Cvalue(), mapping.Offset, int64(this.mapFd)}
+	if err = binary.Write(this.ldrIn, binary.LittleEndian, args); err != nil {
+		return errs.Append(err, "Could not send memory span metadata")
+	}
+	if err = this.ldrIn.Flush(); err != nil {
+		return err
+	}
+	//Check response
+	if err = checkResp(this.ldrOut, respMemloaded); err != nil {
+		return errs.Append(err, "Could not map memory span: %s from file: %s", metadata, mapping.File.Name())
+	}
+	return nil
+}
+
+//closeMapFile has the loader close the file memory spans were mapped from, so
+// the restored process does not inherit it
+func (this *ProcWriter) closeMapFile() error {
+	err := this.ldrIn.WriteByte(opClose)
+	if err != nil {
+		return errs.Append(err, "Could not send command: %d", opClose)
+	}
+	if err = binary.Write(this.ldrIn, binary.LittleEndian, int64(this.mapFd)); err != nil {
+		return errs.Append(err, "Could not send file descriptor to close")
+	}
+	if err = this.ldrIn.Flush(); err != nil {
+		return err
+	}
+	return checkResp(this.ldrOut, respClosed)
+}
+
+//teardown kills and reaps a loader that was started but is not running the
+// restored process, so no half loaded process is left behind
+func (this *ProcWriter) teardown() {
+	if this.ldr == nil || this.ldr.Process == nil {
+		return
+	}
+	this.ldr.Process.Kill()
+	for _, pipe := range this.ldrPipes {
+		pipe.Close()
+	}
+	this.ldr.Process.Wait()
+}
+
+func (this *ProcWriter) reportPhase(phase RestorePhase) {
+	if this.onPhase != nil {
+		this.onPhase(phase)
+	}
+}
+
 func (this *ProcWriter) abort() error {
 	err := this.ldrIn.WriteByte(opStart)
 	if err != nil {
-		return errs.Append(err, "Could not send command: ", opAbort)
+		return errs.Append(err, "Could not send command: %d", opAbort)
 	}
 	this.ldrIn.Flush()
 	if err = checkResp(this.ldrOut, respAborting); err != nil {
@@ -168,34 +289,49 @@ func (this *ProcWriter) abort() error {
 	return nil
 }
 
-func (this *ProcWriter) run(regs *syscall.PtraceRegs, oldPID int) error {
+//run has the loader execute the restored process and supervises it, until it
+// is resumed stopKill is called to keep the loader from being killed on cancel
+func (this *ProcWriter) run(ctx context.Context, stopKill func() bool, regs *syscall.PtraceRegs, oldPID int) error {
+	ldr, err := this.prepareRun(regs)
+	if !stopKill() { //Cancelled, the loader is being killed
+		err = ctx.Err()
+	}
+	if err != nil {
+		this.teardown()
+		return err
+	}
+	//Resume process, process should be restored!
+	os.Stderr.WriteString("Resuming process... \n")
+	supervisor := psupervisor.NewProcSupervisor(ldr, this.ldrIn, this.ldrOut, oldPID, this.fileHandleFixupTable)
+	supervisor.OnResumed(func() { this.reportPhase(RestoreRunning) })
+	return errs.Append(supervisor.ResumeAndSuperviseContext(ctx), "Process supervision failed")
+}
+
+//prepareRun has the loader stop for execution and loads the registers
+func (this *ProcWriter) prepareRun(regs *syscall.PtraceRegs) (*ptrace.TracedProcess, error) {
 	//Send command
 	err := this.ldrIn.WriteByte(opExec)
 	if err != nil {
-		return errs.Append(err, "Could not send command: ", opMemLoad)
+		return nil, errs.Append(err, "Could not send command: %d", opMemLoad)
 	}
 	this.ldrIn.Flush()
 	if err = checkResp(this.ldrOut, respExecing); err != nil {
-		return err
+		return nil, err
 	}
 	//Ptrace
 	os.Stderr.WriteString("Attaching... ")
 	ldr, err := ptrace.AttachAndWait(this.ldr.Process)
 	if err != nil {
-		return errs.Append(err, "Could not attach to loader process: %d, and wait for halt.", this.ldr.Process.Pid)
+		return nil, errs.Append(err, "Could not attach to loader process: %d, and wait for halt.", this.ldr.Process.Pid)
 	}
 	os.Stderr.WriteString("Attached.\n")
 	//Load registers
 	os.Stderr.WriteString("Loading Registers... ")
 	if err = ldr.SetRegisters(regs); err != nil {
-		return errs.Append(err, "Could not load registers into new process")
+		return nil, errs.Append(err, "Could not load registers into new process")
 	}
 	os.Stderr.WriteString("Loaded.\n")
-	//Resume process, process should be restored!
-	os.Stderr.WriteString("Resuming process... \n")
-
-	supervisor := psupervisor.NewProcSupervisor(ldr, this.ldrIn, this.ldrOut, oldPID, this.fileHandleFixupTable)
-	return errs.Append(supervisor.ResumeAndSupervise(), "Process supervision failed")
+	return ldr, nil
 }
 
 func checkResp(src io.ByteReader, expected byte) error {
@@ -207,14 +343,17 @@ func checkResp(src io.ByteReader, expected byte) error {
 	return nil
 }
 
-func startLoader(loaderPath string, openFiles []pfiles.FileEntry, stdioSinks StdioSinks) (*exec.Cmd, *bufio.Writer, *bufio.Reader, map[int]int, error) {
+//startLoader starts the loader, returning the pipes to and from it and the file
+// descriptor of mapFile, if any, in the loader
+func startLoader(loaderPath string, openFiles []pfiles.FileEntry, stdioSinks StdioSinks, mapFile *os.File) (*exec.Cmd, [2]*os.File, map[int]int, int, error) {
+	var pipes [2]*os.File
 	toLoaderRdr, toLoaderWtr, err := os.Pipe()
 	if err != nil {
-		return nil, nil, nil, nil, errs.Append(err, "Could not create pipe 1 (to-loader) to communicate with loader")
+		return nil, pipes, nil, -1, errs.Append(err, "Could not create pipe 1 (to-loader) to communicate with loader")
 	}
 	toParentRdr, toParentWtr, err := os.Pipe()
 	if err != nil {
-		return nil, nil, nil, nil, errs.Append(err, "Could not create pipe 2 (to-supervisor) to communicate with loader")
+		return nil, pipes, nil, -1, errs.Append(err, "Could not create pipe 2 (to-supervisor) to communicate with loader")
 	}
 
 	cmd := exec.Command(loaderPath)
@@ -230,10 +369,10 @@ func startLoader(loaderPath string, openFiles []pfiles.FileEntry, stdioSinks Std
 		}
 		file, err := os.OpenFile(entry.Path, entry.Flags, 0)
 		if err != nil {
-			return nil, nil, nil, nil, errs.Append(err, "Failure to open file while attempting to restore file: %s", entry)
+			return nil, pipes, nil, -1, errs.Append(err, "Failure to open file while attempting to restore file: %s", entry)
 		}
 		if _, err = file.Seek(int64(entry.Pos), os.SEEK_SET); err != nil {
-			return nil, nil, nil, nil, errs.Append(err, "Failure to returning to last seek postion in open file while attempting to restore file: %s", entry)
+			return nil, pipes, nil, -1, errs.Append(err, "Failure to returning to last seek postion in open file while attempting to restore file: %s", entry)
 		}
 
 		cmd.ExtraFiles = append(cmd.ExtraFiles, file)
@@ -242,9 +381,22 @@ func startLoader(loaderPath string, openFiles []pfiles.FileEntry, stdioSinks Std
 		curFdPos++
 	}
 
+	//The file memory is mapped from follows those restored, it is the caller's
+	mapFd, ownFiles := -1, cmd.ExtraFiles
+	if mapFile != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, mapFile)
+		mapFd = curFdPos
+	}
+
 	//Start loader execution
-	if err := cmd.Start(); err != nil {
-		return nil, nil, nil, nil, errs.Append(err, "Could not execute loader at path: %s", loaderPath)
+	err = cmd.Start()
+	//The loader has its own copies now, without closing ours a loader that dies
+	// would leave responses being waited for forever
+	for _, file := range ownFiles {
+		file.Close()
+	}
+	if err != nil {
+		return nil, pipes, nil, -1, errs.Append(err, "Could not execute loader at path: %s", loaderPath)
 	}
-	return cmd, bufio.NewWriter(toLoaderWtr), bufio.NewReader(toParentRdr), fileHandleFixupTable, nil
+	return cmd, [2]*os.File{toLoaderWtr, toParentRdr}, fileHandleFixupTable, mapFd, nil
 }
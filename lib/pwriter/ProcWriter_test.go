@@ -0,0 +1,73 @@
+package pwriter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tarndt/pmigrate/internal/ptest"
+	"github.com/tarndt/pmigrate/lib"
+)
+
+//TestProcWriterCancelTeardown cancels a restore whose loader never answers, the
+// loader must be killed and reaped
+func TestProcWriterCancelTeardown(t *testing.T) {
+	loaderPath := filepath.Join(t.TempDir(), "hungloader")
+	if err := ioutil.WriteFile(loaderPath, []byte("#!/bin/sh\nexec sleep 60\n"), 0700); err != nil {
+		t.Fatalf("Could not write test loader; Details: %s", err)
+	}
+	provider := ptest.NewMemProvider(t, "1000-3000 rw-p 00000000 00:00 0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	wtr := NewProcWriterCustStdio(loaderPath, StdioSinks{})
+	done := make(chan error, 1)
+	go func() { done <- lib.ConsumeContext(ctx, wtr, provider) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Cancelled restore returned: %v, expected the error of its context", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Cancelled restore did not return")
+	}
+	pid := wtr.GetPID()
+	if pid == 0 {
+		t.Fatalf("Loader was never started")
+	}
+	//Reaped processes are gone entirely, unreaped ones linger as zombies
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Fatalf("Loader %d is still present after the restore was cancelled: %v", pid, err)
+	}
+}
+
+func TestConsumeContextCancelled(t *testing.T) {
+	provider := ptest.NewMemProvider(t,
+		"1000-3000 rw-p 00000000 00:00 0",
+		"4000-5000 r--p 00000000 00:00 0",
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := lib.ConsumeContext(ctx, NewProcSnapshotWriter(ioutil.Discard), provider); err != context.Canceled {
+		t.Fatalf("Consuming with a cancelled context returned: %v", err)
+	}
+
+	//Spans already handed out stop being readable too
+	ctx, cancel = context.WithCancel(context.Background())
+	wrapped := lib.WithContext(ctx, provider)
+	meta, _ := wrapped.GetMemoryMeta()
+	span, err := wrapped.GetMemorySpan(meta[0])
+	if err != nil {
+		t.Fatalf("Could not get memory span; Details: %s", err)
+	}
+	cancel()
+	if _, err = span.Read(make([]byte, os.Getpagesize())); err != context.Canceled {
+		t.Fatalf("Reading a span after cancellation returned: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package pwriter
+
+import (
+	"io"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//Ensure ResumableSnapshotWriter implements StateConsumer
+var _ lib.StateConsumer = new(ResumableSnapshotWriter)
+
+//ResumableStream is a single connection of a resumable transfer
+type ResumableStream interface {
+	io.Writer
+	//Finish completes the stream and returns how many memory spans the
+	// destination has acknowledged holding
+	Finish() (int, error)
+	Close() error
+}
+
+//ResumeDialer connects a new stream and returns it along with how many memory
+// spans the destination already holds. lastErr is why the previous stream
+// failed (nil for the first), the dialer decides when to stop retrying.
+type ResumeDialer func(lastErr error) (ResumableStream, int, error)
+
+//ResumableSnapshotWriter writes a snapshot that survives broken connections,
+// every stream carries the header followed by the memory spans the destination
+// does not yet have, and an end of spans marker. The stream that completes the
+// transfer is left open until Close, the destination may still report on it.
+type ResumableSnapshotWriter struct {
+	dial ResumeDialer
+	last ResumableStream
+}
+
+func NewResumableSnapshotWriter(dial ResumeDialer) *ResumableSnapshotWriter {
+	return &ResumableSnapshotWriter{
+		dial: dial,
+	}
+}
+
+func (this *ResumableSnapshotWriter) Consume(provider lib.StateProvider) error {
+	memSpans, err := provider.GetMemoryMeta()
+	if err != nil {
+		return errs.Append(err, readFailMsg, "memory meta data")
+	}
+
+	var lastErr error
+	for {
+		stream, held, err := this.dial(lastErr)
+		if err != nil {
+			if lastErr != nil {
+				return errs.Append(err, "Could not resume transfer interrupted by: %s", lastErr)
+			}
+			return err
+		} else if held > len(memSpans) {
+			stream.Close()
+			return errs.New("Destination claims to hold %d memory spans, but there are only %d", held, len(memSpans))
+		}
+
+		var readErr error
+		if readErr, lastErr = this.send(stream, provider, memSpans[held:]); readErr == nil && lastErr == nil {
+			if held, lastErr = stream.Finish(); lastErr == nil && held != len(memSpans) {
+				lastErr = errs.New("Destination acknowledged %d of %d memory spans", held, len(memSpans))
+			}
+		}
+
+		switch {
+		case readErr != nil: //Retrying can't help
+			stream.Close()
+			return readErr
+		case lastErr == nil:
+			this.last = stream
+			return nil
+		}
+		stream.Close()
+	}
+}
+
+//send writes one stream, distinguishing provider from destination failures
+func (this *ResumableSnapshotWriter) send(dst io.Writer, provider lib.StateProvider, memSpans pmaps.ProcMap) (readErr, writeErr error) {
+	if writeErr = writeHeader(dst, provider, formatVersion); writeErr != nil {
+		return nil, writeErr
+	}
+	for _, entry := range memSpans {
+		span, err := provider.GetMemorySpan(entry)
+		if err != nil {
+			return errs.Append(err, readFailMsg, "memory span"), nil
+		}
+		writeErr = writeSpan(dst, span)
+		span.Close()
+		if writeErr != nil {
+			return nil, writeErr
+		}
+	}
+	return nil, WriteSpansEnd(dst)
+}
+
+func (this *ResumableSnapshotWriter) DebugInfo() string {
+	return ""
+}
+
+//Stream returns the stream that completed the transfer, nil until one has
+func (this *ResumableSnapshotWriter) Stream() ResumableStream {
+	return this.last
+}
+
+func (this *ResumableSnapshotWriter) Close() error {
+	if this.last == nil {
+		return nil
+	}
+	err := this.last.Close()
+	this.last = nil
+	return err
+}
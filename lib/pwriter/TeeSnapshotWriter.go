@@ -0,0 +1,461 @@
+package pwriter
+
+import (
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pfiles"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+)
+
+//Ensure TeeSnapshotWriter implements StateConsumer
+var _ lib.StateConsumer = new(TeeSnapshotWriter)
+
+//DefaultTeeWindow is how many bytes of memory spans are held for consumers that
+// are behind, before capture waits for required ones to catch up and drops
+// best-effort ones
+const DefaultTeeWindow = 128 << 20
+
+//teePieceSize is the most of a memory span read at once, spans are captured and
+// handed to consumers in pieces so no more than the window is ever held
+const teePieceSize = 1 << 20
+
+//TeeTarget is one consumer of a TeeSnapshotWriter
+type TeeTarget struct {
+	Consumer lib.StateConsumer
+	//Required targets fail the snapshot when they fail, the failures of others
+	// are only reported by Errors
+	Required bool
+}
+
+//TeeSnapshotWriter captures the state of a process once and hands it to several
+// consumers, each writing its own snapshot concurrently with its own encoding.
+// Capture runs at the pace of the fastest consumer, until a required one falls
+// a window's worth of memory behind. Best-effort consumers that far behind fail
+// rather than stall capture, unless no other consumer is ahead of them.
+type TeeSnapshotWriter struct {
+	targets []TeeTarget
+	errs    []error
+	window  int
+}
+
+func NewTeeSnapshotWriter(targets []TeeTarget) *TeeSnapshotWriter {
+	return &TeeSnapshotWriter{
+		targets: targets,
+		errs:    make([]error, len(targets)),
+		window:  DefaultTeeWindow,
+	}
+}
+
+//Errors returns the outcome of each target, once Consume has returned
+func (this *TeeSnapshotWriter) Errors() []error {
+	return this.errs
+}
+
+//Consume returns an error if capture failed, a required target failed or every
+// target failed. The first failure of a required target stops the others.
+func (this *TeeSnapshotWriter) Consume(provider lib.StateProvider) error {
+	if len(this.targets) < 1 {
+		return errs.New("At least one destination is required")
+	}
+	src, err := newTeeSource(provider, len(this.targets), this.window)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i, target := range this.targets {
+		wg.Add(1)
+		go func(i int, target TeeTarget, view *teeView) {
+			defer wg.Done()
+			err := target.Consumer.Consume(view)
+			view.release()
+			if err != nil {
+				this.errs[i] = err
+				if target.Required {
+					src.abort(errs.Append(err, "A required destination failed"))
+				}
+			}
+		}(i, target, src.newView(target.Required)) //Every view exists before capture starts
+	}
+	//Reading spans is left to this goroutine as providers are not safe for
+	// concurrent use, and ptrace requests must come from the attached thread
+	captureErr := src.capture()
+	wg.Wait()
+
+	if captureErr != nil {
+		return captureErr
+	}
+	succeeded := 0
+	for i, target := range this.targets {
+		if this.errs[i] == nil {
+			succeeded++
+		} else if target.Required {
+			return this.errs[i]
+		}
+	}
+	if succeeded == 0 {
+		return errs.Append(this.errs[0], "Every destination failed")
+	}
+	return nil
+}
+
+func (this *TeeSnapshotWriter) DebugInfo() string {
+	return ""
+}
+
+func (this *TeeSnapshotWriter) Close() error {
+	return nil
+}
+
+//teeSource holds the captured state, and each piece of a memory span until
+// every consumer still running has taken it
+type teeSource struct {
+	name     string
+	pid      int
+	regs     *syscall.PtraceRegs
+	meta     pmaps.ProcMap
+	files    []pfiles.FileEntry
+	provider lib.StateProvider
+	index    map[uint64]int //Of spans by start address
+	scratch  []byte         //Capture reads pieces into, before copying them out
+
+	lock     sync.Mutex
+	changed  *sync.Cond
+	spans    []teeSpan
+	views    []*teeView
+	live     int //Consumers still running
+	held     int //Bytes of pieces some consumer has yet to take
+	window   int
+	captured int //Spans read whole from the provider
+	err      error
+}
+
+//teeSpan is a memory span as captured so far
+type teeSpan struct {
+	pieces []teePiece
+	whole  bool //Every piece has been captured
+}
+
+type teePiece struct {
+	data    []byte
+	pending int //Consumers yet to take the piece
+}
+
+//newTeeSource reads everything but the memory spans up front
+func newTeeSource(provider lib.StateProvider, consumers, window int) (*teeSource, error) {
+	regs, err := provider.GetRegisters()
+	if err != nil {
+		return nil, errs.Append(err, readFailMsg, "registers")
+	}
+	meta, err := provider.GetMemoryMeta()
+	if err != nil {
+		return nil, errs.Append(err, readFailMsg, "memory meta data")
+	}
+	pieceSize := teePieceSize
+	if window < pieceSize {
+		pieceSize = window
+	}
+	this := &teeSource{
+		name:     provider.GetName(),
+		pid:      provider.GetPID(),
+		regs:     regs,
+		meta:     meta,
+		files:    provider.GetFiles(),
+		provider: provider,
+		index:    make(map[uint64]int, len(meta)),
+		scratch:  make([]byte, pieceSize),
+		spans:    make([]teeSpan, len(meta)),
+		live:     consumers,
+		window:   window,
+	}
+	for i, entry := range meta {
+		this.index[entry.MemStart] = i
+	}
+	this.changed = sync.NewCond(&this.lock)
+	return this, nil
+}
+
+//capture reads every memory span from the provider once, a piece at a time
+func (this *teeSource) capture() error {
+	for i, entry := range this.meta {
+		if err := this.captureSpan(i, entry); err != nil {
+			this.abort(err)
+			return err
+		}
+		this.lock.Lock()
+		stop := this.err != nil || this.live == 0
+		this.lock.Unlock()
+		if stop {
+			break
+		}
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.captured < len(this.meta) && this.err == nil {
+		this.fail(errs.New("Capture ended early")) //Every consumer has stopped
+	}
+	return nil
+}
+
+//captureSpan reads the memory span at index i, waiting before each piece while
+// the window is too full of pieces consumers have yet to take
+func (this *teeSource) captureSpan(i int, entry pmaps.Entry) error {
+	span, err := this.provider.GetMemorySpan(entry)
+	if err != nil {
+		return errs.Append(err, readFailMsg, "memory span")
+	}
+	defer span.Close()
+	for {
+		if !this.awaitRoom() {
+			return nil
+		}
+		n, err := io.ReadFull(span, this.scratch)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		} else if err != nil {
+			return errs.Append(err, readFailMsg, "memory span")
+		}
+
+		this.lock.Lock()
+		if n > 0 {
+			this.add(i, append([]byte(nil), this.scratch[:n]...))
+		}
+		if err == io.EOF {
+			this.spans[i].whole = true
+			this.captured = i + 1
+		}
+		this.changed.Broadcast()
+		this.lock.Unlock()
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+//awaitRoom waits until another piece fits in the window, dropping lagging
+// best-effort consumers, and reports if capture should go on
+func (this *teeSource) awaitRoom() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for this.err == nil && this.live > 0 && this.held > 0 && this.held+len(this.scratch) > this.window {
+		if !this.dropLagging() {
+			this.changed.Wait()
+		}
+	}
+	return this.err == nil && this.live > 0
+}
+
+//add holds a piece of the span at index i for each consumer still running that
+// has not closed the span. The lock must be held.
+func (this *teeSource) add(i int, data []byte) {
+	piece := teePiece{data: data}
+	for _, view := range this.views {
+		if !view.stopped && !view.closed[i] {
+			piece.pending++
+			view.behind += len(data)
+		}
+	}
+	if piece.pending == 0 {
+		piece.data = nil
+	}
+	this.held += len(piece.data)
+	this.spans[i].pieces = append(this.spans[i].pieces, piece)
+}
+
+//dropLagging stops the best-effort consumers keeping the window full, other than
+// the one least behind, and reports if any were. The lock must be held.
+func (this *teeSource) dropLagging() bool {
+	var leader *teeView
+	for _, view := range this.views {
+		if !view.stopped && (leader == nil || view.behind < leader.behind) {
+			leader = view
+		}
+	}
+	dropped := false
+	for _, view := range this.views {
+		if view != leader && !view.stopped && !view.required && view.behind+len(this.scratch) > this.window {
+			view.stop(errs.New("Destination fell %d bytes behind the others and was dropped", view.behind))
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+//abort stops capture and fails the consumers still waiting for spans
+func (this *teeSource) abort(err error) {
+	this.lock.Lock()
+	this.fail(err)
+	this.lock.Unlock()
+}
+
+//fail records the first error, the lock must be held
+func (this *teeSource) fail(err error) {
+	if this.err == nil {
+		this.err = err
+	}
+	this.changed.Broadcast()
+}
+
+//drop counts piece j of the span at index i as taken by a consumer, the lock
+// must be held
+func (this *teeSource) drop(i, j int) {
+	piece := &this.spans[i].pieces[j]
+	if piece.pending == 0 {
+		return
+	}
+	if piece.pending--; piece.pending == 0 {
+		this.held -= len(piece.data)
+		piece.data = nil
+		this.changed.Broadcast()
+	}
+}
+
+func (this *teeSource) newView(required bool) *teeView {
+	view := &teeView{
+		src:      this,
+		required: required,
+		opened:   make([]bool, len(this.meta)),
+		read:     make([]int, len(this.meta)),
+		closed:   make([]bool, len(this.meta)),
+	}
+	this.lock.Lock()
+	this.views = append(this.views, view)
+	this.lock.Unlock()
+	return view
+}
+
+//teeView is the provider one consumer reads the captured state from
+type teeView struct {
+	src      *teeSource
+	required bool
+	//Guarded by the source's lock
+	opened  []bool //Spans handed to the consumer
+	read    []int  //Pieces of each span the consumer has taken
+	closed  []bool //Spans the consumer takes no more pieces of
+	behind  int    //Bytes captured the consumer has yet to take
+	stopped bool   //The consumer has stopped or was dropped
+	err     error  //Why the consumer was dropped
+}
+
+func (this *teeView) GetName() string                            { return this.src.name }
+func (this *teeView) GetPID() int                                { return this.src.pid }
+func (this *teeView) GetRegisters() (*syscall.PtraceRegs, error) { return this.src.regs, nil }
+func (this *teeView) GetMemoryMeta() (pmaps.ProcMap, error)      { return this.src.meta, nil }
+func (this *teeView) GetFiles() []pfiles.FileEntry               { return this.src.files }
+func (this *teeView) Close() error                               { return nil }
+
+func (this *teeView) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	i, isKnown := this.src.index[metadata.MemStart]
+	if !isKnown || this.src.meta[i].MemEnd != metadata.MemEnd {
+		return lib.MemSpan{}, errs.New("Memory span: %s is not part of the captured state", metadata)
+	}
+	this.src.lock.Lock()
+	opened := this.opened[i]
+	this.opened[i] = true
+	this.src.lock.Unlock()
+	if opened {
+		return lib.MemSpan{}, errs.New("Memory span: %s was already read", metadata)
+	}
+	return lib.MemSpan{Metadata: metadata, ReadCloser: &teeSpanReader{view: this, i: i}}, nil
+}
+
+//take hands the consumer the next piece of the span at index i, waiting until
+// it is captured, or io.EOF once it has taken every piece
+func (this *teeView) take(i int) ([]byte, error) {
+	src := this.src
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	span := &src.spans[i]
+	j := this.read[i]
+	for j >= len(span.pieces) && !span.whole && src.err == nil && !this.stopped {
+		src.changed.Wait()
+	}
+	switch {
+	case this.stopped:
+		return nil, this.err
+	case j < len(span.pieces):
+		data := span.pieces[j].data
+		this.read[i]++
+		this.behind -= len(data)
+		src.drop(i, j)
+		return data, nil
+	case span.whole:
+		return nil, io.EOF
+	default:
+		return nil, src.err
+	}
+}
+
+//close gives up the pieces of the span at index i the consumer has not taken
+func (this *teeView) close(i int) {
+	this.src.lock.Lock()
+	defer this.src.lock.Unlock()
+	if !this.stopped && !this.closed[i] {
+		this.closed[i] = true
+		this.giveUp(i)
+	}
+}
+
+//giveUp drops the pieces of the span at index i the consumer has not taken, the
+// source's lock must be held
+func (this *teeView) giveUp(i int) {
+	src := this.src
+	pieces := src.spans[i].pieces
+	for j := this.read[i]; j < len(pieces); j++ {
+		this.behind -= len(pieces[j].data)
+		src.drop(i, j)
+	}
+	this.read[i] = len(pieces)
+}
+
+//release gives up the pieces the consumer has not taken, once it stops
+func (this *teeView) release() {
+	this.src.lock.Lock()
+	defer this.src.lock.Unlock()
+	if !this.stopped {
+		this.stop(nil)
+	}
+}
+
+//stop gives up the pieces the consumer has not taken, failing those it takes
+// later with err. The source's lock must be held.
+func (this *teeView) stop(err error) {
+	src := this.src
+	this.stopped, this.err = true, err
+	src.live--
+	for i := range src.spans {
+		if !this.closed[i] {
+			this.giveUp(i)
+		}
+	}
+	src.changed.Broadcast()
+}
+
+//teeSpanReader reads one memory span for a consumer as its pieces are captured
+type teeSpanReader struct {
+	view *teeView
+	i    int
+	rest []byte //Of the piece last taken
+}
+
+func (this *teeSpanReader) Read(buf []byte) (int, error) {
+	for len(this.rest) == 0 {
+		data, err := this.view.take(this.i)
+		if err != nil {
+			return 0, err
+		}
+		this.rest = data
+	}
+	n := copy(buf, this.rest)
+	this.rest = this.rest[n:]
+	return n, nil
+}
+
+func (this *teeSpanReader) Close() error {
+	this.view.close(this.i)
+	return nil
+}
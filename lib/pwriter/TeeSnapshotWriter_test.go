@@ -0,0 +1,248 @@
+package pwriter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/internal/ptest"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+	"github.com/tarndt/pmigrate/lib/preader"
+)
+
+//countingProvider counts the memory spans read from it
+type countingProvider struct {
+	*ptest.MemProvider
+	lock  sync.Mutex
+	reads map[uint64]int
+}
+
+func (this *countingProvider) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	this.lock.Lock()
+	this.reads[metadata.MemStart]++
+	this.lock.Unlock()
+	return this.MemProvider.GetMemorySpan(metadata)
+}
+
+//failingWriter fails once limit bytes are written
+type failingWriter struct {
+	limit int
+}
+
+func (this *failingWriter) Write(buf []byte) (int, error) {
+	if this.limit -= len(buf); this.limit < 0 {
+		return 0, errs.New("Destination failed")
+	}
+	return len(buf), nil
+}
+
+func TestTeeSnapshotWriter(t *testing.T) {
+	provider := &countingProvider{
+		MemProvider: ptest.NewMemProvider(t,
+			"1000-9000 rw-p 00000000 00:00 0",
+			"a000-b000 r--p 00000000 00:00 0",
+			"c000-e000 rw-p 00000000 00:00 0",
+			"f000-10000 r-xp 00000000 00:00 0",
+		),
+		reads: make(map[uint64]int),
+	}
+
+	var first, second bytes.Buffer
+	tee := NewTeeSnapshotWriter([]TeeTarget{
+		{Consumer: NewProcSnapshotWriter(&first), Required: true},
+		{Consumer: NewProcSnapshotWriter(&failingWriter{limit: 0x1000})},
+		{Consumer: NewProcSnapshotWriter(&second), Required: true},
+	})
+	tee.window = 1 //Capture waits for the required consumers between pieces
+	if err := tee.Consume(provider); err != nil {
+		t.Fatalf("Tee failed despite a single best-effort failure: %s", err)
+	}
+	if results := tee.Errors(); results[0] != nil || results[1] == nil || results[2] != nil {
+		t.Fatalf("Unexpected outcomes: %v", results)
+	}
+	for _, entry := range provider.Meta {
+		if reads := provider.reads[entry.MemStart]; reads != 1 {
+			t.Fatalf("Memory span: %x was read %d times, not once", entry.MemStart, reads)
+		}
+	}
+
+	for i, buf := range []*bytes.Buffer{&first, &second} {
+		snapshot, err := preader.NewProcSnapReader(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatalf("Could not read snapshot %d: %s", i, err)
+		}
+		meta, _ := snapshot.GetMemoryMeta()
+		if len(meta) != len(provider.Meta) {
+			t.Fatalf("Expected %d memory spans, but %d were read", len(provider.Meta), len(meta))
+		}
+		for _, entry := range meta {
+			span, err := snapshot.GetMemorySpan(entry)
+			if err != nil {
+				t.Fatalf("Could not get memory span: %s", err)
+			}
+			data, _ := ioutil.ReadAll(span)
+			span.Close()
+			if !bytes.Equal(data, provider.Data[entry.MemStart]) {
+				t.Fatalf("Memory span: %x of snapshot %d was not preserved", entry.MemStart, i)
+			}
+		}
+	}
+}
+
+//stalledWriter blocks until release is closed, or gives up after a while
+type stalledWriter struct {
+	release <-chan struct{}
+}
+
+func (this *stalledWriter) Write(buf []byte) (int, error) {
+	select {
+	case <-this.release:
+	case <-time.After(5 * time.Second):
+	}
+	return len(buf), nil
+}
+
+//capturedProvider closes captured once its last memory span is read
+type capturedProvider struct {
+	*ptest.MemProvider
+	captured chan struct{}
+}
+
+func (this *capturedProvider) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	if metadata.MemStart == this.Meta[len(this.Meta)-1].MemStart {
+		defer close(this.captured)
+	}
+	return this.MemProvider.GetMemorySpan(metadata)
+}
+
+func TestTeeSnapshotWriterDropsLagging(t *testing.T) {
+	provider := &capturedProvider{
+		MemProvider: ptest.NewMemProvider(t,
+			"1000-9000 rw-p 00000000 00:00 0",
+			"a000-b000 r--p 00000000 00:00 0",
+			"c000-e000 rw-p 00000000 00:00 0",
+		),
+		captured: make(chan struct{}),
+	}
+	var buf bytes.Buffer
+	tee := NewTeeSnapshotWriter([]TeeTarget{
+		{Consumer: NewProcSnapshotWriter(&buf), Required: true},
+		{Consumer: NewProcSnapshotWriter(&stalledWriter{release: provider.captured})},
+	})
+	tee.window = 1
+	if err := tee.Consume(provider); err != nil {
+		t.Fatalf("Tee failed despite only a best-effort destination lagging: %s", err)
+	}
+	if results := tee.Errors(); results[0] != nil || results[1] == nil {
+		t.Fatalf("Lagging best-effort destination was not dropped: %v", results)
+	}
+}
+
+//meteredProvider counts the bytes of memory spans read from it
+type meteredProvider struct {
+	*ptest.MemProvider
+	read int64
+}
+
+func (this *meteredProvider) GetMemorySpan(metadata pmaps.Entry) (lib.MemSpan, error) {
+	span, err := this.MemProvider.GetMemorySpan(metadata)
+	span.ReadCloser = &meteredSpan{ReadCloser: span.ReadCloser, read: &this.read}
+	return span, err
+}
+
+type meteredSpan struct {
+	io.ReadCloser
+	read *int64
+}
+
+func (this *meteredSpan) Read(buf []byte) (int, error) {
+	n, err := this.ReadCloser.Read(buf)
+	atomic.AddInt64(this.read, int64(n))
+	return n, err
+}
+
+//trailingConsumer reads every memory span in small reads, recording the most
+// capture ran ahead of it
+type trailingConsumer struct {
+	provider *meteredProvider
+	ahead    int64
+}
+
+func (this *trailingConsumer) Consume(provider lib.StateProvider) error {
+	meta, _ := provider.GetMemoryMeta()
+	buf, taken := make([]byte, 0x100), int64(0)
+	for _, entry := range meta {
+		span, err := provider.GetMemorySpan(entry)
+		if err != nil {
+			return err
+		}
+		for err == nil {
+			var n int
+			n, err = span.Read(buf)
+			taken += int64(n)
+			if ahead := atomic.LoadInt64(&this.provider.read) - taken; ahead > this.ahead {
+				this.ahead = ahead
+			}
+		}
+		span.Close()
+		if err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *trailingConsumer) DebugInfo() string { return "" }
+func (this *trailingConsumer) Close() error      { return nil }
+
+func TestTeeSnapshotWriterBoundsSpans(t *testing.T) {
+	provider := &meteredProvider{MemProvider: ptest.NewMemProvider(t,
+		"1000-9000 rw-p 00000000 00:00 0",
+		"a000-b000 r--p 00000000 00:00 0",
+	)}
+	trailing := &trailingConsumer{provider: provider}
+	var buf bytes.Buffer
+	tee := NewTeeSnapshotWriter([]TeeTarget{
+		{Consumer: NewProcSnapshotWriter(&buf), Required: true},
+		{Consumer: trailing, Required: true},
+	})
+	tee.window = 0x1000 //An eighth of the first span
+	if err := tee.Consume(provider); err != nil {
+		t.Fatalf("Tee failed: %s", err)
+	}
+	//Capture may hold a window of pieces, and be reading one more
+	if limit := int64(2 * tee.window); trailing.ahead > limit {
+		t.Fatalf("Capture ran %d bytes ahead of a consumer, more than %d", trailing.ahead, limit)
+	}
+}
+
+func TestTeeSnapshotWriterRequiredFailure(t *testing.T) {
+	provider := ptest.NewMemProvider(t,
+		"1000-9000 rw-p 00000000 00:00 0",
+		"a000-b000 r--p 00000000 00:00 0",
+		"c000-e000 rw-p 00000000 00:00 0",
+	)
+	var buf bytes.Buffer
+	tee := NewTeeSnapshotWriter([]TeeTarget{
+		{Consumer: NewProcSnapshotWriter(&failingWriter{limit: 0x1000}), Required: true},
+		{Consumer: NewProcSnapshotWriter(&buf)},
+	})
+	if err := tee.Consume(provider); err == nil {
+		t.Fatalf("Tee succeeded despite a required failure")
+	}
+
+	tee = NewTeeSnapshotWriter([]TeeTarget{
+		{Consumer: NewProcSnapshotWriter(&failingWriter{limit: 0x1000})},
+		{Consumer: NewProcSnapshotWriter(&failingWriter{limit: 0x2000})},
+	})
+	if err := tee.Consume(provider); err == nil {
+		t.Fatalf("Tee succeeded though every destination failed")
+	}
+}
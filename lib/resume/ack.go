@@ -0,0 +1,43 @@
+//Package resume implements the destination side of resumable transfers, which
+// spools received memory spans to disk and acknowledges them to the source so
+// it can continue from where a broken connection left off.
+package resume
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/tarndt/errs"
+)
+
+//Acknowledgements are sent back over the connection (outside of any
+// compression or encryption) by the destination, once with the number of spans
+// it holds when a stream begins and again after the stream's end of spans marker.
+const ackMagic = uint32(0x50414b31) //"PAK1"
+
+//WriteAck tells the source how many memory spans are held
+func WriteAck(dst io.Writer, spans int) error {
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[:4], ackMagic)
+	binary.BigEndian.PutUint64(buf[4:], uint64(spans))
+	if _, err := dst.Write(buf[:]); err != nil {
+		return errs.Append(err, "Could not write span acknowledgement")
+	}
+	return nil
+}
+
+//ReadAck reads how many memory spans the destination holds
+func ReadAck(src io.Reader) (int, error) {
+	var buf [12]byte
+	if _, err := io.ReadFull(src, buf[:]); err != nil {
+		return 0, errs.Append(err, "Could not read span acknowledgement")
+	}
+	if binary.BigEndian.Uint32(buf[:4]) != ackMagic {
+		return 0, errs.New("Destination sent an invalid span acknowledgement, is it a version of pthaw that supports resuming?")
+	}
+	spans := binary.BigEndian.Uint64(buf[4:])
+	if spans > 1<<31 {
+		return 0, errs.New("Destination acknowledged an implausible number of spans: %d", spans)
+	}
+	return int(spans), nil
+}
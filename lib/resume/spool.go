@@ -0,0 +1,143 @@
+package resume
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/preader"
+)
+
+//Spool persists the records of a resumable transfer as they arrive, so the
+// parts already received survive broken connections. Once complete it holds an
+// ordinary snapshot stream.
+type Spool struct {
+	file      *os.File
+	size      int64 //Offset following the last complete record
+	spans     int
+	hasHeader bool
+}
+
+//NewSpool creates the spool file for sessionID in dir
+func NewSpool(dir, sessionID string) (*Spool, error) {
+	//Session IDs come from the source, make sure they can't escape dir
+	if _, err := hex.DecodeString(sessionID); err != nil || sessionID == "" {
+		return nil, errs.New("Invalid transfer session ID: %q", sessionID)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "pmigrate-"+sessionID+".spool"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errs.Append(err, "Could not create spool file")
+	}
+	return &Spool{file: file}, nil
+}
+
+//Spans returns how many complete memory spans have been spooled
+func (this *Spool) Spans() int {
+	return this.spans
+}
+
+//Receive spools the records of inStrm, which must start with a snapshot header,
+// until the end of spans marker and returns if it was reached. Records cut short
+// by an error are discarded.
+func (this *Spool) Receive(inStrm preader.FlexReader) (bool, error) {
+	if _, err := this.file.Seek(this.size, io.SeekStart); err != nil {
+		return false, errs.Append(err, "Could not seek spool file")
+	}
+	wtr := bufio.NewWriter(this.file)
+	rdr := &recordingReader{FlexReader: inStrm, dst: wtr}
+
+	//Every stream repeats the header, only the first copy is kept
+	if this.hasHeader {
+		rdr.dst = ioutil.Discard
+	}
+	if err := preader.ScanHeader(rdr); err != nil {
+		return false, errs.Append(err, "Could not receive snapshot header")
+	}
+	if err := this.commit(wtr, rdr); err != nil {
+		return false, err
+	}
+	this.hasHeader, rdr.dst = true, wtr
+
+	for {
+		end, err := preader.ScanSpan(rdr)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return false, errs.Append(err, "Could not receive memory span %d", this.spans)
+		} else if end { //The marker itself is not kept
+			return true, this.file.Truncate(this.size)
+		}
+		if err = this.commit(wtr, rdr); err != nil {
+			return false, err
+		}
+		this.spans++
+	}
+}
+
+//commit flushes the record just read and advances the spool past it
+func (this *Spool) commit(wtr *bufio.Writer, rdr *recordingReader) error {
+	if err := wtr.Flush(); err != nil {
+		return errs.Append(err, "Could not write spool file")
+	}
+	this.size += rdr.recorded
+	rdr.recorded = 0
+	return nil
+}
+
+//Reader returns the spooled snapshot, which is only complete after Receive
+// has returned true
+func (this *Spool) Reader() (*bufio.Reader, error) {
+	if _, err := this.file.Seek(0, io.SeekStart); err != nil {
+		return nil, errs.Append(err, "Could not seek spool file")
+	}
+	return bufio.NewReader(io.LimitReader(this.file, this.size)), nil
+}
+
+//Close removes the spool file
+func (this *Spool) Close() error {
+	err := this.file.Close()
+	if rmErr := os.Remove(this.file.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+//recordingReader copies everything read through it to dst
+type recordingReader struct {
+	preader.FlexReader
+	dst      io.Writer
+	recorded int64
+	err      error
+}
+
+func (this *recordingReader) Read(buf []byte) (int, error) {
+	n, err := this.FlexReader.Read(buf)
+	this.record(buf[:n])
+	if err == nil {
+		err = this.err
+	}
+	return n, err
+}
+
+func (this *recordingReader) ReadByte() (byte, error) {
+	b, err := this.FlexReader.ReadByte()
+	if err == nil {
+		this.record([]byte{b})
+		err = this.err
+	}
+	return b, err
+}
+
+func (this *recordingReader) record(buf []byte) {
+	if this.err != nil || len(buf) < 1 {
+		return
+	}
+	if _, this.err = this.dst.Write(buf); this.err == nil && this.dst != ioutil.Discard {
+		this.recorded += int64(len(buf))
+	}
+}
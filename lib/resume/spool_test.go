@@ -0,0 +1,113 @@
+package resume
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tarndt/pmigrate/internal/ptest"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+)
+
+var errLinkDown = errors.New("link down")
+
+//flakyStream delivers what was written to it into spool when finished, but only
+//up to limit bytes, beyond which writes fail as if the connection broke
+type flakyStream struct {
+	buf   bytes.Buffer
+	limit int
+	spool *Spool
+}
+
+func (this *flakyStream) Write(buf []byte) (int, error) {
+	if this.buf.Len()+len(buf) > this.limit {
+		n, _ := this.buf.Write(buf[:this.limit-this.buf.Len()])
+		return n, errLinkDown
+	}
+	return this.buf.Write(buf)
+}
+
+func (this *flakyStream) Finish() (int, error) {
+	complete, err := this.spool.Receive(bufio.NewReader(&this.buf))
+	if err != nil || !complete {
+		return 0, errLinkDown
+	}
+	return this.spool.Spans(), nil
+}
+
+func (this *flakyStream) Close() error {
+	if this.buf.Len() > 0 { //Delivered what made it through before breaking
+		this.spool.Receive(bufio.NewReader(&this.buf))
+	}
+	return nil
+}
+
+func TestResumeAfterBrokenStream(t *testing.T) {
+	provider := ptest.NewMemProvider(t,
+		"1000-3000 rw-p 00000000 00:00 0",
+		"4000-5000 r--p 00000000 00:00 0",
+		"6000-9000 rw-p 00000000 00:00 0",
+		"a000-b000 r-xp 00000000 00:00 0",
+	)
+
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := NewSpool(dir, "00ff")
+	if err != nil {
+		t.Fatalf("NewSpool returned: %s", err)
+	}
+	defer spool.Close()
+	if _, err = NewSpool(dir, "../escape"); err == nil {
+		t.Fatalf("NewSpool accepted a session ID that is not hex")
+	}
+
+	//Each connection breaks a little over 3 pages in, so it takes several to finish
+	var dials []int
+	dial := func(lastErr error) (pwriter.ResumableStream, int, error) {
+		if len(dials) > 0 && (lastErr == nil || !strings.Contains(lastErr.Error(), errLinkDown.Error())) {
+			t.Fatalf("Stream %d failed with an unexpected error: %v", len(dials), lastErr)
+		} else if len(dials) > 10 {
+			t.Fatalf("Transfer did not make progress")
+		}
+		dials = append(dials, spool.Spans())
+		return &flakyStream{limit: 3*4096 + 1024, spool: spool}, spool.Spans(), nil
+	}
+	if err = pwriter.NewResumableSnapshotWriter(dial).Consume(provider); err != nil {
+		t.Fatalf("Resumable transfer failed: %s", err)
+	}
+	if len(dials) < 3 {
+		t.Fatalf("Expected the transfer to be interrupted, but it took %d streams", len(dials))
+	}
+	for i := 1; i < len(dials); i++ {
+		if dials[i] <= dials[i-1] {
+			t.Fatalf("Stream %d resumed from span %d, after stream %d began at %d", i, dials[i], i-1, dials[i-1])
+		}
+	}
+
+	spoolRdr, err := spool.Reader()
+	if err != nil {
+		t.Fatalf("Could not read spool: %s", err)
+	}
+	snapshot, err := preader.NewProcSnapReader(spoolRdr)
+	if err != nil {
+		t.Fatalf("Spooled snapshot could not be read: %s", err)
+	}
+	meta, _ := snapshot.GetMemoryMeta()
+	if len(meta) != len(provider.Meta) {
+		t.Fatalf("Expected %d memory spans, but %d were spooled", len(provider.Meta), len(meta))
+	}
+	for i, entry := range meta {
+		span, _ := snapshot.GetMemorySpan(entry)
+		if data, _ := ioutil.ReadAll(span); !bytes.Equal(data, provider.Data[entry.MemStart]) {
+			t.Fatalf("Memory span %d content was not preserved", i)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+//Package rudp provides reliable, ordered and congestion controlled connections
+// over UDP. Lost datagrams are found through selective acknowledgements and
+// retransmission timeouts, and the send rate follows AIMD congestion control
+// paced across the round trip time, much like TCP with SACK.
+package rudp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sendBufSegs     = 4096 //Segments a sender may hold unacknowledged
+	recvBufSegs     = 4096 //Segments a receiver will buffer
+	initialCwnd     = 16
+	minCwnd         = 2
+	initialRTO      = time.Second
+	minRTO          = 200 * time.Millisecond
+	maxRTO          = 8 * time.Second
+	dupThresh       = 3 //Later segments acknowledged before one is considered lost
+	ackEvery        = 4 //In order segments received before an acknowledgement is sent
+	delayedAck      = 5 * time.Millisecond
+	maxBurst        = 16 //Segments that may be sent back to back after an idle period
+	deadPeerTimeout = 30 * time.Second
+	closeLinger     = 2 * time.Second //Time spent acknowledging the peer after closing
+	sockBufSize     = 8 * 1024 * 1024
+)
+
+var (
+	ErrReset       = errors.New("Connection reset by peer")
+	ErrPeerTimeout = errors.New("Peer stopped acknowledging data")
+)
+
+//timeoutError is returned when a deadline passes
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+//Ensure Conn implements net.Conn
+var _ net.Conn = new(Conn)
+
+//Conn is a reliable byte stream over UDP
+type Conn struct {
+	connID    uint32
+	sock      *net.UDPConn
+	remote    *net.UDPAddr
+	connected bool   //sock is dedicated to remote
+	onDone    func() //Called once the connection is finished
+
+	lock     sync.Mutex
+	notify   chan struct{} //Closed and replaced on every state change readers or writers care about
+	wake     chan struct{} //Pokes the run loop
+	done     chan struct{} //Closed once the connection is finished
+	err      error
+	closed   bool
+	doneOnce sync.Once
+
+	readDeadline, writeDeadline time.Time
+
+	//Send side, segments in [sndUna, sndNxt) are in flight and [sndNxt, sndEnd)
+	// are queued
+	segs                   map[uint32]*segment
+	sndUna, sndNxt, sndEnd uint32
+	sacked, lost           int      //In flight segments selectively acknowledged or deemed lost
+	retransQ               []uint32 //Lost segments awaiting retransmission
+	cwnd, ssthresh         float64
+	srtt, rttvar, rto      time.Duration
+	peerWnd                uint32
+	recoverSeq             uint32 //Losses before this belong to an already handled window
+	lastProgress           time.Time
+	nextSendAt             time.Time
+	finSeq                 uint32
+	finQueued              bool
+	lingerUntil            time.Time
+
+	//Receive side
+	rcvNxt     uint32
+	ooo        map[uint32]inSegment //Received but not yet in order
+	readBuf    bytes.Buffer
+	finRcvd    bool
+	ackPending int
+	ackDue     time.Time
+	advWnd     uint32 //Window last advertised
+
+	sendBuf [maxPacket]byte
+}
+
+type segment struct {
+	data           []byte
+	fin            bool
+	sent           time.Time
+	transmits      int
+	isSacked, lost bool
+}
+
+type inSegment struct {
+	data []byte
+	fin  bool
+}
+
+func newConn(connID uint32, sock *net.UDPConn, remote *net.UDPAddr, connected bool, onDone func()) *Conn {
+	this := &Conn{
+		connID:       connID,
+		sock:         sock,
+		remote:       remote,
+		connected:    connected,
+		onDone:       onDone,
+		notify:       make(chan struct{}),
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		segs:         make(map[uint32]*segment, initialCwnd),
+		cwnd:         initialCwnd,
+		ssthresh:     sendBufSegs,
+		rto:          initialRTO,
+		peerWnd:      recvBufSegs,
+		lastProgress: time.Now(),
+		ooo:          make(map[uint32]inSegment),
+		advWnd:       recvBufSegs,
+	}
+	go this.run()
+	return this
+}
+
+func (this *Conn) Read(buf []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for {
+		switch {
+		case this.readBuf.Len() > 0:
+			n, _ := this.readBuf.Read(buf)
+			//Reopen a window that had nearly closed
+			if this.advWnd < recvBufSegs/4 && this.window() >= recvBufSegs/2 {
+				this.sendAck()
+			}
+			return n, nil
+		case this.finRcvd:
+			return 0, io.EOF
+		case this.err != nil:
+			return 0, this.err
+		case this.closed:
+			return 0, net.ErrClosed
+		}
+		if err := this.wait(this.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (this *Conn) Write(buf []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	written := 0
+	for len(buf) > 0 {
+		switch {
+		case this.err != nil:
+			return written, this.err
+		case this.closed:
+			return written, net.ErrClosed
+		case this.sndEnd-this.sndUna >= sendBufSegs:
+			if err := this.wait(this.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		//Top up the last queued segment rather than sending small datagrams
+		if last := this.sndEnd - 1; this.sndEnd != this.sndNxt && len(this.segs[last].data) < maxPayload {
+			seg := this.segs[last]
+			n := min(len(buf), maxPayload-len(seg.data))
+			seg.data = append(seg.data, buf[:n]...)
+			buf, written = buf[n:], written+n
+			continue
+		}
+		n := min(len(buf), maxPayload)
+		seg := &segment{data: make([]byte, n, maxPayload)}
+		copy(seg.data, buf)
+		this.segs[this.sndEnd] = seg
+		this.sndEnd++
+		buf, written = buf[n:], written+n
+		this.poke()
+	}
+	return written, nil
+}
+
+//Close sends everything written, then waits for the peer to acknowledge it
+func (this *Conn) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	this.broadcast()
+	if this.err != nil {
+		this.finish()
+		return nil
+	}
+
+	this.segs[this.sndEnd] = &segment{fin: true}
+	this.finSeq, this.finQueued = this.sndEnd, true
+	this.sndEnd++
+	this.poke()
+	//A peer that has closed its side may have gone away entirely
+	var deadline time.Time
+	if this.finRcvd {
+		deadline = time.Now().Add(closeLinger)
+	}
+	for this.err == nil && !seqLess(this.finSeq, this.sndUna) {
+		if err := this.wait(deadline); err != nil {
+			if this.sndUna != this.finSeq {
+				this.fail(ErrPeerTimeout)
+				return this.err
+			}
+			break
+		}
+	}
+	if this.err != nil {
+		return this.err
+	}
+	//Linger so retransmissions of the peer's close are still acknowledged
+	this.lingerUntil = time.Now().Add(closeLinger)
+	this.poke()
+	return nil
+}
+
+func (this *Conn) LocalAddr() net.Addr {
+	return this.sock.LocalAddr()
+}
+
+func (this *Conn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+func (this *Conn) SetDeadline(deadline time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.readDeadline, this.writeDeadline = deadline, deadline
+	this.broadcast()
+	return nil
+}
+
+func (this *Conn) SetReadDeadline(deadline time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.readDeadline = deadline
+	this.broadcast()
+	return nil
+}
+
+func (this *Conn) SetWriteDeadline(deadline time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.writeDeadline = deadline
+	this.broadcast()
+	return nil
+}
+
+//wait releases the lock until the state changes or deadline passes
+func (this *Conn) wait(deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return timeoutError{}
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	notify := this.notify
+	this.lock.Unlock()
+	defer this.lock.Lock()
+	select {
+	case <-notify:
+		return nil
+	case <-expired:
+		return timeoutError{}
+	}
+}
+
+func (this *Conn) broadcast() {
+	close(this.notify)
+	this.notify = make(chan struct{})
+}
+
+func (this *Conn) poke() {
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+//fail aborts the connection, telling the peer
+func (this *Conn) fail(err error) {
+	if this.err != nil {
+		return
+	}
+	this.err = err
+	if err != ErrReset {
+		this.send(&packet{kind: pktReset})
+	}
+	this.broadcast()
+	this.finish()
+}
+
+//finish releases the connection's resources
+func (this *Conn) finish() {
+	this.doneOnce.Do(func() {
+		close(this.done)
+		if this.connected {
+			this.sock.Close()
+		}
+		if this.onDone != nil {
+			go this.onDone()
+		}
+	})
+}
+
+//handle processes a packet from the peer
+func (this *Conn) handle(pkt packet) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	select {
+	case <-this.done:
+		return
+	default:
+	}
+
+	switch pkt.kind {
+	case pktReset:
+		this.fail(ErrReset)
+		return
+	case pktSyn, pktSynAck:
+		return
+	}
+	this.processAck(pkt.ack, pkt.wnd, pkt.sack)
+	switch pkt.kind {
+	case pktData, pktFin:
+		this.receive(pkt)
+	case pktProbe:
+		this.sendAck()
+	}
+	this.poke()
+}
+
+//receive buffers a data or fin segment
+func (this *Conn) receive(pkt packet) {
+	if seqLess(pkt.seq, this.rcvNxt) || int32(pkt.seq-this.rcvNxt) >= recvBufSegs {
+		this.sendAck() //Duplicate or outside the window, let the sender know where we are
+		return
+	}
+	if _, isDup := this.ooo[pkt.seq]; !isDup {
+		this.ooo[pkt.seq] = inSegment{data: append([]byte(nil), pkt.payload...), fin: pkt.kind == pktFin}
+	}
+
+	inOrder := pkt.seq == this.rcvNxt
+	for {
+		seg, isPresent := this.ooo[this.rcvNxt]
+		if !isPresent {
+			break
+		}
+		delete(this.ooo, this.rcvNxt)
+		this.readBuf.Write(seg.data)
+		this.finRcvd = this.finRcvd || seg.fin
+		this.rcvNxt++
+	}
+	if inOrder {
+		this.broadcast()
+	}
+
+	//Gaps and the end of the stream are reported immediately
+	if this.ackPending++; !inOrder || len(this.ooo) > 0 || this.ackPending >= ackEvery || this.finRcvd {
+		this.sendAck()
+	} else if this.ackPending == 1 {
+		this.ackDue = time.Now().Add(delayedAck)
+	}
+}
+
+//window is how many more segments beyond rcvNxt can be buffered
+func (this *Conn) window() uint32 {
+	free := recvBufSegs - len(this.ooo) - (this.readBuf.Len()+maxPayload-1)/maxPayload
+	if free < 0 {
+		return 0
+	}
+	return uint32(free)
+}
+
+func (this *Conn) sackBits() uint64 {
+	var bits uint64
+	if len(this.ooo) == 0 {
+		return 0
+	}
+	for i := uint32(0); i < 64; i++ {
+		if _, isPresent := this.ooo[this.rcvNxt+1+i]; isPresent {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+func (this *Conn) sendAck() {
+	this.send(&packet{kind: pktAck})
+}
+
+//dropHook lets tests simulate a lossy network, it holds a func([]byte) bool
+var dropHook atomic.Value
+
+//send transmits pkt along with the current receive state
+func (this *Conn) send(pkt *packet) {
+	pkt.connID = this.connID
+	pkt.ack, pkt.wnd, pkt.sack = this.rcvNxt, this.window(), this.sackBits()
+	this.advWnd, this.ackPending = pkt.wnd, 0
+
+	buf := pkt.marshal(this.sendBuf[:])
+	if drop, _ := dropHook.Load().(func([]byte) bool); drop != nil && drop(buf) {
+		return
+	}
+	//Losses are handled by retransmission, so errors are not interesting
+	if this.connected {
+		this.sock.Write(buf)
+	} else {
+		this.sock.WriteToUDP(buf, this.remote)
+	}
+}
+
+//run drives transmission and timers until the connection is finished
+func (this *Conn) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		this.lock.Lock()
+		now := time.Now()
+		this.transmit(now)
+		next := this.nextEvent(now)
+		this.lock.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+		select {
+		case <-this.done:
+			return
+		case <-this.wake:
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package rudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tarndt/errs"
+)
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	synRetryInterval   = 250 * time.Millisecond
+	acceptBacklog      = 16
+)
+
+//Ensure Listener implements net.Listener
+var _ net.Listener = new(Listener)
+
+//Listener accepts connections on a single UDP socket
+type Listener struct {
+	sock   *net.UDPConn
+	accept chan *Conn
+	done   chan struct{}
+
+	lock   sync.Mutex
+	conns  map[connKey]*Conn
+	closed bool
+}
+
+type connKey struct {
+	addr   string
+	connID uint32
+}
+
+//Listen opens a UDP socket on addr (host:port) to accept connections on
+func Listen(addr string) (*Listener, error) {
+	UDPAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errs.Append(err, "Failed to resolve UDP address: %s", addr)
+	}
+	sock, err := net.ListenUDP("udp", UDPAddr)
+	if err != nil {
+		return nil, errs.Append(err, "Failed to listen for UDP packets")
+	}
+	sock.SetReadBuffer(sockBufSize)
+	sock.SetWriteBuffer(sockBufSize)
+
+	this := &Listener{
+		sock:   sock,
+		accept: make(chan *Conn, acceptBacklog),
+		done:   make(chan struct{}),
+		conns:  make(map[connKey]*Conn),
+	}
+	go this.readLoop()
+	return this, nil
+}
+
+func (this *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.accept:
+		return conn, nil
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+//Close stops accepting connections, those already accepted continue until
+// they are closed
+func (this *Listener) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	close(this.done)
+	for pending := true; pending; {
+		select {
+		case conn := <-this.accept:
+			conn.lock.Lock()
+			conn.fail(ErrReset)
+			conn.lock.Unlock()
+		default:
+			pending = false
+		}
+	}
+	this.closeIfIdle()
+	return nil
+}
+
+func (this *Listener) Addr() net.Addr {
+	return this.sock.LocalAddr()
+}
+
+//closeIfIdle releases the socket once closed and without connections
+func (this *Listener) closeIfIdle() {
+	if this.closed && len(this.conns) == 0 {
+		this.sock.Close()
+	}
+}
+
+func (this *Listener) readLoop() {
+	buf := make([]byte, maxPacket+1)
+	for {
+		n, from, err := this.sock.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		pkt, isValid := parsePacket(buf[:n])
+		if !isValid {
+			continue
+		}
+
+		key := connKey{addr: from.String(), connID: pkt.connID}
+		this.lock.Lock()
+		conn := this.conns[key]
+		if pkt.kind == pktSyn {
+			if conn == nil && !this.closed {
+				conn = newConn(pkt.connID, this.sock, from, false, func() { this.remove(key) })
+				select {
+				case this.accept <- conn:
+					this.conns[key] = conn
+				default: //Backlog is full, the client will retry
+					conn.finish()
+					conn = nil
+				}
+			}
+			if conn != nil { //Also repeats a lost acceptance
+				conn.lock.Lock()
+				conn.send(&packet{kind: pktSynAck})
+				conn.lock.Unlock()
+			}
+			this.lock.Unlock()
+			continue
+		}
+		this.lock.Unlock()
+
+		if conn != nil {
+			conn.handle(pkt)
+		} else if pkt.kind != pktReset {
+			reset := packet{kind: pktReset, connID: pkt.connID}
+			this.sock.WriteToUDP(reset.marshal(make([]byte, headerSize)), from)
+		}
+	}
+}
+
+func (this *Listener) remove(key connKey) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.conns, key)
+	this.closeIfIdle()
+}
+
+//Dial connects to a Listener at addr (host:port), a timeout of 0 selects a
+// default
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	UDPAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errs.Append(err, "Failed to resolve UDP address: %s", addr)
+	}
+	sock, err := net.DialUDP("udp", nil, UDPAddr)
+	if err != nil {
+		return nil, errs.Append(err, "Failed to open UDP socket")
+	}
+	sock.SetReadBuffer(sockBufSize)
+	sock.SetWriteBuffer(sockBufSize)
+
+	var idBuf [4]byte
+	if _, err = rand.Read(idBuf[:]); err != nil {
+		sock.Close()
+		return nil, errs.Append(err, "Could not read entropy source to generate a connection ID")
+	}
+	connID := binary.BigEndian.Uint32(idBuf[:])
+
+	//Retry the handshake until accepted
+	syn := packet{kind: pktSyn, connID: connID}
+	synBuf, buf := syn.marshal(make([]byte, headerSize)), make([]byte, maxPacket+1)
+	deadline := time.Now().Add(timeout)
+	for accepted := false; !accepted; {
+		if time.Now().After(deadline) {
+			sock.Close()
+			return nil, errs.New("No response from %s within %s", addr, timeout)
+		}
+		if _, err = sock.Write(synBuf); err != nil {
+			sock.Close()
+			return nil, errs.Append(err, "Could not connect to %s", addr)
+		}
+		sock.SetReadDeadline(time.Now().Add(synRetryInterval))
+		for {
+			n, err := sock.Read(buf)
+			if err != nil {
+				if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+					break
+				}
+				sock.Close()
+				return nil, errs.Append(err, "Could not connect to %s", addr)
+			}
+			if pkt, isValid := parsePacket(buf[:n]); isValid && pkt.connID == connID {
+				if pkt.kind == pktReset {
+					sock.Close()
+					return nil, errs.New("Connection to %s was refused", addr)
+				}
+				accepted = pkt.kind == pktSynAck
+				break
+			}
+		}
+	}
+	sock.SetReadDeadline(time.Time{})
+
+	this := newConn(connID, sock, UDPAddr, true, nil)
+	go this.readLoop()
+	return this, nil
+}
+
+//readLoop receives packets for a dialed connection
+func (this *Conn) readLoop() {
+	buf := make([]byte, maxPacket+1)
+	for {
+		n, err := this.sock.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue //Such as ICMP errors for earlier datagrams
+		}
+		if pkt, isValid := parsePacket(buf[:n]); isValid && pkt.connID == this.connID {
+			this.handle(pkt)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package rudp
+
+import (
+	"encoding/binary"
+)
+
+//Packet kinds
+const (
+	pktSyn    byte = iota + 1 //Client asks to open connection connID
+	pktSynAck                 //Server accepts connection connID
+	pktData                   //Stream payload, occupies a sequence number
+	pktFin                    //End of the sender's stream, occupies a sequence number
+	pktAck                    //Acknowledgement only
+	pktProbe                  //Asks for an acknowledgement, used while the peer's window is closed
+	pktReset                  //Connection is unknown or was aborted
+)
+
+const (
+	//kind, connID, seq, ack, wnd & sack
+	headerSize = 1 + 4 + 4 + 4 + 4 + 8
+	//Keeps datagrams under the IPv6 minimum MTU of 1280 bytes
+	maxPayload = 1200
+	maxPacket  = headerSize + maxPayload
+)
+
+//packet is a single datagram. Every packet carries the sender's receive state:
+// ack is the next sequence number it expects, wnd how many more segments it can
+// buffer beyond that and bit i of sack is set if segment ack+1+i has arrived.
+type packet struct {
+	kind    byte
+	connID  uint32
+	seq     uint32
+	ack     uint32
+	wnd     uint32
+	sack    uint64
+	payload []byte
+}
+
+func (this *packet) marshal(buf []byte) []byte {
+	buf = buf[:headerSize+len(this.payload)]
+	buf[0] = this.kind
+	binary.BigEndian.PutUint32(buf[1:], this.connID)
+	binary.BigEndian.PutUint32(buf[5:], this.seq)
+	binary.BigEndian.PutUint32(buf[9:], this.ack)
+	binary.BigEndian.PutUint32(buf[13:], this.wnd)
+	binary.BigEndian.PutUint64(buf[17:], this.sack)
+	copy(buf[headerSize:], this.payload)
+	return buf
+}
+
+//parsePacket decodes buf, the payload of the result aliases buf
+func parsePacket(buf []byte) (packet, bool) {
+	if len(buf) < headerSize || len(buf) > maxPacket || buf[0] < pktSyn || buf[0] > pktReset {
+		return packet{}, false
+	}
+	return packet{
+		kind:    buf[0],
+		connID:  binary.BigEndian.Uint32(buf[1:]),
+		seq:     binary.BigEndian.Uint32(buf[5:]),
+		ack:     binary.BigEndian.Uint32(buf[9:]),
+		wnd:     binary.BigEndian.Uint32(buf[13:]),
+		sack:    binary.BigEndian.Uint64(buf[17:]),
+		payload: buf[headerSize:],
+	}, true
+}
+
+//seqLess compares sequence numbers allowing for wrap around
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,152 @@
+package rudp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//lossyNetwork drops a fraction of all datagrams, including acknowledgements
+func lossyNetwork(rate float64) func([]byte) bool {
+	var lock sync.Mutex
+	rng := mrand.New(mrand.NewSource(1))
+	return func([]byte) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return rng.Float64() < rate
+	}
+}
+
+func transfer(t *testing.T, size int) {
+	payload := make([]byte, size)
+	rand.Read(payload)
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned: %s", err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- result{err: err}
+			return
+		}
+		data, err := ioutil.ReadAll(conn)
+		if err == nil {
+			_, err = conn.Write([]byte("done"))
+		}
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+		received <- result{data, err}
+	}()
+
+	conn, err := Dial(listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Dial returned: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	//Uneven writes to exercise segment coalescing
+	for rest := payload; len(rest) > 0; {
+		n := min(len(rest), 1+mrand.Intn(5000))
+		if _, err = conn.Write(rest[:n]); err != nil {
+			t.Fatalf("Write returned: %s", err)
+		}
+		rest = rest[n:]
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatalf("Close returned: %s", err)
+	}
+
+	res := <-received
+	if res.err != nil {
+		t.Fatalf("Receiver failed: %s", res.err)
+	} else if !bytes.Equal(res.data, payload) {
+		t.Fatalf("Received %d bytes that did not match the %d sent", len(res.data), len(payload))
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	transfer(t, 4*1024*1024)
+}
+
+func TestLossyTransfer(t *testing.T) {
+	dropHook.Store(lossyNetwork(0.05))
+	defer dropHook.Store(func([]byte) bool { return false })
+	transfer(t, 2*1024*1024)
+}
+
+func TestDuplex(t *testing.T) {
+	dropHook.Store(lossyNetwork(0.05))
+	defer dropHook.Store(func([]byte) bool { return false })
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) //Echo
+	}()
+
+	conn, err := Dial(listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Dial returned: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	for i := 0; i < 50; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 100+i*50)
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatalf("Write returned: %s", err)
+		}
+		echo := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, echo); err != nil {
+			t.Fatalf("Read returned: %s", err)
+		} else if !bytes.Equal(echo, msg) {
+			t.Fatalf("Echo %d did not match", i)
+		}
+	}
+}
+
+func TestDeadlineAndRefusal(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned: %s", err)
+	}
+	go listener.Accept()
+	conn, err := Dial(listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Dial returned: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Read returned without data")
+	} else if netErr, isNetErr := err.(net.Error); !isNetErr || !netErr.Timeout() {
+		t.Fatalf("Expected a timeout, not: %s", err)
+	}
+	conn.Close()
+	listener.Close()
+
+	if _, err = Dial(listener.Addr().String(), 300*time.Millisecond); err == nil {
+		t.Fatalf("Dial succeeded without a listener")
+	}
+}
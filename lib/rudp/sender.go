@@ -0,0 +1,250 @@
+package rudp
+
+import (
+	"time"
+)
+
+//processAck applies the peer's receive state to the segments in flight
+func (this *Conn) processAck(ack, wnd uint32, sack uint64) {
+	if seqLess(this.sndNxt, ack) || seqLess(ack, this.sndUna) {
+		return //Stale or bogus
+	}
+	now := time.Now()
+	this.peerWnd = wnd
+	rttSample := time.Duration(-1)
+
+	//Cumulative acknowledgement
+	advanced := this.sndUna != ack
+	for ; this.sndUna != ack; this.sndUna++ {
+		seg := this.segs[this.sndUna]
+		if seg.transmits == 1 { //Karn's algorithm, retransmissions are ambiguous
+			rttSample = now.Sub(seg.sent)
+		}
+		if seg.isSacked {
+			this.sacked--
+		} else {
+			this.grow()
+		}
+		if seg.lost {
+			this.lost--
+		}
+		delete(this.segs, this.sndUna)
+	}
+	if advanced {
+		this.lastProgress = now
+		this.broadcast()
+	}
+
+	//Selective acknowledgements
+	var (
+		highest   uint32
+		anySacked bool
+	)
+	for i := uint32(0); i < 64 && sack != 0; i++ {
+		if sack&(1<<i) == 0 {
+			continue
+		}
+		seq := ack + 1 + i
+		if !seqLess(seq, this.sndNxt) {
+			break
+		}
+		highest, anySacked = seq, true
+		if seg := this.segs[seq]; !seg.isSacked {
+			seg.isSacked = true
+			this.sacked++
+			if seg.lost {
+				seg.lost = false
+				this.lost--
+			}
+			if seg.transmits == 1 {
+				rttSample = now.Sub(seg.sent)
+			}
+			this.lastProgress = now
+			this.grow()
+		}
+	}
+	if rttSample >= 0 {
+		this.updateRTT(rttSample)
+	}
+
+	//Anything dupThresh or more behind the highest selectively acknowledged
+	// segment is lost, unless a retransmission of it may still be in flight
+	if anySacked {
+		for seq := this.sndUna; int32(highest-seq) >= dupThresh; seq++ {
+			seg := this.segs[seq]
+			if seg.isSacked || seg.lost || (seg.transmits > 1 && now.Sub(seg.sent) < this.srtt) {
+				continue
+			}
+			this.markLost(seq, seg)
+		}
+	}
+}
+
+func (this *Conn) markLost(seq uint32, seg *segment) {
+	seg.lost = true
+	this.lost++
+	this.retransQ = append(this.retransQ, seq)
+	//Multiplicative decrease, once per window of data
+	if !seqLess(seq, this.recoverSeq) {
+		this.ssthresh = max(this.cwnd/2, minCwnd)
+		this.cwnd = this.ssthresh
+		this.recoverSeq = this.sndNxt
+	}
+}
+
+//grow opens the congestion window for an acknowledged segment, exponentially
+// during slow start then additively
+func (this *Conn) grow() {
+	if this.cwnd < this.ssthresh {
+		this.cwnd++
+	} else {
+		this.cwnd += 1 / this.cwnd
+	}
+	this.cwnd = min(this.cwnd, sendBufSegs)
+}
+
+func (this *Conn) updateRTT(sample time.Duration) {
+	if this.srtt == 0 {
+		this.srtt, this.rttvar = sample, sample/2
+	} else {
+		delta := this.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		this.rttvar = (3*this.rttvar + delta) / 4
+		this.srtt = (7*this.srtt + sample) / 8
+	}
+	this.rto = min(max(this.srtt+4*this.rttvar, minRTO), maxRTO)
+}
+
+//transmit sends whatever the congestion window, the peer's window and pacing
+// allow, retransmissions first, and handles expired timers
+func (this *Conn) transmit(now time.Time) {
+	select {
+	case <-this.done:
+		return
+	default:
+	}
+
+	if this.sndUna != this.sndNxt {
+		if now.Sub(this.lastProgress) > deadPeerTimeout {
+			this.fail(ErrPeerTimeout)
+			return
+		}
+		if head := this.segs[this.sndUna]; !head.lost && now.Sub(head.sent) >= this.rto {
+			this.retransmitTimeout(now)
+		}
+	} else if this.sndNxt != this.sndEnd && this.peerWnd == 0 && now.Sub(this.lastProgress) >= this.rto {
+		this.send(&packet{kind: pktProbe}) //The window update may have been lost
+		this.lastProgress = now
+	}
+	if this.ackPending > 0 && !now.Before(this.ackDue) {
+		this.sendAck()
+	}
+	if !this.lingerUntil.IsZero() && !now.Before(this.lingerUntil) {
+		this.finish()
+		return
+	}
+
+	//Segments beyond the reach of selective acknowledgements count as in flight,
+	// so the head of the window is retransmitted regardless or it could stall
+	pipe := int(this.sndNxt-this.sndUna) - this.sacked - this.lost
+	for !now.Before(this.nextSendAt) {
+		var (
+			seq uint32
+			seg *segment
+		)
+		if head := this.segs[this.sndUna]; this.sndUna != this.sndNxt && head.lost {
+			seq, seg = this.sndUna, head
+			seg.lost = false
+			this.lost--
+		} else if pipe >= int(this.cwnd) {
+			break
+		} else if len(this.retransQ) > 0 {
+			seq, this.retransQ = this.retransQ[0], this.retransQ[1:]
+			if seg = this.segs[seq]; seg == nil || !seg.lost {
+				continue
+			}
+			seg.lost = false
+			this.lost--
+		} else if this.sndNxt != this.sndEnd && this.sndNxt-this.sndUna < this.peerWnd {
+			if this.sndNxt == this.sndUna {
+				this.lastProgress = now //Starting from idle
+			}
+			seq, seg = this.sndNxt, this.segs[this.sndNxt]
+			this.sndNxt++
+		} else {
+			break
+		}
+
+		seg.sent = now
+		seg.transmits++
+		pkt := packet{kind: pktData, seq: seq, payload: seg.data}
+		if seg.fin {
+			pkt.kind = pktFin
+		}
+		this.send(&pkt)
+		pipe++
+		this.pace(now)
+	}
+}
+
+//retransmitTimeout handles the oldest segment going unacknowledged for an RTO,
+// everything sent as long ago is presumed lost and the window collapses
+func (this *Conn) retransmitTimeout(now time.Time) {
+	for seq := this.sndUna; seq != this.sndNxt; seq++ {
+		if seg := this.segs[seq]; !seg.isSacked && !seg.lost && now.Sub(seg.sent) >= this.rto {
+			this.markLost(seq, seg)
+		}
+	}
+	this.ssthresh = max(this.cwnd/2, minCwnd)
+	this.cwnd = minCwnd
+	this.recoverSeq = this.sndNxt
+	this.rto = min(this.rto*2, maxRTO)
+}
+
+//pace spreads a window of segments across the round trip time, allowing short
+// bursts after idle periods
+func (this *Conn) pace(now time.Time) {
+	if this.srtt == 0 {
+		return
+	}
+	interval := time.Duration(float64(this.srtt) / this.cwnd)
+	if floor := now.Add(-maxBurst * interval); this.nextSendAt.Before(floor) {
+		this.nextSendAt = floor
+	}
+	this.nextSendAt = this.nextSendAt.Add(interval)
+}
+
+//nextEvent returns how long until transmit next has something to do, absent
+// incoming packets and writes
+func (this *Conn) nextEvent(now time.Time) time.Duration {
+	next := time.Hour
+	consider := func(at time.Time) {
+		if d := at.Sub(now); d < next {
+			next = max(d, 0)
+		}
+	}
+
+	if this.sndUna != this.sndNxt {
+		if head := this.segs[this.sndUna]; !head.lost {
+			consider(head.sent.Add(this.rto))
+		}
+		consider(this.lastProgress.Add(deadPeerTimeout))
+	} else if this.sndNxt != this.sndEnd && this.peerWnd == 0 {
+		consider(this.lastProgress.Add(this.rto))
+	}
+	sendable := len(this.retransQ) > 0 || (this.sndNxt != this.sndEnd && this.sndNxt-this.sndUna < this.peerWnd)
+	if pipe := int(this.sndNxt-this.sndUna) - this.sacked - this.lost; sendable && pipe < int(this.cwnd) {
+		consider(this.nextSendAt)
+	} else if head := this.segs[this.sndUna]; this.sndUna != this.sndNxt && head.lost {
+		consider(this.nextSendAt)
+	}
+	if this.ackPending > 0 {
+		consider(this.ackDue)
+	}
+	if !this.lingerUntil.IsZero() {
+		consider(this.lingerUntil)
+	}
+	return next
+}
@@ -0,0 +1,248 @@
+//Package s3 implements the subset of the S3 API needed to store snapshots in
+// S3-compatible object storage (AWS, MinIO, Ceph and others): streaming
+// multipart uploads and ranged downloads, signed with AWS Signature Version 4.
+//
+//Integrity is checked in both directions: every request carries the SHA-256
+// digest of its payload and every uploaded part its Content-MD5, which the
+// server verifies, while the ETags it returns are compared to the MD5 digests
+// of what was sent. Downloads are verified against the object's ETag once
+// completely read.
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/endpoint"
+)
+
+//Scheme prefixes object storage destinations and sources: s3://bucket/key
+const Scheme = "s3://"
+
+func init() {
+	endpoint.Register(endpoint.Scheme{Name: strings.TrimSuffix(Scheme, "://"), Addressing: endpoint.AddrOpaque})
+}
+
+const (
+	service       = "s3"
+	defaultRegion = "us-east-1"
+	//maxAttempts of requests failing with network or server errors
+	maxAttempts = 4
+	retryDelay  = 500 * time.Millisecond
+)
+
+//Config describes the object storage service and how to authenticate to it
+type Config struct {
+	Endpoint string //URL of the service, such as http://localhost:9000 for MinIO
+	Region   string
+	//PathStyle addresses buckets as the first path element of the endpoint,
+	// rather than as a subdomain of it
+	PathStyle bool
+	Credentials
+}
+
+//ConfigFromEnv reads the standard AWS environment variables: AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, optionally AWS_SESSION_TOKEN, AWS_REGION (or
+// AWS_DEFAULT_REGION) and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL). Services
+// at a custom endpoint are addressed path style.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Region: firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		Credentials: Credentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return cfg, errs.New("Object storage credentials must be provided by AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultRegion
+	}
+	if cfg.Endpoint = firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); cfg.Endpoint != "" {
+		cfg.PathStyle = true
+	} else {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	return cfg, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+//IsURL reports if target is an object storage URL
+func IsURL(target string) bool {
+	return strings.HasPrefix(target, Scheme)
+}
+
+//ParseURL splits an s3://bucket/key URL
+func ParseURL(target string) (bucket, key string, err error) {
+	if !IsURL(target) {
+		return "", "", errs.New("Object storage URLs must be in the form: %sbucket/key, not: %q", Scheme, target)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(target, Scheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errs.New("Object storage URLs must be in the form: %sbucket/key, not: %q", Scheme, target)
+	}
+	return parts[0], parts[1], nil
+}
+
+//Client makes requests to an object storage service
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+	http     *http.Client
+	//PartSize is the size of the parts objects are uploaded in, at least 5 MiB
+	// as S3 requires of all but the last part
+	PartSize int
+	//RangeSize is the size of the ranges objects are downloaded in, each of
+	// which is retried separately
+	RangeSize int64
+}
+
+const (
+	MinPartSize      = 5 << 20
+	DefaultPartSize  = 16 << 20
+	DefaultRangeSize = 16 << 20
+)
+
+func NewClient(cfg Config) (*Client, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, errs.Append(err, "Invalid object storage endpoint: %q", cfg.Endpoint)
+	} else if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, errs.New("Object storage endpoint must be an http or https URL, not: %q", cfg.Endpoint)
+	}
+	return &Client{
+		cfg:       cfg,
+		endpoint:  endpoint,
+		http:      &http.Client{},
+		PartSize:  DefaultPartSize,
+		RangeSize: DefaultRangeSize,
+	}, nil
+}
+
+//Error is an error response of the service
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Resource   string
+}
+
+func (this *Error) Error() string {
+	if this.Code == "" {
+		return "Object storage request for: " + this.Resource + " failed with HTTP status: " + http.StatusText(this.StatusCode)
+	}
+	return "Object storage request for: " + this.Resource + " failed with " + this.Code + ": " + this.Message
+}
+
+//IsNotFound reports if err is the service reporting that an object does not exist
+func IsNotFound(err error) bool {
+	s3Err, isS3Err := err.(*Error)
+	return isS3Err && s3Err.StatusCode == http.StatusNotFound
+}
+
+//objectURL returns the URL of key in bucket with query parameters
+func (this *Client) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := *this.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if this.cfg.PathStyle || strings.Contains(bucket, ".") { //Dotted bucket names do not match wildcard certificates
+		path += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	path += "/" + key
+	u.Path, u.RawPath = path, uriEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+//do signs and sends a request, retrying network and server errors. Responses
+// with other than a 2xx status are returned as an *Error.
+func (this *Client) do(method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	resource := Scheme + bucket + "/" + key
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		if resp, err = this.send(method, bucket, key, query, header, body); err == nil {
+			if resp.StatusCode/100 == 2 {
+				return resp, nil
+			}
+			err = readError(resp, resource)
+			if resp.StatusCode/100 != 5 {
+				return nil, err
+			}
+		}
+		if attempt == maxAttempts {
+			return nil, errs.Append(err, "Gave up on %s of: %s after %d attempts", method, resource, attempt)
+		}
+		time.Sleep(time.Duration(attempt) * retryDelay)
+	}
+}
+
+func (this *Client) send(method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, this.objectURL(bucket, key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errs.Append(err, "Could not create object storage request")
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	payloadHash := hashHex(body)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	sign(req, this.cfg.Credentials, this.cfg.Region, service, payloadHash, time.Now())
+
+	resp, err := this.http.Do(req)
+	if err != nil {
+		return nil, errs.Append(err, "Object storage request failed")
+	}
+	return resp, nil
+}
+
+//readError consumes an error response
+func readError(resp *http.Response, resource string) error {
+	defer resp.Body.Close()
+	s3Err := &Error{StatusCode: resp.StatusCode, Resource: resource}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, s3Err)
+	return s3Err
+}
+
+//readXML decodes a response body, which can be an error despite a 200 status
+func readXML(resp *http.Response, resource string, result interface{}) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return errs.Append(err, "Could not read object storage response")
+	}
+	s3Err := &Error{StatusCode: resp.StatusCode, Resource: resource}
+	if xml.Unmarshal(body, s3Err) == nil && s3Err.Code != "" {
+		return s3Err
+	}
+	if err = xml.Unmarshal(body, result); err != nil {
+		return errs.Append(err, "Could not decode object storage response")
+	}
+	return nil
+}
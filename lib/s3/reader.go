@@ -0,0 +1,189 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tarndt/errs"
+)
+
+//Reader streams an object from storage a range at a time, so failed transfers
+// are retried from where they left off rather than from the start. Objects are
+// verified against their ETag once read to the end, which io.EOF is only
+// returned after.
+type Reader struct {
+	client      *Client
+	bucket, key string
+	size, pos   int64
+	etag        string
+	buf         []byte
+
+	//Verification of the ETag, which for multipart uploads needs their part size
+	verify   bool
+	partSize int64
+	partLen  int64
+	partHash hash.Hash
+	partMD5s [][md5.Size]byte
+}
+
+//Open returns a Reader of the object key in bucket
+func (this *Client) Open(bucket, key string) (*Reader, error) {
+	rdr := &Reader{
+		client:   this,
+		bucket:   bucket,
+		key:      key,
+		partHash: md5.New(),
+	}
+	resp, err := this.do(http.MethodHead, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err //Names the object already, and is checked by IsNotFound
+	}
+	resp.Body.Close()
+	if rdr.size = resp.ContentLength; rdr.size < 0 {
+		return nil, errs.New("Object storage did not report the size of: %s", rdr.resource())
+	}
+	rdr.etag = digestETag(resp)
+
+	//Objects can only be verified if their ETag is a digest of their content,
+	// and for multipart uploads if their part size is known
+	etag := strings.ToLower(strings.Trim(rdr.etag, `"`))
+	if rdr.verify = isDigestETag(etag); strings.Contains(etag, "-") {
+		rdr.partSize, err = strconv.ParseInt(resp.Header.Get(partSizeMeta), 10, 64)
+		rdr.verify = rdr.verify && err == nil && rdr.partSize > 0
+	}
+	if rdr.partSize <= 0 {
+		rdr.partSize = rdr.size
+	}
+	return rdr, nil
+}
+
+func (this *Reader) resource() string {
+	return Scheme + this.bucket + "/" + this.key
+}
+
+//Size returns the size of the object
+func (this *Reader) Size() int64 {
+	return this.size
+}
+
+func (this *Reader) Read(data []byte) (int, error) {
+	if len(this.buf) == 0 {
+		if this.pos >= this.size {
+			if err := this.verifyETag(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		if err := this.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, this.buf)
+	this.buf = this.buf[n:]
+	return n, nil
+}
+
+//fetch downloads the next range of the object, retrying failed transfers
+func (this *Reader) fetch() error {
+	end := this.pos + this.client.RangeSize
+	if end > this.size {
+		end = this.size
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		var data []byte
+		if data, err = this.fetchRange(this.pos, end); err == nil {
+			this.hashRange(data)
+			this.buf, this.pos = data, end
+			return nil
+		} else if _, isS3Err := err.(*Error); isS3Err {
+			return err //Already retried by do when worthwhile
+		}
+		if attempt == maxAttempts {
+			return errs.Append(err, "Gave up on download of: %s after %d attempts", this.resource(), attempt)
+		}
+		time.Sleep(time.Duration(attempt) * retryDelay)
+	}
+}
+
+func (this *Reader) fetchRange(start, end int64) ([]byte, error) {
+	header := http.Header{
+		"Range":    {"bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end-1, 10)},
+		"If-Match": {this.etag}, //Fail rather than mix ranges of different objects
+	}
+	if this.etag == "" {
+		delete(header, "If-Match")
+	}
+	resp, err := this.client.do(http.MethodGet, this.bucket, this.key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && !(start == 0 && end == this.size) {
+		return nil, errs.New("Object storage ignored the range requested of: %s", this.resource())
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return nil, errs.Append(err, "Could not download: %s", this.resource())
+	} else if int64(len(data)) != end-start {
+		return nil, errs.New("Download of: %s was cut short at %d of %d bytes", this.resource(), start+int64(len(data)), this.size)
+	}
+	return data, nil
+}
+
+//hashRange adds a downloaded range to the part digests
+func (this *Reader) hashRange(data []byte) {
+	if !this.verify {
+		return
+	}
+	for len(data) > 0 {
+		n := this.partSize - this.partLen
+		if int64(len(data)) < n {
+			n = int64(len(data))
+		}
+		this.partHash.Write(data[:n])
+		data, this.partLen = data[n:], this.partLen+n
+		if this.partLen == this.partSize {
+			this.endPart()
+		}
+	}
+}
+
+func (this *Reader) endPart() {
+	var sum [md5.Size]byte
+	this.partHash.Sum(sum[:0])
+	this.partMD5s = append(this.partMD5s, sum)
+	this.partHash.Reset()
+	this.partLen = 0
+}
+
+//verifyETag compares the digest of what was read to the object's ETag
+func (this *Reader) verifyETag() error {
+	if !this.verify {
+		return nil
+	}
+	this.verify = false
+	if this.partLen > 0 || len(this.partMD5s) == 0 {
+		this.endPart()
+	}
+	expected := hex.EncodeToString(this.partMD5s[0][:])
+	if strings.Contains(this.etag, "-") {
+		expected = compositeETag(this.partMD5s)
+	}
+	if err := checkETag(this.etag, expected); err != nil {
+		return errs.Append(err, "Object: %s was corrupted in storage or transit", this.resource())
+	}
+	return nil
+}
+
+func (this *Reader) Close() error {
+	this.buf = nil
+	return nil
+}
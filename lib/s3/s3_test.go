@@ -0,0 +1,307 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//TestSign checks signatures against the example of the AWS Signature Version 4
+// documentation
+func TestSign(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	cred := Credentials{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now, _ := time.Parse(amzDate, "20150830T123600Z")
+	sign(req, cred, "us-east-1", "iam", hashHex(nil), now)
+
+	const expected = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Fatalf("Authorization header was:\n\t%s\nexpected:\n\t%s", actual, expected)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	bucket, key, err := ParseURL("s3://snaps/host/app.snap")
+	if err != nil || bucket != "snaps" || key != "host/app.snap" {
+		t.Fatalf("Parsed: %q, %q, %v", bucket, key, err)
+	}
+	for _, bad := range []string{"snaps/app.snap", "s3://snaps", "s3://snaps/", "s3:///app.snap"} {
+		if _, _, err = ParseURL(bad); err == nil {
+			t.Fatalf("Parsing: %q did not fail", bad)
+		}
+	}
+}
+
+//fakeS3 implements enough of the S3 API for Client, checking that requests
+// carry the digests of their payloads
+type fakeS3 struct {
+	t         *testing.T
+	lock      sync.Mutex
+	objects   map[string][]byte
+	etags     map[string]string
+	partSizes map[string]string
+	uploads   map[string]map[int][]byte
+	failGets  int  //Count of range downloads to cut short
+	kms       bool //Encrypt objects with KMS, whose ETags are not content digests
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *Client) {
+	fake := &fakeS3{
+		t:         t,
+		objects:   make(map[string][]byte),
+		etags:     make(map[string]string),
+		partSizes: make(map[string]string),
+		uploads:   make(map[string]map[int][]byte),
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	client, err := NewClient(Config{
+		Endpoint:    srv.URL,
+		Region:      defaultRegion,
+		PathStyle:   true,
+		Credentials: Credentials{AccessKey: "test", SecretKey: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create client: %s", err)
+	}
+	client.PartSize, client.RangeSize = MinPartSize, 1<<20
+	return fake, client
+}
+
+func (this *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	sha := sha256.Sum256(body)
+	if req.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sha[:]) {
+		http.Error(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), signAlgo+" Credential=test/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	sum := md5.Sum(body)
+	if contentMD5 := req.Header.Get("Content-Md5"); contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+		return
+	}
+	name, query := req.URL.Path, req.URL.Query()
+	uploadID := query.Get("uploadId")
+	if this.kms {
+		w.Header().Set(sseHeader, "aws:kms")
+	}
+
+	switch {
+	case req.Method == http.MethodPost && query["uploads"] != nil:
+		uploadID = strconv.Itoa(len(this.uploads) + 1)
+		this.uploads[uploadID] = make(map[int][]byte)
+		this.partSizes[name] = req.Header.Get(partSizeMeta)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case req.Method == http.MethodPut && uploadID != "":
+		partNum, _ := strconv.Atoi(query.Get("partNumber"))
+		this.uploads[uploadID][partNum] = body
+		w.Header().Set("ETag", `"`+this.etag(hex.EncodeToString(sum[:]))+`"`)
+	case req.Method == http.MethodPost && uploadID != "":
+		var request struct {
+			Parts []completePart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &request)
+		var object []byte
+		var partMD5s [][md5.Size]byte
+		for _, part := range request.Parts {
+			data := this.uploads[uploadID][part.PartNumber]
+			object = append(object, data...)
+			partMD5s = append(partMD5s, md5.Sum(data))
+		}
+		delete(this.uploads, uploadID)
+		this.objects[name], this.etags[name] = object, this.etag(compositeETag(partMD5s))
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"%s"</ETag></CompleteMultipartUploadResult>`, this.etags[name])
+	case req.Method == http.MethodDelete && uploadID != "":
+		delete(this.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPut:
+		this.objects[name], this.etags[name] = body, this.etag(hex.EncodeToString(sum[:]))
+		delete(this.partSizes, name)
+		w.Header().Set("ETag", `"`+this.etags[name]+`"`)
+	case req.Method == http.MethodHead || req.Method == http.MethodGet:
+		object, isPresent := this.objects[name]
+		if !isPresent {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+this.etags[name]+`"`)
+		if this.partSizes[name] != "" {
+			w.Header().Set(partSizeMeta, this.partSizes[name])
+		}
+		if req.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+			return
+		}
+		var start, end int
+		fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		if this.failGets > 0 {
+			this.failGets--
+			end = start + (end-start)/2
+		}
+		w.Write(object[start : end+1])
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+//etag returns the ETag of an object whose content has digest, which with KMS
+// is a digest of something else
+func (this *fakeS3) etag(digest string) string {
+	if !this.kms {
+		return digest
+	}
+	sum := md5.Sum([]byte(digest))
+	if i := strings.IndexByte(digest, '-'); i >= 0 {
+		return hex.EncodeToString(sum[:]) + digest[i:]
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+func testObject(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func upload(t *testing.T, client *Client, key string, data []byte) {
+	wtr, err := client.Create("bucket", key)
+	if err != nil {
+		t.Fatalf("Could not create: %s; Details: %s", key, err)
+	}
+	for remaining := data; len(remaining) > 0; { //Odd sized writes
+		n := 100003
+		if n > len(remaining) {
+			n = len(remaining)
+		}
+		if _, err = wtr.Write(remaining[:n]); err != nil {
+			t.Fatalf("Could not write: %s; Details: %s", key, err)
+		}
+		remaining = remaining[n:]
+	}
+	if err = wtr.Close(); err != nil {
+		t.Fatalf("Could not close: %s; Details: %s", key, err)
+	}
+}
+
+func download(client *Client, key string) ([]byte, error) {
+	rdr, err := client.Open("bucket", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+func TestRoundTrip(t *testing.T) {
+	fake, client := newFakeS3(t)
+	for _, size := range []int{0, 1000, MinPartSize, 2*MinPartSize + 12345} {
+		key := "dir/snap " + strconv.Itoa(size)
+		data := testObject(size)
+		upload(t, client, key, data)
+		if size > MinPartSize && fake.partSizes["/bucket/"+key] == "" {
+			t.Fatalf("Object of %d bytes was not uploaded in parts", size)
+		}
+		fake.failGets = 2
+		actual, err := download(client, key)
+		if err != nil {
+			t.Fatalf("Could not download object of %d bytes: %s", size, err)
+		} else if !bytes.Equal(actual, data) {
+			t.Fatalf("Object of %d bytes was downloaded as %d different bytes", size, len(actual))
+		}
+	}
+	if len(fake.uploads) > 0 {
+		t.Fatalf("%d multipart uploads were left incomplete", len(fake.uploads))
+	}
+}
+
+func TestCorruptionDetected(t *testing.T) {
+	fake, client := newFakeS3(t)
+	for _, size := range []int{1000, 2*MinPartSize + 1} {
+		key := "snap" + strconv.Itoa(size)
+		upload(t, client, key, testObject(size))
+		fake.objects["/bucket/"+key][size/2] ^= 0xff
+		if _, err := download(client, key); err == nil {
+			t.Fatalf("Corruption of object of %d bytes was not detected", size)
+		}
+	}
+}
+
+func TestKMSEncrypted(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.kms = true
+	for _, size := range []int{1000, 2*MinPartSize + 1} {
+		key := "snap" + strconv.Itoa(size)
+		data := testObject(size)
+		upload(t, client, key, data)
+		if actual, err := download(client, key); err != nil {
+			t.Fatalf("Could not download KMS encrypted object of %d bytes: %s", size, err)
+		} else if !bytes.Equal(actual, data) {
+			t.Fatalf("KMS encrypted object of %d bytes was downloaded as %d different bytes", size, len(actual))
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	fake, client := newFakeS3(t)
+	wtr, err := client.Create("bucket", "aborted")
+	if err != nil {
+		t.Fatalf("Could not create: %s", err)
+	}
+	if _, err = wtr.Write(testObject(MinPartSize + 1)); err != nil {
+		t.Fatalf("Could not write: %s", err)
+	}
+	if len(fake.uploads) != 1 {
+		t.Fatalf("Expected a multipart upload to be in progress, not %d", len(fake.uploads))
+	}
+	if err = wtr.Abort(); err != nil {
+		t.Fatalf("Could not abort: %s", err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Fatalf("Aborted multipart upload was not deleted")
+	} else if err = wtr.Close(); err == nil {
+		t.Fatalf("Close after Abort did not fail")
+	} else if _, isPresent := fake.objects["/bucket/aborted"]; isPresent {
+		t.Fatalf("Aborted object was created")
+	}
+	if _, err = download(client, "aborted"); !IsNotFound(err) {
+		t.Fatalf("Expected not found error opening aborted object, not: %v", err)
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	query := url.Values{"uploadId": {"a/b+c"}, "partNumber": {"2"}, "uploads": {""}}
+	expected := []string{"partNumber=2", "uploadId=a%2Fb%2Bc", "uploads="}
+	actual := strings.Split(canonicalQuery(query), "&")
+	if !sort.StringsAreSorted(actual) || strings.Join(actual, "&") != strings.Join(expected, "&") {
+		t.Fatalf("Canonical query was: %v, expected: %v", actual, expected)
+	}
+}
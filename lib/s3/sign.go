@@ -0,0 +1,127 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgo  = "AWS4-HMAC-SHA256"
+	amzDate   = "20060102T150405Z"
+	scopeDate = "20060102"
+)
+
+//unsignedHeaders vary between hops or are added by the transport
+var unsignedHeaders = map[string]bool{"authorization": true, "user-agent": true, "expect": true, "connection": true}
+
+//Credentials sign requests
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string //Of temporary credentials, if any
+}
+
+//sign adds an AWS Signature Version 4 Authorization header to req, covering the
+// host, every header already set and the payload with the hex SHA-256 digest
+// payloadHash
+func sign(req *http.Request, cred Credentials, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(amzDate))
+	if cred.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cred.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if unsignedHeaders[name] {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := now.Format(scopeDate) + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := signAlgo + "\n" + now.Format(amzDate) + "\n" + scope + "\n" + hashHex([]byte(canonRequest))
+
+	key := []byte("AWS4" + cred.SecretKey)
+	for _, part := range []string{now.Format(scopeDate), region, service, "aws4_request"} {
+		key = hmacSum(key, part)
+	}
+	req.Header.Set("Authorization", signAlgo+" Credential="+cred.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSum(key, stringToSign)))
+}
+
+//canonicalQuery encodes query sorted by name, as both the request and its
+// signature must
+func canonicalQuery(query map[string][]string) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+//uriEncode percent encodes everything but unreserved characters, and slashes
+// unless encodeSlash is set
+func uriEncode(str string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var enc strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			enc.WriteByte(c)
+		default:
+			enc.WriteByte('%')
+			enc.WriteByte(hexDigits[c>>4])
+			enc.WriteByte(hexDigits[c&15])
+		}
+	}
+	return enc.String()
+}
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
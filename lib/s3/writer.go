@@ -0,0 +1,257 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tarndt/errs"
+)
+
+//partSizeMeta records the part size of multipart uploads, which readers need
+// to verify the object's composite ETag
+const partSizeMeta = "X-Amz-Meta-Pmigrate-Part-Size"
+
+//Headers of responses about objects encrypted on the server side
+const (
+	sseHeader         = "X-Amz-Server-Side-Encryption"
+	sseCustomerHeader = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+)
+
+//Writer streams an object to storage, uploading it in parts as they fill so the
+// object is never held in memory in full. Objects smaller than a part are
+// uploaded with a single request. The object only appears once Close succeeds.
+type Writer struct {
+	client      *Client
+	bucket, key string
+	part        []byte
+	uploadID    string
+	partMD5s    [][md5.Size]byte
+	completed   bool
+	err         error
+}
+
+//Create returns a Writer of the object key in bucket
+func (this *Client) Create(bucket, key string) (*Writer, error) {
+	if this.PartSize < MinPartSize {
+		return nil, errs.New("Object storage part size: %d is smaller than the minimum: %d", this.PartSize, MinPartSize)
+	}
+	return &Writer{
+		client: this,
+		bucket: bucket,
+		key:    key,
+		part:   make([]byte, 0, this.PartSize),
+	}, nil
+}
+
+func (this *Writer) resource() string {
+	return Scheme + this.bucket + "/" + this.key
+}
+
+func (this *Writer) Write(data []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+	written := 0
+	for len(data) > 0 {
+		n := copy(this.part[len(this.part):cap(this.part)], data)
+		this.part, data, written = this.part[:len(this.part)+n], data[n:], written+n
+		if len(this.part) == cap(this.part) {
+			if this.err = this.uploadPart(); this.err != nil {
+				return written, this.err
+			}
+		}
+	}
+	return written, nil
+}
+
+//uploadPart uploads the buffered part, starting the multipart upload with the
+// first part
+func (this *Writer) uploadPart() error {
+	if this.uploadID == "" {
+		header := http.Header{partSizeMeta: {strconv.Itoa(cap(this.part))}}
+		resp, err := this.client.do(http.MethodPost, this.bucket, this.key, url.Values{"uploads": {""}}, header, nil)
+		if err != nil {
+			return errs.Append(err, "Could not start upload of: %s", this.resource())
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err = readXML(resp, this.resource(), &result); err != nil {
+			return errs.Append(err, "Could not start upload of: %s", this.resource())
+		} else if result.UploadID == "" {
+			return errs.New("Object storage did not return an upload ID for: %s", this.resource())
+		}
+		this.uploadID = result.UploadID
+	}
+
+	partNum := len(this.partMD5s) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(partNum)}, "uploadId": {this.uploadID}}
+	resp, err := this.client.do(http.MethodPut, this.bucket, this.key, query, nil, this.part)
+	if err != nil {
+		return errs.Append(err, "Could not upload part %d of: %s", partNum, this.resource())
+	}
+	resp.Body.Close()
+	sum := md5.Sum(this.part)
+	if err = checkETag(digestETag(resp), hex.EncodeToString(sum[:])); err != nil {
+		return errs.Append(err, "Part %d of: %s was corrupted in transit", partNum, this.resource())
+	}
+	this.partMD5s = append(this.partMD5s, sum)
+	this.part = this.part[:0]
+	return nil
+}
+
+//Close uploads what remains buffered and completes the object
+func (this *Writer) Close() error {
+	if this.err != nil || this.completed {
+		return this.err
+	}
+	if this.uploadID == "" {
+		this.err = this.putObject()
+	} else {
+		if len(this.part) > 0 {
+			this.err = this.uploadPart()
+		}
+		if this.err == nil {
+			this.err = this.complete()
+		}
+	}
+	if this.err != nil {
+		this.Abort()
+		return this.err
+	}
+	this.completed = true
+	return nil
+}
+
+//putObject uploads objects smaller than a part with a single request
+func (this *Writer) putObject() error {
+	resp, err := this.client.do(http.MethodPut, this.bucket, this.key, nil, nil, this.part)
+	if err != nil {
+		return errs.Append(err, "Could not upload: %s", this.resource())
+	}
+	resp.Body.Close()
+	sum := md5.Sum(this.part)
+	if err = checkETag(digestETag(resp), hex.EncodeToString(sum[:])); err != nil {
+		return errs.Append(err, "Object: %s was corrupted in transit", this.resource())
+	}
+	return nil
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+//complete assembles the uploaded parts into the object
+func (this *Writer) complete() error {
+	request := struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{}
+	for i, sum := range this.partMD5s {
+		request.Parts = append(request.Parts, completePart{PartNumber: i + 1, ETag: `"` + hex.EncodeToString(sum[:]) + `"`})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return errs.Append(err, "Could not encode upload completion of: %s", this.resource())
+	}
+	resp, err := this.client.do(http.MethodPost, this.bucket, this.key, url.Values{"uploadId": {this.uploadID}}, nil, body)
+	if err != nil {
+		return errs.Append(err, "Could not complete upload of: %s", this.resource())
+	}
+	var result struct {
+		ETag string
+	}
+	if err = readXML(resp, this.resource(), &result); err != nil {
+		return errs.Append(err, "Could not complete upload of: %s", this.resource())
+	}
+	if isEncryptedETag(resp.Header) {
+		result.ETag = ""
+	}
+	if err = checkETag(result.ETag, compositeETag(this.partMD5s)); err != nil {
+		return errs.Append(err, "Object: %s was not assembled from the parts uploaded", this.resource())
+	}
+	return nil
+}
+
+//Abort discards the object, deleting any parts already uploaded. It does
+// nothing once Close has succeeded.
+func (this *Writer) Abort() error {
+	if this.completed {
+		return nil
+	}
+	if this.err == nil {
+		this.err = errs.New("Upload of: %s was aborted", this.resource())
+	}
+	if this.uploadID == "" {
+		return nil
+	}
+	uploadID := this.uploadID
+	this.uploadID = ""
+	resp, err := this.client.do(http.MethodDelete, this.bucket, this.key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return errs.Append(err, "Could not abort upload of: %s", this.resource())
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//compositeETag returns the ETag S3 gives multipart objects: the MD5 digest of
+// the concatenated part digests, suffixed by the part count
+func compositeETag(partMD5s [][md5.Size]byte) string {
+	var all bytes.Buffer
+	for _, sum := range partMD5s {
+		all.Write(sum[:])
+	}
+	sum := md5.Sum(all.Bytes())
+	return hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(len(partMD5s))
+}
+
+//checkETag compares an ETag returned by the service to the expected one.
+// Absent ETags, and those not of the form of a digest, can not be checked.
+func checkETag(etag, expected string) error {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	if etag == "" || !isDigestETag(etag) {
+		return nil
+	}
+	if etag != expected {
+		return errs.New("Object storage returned ETag: %s, expected: %s", etag, expected)
+	}
+	return nil
+}
+
+//digestETag returns the ETag of resp, or "" if it is not a digest of the
+// object's content
+func digestETag(resp *http.Response) string {
+	if isEncryptedETag(resp.Header) {
+		return ""
+	}
+	return resp.Header.Get("ETag")
+}
+
+//isEncryptedETag reports if the response is of an object encrypted with KMS or
+// customer provided keys, whose ETags are not digests of the content although
+// they may have the form of one
+func isEncryptedETag(header http.Header) bool {
+	return strings.HasPrefix(header.Get(sseHeader), "aws:kms") || header.Get(sseCustomerHeader) != ""
+}
+
+//isDigestETag reports if etag has the form of an MD5 digest, optionally
+// suffixed by a part count
+func isDigestETag(etag string) bool {
+	digest := etag
+	if i := strings.IndexByte(etag, '-'); i >= 0 {
+		if _, err := strconv.Atoi(etag[i+1:]); err != nil {
+			return false
+		}
+		digest = etag[:i]
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil && len(digest) == 2*md5.Size
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"os"
 	"syscall"
 
 	"github.com/tarndt/pmigrate/lib/pfiles"
@@ -13,6 +14,14 @@ import (
 type MemSpan struct {
 	Metadata pmaps.Entry
 	io.ReadCloser
+	Mapping FileMapping //Optional: Where the span's data can be mapped from instead of read
+}
+
+//FileMapping locates the data of a memory span stored page aligned in a file,
+// which a loader can map rather than copy. A nil File means there is none.
+type FileMapping struct {
+	File   *os.File
+	Offset int64 //Of the data in the file, a page multiple
 }
 
 func NewMemSpan(metadata pmaps.Entry, rdr io.ReadCloser) MemSpan {
@@ -42,3 +51,14 @@ type StateConsumer interface {
 	DebugInfo() string
 	io.Closer
 }
+
+//ChunkSink keeps memory pages by the SHA-256 digest of their content, so
+// snapshots need only reference them (see pwriter.NewChunkedSnapshotWriter)
+type ChunkSink interface {
+	PutChunk(hash [32]byte, data []byte) error
+}
+
+//ChunkSource returns memory pages kept by a ChunkSink, verifying their content
+type ChunkSource interface {
+	GetChunk(hash [32]byte) ([]byte, error)
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"errors"
+	"io"
+
+	"github.com/tarndt/errs"
+)
+
+//ErrStreamedSpans is returned by the GetMemoryMeta and GetMemorySpan of a
+// SpanStreamer, whose memory spans are only known as they arrive
+var ErrStreamedSpans = errors.New("Memory spans of a streamed snapshot can only be read as they arrive")
+
+//SpanStreamer is a StateProvider whose memory spans are read once each, in the
+// order they arrive rather than by address, such as a snapshot being received.
+// Its GetMemoryMeta and GetMemorySpan return ErrStreamedSpans.
+type SpanStreamer interface {
+	StateProvider
+	//NextMemorySpan returns the next memory span, which must be closed before
+	// the next is asked for, or io.EOF once there are no more
+	NextMemorySpan() (MemSpan, error)
+}
+
+//ForEachMemorySpan calls fn with every memory span of provider, by address or
+// for SpanStreamers as they arrive, closing each span once fn returns
+func ForEachMemorySpan(provider StateProvider, fn func(span MemSpan) error) error {
+	if streamer, isStreamer := provider.(SpanStreamer); isStreamer {
+		for {
+			span, err := streamer.NextMemorySpan()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return errs.Append(err, "Could not get memory span")
+			}
+			err = fn(span)
+			span.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	spans, err := provider.GetMemoryMeta()
+	if err != nil {
+		return errs.Append(err, "Could not get memory metadata")
+	}
+	for _, spanMeta := range spans {
+		span, err := provider.GetMemorySpan(spanMeta)
+		if err != nil {
+			return errs.Append(err, "Could not get memory span")
+		}
+		err = fn(span)
+		span.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
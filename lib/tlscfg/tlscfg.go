@@ -0,0 +1,138 @@
+package tlscfg
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tarndt/errs"
+)
+
+//Options are the TLS settings shared by pfrez and pthaw. Pins are hex encoded
+// SHA-256 digests of a peer certificate's SubjectPublicKeyInfo, which can be
+// computed with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform DER | sha256sum
+//
+// When pins are given without a CA the pinned key is the sole trust anchor,
+// allowing self-signed peers.
+type Options struct {
+	CertFile, KeyFile string
+	CAFile            string
+	Pins              []string
+	ServerName        string
+}
+
+//ParsePins splits a comma separated list of pins
+func ParsePins(pins string) []string {
+	var result []string
+	for _, pin := range strings.Split(pins, ",") {
+		if pin = strings.ToLower(strings.TrimSpace(pin)); pin != "" {
+			result = append(result, pin)
+		}
+	}
+	return result
+}
+
+//PinOf returns the pin of a certificate
+func PinOf(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+//ClientConfig builds the configuration pfrez uses to dial a tls destination
+func ClientConfig(opts Options) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
+	}
+	if err := loadCertificate(cfg, opts); err != nil {
+		return nil, err
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	} else if len(opts.Pins) > 0 {
+		//Chain verification is replaced by the pin check below
+		cfg.InsecureSkipVerify = true
+	}
+	if len(opts.Pins) > 0 {
+		cfg.VerifyConnection = verifyPins(opts.Pins, "server")
+	}
+	return cfg, nil
+}
+
+//ServerConfig builds the configuration pthaw uses to accept tls sources. If a CA
+// or pins are provided clients must present a certificate that satisfies them.
+func ServerConfig(opts Options) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errs.New("A certificate and key are required to accept TLS connections")
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if err := loadCertificate(cfg, opts); err != nil {
+		return nil, err
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if len(opts.Pins) > 0 {
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	}
+	if len(opts.Pins) > 0 {
+		cfg.VerifyConnection = verifyPins(opts.Pins, "client")
+	}
+	return cfg, nil
+}
+
+func loadCertificate(cfg *tls.Config, opts Options) error {
+	if opts.CertFile == "" && opts.KeyFile == "" {
+		return nil
+	} else if opts.CertFile == "" || opts.KeyFile == "" {
+		return errs.New("Both a TLS certificate and its key must be provided")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return errs.Append(err, "Could not load TLS certificate: %s and key: %s", opts.CertFile, opts.KeyFile)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errs.Append(err, "Could not read CA certificate file: %s", path)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, errs.New("CA certificate file: %s, did not contain any PEM encoded certificates", path)
+	}
+	return pool, nil
+}
+
+func verifyPins(pins []string, peerRole string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errs.New("TLS %s did not present a certificate to check against the pinned identity", peerRole)
+		}
+		peerPin := PinOf(state.PeerCertificates[0])
+		for _, pin := range pins {
+			if pin == peerPin {
+				return nil
+			}
+		}
+		return errs.New("TLS %s certificate key: %s does not match any pinned identity", peerRole, peerPin)
+	}
+}
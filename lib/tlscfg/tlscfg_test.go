@@ -0,0 +1,148 @@
+package tlscfg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert              *x509.Certificate
+	key               *ecdsa.PrivateKey
+	certFile, keyFile string
+}
+
+func mustMakeCert(t *testing.T, dir, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	ioutil.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	return result
+}
+
+//handshake connects a client and server over loopback and returns each side's result
+func handshake(t *testing.T, clientOpts, serverOpts Options) (clientErr, serverErr error) {
+	serverCfg, err := ServerConfig(serverOpts)
+	if err != nil {
+		t.Fatalf("ServerConfig returned: %s", err)
+	}
+	clientCfg, err := ClientConfig(clientOpts)
+	if err != nil {
+		t.Fatalf("ClientConfig returned: %s", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverErrCh := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer conn.Close()
+		serverErrCh <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(conn, clientCfg)
+	clientErr = tlsConn.Handshake()
+	if clientErr == nil {
+		//TLS 1.3 client handshakes complete before the server verifies us
+		tlsConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, clientErr = tlsConn.Read(make([]byte, 1))
+		if netErr, ok := clientErr.(net.Error); clientErr == io.EOF || ok && netErr.Timeout() {
+			clientErr = nil
+		}
+	}
+	tlsConn.Close()
+	return clientErr, <-serverErrCh
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlscfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := mustMakeCert(t, dir, "ca", true, nil)
+	server := mustMakeCert(t, dir, "thawhost", false, ca)
+	client := mustMakeCert(t, dir, "frezhost", false, ca)
+	rogue := mustMakeCert(t, dir, "rogue", false, nil)
+
+	serverOpts := Options{CertFile: server.certFile, KeyFile: server.keyFile, CAFile: ca.certFile}
+	clientOpts := Options{CertFile: client.certFile, KeyFile: client.keyFile, CAFile: ca.certFile, ServerName: "thawhost"}
+
+	//CA verified on both sides
+	if clientErr, serverErr := handshake(t, clientOpts, serverOpts); clientErr != nil || serverErr != nil {
+		t.Fatalf("Mutual TLS failed; client: %v, server: %v", clientErr, serverErr)
+	}
+	//Client certificate signed by another authority
+	rogueOpts := clientOpts
+	rogueOpts.CertFile, rogueOpts.KeyFile = rogue.certFile, rogue.keyFile
+	if _, serverErr := handshake(t, rogueOpts, serverOpts); serverErr == nil {
+		t.Fatalf("Server accepted a client certificate not signed by its CA")
+	}
+	//Server pinned without a CA
+	pinOpts := Options{CertFile: client.certFile, KeyFile: client.keyFile, Pins: ParsePins(" " + PinOf(server.cert) + ", ")}
+	if clientErr, serverErr := handshake(t, pinOpts, serverOpts); clientErr != nil || serverErr != nil {
+		t.Fatalf("Pinned TLS failed; client: %v, server: %v", clientErr, serverErr)
+	}
+	//Server pinned to a different identity
+	pinOpts.Pins = []string{PinOf(rogue.cert)}
+	if clientErr, _ := handshake(t, pinOpts, serverOpts); clientErr == nil {
+		t.Fatalf("Client accepted a server that did not match its pin")
+	}
+	//Client pinned by server
+	pinnedServerOpts := Options{CertFile: server.certFile, KeyFile: server.keyFile, Pins: []string{PinOf(client.cert)}}
+	if _, serverErr := handshake(t, rogueOpts, pinnedServerOpts); serverErr == nil {
+		t.Fatalf("Server accepted a client that did not match its pin")
+	}
+}
@@ -0,0 +1,142 @@
+package transpenc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+
+	"github.com/tarndt/errs"
+)
+
+const (
+	ChecksumCRC32C = "CRC32C"
+
+	//defaultChecksumChunkSize is how much data each checksum covers
+	defaultChecksumChunkSize = 64 * 1024
+	//maxChecksumChunkSize bounds the chunk buffer a decoder will allocate
+	maxChecksumChunkSize = 16 * 1024 * 1024
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//ChecksumParams are the parameters of the CRC32C codec
+type ChecksumParams struct {
+	ChunkSize int
+}
+
+//The CRC32C codec detects corruption that neither compression nor the legacy
+// ciphers would. The stream is a sequence of chunks each holding its length
+// (uint32), data and the CRC32C of that data (uint32), and ends with an empty
+// chunk so truncation is detected too.
+func init() {
+	RegisterCodec(ChecksumCRC32C, Codec{Kind: CodecIntegrity, NewEncoder: newChecksumEncoder, NewDecoder: newChecksumDecoder})
+}
+
+type checksumWriter struct {
+	dst io.Writer
+	buf []byte
+}
+
+func newChecksumEncoder(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	params, err := json.Marshal(ChecksumParams{ChunkSize: defaultChecksumChunkSize})
+	if err != nil {
+		return nil, nil, errs.Append(err, "Could not marshal checksum parameters")
+	}
+	return &checksumWriter{dst: dst, buf: make([]byte, 0, defaultChecksumChunkSize)}, params, nil
+}
+
+func (this *checksumWriter) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		n := copy(this.buf[len(this.buf):cap(this.buf)], buf)
+		this.buf = this.buf[:len(this.buf)+n]
+		buf, written = buf[n:], written+n
+		if len(this.buf) == cap(this.buf) {
+			if err := this.flushChunk(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+//Close writes the buffered data and the closing empty chunk
+func (this *checksumWriter) Close() error {
+	if len(this.buf) > 0 {
+		if err := this.flushChunk(); err != nil {
+			return err
+		}
+	}
+	return this.flushChunk()
+}
+
+func (this *checksumWriter) flushChunk() error {
+	var header, trailer [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(this.buf)))
+	binary.LittleEndian.PutUint32(trailer[:], crc32.Checksum(this.buf, castagnoli))
+	for _, part := range [][]byte{header[:], this.buf, trailer[:]} {
+		if _, err := this.dst.Write(part); err != nil {
+			return errs.Append(err, "Could not write checksummed chunk")
+		}
+	}
+	this.buf = this.buf[:0]
+	return nil
+}
+
+type checksumReader struct {
+	src       *bufio.Reader
+	buf, left []byte
+	done      bool
+}
+
+func newChecksumDecoder(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+	var params ChecksumParams
+	if err := unmarshalParams(rawParams, &params); err != nil {
+		return nil, errs.Append(err, "Could not unmarshal checksum parameters")
+	} else if params.ChunkSize < 1 || params.ChunkSize > maxChecksumChunkSize {
+		return nil, errs.New("Checksum chunk size: %d is not between 1 and %d bytes", params.ChunkSize, maxChecksumChunkSize)
+	}
+	return &checksumReader{src: bufio.NewReader(src), buf: make([]byte, params.ChunkSize)}, nil
+}
+
+func (this *checksumReader) Read(buf []byte) (int, error) {
+	for len(this.left) == 0 {
+		if this.done {
+			return 0, io.EOF
+		} else if err := this.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, this.left)
+	this.left = this.left[n:]
+	return n, nil
+}
+
+func (this *checksumReader) readChunk() error {
+	var length, checksum uint32
+	if err := binary.Read(this.src, binary.LittleEndian, &length); err != nil {
+		return errs.Append(noEOF(err), "Could not read checksummed chunk length")
+	} else if int(length) > len(this.buf) {
+		return errs.New("Checksummed chunk of: %d bytes exceeds the chunk size of: %d bytes", length, len(this.buf))
+	}
+	chunk := this.buf[:length]
+	if _, err := io.ReadFull(this.src, chunk); err != nil {
+		return errs.Append(noEOF(err), "Could not read checksummed chunk")
+	} else if err = binary.Read(this.src, binary.LittleEndian, &checksum); err != nil {
+		return errs.Append(noEOF(err), "Could not read chunk checksum")
+	} else if actual := crc32.Checksum(chunk, castagnoli); actual != checksum {
+		return errs.New("Chunk checksum mismatch, stream is corrupt (expected: %08x, actual: %08x)", checksum, actual)
+	}
+	this.left, this.done = chunk, length == 0
+	return nil
+}
+
+//noEOF reports a stream ending before its closing chunk as truncated
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,289 @@
+package transpenc
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tarndt/errs"
+)
+
+//CodecKind is what a codec does to a stream, so tools can tell which codecs may
+// be used where they ask for a compression algorithm or a cipher
+type CodecKind int
+
+const (
+	CodecCompression CodecKind = iota
+	CodecEncryption
+	CodecIntegrity
+)
+
+func (this CodecKind) String() string {
+	switch this {
+	case CodecCompression:
+		return "compression"
+	case CodecEncryption:
+		return "encryption"
+	case CodecIntegrity:
+		return "integrity"
+	}
+	return "unknown"
+}
+
+//EncodeOptions are the settings a stream is encoded with, codecs use the ones
+// that apply to them
+type EncodeOptions struct {
+	Level      int    //Compression level, 0 for the algorithm's default
+	DictPath   string //Path of a compression dictionary, recorded by name
+	KeyPath    string //Path of a key file, recorded by name
+	SessionKey []byte //Key negotiated by a peer handshake, used instead of KeyPath
+}
+
+//DecodeOptions locate what decoding needs beyond the recorded parameters
+type DecodeOptions struct {
+	DictDir    string //Directory of the compression dictionaries streams name
+	KeyDir     string //Directory of the key files streams name
+	SessionKey []byte //Key negotiated by a peer handshake, if one was performed
+}
+
+//Codec is a stream transform, such as a compression algorithm or a cipher. The
+// encoder returns the parameters its decoder needs, which are recorded with the
+// stream. Closing an encoder flushes it without closing the writer it wraps.
+type Codec struct {
+	Kind       CodecKind
+	NewEncoder func(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error)
+	NewDecoder func(src io.Reader, params json.RawMessage, opts DecodeOptions) (io.Reader, error)
+}
+
+type namedCodec struct {
+	name string
+	Codec
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[string]namedCodec) //By lower case name
+)
+
+//RegisterCodec makes codec available under name, which is matched ignoring case.
+// Like database/sql drivers, codecs register themselves in init functions, and
+// registering a name twice or a codec missing a constructor panics.
+func RegisterCodec(name string, codec Codec) {
+	if name == "" || strings.EqualFold(name, "none") {
+		panic("transpenc: Invalid codec name: " + name)
+	} else if codec.NewEncoder == nil || codec.NewDecoder == nil {
+		panic("transpenc: Codec " + name + " must have both an encoder and a decoder")
+	}
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	key := strings.ToLower(name)
+	if _, dup := codecs[key]; dup {
+		panic("transpenc: Codec " + name + " registered twice")
+	}
+	codecs[key] = namedCodec{name: name, Codec: codec}
+}
+
+//LookupCodec returns the codec registered as name (ignoring case) and the name it
+// was registered with
+func LookupCodec(name string) (Codec, string, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, found := codecs[strings.ToLower(name)]
+	return codec.Codec, codec.name, found
+}
+
+//Codecs returns the sorted names of the registered codecs of kind
+func Codecs(kind CodecKind) []string {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	var names []string
+	for _, codec := range codecs {
+		if codec.Kind == kind {
+			names = append(names, codec.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Transform records a codec a stream was encoded with, and its parameters
+type Transform struct {
+	Codec  string
+	Params json.RawMessage `json:",omitempty"`
+}
+
+//Step is a codec to encode a stream with and its settings
+type Step struct {
+	Codec string
+	Opts  EncodeOptions
+}
+
+//NewEncoder returns a writer applying steps in order (compressing before
+// encrypting for example) to what is written to it before it reaches dst, and
+// records them in transpEnc. Steps naming no codec ("" or "none") are skipped.
+// Closing the writer flushes every step, but does not close dst.
+func NewEncoder(dst io.Writer, steps []Step, transpEnc *TranportEncoding) (io.WriteCloser, error) {
+	var (
+		codecs []namedCodec
+		opts   []EncodeOptions
+	)
+	for _, step := range steps {
+		if step.Codec == "" || strings.EqualFold(step.Codec, "none") {
+			continue
+		}
+		codec, name, found := LookupCodec(step.Codec)
+		if !found {
+			return nil, errs.New("Unknown codec: %q", step.Codec)
+		}
+		codecs = append(codecs, namedCodec{name: name, Codec: codec})
+		opts = append(opts, step.Opts)
+	}
+
+	//The last step applied is the first to see dst
+	transforms := make([]Transform, len(codecs))
+	chain := &chainWriter{Writer: dst, wtrs: make([]io.WriteCloser, len(codecs))}
+	for i := len(codecs) - 1; i >= 0; i-- {
+		wtr, params, err := codecs[i].NewEncoder(chain.Writer, opts[i])
+		if err != nil {
+			chain.wtrs = chain.wtrs[i+1:]
+			chain.Close()
+			return nil, errs.Append(err, "Could not create %s encoder", codecs[i].name)
+		}
+		transforms[i] = Transform{Codec: codecs[i].name, Params: params}
+		chain.Writer, chain.wtrs[i] = wtr, wtr
+	}
+	transpEnc.Transforms = transforms
+	if err := transpEnc.recordLegacy(); err != nil {
+		chain.Close()
+		return nil, err
+	}
+	return chain, nil
+}
+
+//chainWriter writes to the encoder of the first step
+type chainWriter struct {
+	io.Writer
+	wtrs []io.WriteCloser //In the order the steps apply
+}
+
+//Close flushes each step into the next
+func (this *chainWriter) Close() error {
+	var err error
+	for _, wtr := range this.wtrs {
+		if closeErr := wtr.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+//NewDecoder returns a reader of the stream src, which was encoded as transpEnc
+// records
+func NewDecoder(src io.Reader, transpEnc TranportEncoding, opts DecodeOptions) (io.Reader, error) {
+	transforms, err := transpEnc.Chain()
+	if err != nil {
+		return nil, err
+	}
+	var encrypted bool
+	codecs := make([]Codec, len(transforms))
+	for i, transform := range transforms {
+		codec, _, found := LookupCodec(transform.Codec)
+		if !found {
+			return nil, errs.New("Stream was encoded with: %q which is not a registered codec", transform.Codec)
+		}
+		codecs[i] = codec
+		encrypted = encrypted || codec.Kind == CodecEncryption
+	}
+	if opts.SessionKey != nil && !encrypted {
+		return nil, errs.New("Source was authenticated but its stream is not protected by the negotiated session key")
+	}
+
+	//The last step applied is the first to be undone
+	for i := len(codecs) - 1; i >= 0; i-- {
+		if src, err = codecs[i].NewDecoder(src, transforms[i].Params, opts); err != nil {
+			return nil, errs.Append(err, "Could not create %s decoder", transforms[i].Codec)
+		}
+	}
+	return src, nil
+}
+
+//Chain returns the transforms the stream was encoded with, in the order they
+// were applied. Streams written before transforms were recorded were compressed
+// and then encrypted as CompressAlgo and EncParams describe.
+func (this TranportEncoding) Chain() ([]Transform, error) {
+	if this.Transforms != nil {
+		return this.Transforms, nil
+	}
+	var transforms []Transform
+	if algo := this.CompressAlgo; algo != "" && algo != "none" {
+		params, err := json.Marshal(CompressParams{Level: this.CompressLevel, Dict: this.CompressDict})
+		if err != nil {
+			return nil, errs.Append(err, "Could not marshal compression parameters")
+		}
+		transforms = append(transforms, Transform{Codec: algo, Params: params})
+	} else if this.CompressDict != "" {
+		return nil, errs.New("Stream names a compression dictionary but was not compressed")
+	}
+	if algo := this.EncParams.EncryptAlgo; algo != "" && algo != "none" {
+		params, err := json.Marshal(this.EncParams)
+		if err != nil {
+			return nil, errs.Append(err, "Could not marshal encryption parameters")
+		}
+		transforms = append(transforms, Transform{Codec: algo, Params: params})
+	} else if this.EncParams.KeyName == SessionKeyName {
+		return nil, errs.New("Stream names the session key but was not encrypted")
+	}
+	return transforms, nil
+}
+
+//legacyRefused is recorded as the compression and encryption of streams older
+// releases can not decode, which they refuse as unknown
+const legacyRefused = "transforms"
+
+//recordLegacy also records the built in compression and encryption of the
+// transforms in CompressAlgo and EncParams, which releases predating transform
+// chains decode streams with. Chains other than built in compression followed
+// by built in encryption (either optional) are recorded as legacyRefused.
+func (this *TranportEncoding) recordLegacy() error {
+	this.CompressAlgo, this.CompressLevel, this.CompressDict = "none", 0, ""
+	this.EncParams = EncryptionParams{EncryptAlgo: "none"}
+	transforms := this.Transforms
+	if len(transforms) > 0 && isBuiltinCompression(transforms[0].Codec) {
+		var params CompressParams
+		if err := unmarshalParams(transforms[0].Params, &params); err != nil {
+			return errs.Append(err, "Could not record %s parameters", transforms[0].Codec)
+		}
+		this.CompressAlgo, this.CompressLevel, this.CompressDict = transforms[0].Codec, params.Level, params.Dict
+		transforms = transforms[1:]
+	}
+	if len(transforms) > 0 && isBuiltinEncryption(transforms[0].Codec) {
+		if err := unmarshalParams(transforms[0].Params, &this.EncParams); err != nil {
+			return errs.Append(err, "Could not record %s parameters", transforms[0].Codec)
+		}
+		transforms = transforms[1:]
+	}
+	if len(transforms) > 0 {
+		this.CompressAlgo, this.CompressLevel, this.CompressDict = legacyRefused, 0, ""
+		this.EncParams = EncryptionParams{EncryptAlgo: legacyRefused}
+	}
+	return nil
+}
+
+//checkFileName verifies name, taken from a stream, names a file within the
+// directory it is looked up in
+func checkFileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return errs.New("%q is not a file name", name)
+	}
+	return nil
+}
+
+//unmarshalParams treats absent parameters as the zero value of params
+func unmarshalParams(raw json.RawMessage, params interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, params)
+}
@@ -0,0 +1,247 @@
+package transpenc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func testPayload() []byte {
+	payload := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(payload[:len(payload)/2]) //Half random, half zeros
+	return payload
+}
+
+//encode writes payload through steps with its transport encoding ahead of it,
+// as a destination stream is written
+func encode(t *testing.T, payload []byte, steps ...Step) []byte {
+	var (
+		transpEnc TranportEncoding
+		encoded   bytes.Buffer
+	)
+	wtr, err := NewEncoder(&encoded, steps, &transpEnc)
+	if err != nil {
+		t.Fatalf("Could not create encoder of: %+v; Details: %s", steps, err)
+	}
+	if _, err = wtr.Write(payload); err != nil {
+		t.Fatalf("Could not encode with: %+v; Details: %s", steps, err)
+	} else if err = wtr.Close(); err != nil {
+		t.Fatalf("Could not finish encoding with: %+v; Details: %s", steps, err)
+	}
+	stream := new(bytes.Buffer)
+	if err = transpEnc.Write(stream); err != nil {
+		t.Fatalf("Could not write transport encoding; Details: %s", err)
+	}
+	stream.Write(encoded.Bytes())
+	return stream.Bytes()
+}
+
+func decode(stream []byte, opts DecodeOptions) ([]byte, TranportEncoding, error) {
+	var transpEnc TranportEncoding
+	rdr := bytes.NewReader(stream)
+	if err := ReadTranportEncoding(rdr, &transpEnc); err != nil {
+		return nil, transpEnc, err
+	}
+	decoder, err := NewDecoder(rdr, transpEnc, opts)
+	if err != nil {
+		return nil, transpEnc, err
+	}
+	decoded, err := ioutil.ReadAll(decoder)
+	return decoded, transpEnc, err
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	keyDir := t.TempDir()
+	keyPath := filepath.Join(keyDir, "test.key")
+	if err := ioutil.WriteFile(keyPath, bytes.Repeat([]byte{7}, 32), 0600); err != nil {
+		t.Fatalf("Could not write key file; Details: %s", err)
+	}
+	payload := testPayload()
+
+	for _, compress := range []string{"none", "gzip", "flate", "snappy", "lz4"} {
+		for _, encrypt := range []string{"none", EncryptAESGCM, EncryptChaCha20Poly1305, EncryptAESCTR} {
+			for _, checksum := range []string{"none", ChecksumCRC32C} {
+				stream := encode(t, payload,
+					Step{Codec: compress},
+					Step{Codec: encrypt, Opts: EncodeOptions{KeyPath: keyPath}},
+					Step{Codec: checksum})
+				decoded, transpEnc, err := decode(stream, DecodeOptions{KeyDir: keyDir})
+				if err != nil {
+					t.Fatalf("Could not decode %s→%s→%s; Details: %s", compress, encrypt, checksum, err)
+				} else if !bytes.Equal(decoded, payload) {
+					t.Fatalf("Decoded %s→%s→%s stream did not match what was encoded", compress, encrypt, checksum)
+				}
+				legacyCompress, legacyEncrypt := compress, encrypt
+				if checksum != "none" { //Older releases can not undo the checksum
+					legacyCompress, legacyEncrypt = legacyRefused, legacyRefused
+				}
+				if transpEnc.CompressAlgo != legacyCompress || transpEnc.EncParams.EncryptAlgo != legacyEncrypt {
+					t.Fatalf("Legacy fields: %s & %s were recorded for %s→%s→%s", transpEnc.CompressAlgo, transpEnc.EncParams.EncryptAlgo, compress, encrypt, checksum)
+				}
+			}
+		}
+	}
+}
+
+//TestLegacyChain decodes streams whose transport encoding predates transform
+// chains
+func TestLegacyChain(t *testing.T) {
+	keyDir := t.TempDir()
+	keyPath := filepath.Join(keyDir, "legacy.key")
+	if err := ioutil.WriteFile(keyPath, bytes.Repeat([]byte{3}, 32), 0600); err != nil {
+		t.Fatalf("Could not write key file; Details: %s", err)
+	}
+	payload := testPayload()
+	stream := encode(t, payload, Step{Codec: "gzip", Opts: EncodeOptions{Level: 9}}, Step{Codec: EncryptAESGCM, Opts: EncodeOptions{KeyPath: keyPath}})
+
+	//Rewrite the transport encoding without its transforms
+	var transpEnc TranportEncoding
+	rdr := bytes.NewReader(stream)
+	if err := ReadTranportEncoding(rdr, &transpEnc); err != nil {
+		t.Fatalf("Could not read transport encoding; Details: %s", err)
+	}
+	transpEnc.Transforms = nil
+	legacy := new(bytes.Buffer)
+	transpEnc.Write(legacy)
+	io.Copy(legacy, rdr)
+	if bytes.Contains(legacy.Bytes()[:bytes.IndexByte(legacy.Bytes(), '}')], []byte("Transforms")) {
+		t.Fatalf("Transforms were not removed from the transport encoding")
+	}
+
+	decoded, _, err := decode(legacy.Bytes(), DecodeOptions{KeyDir: keyDir})
+	if err != nil {
+		t.Fatalf("Could not decode legacy stream; Details: %s", err)
+	} else if !bytes.Equal(decoded, payload) {
+		t.Fatalf("Decoded legacy stream did not match what was encoded")
+	}
+}
+
+//TestLegacyRefused checks streams older releases can not decode are recorded as
+// such, rather than as the built in codecs they contain
+func TestLegacyRefused(t *testing.T) {
+	keyDir := t.TempDir()
+	keyPath := filepath.Join(keyDir, "test.key")
+	if err := ioutil.WriteFile(keyPath, bytes.Repeat([]byte{5}, 32), 0600); err != nil {
+		t.Fatalf("Could not write key file; Details: %s", err)
+	}
+	payload := testPayload()
+	stream := encode(t, payload, Step{Codec: EncryptAESGCM, Opts: EncodeOptions{KeyPath: keyPath}}, Step{Codec: "gzip"})
+	decoded, transpEnc, err := decode(stream, DecodeOptions{KeyDir: keyDir})
+	if err != nil {
+		t.Fatalf("Could not decode encrypted then compressed stream; Details: %s", err)
+	} else if !bytes.Equal(decoded, payload) {
+		t.Fatalf("Decoded encrypted then compressed stream did not match what was encoded")
+	}
+	if transpEnc.CompressAlgo != legacyRefused || transpEnc.EncParams.EncryptAlgo != legacyRefused {
+		t.Fatalf("Legacy fields: %s & %s were recorded for an encrypted then compressed stream", transpEnc.CompressAlgo, transpEnc.EncParams.EncryptAlgo)
+	}
+}
+
+func TestChecksumDetectsCorruption(t *testing.T) {
+	payload := testPayload()
+	stream := encode(t, payload, Step{Codec: "lz4"}, Step{Codec: ChecksumCRC32C})
+
+	corrupt := append([]byte(nil), stream...)
+	corrupt[len(corrupt)/2] ^= 0x10
+	if _, _, err := decode(corrupt, DecodeOptions{}); err == nil {
+		t.Fatalf("Corrupt stream was decoded")
+	}
+	if _, _, err := decode(stream[:len(stream)-8], DecodeOptions{}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Truncated stream returned: %v, expected an unexpected EOF", err)
+	}
+}
+
+func TestDecodeRequiresSessionKey(t *testing.T) {
+	stream := encode(t, testPayload(), Step{Codec: "snappy"})
+	if _, _, err := decode(stream, DecodeOptions{SessionKey: bytes.Repeat([]byte{1}, 32)}); err == nil {
+		t.Fatalf("Stream without encryption was accepted from an authenticated source")
+	}
+
+	sessionKey := bytes.Repeat([]byte{9}, 32)
+	stream = encode(t, testPayload(), Step{Codec: EncryptChaCha20Poly1305, Opts: EncodeOptions{SessionKey: sessionKey}})
+	if _, _, err := decode(stream, DecodeOptions{}); err == nil {
+		t.Fatalf("Stream protected by a session key was decoded without one")
+	} else if _, _, err = decode(stream, DecodeOptions{SessionKey: sessionKey}); err != nil {
+		t.Fatalf("Could not decode stream protected by a session key; Details: %s", err)
+	}
+}
+
+//xorCodec stands in for a codec registered by a third party
+type xorParams struct{ Mask byte }
+
+type xorWriter struct {
+	dst  io.Writer
+	mask byte
+}
+
+func (this xorWriter) Write(buf []byte) (int, error) {
+	masked := make([]byte, len(buf))
+	for i, b := range buf {
+		masked[i] = b ^ this.mask
+	}
+	return this.dst.Write(masked)
+}
+
+func (this xorWriter) Close() error { return nil }
+
+type xorReader struct {
+	src  io.Reader
+	mask byte
+}
+
+func (this xorReader) Read(buf []byte) (int, error) {
+	n, err := this.src.Read(buf)
+	for i := range buf[:n] {
+		buf[i] ^= this.mask
+	}
+	return n, err
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec("test-xor", Codec{
+		Kind: CodecIntegrity,
+		NewEncoder: func(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+			params, err := json.Marshal(xorParams{Mask: byte(opts.Level)})
+			return xorWriter{dst: dst, mask: byte(opts.Level)}, params, err
+		},
+		NewDecoder: func(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+			var params xorParams
+			err := json.Unmarshal(rawParams, &params)
+			return xorReader{src: src, mask: params.Mask}, err
+		},
+	})
+	if _, name, found := LookupCodec("TEST-XOR"); !found || name != "test-xor" {
+		t.Fatalf("Registered codec was not found ignoring case (found: %t, name: %q)", found, name)
+	}
+	integrity := Codecs(CodecIntegrity)
+	if len(integrity) != 2 || integrity[0] != ChecksumCRC32C || integrity[1] != "test-xor" {
+		t.Fatalf("Integrity codecs: %v, expected CRC32C and test-xor", integrity)
+	}
+
+	payload := testPayload()
+	stream := encode(t, payload, Step{Codec: "flate"}, Step{Codec: "test-xor", Opts: EncodeOptions{Level: 0x5a}}, Step{Codec: ChecksumCRC32C})
+	decoded, transpEnc, err := decode(stream, DecodeOptions{})
+	if err != nil {
+		t.Fatalf("Could not decode stream with a registered codec; Details: %s", err)
+	} else if !bytes.Equal(decoded, payload) {
+		t.Fatalf("Decoded stream with a registered codec did not match what was encoded")
+	}
+	chain := []string{"flate", "test-xor", ChecksumCRC32C}
+	for i, transform := range transpEnc.Transforms {
+		if i >= len(chain) || transform.Codec != chain[i] {
+			t.Fatalf("Recorded transforms: %+v, expected: %v", transpEnc.Transforms, chain)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Registering a codec twice did not panic")
+		}
+	}()
+	RegisterCodec("Test-Xor", Codec{NewEncoder: newChecksumEncoder, NewDecoder: newChecksumDecoder})
+}
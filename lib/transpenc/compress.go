@@ -0,0 +1,196 @@
+package transpenc
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/tarndt/errs"
+)
+
+//CompressParams are the parameters of the built in compression codecs. Level is
+// 0 for the algorithm's default and Dict names the zstd dictionary, if any, the
+// stream was compressed with.
+type CompressParams struct {
+	Level int    `json:",omitempty"`
+	Dict  string `json:",omitempty"`
+}
+
+var lz4Levels = []lz4.CompressionLevel{lz4.Fast,
+	lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+
+func init() {
+	RegisterCodec("gzip", Codec{Kind: CodecCompression, NewEncoder: newGzipEncoder, NewDecoder: newGzipDecoder})
+	RegisterCodec("flate", Codec{Kind: CodecCompression, NewEncoder: newFlateEncoder, NewDecoder: newFlateDecoder})
+	RegisterCodec("snappy", Codec{Kind: CodecCompression, NewEncoder: newSnappyEncoder, NewDecoder: newSnappyDecoder})
+	RegisterCodec("zstd", Codec{Kind: CodecCompression, NewEncoder: newZstdEncoder, NewDecoder: newZstdDecoder})
+	RegisterCodec("lz4", Codec{Kind: CodecCompression, NewEncoder: newLz4Encoder, NewDecoder: newLz4Decoder})
+}
+
+func isBuiltinCompression(codec string) bool {
+	switch codec {
+	case "gzip", "flate", "snappy", "zstd", "lz4":
+		return true
+	}
+	return false
+}
+
+//compressParams records the level of opts, only zstd supports dictionaries
+func compressParams(opts EncodeOptions, allowDict bool) (json.RawMessage, error) {
+	params := CompressParams{Level: opts.Level}
+	if opts.DictPath != "" {
+		if !allowDict {
+			return nil, errs.New("Compression dictionaries are only supported by zstd")
+		}
+		params.Dict = filepath.Base(opts.DictPath)
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, errs.Append(err, "Could not marshal compression parameters")
+	}
+	return rawParams, nil
+}
+
+func readCompressParams(rawParams json.RawMessage, allowDict bool) (CompressParams, error) {
+	var params CompressParams
+	if err := unmarshalParams(rawParams, &params); err != nil {
+		return params, errs.Append(err, "Could not unmarshal compression parameters")
+	} else if params.Dict != "" && !allowDict {
+		return params, errs.New("Compression dictionaries are only supported by zstd")
+	}
+	return params, nil
+}
+
+func newGzipEncoder(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	params, err := compressParams(opts, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Level == 0 {
+		return gzip.NewWriter(dst), params, nil
+	}
+	gzipWtr, err := gzip.NewWriterLevel(dst, opts.Level)
+	return gzipWtr, params, err
+}
+
+func newGzipDecoder(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+	if _, err := readCompressParams(rawParams, false); err != nil {
+		return nil, err
+	}
+	return gzip.NewReader(src)
+}
+
+func newFlateEncoder(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	params, err := compressParams(opts, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	level := opts.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	flateWtr, err := flate.NewWriter(dst, level)
+	return flateWtr, params, err
+}
+
+func newFlateDecoder(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+	if _, err := readCompressParams(rawParams, false); err != nil {
+		return nil, err
+	}
+	return flate.NewReader(src), nil
+}
+
+type noopWtrCloser struct {
+	io.Writer
+}
+
+func (this noopWtrCloser) Close() error { return nil }
+
+func newSnappyEncoder(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	params, err := compressParams(opts, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return noopWtrCloser{snappy.NewWriter(dst)}, params, nil
+}
+
+func newSnappyDecoder(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+	if _, err := readCompressParams(rawParams, false); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(snappy.NewReader(src)), nil
+}
+
+//newZstdEncoder compresses with the dictionary at opts.DictPath if set, which
+// the decoder must find by name in its dictionary directory
+func newZstdEncoder(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	params, err := compressParams(opts, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	zstdOpts := []zstd.EOption{}
+	if opts.Level != 0 {
+		zstdOpts = append(zstdOpts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+	if opts.DictPath != "" {
+		dict, err := ioutil.ReadFile(opts.DictPath)
+		if err != nil {
+			return nil, nil, errs.Append(err, "Could not read compression dictionary")
+		}
+		zstdOpts = append(zstdOpts, zstd.WithEncoderDict(dict))
+	}
+	zstdWtr, err := zstd.NewWriter(dst, zstdOpts...)
+	return zstdWtr, params, err
+}
+
+func newZstdDecoder(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+	params, err := readCompressParams(rawParams, true)
+	if err != nil {
+		return nil, err
+	}
+	zstdOpts := []zstd.DOption{}
+	if params.Dict != "" {
+		if err = checkFileName(params.Dict); err != nil {
+			return nil, errs.Append(err, "Invalid compression dictionary name")
+		}
+		dict, err := ioutil.ReadFile(filepath.Join(opts.DictDir, params.Dict))
+		if err != nil {
+			return nil, errs.Append(err, "Could not read compression dictionary")
+		}
+		zstdOpts = append(zstdOpts, zstd.WithDecoderDicts(dict))
+	}
+	zstdRdr, err := zstd.NewReader(src, zstdOpts...)
+	if err != nil {
+		return nil, errs.Append(err, "Could not create zstd decompressor")
+	}
+	return zstdRdr.IOReadCloser(), nil
+}
+
+func newLz4Encoder(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	params, err := compressParams(opts, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Level < 0 || opts.Level >= len(lz4Levels) {
+		return nil, nil, errs.New("lz4 compression level must be between 0 and %d", len(lz4Levels)-1)
+	}
+	lz4Wtr := lz4.NewWriter(dst)
+	if err := lz4Wtr.Apply(lz4.CompressionLevelOption(lz4Levels[opts.Level])); err != nil {
+		return nil, nil, errs.Append(err, "Could not set lz4 compression level")
+	}
+	return lz4Wtr, params, nil
+}
+
+func newLz4Decoder(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+	if _, err := readCompressParams(rawParams, false); err != nil {
+		return nil, err
+	}
+	return lz4.NewReader(src), nil
+}
@@ -0,0 +1,209 @@
+package transpenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/aeadstream"
+)
+
+//maxAEADChunkSize bounds the chunk buffer an AEAD decoder will allocate, as the
+// chunk size is read from the unauthenticated transport encoding
+const maxAEADChunkSize = 16 * 1024 * 1024
+
+func init() {
+	for _, algo := range []string{EncryptAESGCM, EncryptChaCha20Poly1305} {
+		RegisterCodec(algo, Codec{Kind: CodecEncryption, NewEncoder: aeadEncoder(algo), NewDecoder: newAEADDecoder})
+	}
+	RegisterCodec(EncryptAESCFB, Codec{Kind: CodecEncryption,
+		NewEncoder: aesStreamEncoder(EncryptAESCFB, cipher.NewCFBEncrypter), NewDecoder: aesStreamDecoder(cipher.NewCFBDecrypter)})
+	RegisterCodec(EncryptAESCTR, Codec{Kind: CodecEncryption,
+		NewEncoder: aesStreamEncoder(EncryptAESCTR, cipher.NewCTR), NewDecoder: aesStreamDecoder(cipher.NewCTR)})
+	RegisterCodec(EncryptAESOFB, Codec{Kind: CodecEncryption,
+		NewEncoder: aesStreamEncoder(EncryptAESOFB, cipher.NewOFB), NewDecoder: aesStreamDecoder(cipher.NewOFB)})
+}
+
+func isBuiltinEncryption(codec string) bool {
+	switch codec {
+	case EncryptAESGCM, EncryptChaCha20Poly1305, EncryptAESCFB, EncryptAESCTR, EncryptAESOFB:
+		return true
+	}
+	return false
+}
+
+//encryptionKey returns the key to encrypt with: the session key negotiated by a
+// peer handshake if there is one, otherwise the key file at opts.KeyPath
+func encryptionKey(opts EncodeOptions, encParams *EncryptionParams) ([]byte, error) {
+	if opts.SessionKey != nil {
+		if !encParams.IsAuthenticated() {
+			return nil, errs.New("Peer authenticated sessions require AES-GCM or CHACHA20-POLY1305, not: %q", encParams.EncryptAlgo)
+		}
+		encParams.KeyName = SessionKeyName
+		return opts.SessionKey, nil
+	} else if opts.KeyPath == "" {
+		return nil, errs.New("%s encryption requires a key file", encParams.EncryptAlgo)
+	}
+	key, err := ioutil.ReadFile(opts.KeyPath)
+	if err != nil {
+		return nil, errs.Append(err, "Could not read encryption key file")
+	}
+	encParams.KeyName = filepath.Base(opts.KeyPath)
+	return key, nil
+}
+
+//decryptionKey returns the key to decrypt with: the session key negotiated by a
+// peer handshake if there is one, otherwise the key file of the name recorded in
+// encParams found in opts.KeyDir
+func decryptionKey(encParams EncryptionParams, opts DecodeOptions) ([]byte, error) {
+	if opts.SessionKey != nil {
+		if encParams.KeyName != SessionKeyName || !encParams.IsAuthenticated() {
+			return nil, errs.New("Source was authenticated but its stream is not protected by the negotiated session key")
+		}
+		return opts.SessionKey, nil
+	} else if encParams.KeyName == SessionKeyName {
+		return nil, errs.New("Source stream is protected by a session key, but no peer handshake was performed, please specify -identity")
+	}
+	if err := checkFileName(encParams.KeyName); err != nil {
+		return nil, errs.Append(err, "Invalid decryption key file name")
+	}
+	key, err := ioutil.ReadFile(filepath.Join(opts.KeyDir, encParams.KeyName))
+	if err != nil {
+		return nil, errs.Append(err, "Could not read decryption key file")
+	}
+	return key, nil
+}
+
+func marshalEncParams(encParams EncryptionParams) (json.RawMessage, error) {
+	rawParams, err := json.Marshal(encParams)
+	if err != nil {
+		return nil, errs.Append(err, "Could not marshal encryption parameters")
+	}
+	return rawParams, nil
+}
+
+func unmarshalEncParams(rawParams json.RawMessage) (EncryptionParams, error) {
+	var encParams EncryptionParams
+	if err := unmarshalParams(rawParams, &encParams); err != nil {
+		return encParams, errs.Append(err, "Could not unmarshal encryption parameters")
+	}
+	return encParams, nil
+}
+
+func aeadEncoder(algo string) func(io.Writer, EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	return func(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+		encParams := EncryptionParams{EncryptAlgo: algo}
+		key, err := encryptionKey(opts, &encParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		aead, err := aeadstream.NewAEAD(algo, key)
+		if err != nil {
+			return nil, nil, errs.Append(err, "Could not create %s encryptor", algo)
+		}
+
+		noncePrefix := make([]byte, aeadstream.NoncePrefixSize)
+		if _, err = rand.Read(noncePrefix); err != nil {
+			return nil, nil, errs.Append(err, "Could not read entropy source to populate nonce prefix")
+		}
+		encParams.InitVector = hex.EncodeToString(noncePrefix)
+		encParams.ChunkSize = aeadstream.DefaultChunkSize
+
+		rawParams, err := marshalEncParams(encParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		aeadWtr, err := aeadstream.NewWriter(dst, aead, noncePrefix, encParams.ChunkSize)
+		return aeadWtr, rawParams, err
+	}
+}
+
+func newAEADDecoder(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+	encParams, err := unmarshalEncParams(rawParams)
+	if err != nil {
+		return nil, err
+	}
+	if encParams.ChunkSize <= 0 || encParams.ChunkSize > maxAEADChunkSize {
+		return nil, errs.New("Encrypted chunk size: %d is outside of the valid range 1-%d", encParams.ChunkSize, maxAEADChunkSize)
+	}
+	key, err := decryptionKey(encParams, opts)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := aeadstream.NewAEAD(encParams.EncryptAlgo, key)
+	if err != nil {
+		return nil, errs.Append(err, "Could not create %s decryptor", encParams.EncryptAlgo)
+	}
+
+	noncePrefix, err := hex.DecodeString(encParams.InitVector)
+	if err != nil {
+		return nil, errs.Append(err, "Provided nonce prefix could not be hex decoded")
+	}
+	return aeadstream.NewReader(src, aead, noncePrefix, encParams.ChunkSize)
+}
+
+//aesStreamEncoder encrypts with one of the deprecated unauthenticated AES modes
+func aesStreamEncoder(algo string, cipherConstructor func(cipher.Block, []byte) cipher.Stream) func(io.Writer, EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+	return func(dst io.Writer, opts EncodeOptions) (io.WriteCloser, json.RawMessage, error) {
+		encParams := EncryptionParams{EncryptAlgo: algo}
+		key, err := encryptionKey(opts, &encParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		aesEnc, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, nil, errs.Append(err, "Could not create AES encryptor")
+		}
+
+		initVect := make([]byte, aes.BlockSize)
+		if _, err = rand.Read(initVect); err != nil {
+			return nil, nil, errs.Append(err, "Could not read entropy source to populate AES initialization vector")
+		}
+		encParams.InitVector = hex.EncodeToString(initVect)
+
+		rawParams, err := marshalEncParams(encParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cipher.StreamWriter{
+			S: cipherConstructor(aesEnc, initVect),
+			W: noopWtrCloser{dst}, //Sheild our writer from being closed
+		}, rawParams, nil
+	}
+}
+
+func aesStreamDecoder(cipherConstructor func(cipher.Block, []byte) cipher.Stream) func(io.Reader, json.RawMessage, DecodeOptions) (io.Reader, error) {
+	return func(src io.Reader, rawParams json.RawMessage, opts DecodeOptions) (io.Reader, error) {
+		encParams, err := unmarshalEncParams(rawParams)
+		if err != nil {
+			return nil, err
+		}
+		key, err := decryptionKey(encParams, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		aesEnc, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errs.Append(err, "Could not create AES decryptor")
+		}
+
+		initVect, err := hex.DecodeString(encParams.InitVector)
+		if err != nil {
+			return nil, errs.Append(err, "Provided AES initialization vector could not bed hex decoded")
+		} else if len(initVect) != aes.BlockSize {
+			return nil, errs.New("Provided AES initialization vector has: %d bytes, rather than the required: %d bytes.", len(initVect), aes.BlockSize)
+		}
+
+		return cipher.StreamReader{
+			S: cipherConstructor(aesEnc, initVect),
+			R: src,
+		}, nil
+	}
+}
@@ -0,0 +1,43 @@
+package transpenc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/tarndt/errs"
+)
+
+//HTTPHeader carries the transport encoding of streams sent over HTTP, in place
+// of the length prefixed JSON that precedes the stream elsewhere. Its value is
+// the JSON, base64 encoded (URL alphabet, unpadded) as header values must be
+// printable.
+const HTTPHeader = "X-Pmigrate-Transport-Encoding"
+
+//WriteHTTPHeader records the transport encoding in header
+func (this TranportEncoding) WriteHTTPHeader(header http.Header) error {
+	rawBytes, err := json.Marshal(&this)
+	if err != nil {
+		return errs.Append(err, "Could not marshal transport encoding parameters")
+	}
+	header.Set(HTTPHeader, base64.RawURLEncoding.EncodeToString(rawBytes))
+	return nil
+}
+
+//ReadTranportEncodingHeader reads the transport encoding from header, and
+// reports if it was present. Streams without it begin with the encoding, as
+// snapshot files served over HTTP do.
+func ReadTranportEncodingHeader(header http.Header, transpEnc *TranportEncoding) (bool, error) {
+	value := header.Get(HTTPHeader)
+	if value == "" {
+		return false, nil
+	}
+	rawBytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return true, errs.Append(err, "Could not decode transport encoding header")
+	}
+	if err = json.Unmarshal(rawBytes, transpEnc); err != nil {
+		return true, errs.Append(err, "Could not unmarshal transport encoding parameters")
+	}
+	return true, nil
+}
@@ -1,6 +1,7 @@
 package transpenc
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"io"
@@ -8,15 +9,109 @@ import (
 	"lib/errs"
 )
 
+const (
+	EncryptNone             = "none"
+	EncryptAESGCM           = "AES-GCM"
+	EncryptChaCha20Poly1305 = "CHACHA20-POLY1305"
+
+	//Deprecated: the following stream modes are unauthenticated, tampering with
+	// the ciphertext goes undetected. Use AES-GCM or CHACHA20-POLY1305 instead.
+	EncryptAESCFB = "AES-CFB"
+	EncryptAESCTR = "AES-CTR"
+	EncryptAESOFB = "AES-OFB"
+
+	//SessionKeyName is recorded as the KeyName when the key was derived by a
+	// peer handshake (see lib/peerauth) rather than read from a key file
+	SessionKeyName = "@session"
+)
+
+//EncryptionParams describes how a stream was encrypted. For the AEAD modes
+// InitVector holds the hex encoded nonce prefix and ChunkSize the maximum
+// plaintext length of each sealed chunk.
 type EncryptionParams struct {
 	KeyName     string
 	EncryptAlgo string
 	InitVector  string
+	ChunkSize   int `json:",omitempty"`
+}
+
+//IsAuthenticated reports if the stream is protected by an AEAD mode
+func (this EncryptionParams) IsAuthenticated() bool {
+	switch this.EncryptAlgo {
+	case EncryptAESGCM, EncryptChaCha20Poly1305:
+		return true
+	}
+	return false
 }
 
+//IsDeprecated reports if the stream uses one of the legacy unauthenticated modes
+func (this EncryptionParams) IsDeprecated() bool {
+	switch this.EncryptAlgo {
+	case EncryptAESCFB, EncryptAESCTR, EncryptAESOFB:
+		return true
+	}
+	return false
+}
+
+//TranportEncoding describes how the stream following it was encoded.
+// Transforms records the codecs (see RegisterCodec) applied to the stream in
+// order, the built in compression and encryption among them are also recorded
+// in CompressAlgo and EncParams for releases predating transform chains.
+// CompressLevel is 0 for the algorithm's default and CompressDict names the
+// zstd dictionary, if any, the stream was compressed with. Snapshots split over
+// parallel streams share a SessionID, and each stream records its position.
+// Resumable streams are acknowledged by the destination (see lib/resume) and
+// may be reconnected under the same SessionID. When ReportRestore is set every
+// stream ends with an end of spans marker, and the destination reports the
+// progress of the restore over the connection of the first stream (see
+// lib/migration). PageAligned transport encodings are padded to end on a page
+// boundary, so the data of page aligned snapshots stored after them without
+// transforms can be mapped from the file (see pwriter.NewAlignedSnapshotWriter).
 type TranportEncoding struct {
-	CompressAlgo string
-	EncParams    EncryptionParams
+	CompressAlgo  string
+	CompressLevel int    `json:",omitempty"`
+	CompressDict  string `json:",omitempty"`
+	EncParams     EncryptionParams
+	Transforms    []Transform `json:",omitempty"`
+	SessionID     string      `json:",omitempty"`
+	StreamIndex   int         `json:",omitempty"`
+	StreamCount   int         `json:",omitempty"`
+	Resumable     bool        `json:",omitempty"`
+	ReportRestore bool        `json:",omitempty"`
+	PageAligned   bool        `json:",omitempty"`
+}
+
+//alignment is the page size PageAligned transport encodings are padded to
+const alignment = 4096
+
+//DeprecatedEncryption returns the deprecated unauthenticated mode the stream was
+// encrypted with, if any
+func (this TranportEncoding) DeprecatedEncryption() string {
+	transforms, err := this.Chain()
+	if err != nil {
+		return "" //The stream can not be decoded at all
+	}
+	for _, transform := range transforms {
+		if encParams := (EncryptionParams{EncryptAlgo: transform.Codec}); encParams.IsDeprecated() {
+			return transform.Codec
+		}
+	}
+	return ""
+}
+
+//IsAuthenticated reports if the stream is encrypted with an authenticated mode,
+// so its contents can not be altered without detection
+func (this TranportEncoding) IsAuthenticated() bool {
+	transforms, err := this.Chain()
+	if err != nil {
+		return false
+	}
+	for _, transform := range transforms {
+		if encParams := (EncryptionParams{EncryptAlgo: transform.Codec}); encParams.IsAuthenticated() {
+			return true
+		}
+	}
+	return false
 }
 
 func (this TranportEncoding) Write(wtr io.Writer) error {
@@ -24,6 +119,10 @@ func (this TranportEncoding) Write(wtr io.Writer) error {
 	if err != nil {
 		return errs.Append(err, "Could not marshal transport encoding parameters")
 	}
+	if this.PageAligned { //JSON permits trailing white space
+		padLen := (alignment - (4+len(rawBytes))%alignment) % alignment
+		rawBytes = append(rawBytes, bytes.Repeat([]byte{' '}, padLen)...)
+	}
 	if err = binary.Write(wtr, binary.LittleEndian, uint32(len(rawBytes))); err != nil {
 		return errs.Append(err, "Could not write transport encoding length")
 	}
@@ -33,11 +132,27 @@ func (this TranportEncoding) Write(wtr io.Writer) error {
 	return nil
 }
 
+//maxTranportEncodingLen bounds the transport encoding read ahead of a stream,
+// which is typically a few hundred bytes
+const maxTranportEncodingLen = 64 * 1024
+
+//TranportEncodingLen returns the length of the transport encoding at the start
+// of rdr, which is where the stream it precedes begins
+func TranportEncodingLen(rdr io.ReaderAt) (int64, error) {
+	var length [4]byte
+	if _, err := rdr.ReadAt(length[:], 0); err != nil {
+		return 0, errs.Append(err, "Could not read transport encoding length")
+	}
+	return int64(len(length)) + int64(binary.LittleEndian.Uint32(length[:])), nil
+}
+
 func ReadTranportEncoding(rdr io.Reader, transpEnc *TranportEncoding) error {
 	var length uint32
 	err := binary.Read(rdr, binary.LittleEndian, &length)
 	if err != nil {
 		return errs.Append(err, "Could not read transport encoding length")
+	} else if length > maxTranportEncodingLen {
+		return errs.New("Transport encoding of: %d bytes exceeds the limit of %d, the stream is not a snapshot or is corrupt", length, maxTranportEncodingLen)
 	}
 	rawBytes := make([]byte, length)
 	if _, err = io.ReadFull(rdr, rawBytes); err != nil {
@@ -2,16 +2,24 @@ package transpenc
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
 func TestTranportEncoding(t *testing.T) {
 	origEnc := &TranportEncoding{
-		CompressAlgo: "TestCompressAlgo",
+		CompressAlgo:  "TestCompressAlgo",
+		CompressLevel: 7,
+		CompressDict:  "TestCompressDict",
 		EncParams: EncryptionParams{
 			KeyName:     "TestKeyName",
 			EncryptAlgo: "TestEncryptAlgo",
 			InitVector:  "TestInitVector",
+			ChunkSize:   4096,
 		},
 	}
 	encBuf := new(bytes.Buffer)
@@ -21,7 +29,99 @@ func TestTranportEncoding(t *testing.T) {
 	if err := ReadTranportEncoding(bytes.NewReader(encBuf.Bytes()), resultEnc); err != nil {
 		t.Fatalf("Unexepected error while testing TranportEncoding deserialization: %s", err)
 	}
-	if *origEnc != *resultEnc {
+	if !reflect.DeepEqual(origEnc, resultEnc) {
 		t.Fatalf("Deserialized TranportEncoding did not match original TranportEncoding that was serialized!")
 	}
 }
+
+func TestTranportEncodingHeader(t *testing.T) {
+	origEnc := TranportEncoding{
+		CompressAlgo: "zstd",
+		CompressDict: "dict \"name\"\n",
+		EncParams: EncryptionParams{
+			KeyName:     "TestKeyName",
+			EncryptAlgo: EncryptAESGCM,
+			InitVector:  "TestInitVector",
+		},
+		SessionID: "TestSessionID",
+	}
+	header := make(http.Header)
+	if err := origEnc.WriteHTTPHeader(header); err != nil {
+		t.Fatalf("Could not write TranportEncoding header: %s", err)
+	}
+	var resultEnc TranportEncoding
+	if present, err := ReadTranportEncodingHeader(header, &resultEnc); err != nil || !present {
+		t.Fatalf("Could not read TranportEncoding header (present: %t): %v", present, err)
+	} else if !reflect.DeepEqual(resultEnc, origEnc) {
+		t.Fatalf("TranportEncoding read from header: %+v did not match the original: %+v", resultEnc, origEnc)
+	}
+
+	if present, err := ReadTranportEncodingHeader(make(http.Header), &resultEnc); present || err != nil {
+		t.Fatalf("Absent TranportEncoding header was read (present: %t): %v", present, err)
+	}
+	header.Set(HTTPHeader, "not base64!")
+	if _, err := ReadTranportEncodingHeader(header, &resultEnc); err == nil {
+		t.Fatalf("Invalid TranportEncoding header was accepted")
+	}
+}
+
+func TestTranportEncodingUntrusted(t *testing.T) {
+	var transpEnc TranportEncoding
+	oversized := make([]byte, 4)
+	binary.LittleEndian.PutUint32(oversized, maxTranportEncodingLen+1)
+	if err := ReadTranportEncoding(bytes.NewReader(oversized), &transpEnc); err == nil {
+		t.Fatalf("Transport encoding longer than the limit was accepted")
+	}
+
+	for _, keyName := range []string{"../../etc/shadow", "/etc/shadow", "..", ""} {
+		transpEnc = TranportEncoding{EncParams: EncryptionParams{KeyName: keyName, EncryptAlgo: EncryptAESGCM}}
+		if _, err := NewDecoder(bytes.NewReader(nil), transpEnc, DecodeOptions{KeyDir: t.TempDir()}); err == nil {
+			t.Fatalf("Decryption key name: %q outside the key directory was accepted", keyName)
+		}
+	}
+
+	//Chunks are only authenticated once read whole
+	keyDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "k.key"), bytes.Repeat([]byte{1}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunkSize := range []int{0, -1, maxAEADChunkSize + 1, 1<<31 - 65} {
+		transpEnc = TranportEncoding{EncParams: EncryptionParams{KeyName: "k.key", EncryptAlgo: EncryptAESGCM, InitVector: "00000000000000", ChunkSize: chunkSize}}
+		if _, err := NewDecoder(bytes.NewReader(nil), transpEnc, DecodeOptions{KeyDir: keyDir}); err == nil {
+			t.Fatalf("Encrypted chunk size: %d was accepted", chunkSize)
+		}
+	}
+}
+
+func FuzzReadTranportEncoding(f *testing.F) {
+	seed := new(bytes.Buffer)
+	TranportEncoding{CompressAlgo: "gzip", Transforms: []Transform{{Codec: ChecksumCRC32C, Params: []byte(`{"ChunkSize":16}`)}}}.Write(seed)
+	f.Add(seed.Bytes())
+
+	//Streams naming the key reach the AEAD decoder
+	keyDir := f.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "fuzz.key"), bytes.Repeat([]byte{1}, 32), 0600); err != nil {
+		f.Fatal(err)
+	}
+	seed.Reset()
+	encParams := EncryptionParams{KeyName: "fuzz.key", EncryptAlgo: EncryptAESGCM, InitVector: "00000000000000", ChunkSize: 16}
+	TranportEncoding{EncParams: encParams}.Write(seed)
+	seed.Write([]byte{0xff, 0xff, 0xff, 0x7f})
+	f.Add(seed.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var transpEnc TranportEncoding
+		rdr := bytes.NewReader(data)
+		if err := ReadTranportEncoding(rdr, &transpEnc); err != nil {
+			return
+		}
+		if decoder, err := NewDecoder(rdr, transpEnc, DecodeOptions{KeyDir: keyDir}); err == nil {
+			buf := make([]byte, 4096)
+			for i := 0; i < 64; i++ {
+				if _, err = decoder.Read(buf); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate"
+)
+
+//controlTimeout bounds reading a request on the control socket, and waiting to
+// connect to it. Checkpoints themselves may take longer.
+const controlTimeout = 10 * time.Second
+
+//checkpointRequest is sent by pfrez ctl as a single JSON value, it is answered
+// with a single checkpointResponse once the checkpoint is written. Options left
+// empty are those pfrez was started with.
+type checkpointRequest struct {
+	Command       string //checkpoint
+	Dest          string `json:",omitempty"`
+	Compress      string `json:",omitempty"`
+	CompressLevel int    `json:",omitempty"`
+	CompressDict  string `json:",omitempty"`
+	Encrypt       string `json:",omitempty"`
+	Checksum      string `json:",omitempty"`
+	Halt          bool   `json:",omitempty"` //Kill the target once checkpointed
+}
+
+type checkpointResponse struct {
+	Path   string `json:",omitempty"`
+	Frozen string `json:",omitempty"` //How long the target was frozen
+	Error  string `json:",omitempty"`
+}
+
+//watchRequest returns the request for the watcher, options left empty are those
+// it was started with
+func (this checkpointRequest) watchRequest() pmigrate.WatchRequest {
+	return pmigrate.WatchRequest{
+		Dest: pmigrate.Destination{
+			URL:           this.Dest,
+			Compress:      this.Compress,
+			CompressLevel: this.CompressLevel,
+			CompressDict:  this.CompressDict,
+			Encrypt:       this.Encrypt,
+			Checksum:      this.Checksum,
+		},
+		Halt: this.Halt,
+	}
+}
+
+//defaultControlPath is the control socket of pfrez watching pid
+func defaultControlPath(pid int) string {
+	return fmt.Sprintf("/run/pfrez-%d.sock", pid)
+}
+
+//listenControl accepts checkpoint requests for watcher on a unix socket at
+// path, accessible to root only, adding the requests being handled to pending.
+// Closing the returned listener removes the socket.
+func listenControl(path string, watcher *pmigrate.Watcher, pending *sync.WaitGroup) (net.Listener, error) {
+	//A socket left behind by a pfrez that did not exit cleanly is replaced
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, errs.New("Control socket: %s is in use, is another pfrez watching?", path)
+	} else if info, statErr := os.Lstat(path); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errs.Append(err, "Listen: unix/%s failed", path)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, errs.Append(err, "Could not restrict access to control socket: %s", path)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Control socket accept failed; Details:\n\t%s", err)
+				}
+				return
+			}
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				handleControl(conn, watcher)
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+func handleControl(conn net.Conn, watcher *pmigrate.Watcher) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(controlTimeout))
+
+	var (
+		req  checkpointRequest
+		resp checkpointResponse
+	)
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = "Malformed request: " + err.Error()
+	} else if req.Command != "checkpoint" {
+		resp.Error = fmt.Sprintf("Unknown command: %q", req.Command)
+	} else {
+		result, err := watcher.Checkpoint(req.watchRequest())
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Path, resp.Frozen = result.Path, result.Frozen.String()
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		log.Printf("Could not answer control request; Details:\n\t%s", err)
+	}
+}
+
+//getCtlRequest builds the request pfrez ctl sends from its arguments, only
+// options given explicitly override those of the watching pfrez
+func getCtlRequest(args []string, halt bool) (checkpointRequest, error) {
+	if len(args) != 1 || args[0] != "checkpoint" {
+		return checkpointRequest{}, errs.New("Usage: pfrez ctl [-pid PID | -control socketpath] [-dest, -compress, -compress-level, -compress-dict, -encrypt & -halt overrides] checkpoint")
+	}
+	req := checkpointRequest{Command: args[0], Halt: halt}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dest":
+			if dests := *f.Value.(*destFlags); len(dests) != 1 || strings.ContainsRune(dests[0], ';') {
+				err = errs.New("Checkpoint requests take a single -dest without settings, use the -compress, -compress-level, -compress-dict, -encrypt & -checksum overrides")
+				return
+			}
+			//Paths are resolved by the watching pfrez, which may run elsewhere
+			req.Dest, err = pmigrate.AbsDestination(f.Value.String())
+		case "compress":
+			req.Compress = f.Value.String()
+		case "compress-level":
+			req.CompressLevel, err = strconv.Atoi(f.Value.String())
+		case "compress-dict":
+			req.CompressDict = f.Value.String()
+		case "encrypt":
+			req.Encrypt = f.Value.String()
+		case "checksum":
+			req.Checksum = f.Value.String()
+		}
+	})
+	return req, err
+}
+
+//runCtl sends req to the pfrez watching on the control socket at path, waits
+// for the checkpoint to be written and prints where
+func runCtl(path string, req checkpointRequest) error {
+	if path == "" {
+		return errs.New("pfrez ctl requires the -pid of the watched process or its -control socket")
+	}
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return errs.Append(err, "Could not connect to control socket: %s", path)
+	}
+	defer conn.Close()
+
+	var resp checkpointResponse
+	if err = json.NewEncoder(conn).Encode(&req); err != nil {
+		return errs.Append(err, "Could not send control request")
+	}
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return errs.Append(err, "Could not read control response")
+	}
+	if resp.Error != "" {
+		return errs.New("%s", resp.Error)
+	}
+	fmt.Printf("Wrote checkpoint %s (target frozen for %s)\n", resp.Path, resp.Frozen)
+	return nil
+}
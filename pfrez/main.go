@@ -1,37 +1,185 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/tarndt/pmigrate/lib"
-	"github.com/tarndt/pmigrate/lib/iotimeout"
+	"github.com/tarndt/pmigrate"
 	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/progress"
 	"github.com/tarndt/pmigrate/lib/pwriter"
-	"github.com/tarndt/pmigrate/lib/transpenc"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
 )
 
 func main() {
 	var (
-		PID                       int
-		dest, compress, encrypt   string
+		PID, compressLevel        int
+		streamCount, keep         int
+		compressDict, trainDict   string
+		compress, encrypt         string
+		checksum                  string
+		identity, knownHosts      string
+		controlPath               string
+		parent, keyDir, dictDir   string
+		tlsCert, tlsKey, tlsCA    string
+		tlsPins, tlsServerName    string
+		httpMethod, httpToken     string
+		progressFmt, rateLimit    string
 		dialTimeout, writeTimeout time.Duration
-		halt, debug               bool
+		resumeTimeout             time.Duration
+		restoreTimeout, interval  time.Duration
+		halt, debug, watch, dedup bool
+		pageAlign                 bool
+		destValues                destFlags
 	)
+
+	//Subcommands: ctl requests a checkpoint from a watching pfrez, merge flattens
+	// a chain of incremental snapshots
+	args, command := os.Args[1:], ""
+	if len(args) > 0 && (args[0] == "ctl" || args[0] == "merge") {
+		command, args = args[0], args[1:]
+	}
+
+	runtime.LockOSThread() //PTRACE requests are only accepted from the thread that attached to the target
 	flag.IntVar(&PID, "pid", -1, "PID of process to be frozen")
-	flag.StringVar(&dest, "dest", "stdout", "Output sink: stdout | tcp|udp:host:port | unix:socketpath | snapshot-filepath")
-	flag.StringVar(&compress, "compress", "none", "Compression mode: none | gzip | flate | snappy")
-	flag.StringVar(&encrypt, "encrypt", "none", "Encryption mode: none | AES-CFB|AES-CTR|AES-OFB:keypath")
+	flag.Var(&destValues, "dest", "Output sink: stdout | tcp|udp|tls://host:port[?options] | unix:///socketpath | file:///filepath | repo:dirpath[@tag,...] | s3://bucket/key | http(s)://url | snapshot-filepath (default stdout). Repeat to write the snapshot to several at once, each optionally followed by its own settings: ;required | ;best-effort, ;compress=, ;compress-level=, ;compress-dict=, ;encrypt= & ;checksum=")
+	flag.StringVar(&compress, "compress", "none", "Compression mode: none | gzip | flate | snappy | zstd | lz4 | auto (lz4 on fast links, zstd on slow ones)")
+	flag.IntVar(&compressLevel, "compress-level", 0, "Optional: Compression level, 0 selects the algorithm's default (zstd: 1-22, lz4: 1-9, gzip/flate: 1-9)")
+	flag.StringVar(&compressDict, "compress-dict", "", "Optional: zstd dictionary, pthaw must find a file of the same name in its -dictdir")
+	flag.StringVar(&trainDict, "train-dict", "", "Train a zstd dictionary on the memory of the target process, write it to this path and exit")
+	flag.StringVar(&encrypt, "encrypt", "none", "Encryption mode: none | AES-GCM|CHACHA20-POLY1305:keypath (AES-CFB|AES-CTR|AES-OFB are deprecated)")
+	flag.StringVar(&checksum, "checksum", "none", "Optional: Checksum the stream after encryption so pthaw detects corruption: none | CRC32C")
+	flag.StringVar(&identity, "identity", "", "Optional: Path to an Ed25519 private key (PEM), enables a mutually authenticated key exchange with the destination")
+	flag.StringVar(&knownHosts, "known-hosts", "", "Path to the file of trusted destination public keys, required with -identity")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Optional: TLS client certificate (PEM) presented to tls destinations")
+	flag.StringVar(&tlsKey, "tls-key", "", "Optional: Private key (PEM) for -tls-cert")
+	flag.StringVar(&tlsCA, "tls-ca", "", "Optional: CA certificates (PEM) used to verify tls destinations instead of the system roots")
+	flag.StringVar(&tlsPins, "tls-pin", "", "Optional: Comma separated hex SHA-256 digests of acceptable destination public keys (SubjectPublicKeyInfo)")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "Optional: Server name to verify tls destinations against (defaults to the destination host)")
+	flag.StringVar(&httpMethod, "http-method", "POST", "Method of the request http(s) destinations are sent with: POST | PUT")
+	flag.StringVar(&httpToken, "http-token", "", "Optional: File containing a bearer token http(s) destinations are sent with")
+	flag.IntVar(&streamCount, "streams", 1, "Number of parallel connections, each with its own compression and encryption, to spread memory across (tcp, udp, tls & unix only)")
 	flag.DurationVar(&dialTimeout, "dial-timeout", 0, "Optional: Duration to wait for socket level connection to be established")
 	flag.DurationVar(&writeTimeout, "write-timeout", 0, "Optional: Duration to wait transmitting data to an active stream before timing out")
-	flag.BoolVar(&halt, "halt", false, "Halt the target process after state capture and transmission is complete")
+	flag.DurationVar(&resumeTimeout, "resume-timeout", 0, "Optional: Make the transfer resumable, after a broken connection keep reconnecting for this long and continue from the last memory span the destination acknowledged")
+	flag.DurationVar(&restoreTimeout, "restore-timeout", 2*time.Minute, "With -halt and a socket destination, duration to wait for the destination to report the process restored and running before resuming the target process instead")
+	flag.DurationVar(&interval, "interval", 0, "Optional: Stay attached and write a checkpoint of the target into the -dest directory at this interval, until it exits or pfrez is interrupted")
+	flag.IntVar(&keep, "keep", 0, "Optional: With -interval or -watch, number of the newest checkpoints to keep in a -dest directory or repository (0 keeps all)")
+	flag.BoolVar(&watch, "watch", false, "Stay attached and write a checkpoint of the target to -dest on SIGUSR1 or a pfrez ctl request, until it exits or pfrez is interrupted")
+	flag.StringVar(&controlPath, "control", "", "watch & ctl: Unix socket on which checkpoints are requested (default /run/pfrez-<pid>.sock)")
+	flag.BoolVar(&halt, "halt", false, "Halt the target process once it is running at a socket destination (a two-phase migration, the target resumes if the restore fails), or after state capture and transmission to other destinations")
+	flag.BoolVar(&dedup, "dedup", false, "Optional: Store memory pages once in the chunk store of a repo: destination, shared by all snapshots in it (can not be combined with -encrypt)")
+	flag.BoolVar(&pageAlign, "page-align", false, "Optional: Start the memory of every span on a page boundary of the snapshot, so pthaw maps it from a snapshot file written with -compress none, -encrypt none & -checksum none instead of copying it")
+	flag.StringVar(&parent, "parent", "", "Optional: Snapshot file or repo:dirpath[@ID|tag] the target was captured in before, only memory pages that changed since are written")
+	flag.StringVar(&keyDir, "keydir", ".", "parent & merge: Directory of the key files encrypted snapshots being read name, as pthaw -keydir")
+	flag.StringVar(&dictDir, "dictdir", ".", "parent & merge: Directory of the zstd dictionaries compressed snapshots being read name, as pthaw -dictdir")
+	flag.StringVar(&progressFmt, "progress", "none", "Report transfer progress on stderr: none | tty (a progress bar) | json (an object per line)")
+	flag.StringVar(&rateLimit, "rate-limit", "", "Optional: Most bytes per second to send, shared by all streams, such as 50MiB or 100Mbit")
 	flag.BoolVar(&debug, "debug", false, "Debug: true | false, if enabled outgoing data will be displayed")
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+
+	if controlPath == "" && PID != -1 {
+		controlPath = defaultControlPath(PID)
+	}
+	if command == "ctl" {
+		req, err := getCtlRequest(flag.Args(), halt)
+		if err == nil {
+			err = runCtl(controlPath, req)
+		}
+		if err != nil {
+			log.Fatalf("Checkpoint request failed; Details:\n\t%s", err)
+		}
+		return
+	}
+
+	token, err := pmigrate.ReadTokenFile(httpToken)
+	if err != nil {
+		log.Fatalf("Could not read HTTP credentials; Details:\n\t%s", err)
+	}
+	progressFormat, err := progress.ParseFormat(progressFmt)
+	if err != nil {
+		log.Fatalf("Invalid -progress; Details:\n\t%s", err)
+	}
+	opts := pmigrate.CheckpointOptions{
+		DialTimeout:  dialTimeout,
+		WriteTimeout: writeTimeout,
+		TLS: tlscfg.Options{
+			CertFile:   tlsCert,
+			KeyFile:    tlsKey,
+			CAFile:     tlsCA,
+			Pins:       tlscfg.ParsePins(tlsPins),
+			ServerName: tlsServerName,
+		},
+		HTTPMethod:     httpMethod,
+		HTTPToken:      token,
+		Identity:       identity,
+		KnownHosts:     knownHosts,
+		Streams:        streamCount,
+		ResumeTimeout:  resumeTimeout,
+		Halt:           halt,
+		RestoreTimeout: restoreTimeout,
+		Dedup:          dedup,
+		Parent:         parent,
+		PageAlign:      pageAlign,
+		Decode:         preader.DecodeOptions{KeyDir: keyDir, DictDir: dictDir},
+	}
+	if rateLimit != "" {
+		rate, err := progress.ParseRate(rateLimit)
+		if err != nil {
+			log.Fatalf("Invalid -rate-limit; Details:\n\t%s", err)
+		}
+		opts.Limiter = progress.NewLimiter(rate)
+	}
+	if progressFormat != progress.FormatNone {
+		opts.Meter = progress.NewMeter("send")
+	}
+	if debug {
+		opts.Consumer = pwriter.NewDebugConsumer()
+	}
+	if len(destValues) == 0 {
+		destValues = destFlags{"stdout"}
+	}
+	defaults := pmigrate.Destination{Compress: compress, CompressLevel: compressLevel, CompressDict: compressDict, Encrypt: encrypt, Checksum: checksum}
+	for _, value := range destValues {
+		dest, err := pmigrate.ParseDestination(value, defaults)
+		if err != nil {
+			log.Fatalf("Invalid destination; Details:\n\t%s", err)
+		}
+		opts.Dests = append(opts.Dests, dest)
+	}
+	if len(opts.Dests) > 1 && (command == "merge" || interval > 0 || watch) {
+		log.Fatalf("Merges and checkpoints take a single -dest")
+	} else if len(opts.Dests) > 1 && debug {
+		log.Fatalf("Multiple destinations can not be combined with -debug")
+	}
+	//Interrupting pfrez resumes the target and aborts the destinations, a second
+	// interrupt exits at once should that hang
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	if command == "merge" {
+		if len(flag.Args()) != 1 {
+			log.Fatalf("Usage: pfrez merge [-keydir dirpath, -dictdir dirpath, -dest, -compress, -compress-level, -compress-dict, -encrypt, -checksum & -page-align] snapshot-filepath|repo:dirpath@ref")
+		}
+		merged, err := pmigrate.Merge(ctx, flag.Arg(0), opts.Dests[0], opts)
+		if err != nil {
+			log.Fatalf("Could not merge snapshot chain; Details:\n\t%s", err)
+		}
+		log.Printf("Merged snapshot chain into %s", merged)
+		return
+	}
 
 	if os.Getuid() != 0 {
 		fmt.Fprintln(os.Stderr, "pfrez: This utility must be executed as root.")
@@ -43,67 +191,81 @@ func main() {
 		os.Exit(1)
 	}
 
-	var wtr lib.StateConsumer
-	if debug {
-		wtr = pwriter.NewDebugConsumer()
-	} else {
-		var transpEnc transpenc.TranportEncoding
-
-		dstWriter, err := getDestWriter(dest, dialTimeout)
-		if err != nil {
-			log.Fatalf("Could not create process state destination; Details:\n\t%s", err)
-		}
-		defer dstWriter.Close()
-
-		var timeoutWtr io.Writer
-		if writeTimeout > 0 {
-			timeoutWtr = iotimeout.WrapWriteTimeout(dstWriter, writeTimeout)
-		} else {
-			timeoutWtr = dstWriter
+	if trainDict != "" {
+		dict, samples, err := pmigrate.TrainDictionary(ctx, PID)
+		if err == nil {
+			err = ioutil.WriteFile(trainDict, dict, 0600)
 		}
-
-		dstEncyptor, err := getDestEncryptor(timeoutWtr, encrypt, &transpEnc)
 		if err != nil {
-			log.Fatalf("Could not create process state encryptor; Details:\n\t%s", err)
+			log.Fatalf("Could not train compression dictionary; Details:\n\t%s", err)
 		}
-		defer dstEncyptor.Close()
+		log.Printf("Wrote %d byte dictionary trained on %d pages to %s", len(dict), samples, trainDict)
+		return
+	}
 
-		dstCompressor, err := getDestCompressor(dstEncyptor, compress, &transpEnc)
-		if err != nil {
-			log.Fatalf("Could not create process state compressor; Details:\n\t%s", err)
+	if interval > 0 || watch {
+		if err = runWatch(ctx, PID, pmigrate.WatchOptions{CheckpointOptions: opts, Interval: interval, Keep: keep}, controlPath); err != nil {
+			log.Fatalf("Checkpoints of process with PID: %d failed; Details:\n\t%s", PID, err)
 		}
-		defer dstCompressor.Close()
-
-		outStrm := bufio.NewWriter(dstCompressor)
-		defer outStrm.Flush()
+		return
+	}
 
-		if err := transpEnc.Write(dstWriter); err != nil {
-			log.Fatalf("Could not write transport encoding; Details:\n\t%s", err)
+	reporter := progress.Report(opts.Meter, os.Stderr, progressFormat, progress.DefaultInterval)
+	result, err := pmigrate.Checkpoint(ctx, PID, opts)
+	reporter.Stop()
+	if err != nil {
+		log.Fatalf("Checkpoint of process with PID: %d failed; Details:\n\t%s", PID, err)
+	}
+	for _, err := range result.Failed {
+		log.Printf("Skipped best-effort destination; Details:\n\t%s", err)
+	}
+	for _, written := range result.Written {
+		if prepo.IsRepo(written) {
+			log.Printf("Stored snapshot %s", written)
 		}
-		wtr = pwriter.NewProcSnapshotWriter(outStrm)
 	}
-	defer wtr.Close()
+	if debug {
+		os.Stdout.WriteString(opts.Consumer.DebugInfo())
+	}
+}
 
-	targetProcess, err := os.FindProcess(PID)
+//runWatch stays attached to the process with pid, writing a checkpoint every
+// interval (if any), on SIGUSR1 and for every request on the control socket at
+// controlPath, until it exits, a checkpoint halts it or ctx is done, which leaves
+// it running
+func runWatch(ctx context.Context, pid int, opts pmigrate.WatchOptions, controlPath string) error {
+	watcher, err := pmigrate.Watch(pid, opts)
 	if err != nil {
-		log.Fatalf("Could not find target process with PID: %d; Details:\n\t%s", PID, err)
+		return err
 	}
-
-	rdr, err := preader.NewProcReader(targetProcess)
+	var pending sync.WaitGroup //Control requests still to be answered
+	defer pending.Wait()
+	control, err := listenControl(controlPath, watcher, &pending)
 	if err != nil {
-		log.Fatalf("Could not attach to process with PID: %d; Details:\n\t%s", PID, err)
+		return err
 	}
-	defer rdr.Close()
+	defer control.Close()
 
-	if err = wtr.Consume(rdr); err != nil {
-		log.Fatalf("Could not capture state of target process with PID: %d and invocation command: %q; Details:\n\t%s", PID, rdr.GetName(), err)
-	}
-	if debug {
-		os.Stdout.WriteString(wtr.DebugInfo())
-	}
-	if halt {
-		if err = rdr.GetProcess().Kill(); err != nil {
-			log.Printf("Could not halt target process as requested; Details:\n\t%s", err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	go func() {
+		for range signals {
+			watcher.Trigger()
 		}
-	}
+	}()
+	log.Printf("Watching process %d, checkpoints are requested on SIGUSR1 or control socket: %s", pid, controlPath)
+	return watcher.Run(ctx)
+}
+
+//destFlags collects every -dest given, the snapshot is written to each
+type destFlags []string
+
+func (this *destFlags) String() string {
+	return strings.Join(*this, " ")
+}
+
+func (this *destFlags) Set(value string) error {
+	*this = append(*this, value)
+	return nil
 }
@@ -0,0 +1,374 @@
+//Package pmigrate checkpoints running processes to, and restores them from,
+// snapshots carried over any of the supported transports: files, sockets,
+// repositories, object storage and HTTP. It is what pfrez and pthaw are built
+// on, for services that migrate processes themselves.
+//
+//Checkpoint captures a process and writes a snapshot of it to one or more
+// destinations, Restore receives a snapshot and restores its process, and
+// Server restores every snapshot sent to it. Watch keeps a process attached to
+// checkpoint it on demand. Checkpointing requires root, as does restoring.
+package pmigrate
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/progress"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//Destination is where a snapshot is written, and how it is encoded on the way
+type Destination struct {
+	//URL is one of stdout, tcp|udp|tls://host:port[?options], unix:///socketpath,
+	// file:///filepath, repo:dirpath[@tag,...], s3://bucket/key, http(s)://url or
+	// a snapshot file path. Empty is stdout.
+	URL string
+	//Compress is none, gzip, flate, snappy, zstd, lz4, auto (lz4 on fast links,
+	// zstd on slow ones) or a compression codec registered with lib/transpenc,
+	// at CompressLevel (0 for the algorithm's default)
+	Compress      string
+	CompressLevel int
+	CompressDict  string //Optional: Path of a zstd dictionary the restore must find by name
+	//Encrypt is none, or ALGO:keypath with ALGO being AES-GCM or CHACHA20-POLY1305
+	// (AES-CFB, AES-CTR & AES-OFB are deprecated). With an identity only the
+	// algorithm is given, the key is negotiated.
+	Encrypt string
+	//Checksum is none or CRC32C, applied after encryption to detect corruption
+	Checksum string
+	//BestEffort destinations among several are dropped when they fail, failures
+	// of the others fail the checkpoint
+	BestEffort bool
+}
+
+//ParseDestination parses a destination optionally followed by settings for it,
+// overriding those of defaults, such as:
+//	s3://archive/app.snap;best-effort;compress=zstd;compress-level=19
+//The settings are required, best-effort, compress=, compress-level=,
+// compress-dict=, encrypt= and checksum=.
+func ParseDestination(spec string, defaults Destination) (Destination, error) {
+	parts := strings.Split(spec, ";")
+	this := defaults
+	this.URL = strings.TrimSpace(parts[0])
+	var err error
+	for _, setting := range parts[1:] {
+		name, arg := strings.TrimSpace(setting), ""
+		if sep := strings.IndexByte(name, '='); sep >= 0 {
+			name, arg = strings.TrimSpace(name[:sep]), strings.TrimSpace(name[sep+1:])
+		}
+		switch name {
+		case "required":
+			this.BestEffort = false
+		case "best-effort":
+			this.BestEffort = true
+		case "compress":
+			this.Compress = arg
+		case "compress-level":
+			if this.CompressLevel, err = strconv.Atoi(arg); err != nil {
+				return this, optionsError("Invalid compress-level of destination: %q", spec)
+			}
+		case "compress-dict":
+			this.CompressDict = arg
+		case "encrypt":
+			this.Encrypt = arg
+		case "checksum":
+			this.Checksum = arg
+		default:
+			return this, optionsError("Unknown setting: %q of destination: %q, use: required, best-effort, compress=, compress-level=, compress-dict=, encrypt= or checksum=", setting, spec)
+		}
+	}
+	return this, nil
+}
+
+//CheckpointOptions are the settings of a checkpoint, and of the connections to
+// its destinations
+type CheckpointOptions struct {
+	Dests []Destination //The snapshot is written to each, stdout if none are given
+	//Consumer, if not nil, receives the captured state instead of Dests, such as
+	// pwriter.NewDebugConsumer
+	Consumer lib.StateConsumer
+
+	DialTimeout  time.Duration //Optional: Wait for socket connections to be established
+	WriteTimeout time.Duration //Optional: Wait transmitting to an active stream
+	TLS          tlscfg.Options
+	HTTPMethod   string //POST (the default) or PUT, of http(s) destinations
+	HTTPToken    string //Optional: Bearer token http(s) destinations are sent with
+	//Identity is the path of an Ed25519 private key (PEM), which enables a
+	// mutually authenticated key exchange with socket destinations whose public
+	// keys are in the KnownHosts file
+	Identity, KnownHosts string
+
+	//Streams spreads memory across this many connections to a single socket
+	// destination, each with its own compression and encryption
+	Streams int
+	//ResumeTimeout makes the transfer to a single socket destination resumable,
+	// after a broken connection it is reconnected for this long
+	ResumeTimeout time.Duration
+	//Halt kills the target process once it is running at the socket destinations
+	// (a two-phase migration, if they fail to restore it the target resumes), or
+	// once the snapshot is written to other destinations
+	Halt bool
+	//RestoreTimeout bounds waiting for socket destinations to report the
+	// process restored when halting, 0 waits indefinitely
+	RestoreTimeout time.Duration
+
+	Dedup  bool                  //Store memory pages once in the chunk stores of repo: destinations
+	Parent string                //Optional: Snapshot file or repo:dirpath[@ID|tag] to write an incremental snapshot against
+	Decode preader.DecodeOptions //Locates the keys and dictionaries of Parent
+	//PageAlign writes page aligned snapshots (see pwriter.NewAlignedSnapshotWriter),
+	// whose memory is mapped from the file rather than copied when restored from
+	// a snapshot file stored without compression, encryption or checksums
+	PageAlign bool
+
+	Limiter *progress.Limiter //Optional: Of the bytes sent
+	Meter   *progress.Meter   //Optional: Measures the bytes and memory spans sent
+
+	name string //Of the target if it is not running, as when merging
+}
+
+//CheckpointResult describes a completed checkpoint
+type CheckpointResult struct {
+	Name    string   //Invocation command of the target process
+	Written []string //Destinations written, repository snapshots including their ID
+	Failed  []error  //The *DestinationErrors of best-effort destinations that failed
+	Halted  bool     //The target process was killed as requested
+}
+
+//destOptions returns the options of the stream(s) to dest
+func (this CheckpointOptions) destOptions(dest Destination, pid int) (destOptions, error) {
+	if dest.URL == "" {
+		dest.URL = "stdout"
+	}
+	url, err := normalizeDest(dest.URL)
+	if err != nil {
+		return destOptions{}, &OptionsError{Msg: errs.Append(err, "Invalid destination").Error()}
+	}
+	return destOptions{
+		dest:          url,
+		dialTimeout:   this.DialTimeout,
+		writeTimeout:  this.WriteTimeout,
+		tlsOpts:       this.TLS,
+		httpMethod:    this.HTTPMethod,
+		httpToken:     this.HTTPToken,
+		identity:      this.Identity,
+		knownHosts:    this.KnownHosts,
+		encrypt:       dest.Encrypt,
+		compress:      dest.Compress,
+		compressDict:  dest.CompressDict,
+		compressLevel: dest.CompressLevel,
+		checksum:      dest.Checksum,
+		resumeTimeout: this.ResumeTimeout,
+		pid:           pid,
+		name:          this.name,
+		dedup:         this.Dedup,
+		pageAlign:     this.PageAlign,
+		limiter:       this.Limiter,
+		meter:         this.Meter,
+	}, nil
+}
+
+//Checkpoint captures the process with pid and writes a snapshot of it to every
+// destination of opts. The process is frozen while it is captured, then resumed
+// unless halted. Errors are *OptionsError, *TargetError, *DestinationError,
+// *MigrationError or that of ctx. Once ctx is done the checkpoint is abandoned:
+// stuck transfers are interrupted, destinations aborted and the target resumed,
+// the error wrapping that of ctx.
+func Checkpoint(ctx context.Context, pid int, opts CheckpointOptions) (*CheckpointResult, error) {
+	//PTRACE requests are only accepted from the thread that attached to the target
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if len(opts.Dests) == 0 {
+		opts.Dests = []Destination{{URL: "stdout"}}
+	}
+	if opts.Streams == 0 {
+		opts.Streams = 1
+	}
+	if len(opts.Dests) > 1 && opts.Consumer == nil {
+		return checkpointTee(ctx, pid, opts)
+	}
+	dest, err := opts.destOptions(opts.Dests[0], pid)
+	if err != nil {
+		return nil, err
+	}
+	dest.ctx = ctx
+	socketDest := isSocketDest(dest.dest)
+	if opts.Consumer == nil {
+		switch {
+		case opts.Streams < 1:
+			return nil, optionsError("The number of streams must be at least 1, not: %d", opts.Streams)
+		case opts.Streams > 1 && !socketDest:
+			return nil, optionsError("Multiple streams require a tcp, udp, tls or unix socket destination")
+		case opts.ResumeTimeout > 0 && (opts.Streams > 1 || !socketDest):
+			return nil, optionsError("Resumable transfers require a single stream to a tcp, udp, tls or unix socket destination")
+		case opts.Dedup && !prepo.IsRepo(dest.dest):
+			return nil, optionsError("Deduplication requires a repo: destination")
+		case opts.Parent != "" && (opts.Dedup || opts.Streams > 1 || opts.ResumeTimeout > 0):
+			return nil, optionsError("Incremental snapshots can not be combined with deduplication, multiple streams or resumable transfers")
+		case opts.PageAlign && (opts.Dedup || opts.Parent != "" || opts.Streams > 1 || opts.ResumeTimeout > 0):
+			return nil, optionsError("Page aligned snapshots can not be combined with deduplication, incremental snapshots, multiple streams or resumable transfers")
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	//Halting the target only once the destination confirms its restore makes
+	// this a migration rather than a copy
+	twoPhase := opts.Halt && opts.Consumer == nil && socketDest
+	var (
+		wtr       = opts.Consumer
+		streams   []*destStream
+		resumable *pwriter.ResumableSnapshotWriter
+	)
+	abort := func() {
+		for _, stream := range streams {
+			stream.abort() //Incomplete snapshots must not be stored
+		}
+	}
+	if wtr == nil {
+		//The parent is read before the target is frozen
+		if opts.Parent != "" {
+			if dest.parent, err = resolveParent(opts.Parent); err == nil {
+				dest.parentPages, err = indexParent(dest.parent, opts.Decode)
+			}
+			if err != nil {
+				return nil, &OptionsError{Msg: errs.Append(err, "Could not read parent snapshot").Error()}
+			}
+		}
+		sessionID, err := newSessionID()
+		if err != nil {
+			return nil, &DestinationError{Dest: dest.dest, Err: errs.Append(err, "Could not create transfer session")}
+		}
+
+		//Connect every stream before capture starts, so the target is not frozen
+		// any longer than necessary
+		if opts.ResumeTimeout > 0 {
+			transpEnc := transpenc.TranportEncoding{SessionID: sessionID, ReportRestore: twoPhase}
+			stream, held, err := openResumableStream(dest, transpEnc)
+			if err != nil {
+				return nil, &DestinationError{Dest: dest.dest, Err: errs.Append(err, "Could not open process state stream")}
+			}
+			resumable = pwriter.NewResumableSnapshotWriter(resumeDialer(dest, transpEnc, stream, held))
+			wtr = resumable
+		} else {
+			dsts := make([]io.Writer, opts.Streams)
+			for i := range dsts {
+				transpEnc := transpenc.TranportEncoding{SessionID: sessionID, StreamIndex: i, StreamCount: opts.Streams, ReportRestore: twoPhase}
+				stream, err := openDestStream(dest, transpEnc)
+				if err != nil {
+					abort()
+					return nil, &DestinationError{Dest: dest.dest, Err: errs.Append(err, "Could not open process state stream %d of %d", i+1, opts.Streams)}
+				}
+				streams, dsts[i] = append(streams, stream), stream
+			}
+			if opts.Streams == 1 {
+				if wtr, err = newSnapshotWriter(streams[0], dest); err != nil {
+					abort()
+					return nil, &DestinationError{Dest: dest.dest, Err: errs.Append(err, "Could not write process state stream")}
+				}
+			} else {
+				wtr = pwriter.NewParallelSnapshotWriter(dsts)
+			}
+		}
+		defer wtr.Close()
+	}
+
+	rdr, err := attach(ctx, pid)
+	if err != nil {
+		abort()
+		return nil, err
+	}
+	defer rdr.Close() //Resumes the target unless it is killed
+
+	result := &CheckpointResult{Name: rdr.GetName()}
+	target := newTargetProvider(rdr)
+	if err = lib.ConsumeContext(ctx, wtr, opts.Meter.Provider(target)); err != nil {
+		abort()
+		return nil, target.consumeError(ctx, dest.dest, err)
+	}
+	//The first stream stays open to a two-phase destination for its restore status
+	var statusStream *destStream
+	for i, stream := range streams {
+		if twoPhase {
+			err = pwriter.WriteSpansEnd(stream)
+		}
+		if err == nil && twoPhase && i == 0 {
+			statusStream = stream
+		} else if err == nil {
+			err = stream.Close()
+		}
+		if err != nil {
+			if statusStream != nil {
+				statusStream.abort()
+			}
+			for _, stream := range streams[i:] {
+				stream.abort()
+			}
+			return nil, &DestinationError{Dest: dest.dest, Err: cause(ctx, errs.Append(err, "Could not complete transmission of process state stream %d of %d", i+1, len(streams)))}
+		}
+	}
+	if twoPhase && resumable != nil {
+		statusStream, _ = resumable.Stream().(*destStream)
+	}
+	if opts.Consumer == nil {
+		written := dest.dest
+		if len(streams) == 1 {
+			written = describeDest(dest.dest, streams[0])
+		}
+		result.Written = append(result.Written, written)
+	}
+
+	if !opts.Halt {
+		return result, nil
+	}
+	if twoPhase {
+		err = errs.New("No connection to the destination remains to learn the outcome of its restore")
+		if statusStream != nil {
+			err = statusStream.awaitRestore(opts.RestoreTimeout)
+			statusStream.Close()
+		}
+		if err != nil {
+			return nil, &MigrationError{Dest: dest.dest, PID: pid, Err: cause(ctx, err)}
+		}
+	}
+	result.Halted = halt(rdr)
+	return result, nil
+}
+
+//attach finds the process with pid and freezes it, returning its reader,
+// unless ctx is done
+func attach(ctx context.Context, pid int) (*preader.ProcReader, error) {
+	targetProcess, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, &TargetError{PID: pid, Err: errs.Append(err, "Could not find target process")}
+	}
+	rdr, err := preader.NewProcReaderContext(ctx, targetProcess)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, &TargetError{PID: pid, Err: errs.Append(err, "Could not attach to target process")}
+	}
+	return rdr, nil
+}
+
+//halt kills the target process as requested, a failure to is only logged as
+// its snapshot is complete
+func halt(rdr *preader.ProcReader) bool {
+	if err := rdr.GetProcess().Kill(); err != nil {
+		log.Printf("Could not halt target process as requested; Details:\n\t%s", err)
+		return false
+	}
+	return true
+}
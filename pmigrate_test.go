@@ -0,0 +1,263 @@
+package pmigrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/pmaps"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+func TestParseDestination(t *testing.T) {
+	defaults := Destination{Compress: "gzip", Encrypt: "none"}
+	dest, err := ParseDestination("s3://archive/app.snap; best-effort;compress=zstd;compress-level=19", defaults)
+	if err != nil {
+		t.Fatalf("Could not parse destination; Details:\n\t%s", err)
+	}
+	expected := Destination{URL: "s3://archive/app.snap", Compress: "zstd", CompressLevel: 19, Encrypt: "none", BestEffort: true}
+	if dest != expected {
+		t.Fatalf("Parsed destination: %+v, expected: %+v", dest, expected)
+	}
+
+	if dest, err = ParseDestination("/tmp/app.snap", defaults); err != nil {
+		t.Fatalf("Could not parse destination; Details:\n\t%s", err)
+	} else if dest.URL != "/tmp/app.snap" || dest.Compress != "gzip" || dest.BestEffort {
+		t.Fatalf("Destination without settings: %+v did not keep the defaults", dest)
+	}
+
+	for _, spec := range []string{"x;compress-level=high", "x;bogus"} {
+		var optsErr *OptionsError
+		if _, err = ParseDestination(spec, defaults); !errors.As(err, &optsErr) {
+			t.Fatalf("Destination: %q was not rejected with an *OptionsError: %v", spec, err)
+		}
+	}
+}
+
+func TestCheckpointInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CheckpointOptions
+	}{
+		{"streams to a file", CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}}, Streams: 2}},
+		{"resumable file", CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}}, ResumeTimeout: time.Second}},
+		{"dedup without repo", CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}}, Dedup: true}},
+		{"two stdouts", CheckpointOptions{Dests: []Destination{{URL: "stdout"}, {URL: "-"}}}},
+		{"tee with streams", CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}, {URL: "/tmp/y.snap"}}, Streams: 2}},
+	}
+	for _, test := range tests {
+		//The target must not be attached to, so any PID will do
+		var optsErr *OptionsError
+		if _, err := Checkpoint(context.Background(), -1, test.opts); !errors.As(err, &optsErr) {
+			t.Fatalf("Checkpoint with %s was not rejected with an *OptionsError: %v", test.name, err)
+		}
+	}
+}
+
+func TestRestoreRequiresLoader(t *testing.T) {
+	var optsErr *OptionsError
+	if _, err := Restore(context.Background(), "stdin", RestoreOptions{}); !errors.As(err, &optsErr) {
+		t.Fatalf("Restore without a loader was not rejected with an *OptionsError: %v", err)
+	}
+	if _, err := NewServer(RestoreOptions{LoaderPath: "ploader"}, 0); !errors.As(err, &optsErr) {
+		t.Fatalf("Server without restore slots was not rejected with an *OptionsError: %v", err)
+	}
+}
+
+func TestRestoreRemoteParents(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	for _, srcRdr := range []io.Reader{conn, os.Stdin} {
+		job := newRestoreJob(srcRdr, transpenc.TranportEncoding{}, nil, RestoreOptions{}.srcOptions())
+		if _, err := job.opts.parents("/etc/passwd"); err == nil || !strings.Contains(err.Error(), "only restored from a local file") {
+			t.Fatalf("Parent of a snapshot received from: %T was opened: %v", srcRdr, err)
+		}
+	}
+
+	file, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Could not open local source; Details: %s", err)
+	}
+	defer file.Close()
+	job := newRestoreJob(file, transpenc.TranportEncoding{}, nil, RestoreOptions{}.srcOptions())
+	if _, err = job.opts.parents(filepath.Join(t.TempDir(), "missing.snap")); err == nil || strings.Contains(err.Error(), "only restored from a local file") {
+		t.Fatalf("Parent of a local snapshot was not opened: %v", err)
+	}
+}
+
+func TestRestoreRejectUnauthenticated(t *testing.T) {
+	opts := RestoreOptions{}.srcOptions()
+	for _, transpEnc := range []transpenc.TranportEncoding{
+		{},
+		{CompressAlgo: "none", EncParams: transpenc.EncryptionParams{EncryptAlgo: "none"}},
+		{Transforms: []transpenc.Transform{}},
+		{Transforms: []transpenc.Transform{{Codec: transpenc.ChecksumCRC32C}}},
+		{EncParams: transpenc.EncryptionParams{KeyName: "key", EncryptAlgo: transpenc.EncryptAESCTR}},
+	} {
+		stream := new(bytes.Buffer)
+		if err := transpEnc.Write(stream); err != nil {
+			t.Fatalf("Could not write transport encoding: %+v; Details: %s", transpEnc, err)
+		}
+		if _, _, err := openSrcStream(stream, opts); err == nil || !strings.Contains(err.Error(), "-allow-unauthenticated") {
+			t.Fatalf("Stream with transport encoding: %+v was accepted: %v", transpEnc, err)
+		}
+	}
+}
+
+func TestRestoreRejectDowngrade(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+	keyPath := filepath.Join(keyDir, "k.key")
+	if err = ioutil.WriteFile(keyPath, bytes.Repeat([]byte{7}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed bytes.Buffer
+	var transpEnc transpenc.TranportEncoding
+	enc, err := transpenc.NewEncoder(&sealed, []transpenc.Step{{Codec: transpenc.EncryptAESGCM, Opts: transpenc.EncodeOptions{KeyPath: keyPath}}}, &transpEnc)
+	if err == nil {
+		if _, err = enc.Write([]byte("snapshot")); err == nil {
+			err = enc.Close()
+		}
+	}
+	if err != nil {
+		t.Fatalf("Could not encrypt stream; Details: %s", err)
+	}
+	opts := RestoreOptions{KeyDir: keyDir}.srcOptions()
+	stream := new(bytes.Buffer)
+	if err = transpEnc.Write(stream); err == nil {
+		stream.Write(sealed.Bytes())
+		_, _, err = openSrcStream(stream, opts)
+	}
+	if err != nil {
+		t.Fatalf("Encrypted stream was refused: %s", err)
+	}
+
+	//An on-path attacker rewrites the header to replace the stream with their own
+	for _, downgraded := range []transpenc.TranportEncoding{
+		{},
+		{EncParams: transpenc.EncryptionParams{KeyName: "k.key", EncryptAlgo: transpenc.EncryptAESCTR, InitVector: strings.Repeat("00", 16)}},
+	} {
+		for _, allow := range []bool{false, true} {
+			stream.Reset()
+			if err = downgraded.Write(stream); err != nil {
+				t.Fatalf("Could not write transport encoding: %+v; Details: %s", downgraded, err)
+			}
+			stream.WriteString("injected memory")
+			opts.allowLegacy = allow
+			if _, _, err = openSrcStream(stream, opts); !allow && err == nil {
+				t.Fatalf("Stream downgraded to transport encoding: %+v was accepted", downgraded)
+			} else if allow && err != nil {
+				t.Fatalf("Stream with transport encoding: %+v was refused with -allow-unauthenticated: %s", downgraded, err)
+			}
+		}
+	}
+
+	//Local snapshot files were not in transit
+	opts.allowLegacy = false
+	snapPath := filepath.Join(keyDir, "plain.snap")
+	stream.Reset()
+	if err = (transpenc.TranportEncoding{}).Write(stream); err == nil {
+		err = ioutil.WriteFile(snapPath, stream.Bytes(), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(snapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, _, err = openSrcStream(file, opts); err != nil {
+		t.Fatalf("Unencrypted local snapshot file was refused: %s", err)
+	}
+}
+
+func TestWatchInvalidOptions(t *testing.T) {
+	tests := []WatchOptions{
+		{CheckpointOptions: CheckpointOptions{Dests: []Destination{{URL: "stdout"}}}},
+		{CheckpointOptions: CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}}, Halt: true}},
+		{CheckpointOptions: CheckpointOptions{Dests: []Destination{{URL: "/nonexistent/dir"}}}, Interval: time.Minute},
+		{CheckpointOptions: CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}}}, Keep: -1},
+		{CheckpointOptions: CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}, {URL: "/tmp/y.snap"}}}},
+	}
+	for i, opts := range tests {
+		var optsErr *OptionsError
+		if _, err := Watch(-1, opts); !errors.As(err, &optsErr) {
+			t.Fatalf("Watch options %d: %+v were not rejected with an *OptionsError: %v", i, opts, err)
+		}
+	}
+}
+
+func TestCheckpointCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	//The target must not be attached to once cancelled, so any PID will do
+	if _, err := Checkpoint(ctx, -1, CheckpointOptions{Dests: []Destination{{URL: "/tmp/x.snap"}}}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Cancelled checkpoint returned: %v", err)
+	}
+}
+
+//brokenTarget is a target process whose memory can not be read
+type brokenTarget struct {
+	lib.StateProvider
+}
+
+func (brokenTarget) GetPID() int     { return 1 }
+func (brokenTarget) GetName() string { return "broken" }
+
+func (brokenTarget) GetMemoryMeta() (pmaps.ProcMap, error) {
+	return nil, errors.New("memory unreadable")
+}
+
+//metaConsumer reads the memory layout of its provider then fails with err
+type metaConsumer struct {
+	lib.StateConsumer
+	err error
+}
+
+func (this metaConsumer) Consume(provider lib.StateProvider) error {
+	if _, err := provider.GetMemoryMeta(); err != nil {
+		return err
+	}
+	return this.err
+}
+
+func TestConsumeErrorOrigin(t *testing.T) {
+	ctx := context.Background()
+	target := newTargetProvider(brokenTarget{})
+	err := lib.ConsumeContext(ctx, metaConsumer{}, target)
+	var targetErr *TargetError
+	if !errors.As(target.consumeError(ctx, "/tmp/x.snap", err), &targetErr) {
+		t.Fatalf("Failure to read the target was not a *TargetError: %v", err)
+	}
+
+	target = newTargetProvider(readableTarget{brokenTarget{}})
+	err = lib.ConsumeContext(ctx, metaConsumer{err: errors.New("disk full")}, target)
+	var destErr *DestinationError
+	if err = target.consumeError(ctx, "/tmp/x.snap", err); !errors.As(err, &destErr) || destErr.Dest != "/tmp/x.snap" {
+		t.Fatalf("Failure to write the destination was not its *DestinationError: %v", err)
+	}
+}
+
+//readableTarget is a target process with no memory
+type readableTarget struct {
+	brokenTarget
+}
+
+func (readableTarget) GetMemoryMeta() (pmaps.ProcMap, error) {
+	return nil, nil
+}
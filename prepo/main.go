@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/prepo"
+)
+
+//partialMinAge spares partial snapshot files from gc, as they may still be
+// written to by a running pfrez
+const partialMinAge = time.Hour
+
+const usage = `Usage: prepo -repo dirpath [options] command
+Commands:
+  list                 List snapshots, narrowed by any filter options given
+  search               As list, but requires at least one filter option
+  tag ID|TAG TAG...    Add tags to a snapshot
+  untag ID|TAG TAG...  Remove tags from a snapshot
+  verify [ID...]       Check snapshots (all by default) against their catalogued size and digest
+  remove ID...         Remove snapshots
+  prune                Remove snapshots beyond -keep or older than -older-than, narrowed by filter options
+  gc                   Remove snapshot files the catalog does not refer to and unreferenced chunks
+  stats                Show storage used and how much chunked snapshots deduplicate
+Options:
+`
+
+func main() {
+	var (
+		repoDir, name, tag, host string
+		PID, keep                int
+		olderThan, newerThan     time.Duration
+		asJSON                   bool
+	)
+
+	flag.StringVar(&repoDir, "repo", "", "Snapshot repository directory (as in pfrez -dest repo:dirpath)")
+	flag.StringVar(&name, "name", "", "Filter: Snapshots whose invocation command contains this")
+	flag.StringVar(&tag, "tag", "", "Filter: Snapshots carrying this tag")
+	flag.StringVar(&host, "host", "", "Filter: Snapshots taken on this host")
+	flag.IntVar(&PID, "pid", 0, "Filter: Snapshots of the process that had this PID")
+	flag.DurationVar(&newerThan, "newer-than", 0, "Filter: Snapshots taken within this duration")
+	flag.DurationVar(&olderThan, "older-than", 0, "Filter: Snapshots taken longer ago than this duration, for prune the age beyond which snapshots are removed")
+	flag.IntVar(&keep, "keep", 0, "prune: Number of the newest snapshots to keep (0 does not limit the count)")
+	flag.BoolVar(&asJSON, "json", false, "list & search: Print catalog entries as JSON")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if repoDir == "" || len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	repo, err := prepo.Open(repoDir)
+	if err != nil {
+		log.Fatalf("Could not open snapshot repository; Details:\n\t%s", err)
+	}
+
+	now := time.Now()
+	filter := prepo.Filter{Name: name, Tag: tag, Host: host, OrigPID: PID}
+	if newerThan > 0 {
+		filter.Since = now.Add(-newerThan)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "list", "search":
+		if olderThan > 0 {
+			filter.Before = now.Add(-olderThan)
+		}
+		if command == "search" && filter == (prepo.Filter{}) {
+			err = errs.New("search requires at least one of -name, -tag, -host, -pid, -newer-than or -older-than")
+			break
+		}
+		err = list(repo, filter, asJSON)
+	case "tag", "untag":
+		if len(args) < 2 {
+			err = errs.New("Usage: prepo %s ID|TAG TAG...", command)
+			break
+		}
+		var snap prepo.Snapshot
+		if snap, err = repo.Find(args[0]); err != nil {
+			break
+		}
+		if command == "tag" {
+			err = repo.Tag(snap.ID, args[1:], nil)
+		} else {
+			err = repo.Tag(snap.ID, nil, args[1:])
+		}
+	case "verify":
+		err = verify(repo, args)
+	case "remove":
+		if len(args) < 1 {
+			err = errs.New("Usage: prepo remove ID...")
+			break
+		}
+		err = repo.Remove(args...)
+	case "prune":
+		if keep < 1 && olderThan <= 0 {
+			err = errs.New("prune requires -keep or -older-than")
+			break
+		}
+		var removed []prepo.Snapshot
+		removed, err = repo.Prune(prepo.PrunePolicy{Filter: filter, Keep: keep, MaxAge: olderThan}, now)
+		for _, snap := range removed {
+			fmt.Printf("Removed %s (%s)\n", snap.ID, snap.Name)
+		}
+	case "gc":
+		var result prepo.GCResult
+		result, err = repo.GC(partialMinAge)
+		for _, name := range result.Files {
+			fmt.Printf("Removed %s\n", name)
+		}
+		if result.Chunks > 0 {
+			fmt.Printf("Removed %d unreferenced chunks (%d bytes)\n", result.Chunks, result.ChunkBytes)
+		}
+	case "stats":
+		err = stats(repo)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("prepo %s failed; Details:\n\t%s", command, err)
+	}
+}
+
+func list(repo *prepo.Repo, filter prepo.Filter, asJSON bool) error {
+	snaps, err := repo.Search(filter)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(snaps)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tHOST\tKERNEL\tPID\tSIZE\tTAGS\tPARENT\tNAME")
+	for _, snap := range snaps {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", snap.ID, snap.Created.Format(time.RFC3339), snap.Host,
+			snap.Kernel, snap.OrigPID, snap.Size, strings.Join(snap.Tags, ","), snap.Parent, snap.Name)
+	}
+	return tw.Flush()
+}
+
+func stats(repo *prepo.Repo) error {
+	stats, err := repo.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Snapshots:  %d (%d bytes)\n", stats.Snapshots, stats.SnapshotBytes)
+	fmt.Printf("Chunks:     %d (%d bytes)\n", stats.Chunks, stats.ChunkBytes)
+	if stats.Chunks > 0 {
+		fmt.Printf("References: %d (%.2fx deduplication)\n", stats.References, float64(stats.References)/float64(stats.Chunks))
+	}
+	return nil
+}
+
+//verify checks the snapshots with ids, or all of them, reporting every failure
+func verify(repo *prepo.Repo, ids []string) error {
+	if len(ids) == 0 {
+		snaps, err := repo.List()
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			ids = append(ids, snap.ID)
+		}
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := repo.Verify(id); err != nil {
+			fmt.Printf("FAILED %s: %s\n", id, err)
+			failed++
+		} else {
+			fmt.Printf("OK     %s\n", id)
+		}
+	}
+	if failed > 0 {
+		return errs.New("%d of %d snapshots failed verification", failed, len(ids))
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate"
+)
+
+//controlTimeout bounds a single request on the control socket
+const controlTimeout = 10 * time.Second
+
+//controlRequest is sent by pthaw ctl as a single JSON value, it is answered
+// with a single controlResponse after which the connection is closed
+type controlRequest struct {
+	Command string //list | kill | prune
+	ID      int    `json:",omitempty"`
+}
+
+type controlResponse struct {
+	Restores []pmigrate.RestoreEntry `json:",omitempty"`
+	Pruned   int                     `json:",omitempty"`
+	Error    string                  `json:",omitempty"`
+}
+
+//listenControl serves the registry of server on a unix socket at path, accessible to root only.
+// Closing the returned listener removes the socket.
+func listenControl(path string, server *pmigrate.Server) (net.Listener, error) {
+	//A socket left behind by a pthaw that did not exit cleanly is replaced
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, errs.New("Control socket: %s is in use, is another pthaw serving?", path)
+	} else if info, statErr := os.Lstat(path); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errs.Append(err, "Listen: unix/%s failed", path)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, errs.Append(err, "Could not restrict access to control socket: %s", path)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Control socket accept failed; Details:\n\t%s", err)
+				}
+				return
+			}
+			go handleControl(conn, server)
+		}
+	}()
+	return listener, nil
+}
+
+func handleControl(conn net.Conn, server *pmigrate.Server) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var (
+		req  controlRequest
+		resp controlResponse
+	)
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = "Malformed request: " + err.Error()
+	} else {
+		switch req.Command {
+		case "list":
+			resp.Restores = server.Restores()
+		case "kill":
+			if err = server.Kill(req.ID); err != nil {
+				resp.Error = err.Error()
+			}
+		case "prune":
+			resp.Pruned = server.Prune()
+		default:
+			resp.Error = fmt.Sprintf("Unknown command: %q", req.Command)
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		log.Printf("Could not answer control request; Details:\n\t%s", err)
+	}
+}
+
+//runCtl sends the command in args (list | kill ID | prune) to the pthaw serving
+// on the control socket at path and prints the answer
+func runCtl(path string, args []string) error {
+	var req controlRequest
+	switch {
+	case len(args) == 1 && (args[0] == "list" || args[0] == "prune"):
+		req.Command = args[0]
+	case len(args) == 2 && args[0] == "kill":
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errs.Append(err, "Invalid restore ID: %q", args[1])
+		}
+		req.Command, req.ID = args[0], id
+	default:
+		return errs.New("Usage: pthaw ctl [-control socketpath] list | kill ID | prune")
+	}
+
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return errs.Append(err, "Could not connect to control socket: %s", path)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var resp controlResponse
+	if err = json.NewEncoder(conn).Encode(&req); err != nil {
+		return errs.Append(err, "Could not send control request")
+	}
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return errs.Append(err, "Could not read control response")
+	}
+	if resp.Error != "" {
+		return errs.New("%s", resp.Error)
+	}
+
+	switch req.Command {
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATE\tPID\tORIG PID\tSOURCE\tSTARTED\tNAME\tERROR")
+		for _, entry := range resp.Restores {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", entry.ID, entry.State, entry.PID, entry.OrigPID,
+				entry.Source, entry.Started.Format(time.RFC3339), entry.Name, entry.Error)
+		}
+		return tw.Flush()
+	case "prune":
+		fmt.Printf("Pruned %d finished restores\n", resp.Pruned)
+	}
+	return nil
+}
@@ -1,36 +1,76 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
-	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
-	"github.com/tarndt/pmigrate/lib/iotimeout"
+	"github.com/tarndt/pmigrate"
 	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/progress"
 	"github.com/tarndt/pmigrate/lib/pwriter"
-	"github.com/tarndt/pmigrate/lib/transpenc"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
 )
 
 func main() {
 	var (
-		src, loaderPath, keyDir string
-		readTimeout             time.Duration
-		debug                   bool
+		src, loaderPath, keyDir  string
+		dictDir                  string
+		identity, authorizedKeys string
+		tlsCert, tlsKey, tlsCA   string
+		tlsPins                  string
+		spoolDir, controlPath    string
+		httpAddr, httpToken      string
+		progressFmt, rateLimit   string
+		maxRestores, maxFiles    int
+		maxMemoryMiB             uint64
+		readTimeout              time.Duration
+		resumeTimeout            time.Duration
+		debug, allowLegacy       bool
+		copyMemory               bool
 	)
 
+	//Subcommands: serve restores continuously, ctl manages a serving pthaw
+	args, command := os.Args[1:], ""
+	if len(args) > 0 && (args[0] == "serve" || args[0] == "ctl") {
+		command, args = args[0], args[1:]
+	}
+
 	runtime.LockOSThread() //This is needed to ensure PTRACE syscall interdiction always comes back the thread which is expecting the PTRACE events
 
-	flag.StringVar(&src, "src", "stdin", "Input source: stdin | tcp|udp:port | unix:socketpath | snapshot-filepath")
+	flag.StringVar(&src, "src", "stdin", "Input source: stdin | tcp|udp|tls://[host]:port[?options] | unix:///socketpath | file:///filepath | repo:dirpath[@id|tag] | s3://bucket/key | http(s)://url | snapshot-filepath")
 	flag.StringVar(&loaderPath, "loader", "", "Optional: Alternate path to loader executable")
 	flag.StringVar(&keyDir, "keydir", "", "Optional: Directory containing decryption keys")
+	flag.StringVar(&dictDir, "dictdir", "", "Optional: Directory containing zstd compression dictionaries")
+	flag.StringVar(&identity, "identity", "", "Optional: Path to an Ed25519 private key (PEM), enables a mutually authenticated key exchange with the source")
+	flag.StringVar(&authorizedKeys, "authorized-keys", "", "Path to the file of public keys allowed to send process state, required with -identity")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS server certificate (PEM), required for tls sources")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key (PEM) for -tls-cert")
+	flag.StringVar(&tlsCA, "tls-ca", "", "Optional: CA certificates (PEM), if given tls sources must present a client certificate signed by them")
+	flag.StringVar(&tlsPins, "tls-pin", "", "Optional: Comma separated hex SHA-256 digests of acceptable client public keys (SubjectPublicKeyInfo)")
+	flag.StringVar(&httpAddr, "http", "", "serve: Address ([host]:port) to receive snapshots sent by HTTP POST or PUT on instead of -src, HTTPS with -tls-cert")
+	flag.StringVar(&httpToken, "http-token", "", "Optional: File containing the bearer token HTTP requests must carry, or http(s) sources are requested with")
 	flag.DurationVar(&readTimeout, "read-timeout", 0, "Optional: Duration to wait for incomming data on an active stream before timing out")
+	flag.StringVar(&spoolDir, "spool-dir", os.TempDir(), "Directory in which resumable transfers are kept until complete")
+	flag.DurationVar(&resumeTimeout, "resume-timeout", 5*time.Minute, "Duration to wait for an interrupted resumable source to reconnect")
+	flag.BoolVar(&allowLegacy, "allow-unauthenticated", false, "Accept streams received that are not encrypted with AES-GCM or CHACHA20-POLY1305, including unencrypted ones and the deprecated AES-CFB, AES-CTR & AES-OFB modes, as older releases send (insecure: their contents can be altered in transit). Local snapshot files and repositories are always accepted")
+	flag.Uint64Var(&maxMemoryMiB, "max-memory", 0, "Optional: MiB of memory a snapshot may hold, more is refused (default the host's RAM and swap)")
+	flag.IntVar(&maxFiles, "max-files", preader.DefaultLimits.MaxFiles, "Number of open files a snapshot may hold, more is refused")
+	flag.BoolVar(&copyMemory, "copy-memory", false, "Copy the memory of page aligned snapshot files (see pfrez -page-align) into the restored process rather than mapping it from the file")
+	flag.IntVar(&maxRestores, "max-restores", 4, "serve: Number of snapshots received and loaded at once, further sources are turned away until one is running")
+	flag.StringVar(&controlPath, "control", "/run/pthaw.sock", "serve & ctl: Unix socket on which the registry of restored processes is managed")
+	flag.StringVar(&progressFmt, "progress", "none", "Report transfer progress on stderr: none | tty (a progress bar) | json (an object per line)")
+	flag.StringVar(&rateLimit, "rate-limit", "", "Optional: Most bytes per second to receive, shared by all sources, such as 50MiB or 100Mbit")
 	flag.BoolVar(&debug, "debug", false, "Debug: true | false, if enabled incomming data will be displayed")
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	if loaderPath == "" {
 		loaderPath = filepath.Join(mustGetExecDir(), "ploader")
@@ -38,54 +78,138 @@ func main() {
 	if keyDir == "" {
 		keyDir = filepath.Join(mustGetExecDir(), "/")
 	}
+	if dictDir == "" {
+		dictDir = mustGetExecDir()
+	}
+
+	if command == "ctl" {
+		if err := runCtl(controlPath, flag.Args()); err != nil {
+			log.Fatalf("Control request failed; Details:\n\t%s", err)
+		}
+		return
+	}
 
-	srcRdr, err := getSourceReader(src)
+	token, err := pmigrate.ReadTokenFile(httpToken)
+	if err != nil {
+		log.Fatalf("Could not read HTTP credentials; Details:\n\t%s", err)
+	}
+	progressFormat, err := progress.ParseFormat(progressFmt)
 	if err != nil {
-		log.Fatalf("Could not open process state destination; Details:\n\t%s", err)
+		log.Fatalf("Invalid -progress; Details:\n\t%s", err)
+	}
+	tlsOpts := tlscfg.Options{
+		CertFile: tlsCert,
+		KeyFile:  tlsKey,
+		CAFile:   tlsCA,
+		Pins:     tlscfg.ParsePins(tlsPins),
+	}
+	opts := pmigrate.RestoreOptions{
+		LoaderPath:           loaderPath,
+		KeyDir:               keyDir,
+		DictDir:              dictDir,
+		Identity:             identity,
+		AuthorizedKeys:       authorizedKeys,
+		TLS:                  tlsOpts,
+		HTTPToken:            token,
+		SpoolDir:             spoolDir,
+		ReadTimeout:          readTimeout,
+		ResumeTimeout:        resumeTimeout,
+		AllowUnauthenticated: allowLegacy,
+		Limits:               preader.Limits{MaxMemory: maxMemoryMiB << 20, MaxFiles: maxFiles},
+		CopyMemory:           copyMemory,
+	}
+	if rateLimit != "" {
+		rate, err := progress.ParseRate(rateLimit)
+		if err != nil {
+			log.Fatalf("Invalid -rate-limit; Details:\n\t%s", err)
+		}
+		opts.Limiter = progress.NewLimiter(rate)
 	}
-	defer srcRdr.Close()
 
-	var timeoutRdr io.Reader
-	if readTimeout > 0 {
-		timeoutRdr = iotimeout.WrapReadTimeout(srcRdr, readTimeout)
-	} else {
-		timeoutRdr = srcRdr
+	if command == "serve" {
+		if debug || progressFormat != progress.FormatNone {
+			log.Fatalf("pthaw serve does not support -debug or -progress")
+		} else if httpAddr != "" && identity != "" {
+			log.Fatalf("HTTP sources can not take part in a key exchange, use -tls-cert and -http-token instead of -identity")
+		}
+		if err := serve(src, httpAddr, controlPath, maxRestores, opts); err != nil {
+			log.Fatalf("Could not serve restores; Details:\n\t%s", err)
+		}
+		return
 	}
 
-	inStrm := bufio.NewReader(timeoutRdr)
-	var transpEnc transpenc.TranportEncoding
-	if err = transpenc.ReadTranportEncoding(inStrm, &transpEnc); err != nil {
-		log.Fatalf("Could not read transport encoding of source stream; Details:\n\t%s", err)
+	if progressFormat != progress.FormatNone {
+		opts.Meter = progress.NewMeter("receive")
 	}
+	if debug {
+		opts.Consumer = pwriter.NewDebugConsumer()
+	}
+	//Interrupting pthaw tears a loader down, a running process is left running
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	reporter := progress.Report(opts.Meter, os.Stderr, progressFormat, progress.DefaultInterval)
+	result, err := pmigrate.Restore(ctx, src, opts)
+	reporter.Stop()
+	if err != nil && result != nil && result.PID != 0 && errors.Is(err, context.Canceled) {
+		log.Printf("Stopped supervising restored process %d, it keeps running unsupervised", result.PID)
+		return
+	} else if err != nil {
+		log.Fatalf("Restore failed; Details:\n\t%s", err)
+	}
+	if debug {
+		os.Stdout.WriteString(opts.Consumer.DebugInfo())
+	}
+}
 
-	srcDecryptor, err := getSrcDecyptor(inStrm, transpEnc.EncParams, keyDir)
+//serve listens on src, or for HTTP requests on httpAddr, until interrupted,
+// restoring up to maxRestores snapshots at once and managing the registry of
+// restored processes on controlPath
+func serve(src, httpAddr, controlPath string, maxRestores int, opts pmigrate.RestoreOptions) error {
+	server, err := pmigrate.NewServer(opts, maxRestores)
 	if err != nil {
-		log.Fatalf("Could not source decryptor; Details:\n\t%s", err)
+		return err
+	}
+	var listener net.Listener
+	if httpAddr != "" {
+		listener, err = pmigrate.ListenHTTP(httpAddr, opts.TLS)
+		src = "http://" + httpAddr
+		if opts.TLS.CertFile != "" {
+			src = "https://" + httpAddr
+		}
+	} else {
+		listener, err = pmigrate.ListenSource(src, opts.TLS)
 	}
-
-	srcDecompressor, err := getSrcDecompressor(srcDecryptor, transpEnc.CompressAlgo)
 	if err != nil {
-		log.Fatalf("Could not source decompressor; Details:\n\t%s", err)
+		return err
 	}
+	defer listener.Close()
 
-	snapshotRdr, err := preader.NewProcSnapReader(bufio.NewReader(srcDecompressor))
+	control, err := listenControl(controlPath, server)
 	if err != nil {
-		log.Fatalf("Could not read process state from source; Details:\n\t%s", err)
+		return err
 	}
-	defer snapshotRdr.Close()
+	defer control.Close()
 
-	if debug {
-		debugWtr := pwriter.NewDebugConsumer()
-		if err := debugWtr.Consume(snapshotRdr); err != nil {
-			log.Fatalf("Could not consume process snapshot; Details:\n\t%s", err)
-		}
-		os.Stdout.WriteString(debugWtr.DebugInfo())
+	//Stop accepting on request, so the control socket is removed on the way out
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("Received %s, shutting down", <-signals)
+		cancel()
+	}()
+
+	log.Printf("Serving restores from %s, control socket: %s", src, controlPath)
+	if httpAddr != "" {
+		err = server.ServeRequests(ctx, listener)
 	} else {
-		procWriter := pwriter.NewProcWriter(loaderPath)
-		if err := procWriter.Consume(snapshotRdr); err != nil {
-			log.Fatalf("Could not consume process snapshot; Details:\n\t%s", err)
-		}
+		err = server.Serve(ctx, listener)
+	}
+	if running := server.Running(); running > 0 {
+		log.Printf("Warning: %d restored processes will continue without supervision", running)
 	}
+	return err
 }
 
 var execDir string
@@ -18,16 +18,21 @@ void main() {
 #define opMemLoad 66
 #define opExec    67
 #define opAbort   68
+#define opMemMap  69
+#define opClose   70
 
 #define respStarted    97
 #define respMemloaded  98
 #define respExecing    99
 #define respAborting  100
 #define respFail      101
+#define respClosed    102
 
 void execByteCode() {
 	char opCode;
 	int64 mmapArgs[3]; //6 - 3 = 3, we ignore flags, fd and offset
+	int64 fileMapArgs[5]; //addr, len, prot, offset and the fd of the file
+	int64 fd;
 	
 	//Buffer used for memory xfers
 	const int64 bufLen = 512;
@@ -85,6 +90,28 @@ void execByteCode() {
 				}
 				ack(respMemloaded);
 				continue;			
+			case opMemMap:
+				//Read mmap args, the file is one the parent passed us already open
+				if(read(ldrIn, &fileMapArgs, sizeof(fileMapArgs)) != sizeof(fileMapArgs)) {
+					fputs("Error: Could not read arguments for file mmap operation!\n", stderr);
+					exit(EXIT_FAILURE);
+				}
+				//A private mapping is copy on write, the file is never written
+				if(mmap((void*)fileMapArgs[0], fileMapArgs[1], fileMapArgs[2], MAP_PRIVATE|MAP_FIXED, fileMapArgs[4], fileMapArgs[3]) != (void*)fileMapArgs[0]) {
+					fputs("Error: Failed to map file at correct address!\n", stderr);
+					exit(EXIT_FAILURE);
+				}
+				ack(respMemloaded);
+				continue;
+			case opClose:
+				//Files mapped from are closed before execution, the mappings
+				// outlive their file descriptors
+				if(read(ldrIn, &fd, sizeof(fd)) != sizeof(fd) || close(fd) != 0) {
+					fputs("Error: Could not close mapped file!\n", stderr);
+					exit(EXIT_FAILURE);
+				}
+				ack(respClosed);
+				continue;
 			case opStart:
 				//Used to sanity check we are getting a valid data-stream
 				ack(respStarted);
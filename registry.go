@@ -0,0 +1,128 @@
+package pmigrate
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tarndt/errs"
+)
+
+//States of a restore by a Server
+const (
+	StateReceiving = "receiving"
+	StateLoading   = "loading"
+	StateRunning   = "running"
+	StateExited    = "exited"
+	StateFailed    = "failed"
+)
+
+//RestoreEntry describes one restore by a Server
+type RestoreEntry struct {
+	ID        int
+	SessionID string `json:",omitempty"`
+	Source    string //Remote address of the first stream
+	Name      string `json:",omitempty"` //Invocation command
+	OrigPID   int    `json:",omitempty"` //PID at the source
+	PID       int    `json:",omitempty"` //PID of the restored process
+	State     string
+	Started   time.Time
+	Error     string `json:",omitempty"`
+}
+
+//registry keeps track of every restore since a Server started, until pruned
+type registry struct {
+	lock    sync.Mutex
+	nextID  int
+	entries map[int]*RestoreEntry
+}
+
+func newRegistry() *registry {
+	return &registry{
+		nextID:  1,
+		entries: make(map[int]*RestoreEntry),
+	}
+}
+
+//add records a new restore and returns its ID
+func (this *registry) add(sessionID, source string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	id := this.nextID
+	this.nextID++
+	this.entries[id] = &RestoreEntry{
+		ID:        id,
+		SessionID: sessionID,
+		Source:    source,
+		State:     StateReceiving,
+		Started:   time.Now(),
+	}
+	return id
+}
+
+//update applies fn to the restore with id, if it has not been pruned
+func (this *registry) update(id int, fn func(entry *RestoreEntry)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if entry := this.entries[id]; entry != nil {
+		fn(entry)
+	}
+}
+
+//list returns a copy of every restore in ID order
+func (this *registry) list() []RestoreEntry {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	entries := make([]RestoreEntry, 0, len(this.entries))
+	for _, entry := range this.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+//running returns how many restored processes are running
+func (this *registry) running() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	count := 0
+	for _, entry := range this.entries {
+		if entry.State == StateRunning {
+			count++
+		}
+	}
+	return count
+}
+
+//kill terminates a restored process. Only SIGKILL is used as the supervisor
+// does not pass signals on to the process it traces.
+func (this *registry) kill(id int) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	entry := this.entries[id]
+	switch {
+	case entry == nil:
+		return errs.New("There is no restore with ID: %d", id)
+	case entry.State != StateRunning || entry.PID <= 0:
+		return errs.New("Restore %d is %s, not running", id, entry.State)
+	}
+	if err := syscall.Kill(entry.PID, syscall.SIGKILL); err != nil {
+		return errs.Append(err, "Could not kill restored process with PID: %d", entry.PID)
+	}
+	return nil
+}
+
+//prune forgets every restore that has exited or failed, returning how many
+func (this *registry) prune() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	pruned := 0
+	for id, entry := range this.entries {
+		if entry.State == StateExited || entry.State == StateFailed {
+			delete(this.entries, id)
+			pruned++
+		}
+	}
+	return pruned
+}
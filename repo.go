@@ -0,0 +1,99 @@
+package pmigrate
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/endpoint"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+)
+
+//createRepoSnapshot starts a snapshot of the process opts.PID in the repository
+// a repo:/path[@tag,tag...] destination names, it is catalogued once closed.
+// Incremental snapshots record a parent stored in the same repository, which
+// can then not be removed before them.
+func createRepoSnapshot(ep *endpoint.Endpoint, opts endpoint.Options) (io.WriteCloser, error) {
+	dir, ref, err := prepo.ParseTarget(ep.String())
+	if err != nil {
+		return nil, err
+	}
+	repo, err := prepo.Init(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := prepo.Snapshot{Name: opts.Name, OrigPID: opts.PID, Parent: repoParentID(opts.Parent, dir)}
+	if ref != "" {
+		snap.Tags = strings.Split(ref, ",")
+	}
+	if snap.Name == "" {
+		if snap.Name, err = preader.GetProcName(opts.PID); err != nil {
+			return nil, errs.Append(err, "Could not describe process with PID: %d", opts.PID)
+		}
+	}
+	wtr, err := repo.Create(snap)
+	if err != nil {
+		return nil, err
+	}
+	return wtr, nil
+}
+
+//pruneRepoSnapshots removes all but the newest keep snapshots this host took of
+// the process with pid, 0 keeps all
+func pruneRepoSnapshots(dest string, pid, keep int) error {
+	if keep < 1 {
+		return nil
+	}
+	dir, _, err := prepo.ParseTarget(dest)
+	if err != nil {
+		return err
+	}
+	repo, err := prepo.Open(dir)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	_, err = repo.Prune(prepo.PrunePolicy{Filter: prepo.Filter{OrigPID: pid, Host: host}, Keep: keep}, time.Now())
+	return err
+}
+
+//describeDest names where stream was written, for repositories including the
+// snapshot's ID
+func describeDest(dest string, stream *destStream) string {
+	if repoWtr, isRepo := stream.dstWriter.(*prepo.Writer); isRepo {
+		dir, _, _ := prepo.ParseTarget(dest)
+		return prepo.Scheme + dir + "@" + repoWtr.ID()
+	}
+	return dest
+}
+
+//newSnapshotWriter returns the writer of a snapshot to stream. With -parent it
+// writes an incremental snapshot, with -dedup a chunked snapshot storing memory
+// pages in the chunk store of the stream's repository and with -page-align a
+// page aligned snapshot.
+func newSnapshotWriter(stream *destStream, opts destOptions) (*pwriter.ProcSnapshotWriter, error) {
+	if opts.parentPages != nil {
+		return pwriter.NewIncrementalSnapshotWriter(stream, opts.parentPages, opts.parent), nil
+	} else if opts.pageAlign && !opts.dedup {
+		return pwriter.NewAlignedSnapshotWriter(stream), nil
+	} else if !opts.dedup {
+		return pwriter.NewProcSnapshotWriter(stream), nil
+	}
+	repoWtr, isRepo := stream.dstWriter.(*prepo.Writer)
+	if !isRepo {
+		return nil, errs.New("Deduplication requires a repository destination, not: %q", opts.dest)
+	} else if opts.encrypt != "" && strings.ToLower(opts.encrypt) != "none" {
+		//Chunks are shared between snapshots and stored as captured
+		return nil, errs.New("Deduplicated snapshots can not be encrypted")
+	}
+	chunks, err := repoWtr.Chunks()
+	if err != nil {
+		return nil, err
+	}
+	return pwriter.NewChunkedSnapshotWriter(stream, chunks), nil
+}
@@ -0,0 +1,200 @@
+package pmigrate
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/migration"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/progress"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+)
+
+//DefaultResumeTimeout is how long an interrupted resumable source is waited for
+// to reconnect, unless RestoreOptions sets otherwise
+const DefaultResumeTimeout = 5 * time.Minute
+
+//RestoreOptions are the settings of a restore, and of the connections to its
+// sources
+type RestoreOptions struct {
+	LoaderPath string //Of the loader executable (ploader) the process is restored by
+	KeyDir     string //Directory of the key files encrypted snapshots name
+	DictDir    string //Directory of the zstd dictionaries compressed snapshots name
+	//Identity is the path of an Ed25519 private key (PEM), which enables a
+	// mutually authenticated key exchange with socket sources whose public keys
+	// are in the AuthorizedKeys file
+	Identity, AuthorizedKeys string
+	TLS                      tlscfg.Options //tls sources require a server certificate
+	//HTTPToken is the bearer token http(s) sources are requested with, and that
+	// requests to a Server must carry
+	HTTPToken string
+
+	SpoolDir      string        //Where resumable transfers are kept until complete, os.TempDir() if empty
+	ReadTimeout   time.Duration //Optional: Wait for incoming data on an active stream
+	ResumeTimeout time.Duration //Wait for an interrupted resumable source to reconnect, DefaultResumeTimeout if 0
+	//AllowUnauthenticated accepts streams received that are not encrypted with
+	// AES-GCM or CHACHA20-POLY1305, whether unencrypted or encrypted with the
+	// deprecated unauthenticated AES-CFB, AES-CTR & AES-OFB modes, as older
+	// releases send. They are refused by default as their transport encoding can
+	// be rewritten in transit undetected, and always for sessions authenticated
+	// with Identity. Local files and repositories are accepted regardless.
+	AllowUnauthenticated bool
+	//Limits bound the resources a snapshot may take, as sources may be
+	// untrusted. Fields left 0 take the value in preader.DefaultLimits.
+	Limits preader.Limits
+	//CopyMemory copies the memory of page aligned snapshot files (see
+	// CheckpointOptions.PageAlign) into the restored process, which otherwise
+	// maps it from the file. Mapped files must not be modified or truncated while
+	// processes restored from them run.
+	CopyMemory bool
+
+	Stdio *pwriter.StdioSinks //Optional: Of the restored process
+	//Consumer, if not nil, receives the snapshot instead of the loader, such as
+	// pwriter.NewDebugConsumer. Servers do not use it. Unless read from a file
+	// it is a lib.SpanStreamer, so its memory spans are read with
+	// lib.ForEachMemorySpan.
+	Consumer lib.StateConsumer
+	Running  func(pid int) //Optional: Called once the restored process runs
+
+	Limiter *progress.Limiter //Optional: Of the bytes received
+	Meter   *progress.Meter   //Optional: Measures the bytes received and memory spans loaded
+}
+
+//RestoreResult describes a restored process
+type RestoreResult struct {
+	Name    string //Invocation command
+	OrigPID int    //PID at the source
+	PID     int    //Of the restored process, 0 if it did not start
+}
+
+//srcOptions returns the options of the stream(s) from sources
+func (this RestoreOptions) srcOptions() srcOptions {
+	if this.SpoolDir == "" {
+		this.SpoolDir = os.TempDir()
+	}
+	if this.ResumeTimeout == 0 {
+		this.ResumeTimeout = DefaultResumeTimeout
+	}
+	return srcOptions{
+		keyDir:         this.KeyDir,
+		dictDir:        this.DictDir,
+		identity:       this.Identity,
+		authorizedKeys: this.AuthorizedKeys,
+		spoolDir:       this.SpoolDir,
+		readTimeout:    this.ReadTimeout,
+		resumeTimeout:  this.ResumeTimeout,
+		allowLegacy:    this.AllowUnauthenticated,
+		parents:        preader.DecodeOptions{KeyDir: this.KeyDir, DictDir: this.DictDir, Limits: this.Limits}.Parents(),
+		limits:         this.Limits,
+		mapFiles:       !this.CopyMemory,
+		limiter:        this.Limiter,
+		meter:          this.Meter,
+	}
+}
+
+//newProcWriter returns the loader of a restore, its process has sinks as its
+// standard output and error unless opts set others
+func (this RestoreOptions) newProcWriter(sinks pwriter.StdioSinks) *pwriter.ProcWriter {
+	if this.Stdio != nil {
+		sinks = *this.Stdio
+	}
+	return pwriter.NewProcWriterCustStdio(this.LoaderPath, sinks)
+}
+
+//Restore receives a snapshot from src and restores its process, then
+// supervises the process until it exits. src is one of stdin, tcp|udp|tls://
+// [host]:port[?options], unix:///socketpath, file:///filepath, repo:dirpath
+// [@id|tag], s3://bucket/key, http(s)://url or a snapshot file path. Errors are
+// *OptionsError, *SourceError, *LoadError or that of ctx. Once ctx is done the
+// source is closed and a loader that was started is killed, the error wrapping
+// that of ctx, or if the process already runs it is left running unsupervised.
+func Restore(ctx context.Context, src string, opts RestoreOptions) (*RestoreResult, error) {
+	//PTRACE events are only delivered to the thread that started the loader
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if opts.LoaderPath == "" && opts.Consumer == nil {
+		return nil, optionsError("The path of the loader executable is required")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	srcOpts := opts.srcOptions()
+	if prepo.IsRepo(src) {
+		chunks, err := openRepoChunks(src)
+		if err != nil {
+			return nil, &SourceError{Src: src, Err: errs.Append(err, "Could not open chunk store of snapshot repository")}
+		}
+		srcOpts.chunks = chunks
+	}
+	srcRdr, listener, err := getSourceReader(ctx, src, opts.HTTPToken, opts.TLS)
+	if err != nil {
+		return nil, &SourceError{Src: src, Err: cause(ctx, err)}
+	}
+	defer srcRdr.Close()
+	if listener != nil {
+		defer listener.Close()
+	}
+	//A source that stops sending is only interrupted by closing it
+	stopClose := context.AfterFunc(ctx, func() {
+		srcRdr.Close()
+		if listener != nil {
+			listener.Close()
+		}
+	})
+	defer stopClose()
+	if opts.Meter != nil {
+		opts.Meter.SetTotalBytes(getSourceSize(srcRdr))
+	}
+
+	inStrm, transpEnc, err := openSrcStream(srcRdr, srcOpts)
+	if err != nil {
+		return nil, &SourceError{Src: src, Err: cause(ctx, err)}
+	}
+	job := newRestoreJob(srcRdr, transpEnc, newListenerAcceptor(listener, srcOpts), srcOpts)
+	defer job.Close()
+	snapshotRdr, err := job.receive(srcRdr, inStrm, transpEnc)
+	if err != nil {
+		job.reporter.fail("Could not receive process state", err)
+		return nil, &SourceError{Src: src, Err: cause(ctx, err)}
+	}
+	defer snapshotRdr.Close()
+	if opts.Meter != nil {
+		opts.Meter.SetPhase("load")
+	}
+	provider := opts.Meter.Provider(snapshotRdr)
+	result := &RestoreResult{Name: snapshotRdr.GetName(), OrigPID: snapshotRdr.GetPID()}
+
+	if opts.Consumer != nil {
+		job.reporter.report(migration.StatusFailed, "The destination only inspects snapshots, it does not restore processes")
+		if err = lib.ConsumeContext(ctx, opts.Consumer, provider); err != nil {
+			return result, &LoadError{Name: result.Name, Err: err}
+		}
+		return result, nil
+	}
+	procWriter := opts.newProcWriter(pwriter.DefaultStdioSinks())
+	if job.mapFile != nil { //Passed to the loader rather than opened again by it
+		procWriter.SetMapFile(job.mapFile)
+	}
+	procWriter.SetPhaseFunc(func(phase pwriter.RestorePhase) {
+		job.reporter.reportPhase(phase)
+		if phase == pwriter.RestoreRunning {
+			result.PID = procWriter.GetPID()
+			if opts.Running != nil {
+				opts.Running(result.PID)
+			}
+		}
+	})
+	//Supervision only ends when the process does
+	if err = procWriter.ConsumeContext(ctx, provider); err != nil {
+		job.reporter.fail("Could not consume process snapshot", err)
+		return result, &LoadError{Name: result.Name, Err: cause(ctx, err)}
+	}
+	return result, nil
+}
@@ -0,0 +1,142 @@
+package pmigrate
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/migration"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//restoreJob receives one snapshot, from whichever streams its session consists
+// of, and keeps them open until the restore is over
+type restoreJob struct {
+	opts     srcOptions
+	acceptor streamAcceptor
+	reporter *restoreReporter
+	closers  []io.Closer
+	mapFile  *os.File //The snapshot file memory is mapped from, if any
+}
+
+//newRestoreJob prepares to receive the snapshot whose first stream arrived on
+// srcRdr, further streams of its session come from acceptor
+func newRestoreJob(srcRdr io.Reader, transpEnc transpenc.TranportEncoding, acceptor streamAcceptor, opts srcOptions) *restoreJob {
+	this := &restoreJob{
+		opts:     opts,
+		acceptor: acceptor,
+		reporter: newRestoreReporter(nil),
+	}
+	//Parent references are read from the snapshot, only snapshots stored locally
+	// are trusted to name the files and repositories to open
+	if !isLocalSource(srcRdr) {
+		this.opts.parents = remoteParents
+	}
+	//Sources migrating a process wait for it to be restored before halting theirs
+	if conn, isConn := srcRdr.(net.Conn); isConn && transpEnc.ReportRestore {
+		this.reporter = newRestoreReporter(conn)
+	} else if stream, isHTTP := srcRdr.(*httpStream); isHTTP && stream.reply != nil {
+		this.reporter.reply = stream.reply
+	}
+	return this
+}
+
+//remoteParents refuses to open the parents of incremental snapshots that were
+// not read from a local file or repository, as their sender controls the
+// parent reference and could have any local file or repository read into the
+// restored process
+func remoteParents(ref string) (*preader.ProcSnapReader, error) {
+	return nil, errs.New("Incremental snapshots are only restored from a local file or repository, the parent: %s of one received is not opened (merge the chain with pfrez merge before sending it)", ref)
+}
+
+//receive reads the snapshot header, inStrm is the decoded first stream.
+// Snapshots stored in files without transforms are read in place, the memory
+// of page aligned ones mapped from the file unless it is to be copied. Others
+// are streamed, their memory spans are read as the restore consumes them.
+func (this *restoreJob) receive(srcRdr io.Reader, inStrm *bufio.Reader, transpEnc transpenc.TranportEncoding) (lib.StateProvider, error) {
+	if file, isFile := srcRdr.(*os.File); isFile && file != os.Stdin && !transpEnc.Resumable && transpEnc.StreamCount <= 1 {
+		snapshot, err := indexSnapshot(file, transpEnc, this.opts.limits)
+		if err == nil {
+			if this.opts.mapFiles && transpEnc.PageAligned {
+				snapshot.MapFrom(file)
+				this.mapFile = file
+			}
+			this.reporter.report(migration.StatusReceived, "")
+			return snapshot, nil
+		} else if !errors.Is(err, preader.ErrNotIndexable) {
+			return nil, errs.Append(err, "Could not read process state from source")
+		}
+	}
+
+	inStrms := []preader.FlexReader{inStrm}
+	if transpEnc.Resumable {
+		conn, isConn := srcRdr.(net.Conn)
+		if !isConn {
+			return nil, errs.New("Source stream is resumable, but the source can not accept reconnections")
+		}
+		spool, lastConn, err := receiveResumable(conn, this.acceptor, transpEnc, inStrm, this.opts)
+		if err != nil {
+			return nil, errs.Append(err, "Could not receive resumable process state")
+		}
+		this.closers = append(this.closers, spool, lastConn)
+		if transpEnc.ReportRestore {
+			this.reporter = newRestoreReporter(lastConn)
+		}
+		if inStrms[0], err = spool.Reader(); err != nil {
+			return nil, errs.Append(err, "Could not read spooled process state")
+		}
+	} else if transpEnc.StreamCount > 1 {
+		var (
+			conns []io.Closer
+			err   error
+		)
+		inStrms, conns, err = acceptSrcStreams(this.acceptor, transpEnc, inStrm)
+		this.closers = append(this.closers, conns...)
+		if err != nil {
+			return nil, errs.Append(err, "Could not open parallel process state sources")
+		}
+	}
+
+	snapshot, err := preader.NewProcSnapStream(this.opts.limits, this.opts.chunks, this.opts.parents, inStrms...)
+	if err != nil {
+		return nil, errs.Append(err, "Could not read process state from source")
+	}
+	snapshot.SetEndFunc(func() { this.reporter.report(migration.StatusReceived, "") })
+	return snapshot, nil
+}
+
+//indexSnapshot indexes the snapshot in file, which must have been opened by
+// this process so it is read from its start. Snapshots stored with transforms
+// return preader.ErrNotIndexable.
+func indexSnapshot(file *os.File, transpEnc transpenc.TranportEncoding, limits preader.Limits) (*preader.ProcSnapIndex, error) {
+	if transforms, err := transpEnc.Chain(); err != nil || len(transforms) > 0 {
+		return nil, preader.ErrNotIndexable
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, preader.ErrNotIndexable
+	}
+	offset, err := transpenc.TranportEncodingLen(file)
+	if err != nil {
+		return nil, err
+	}
+	return preader.NewProcSnapIndex(limits, file, offset, info.Size())
+}
+
+//Close releases every stream and spool of the session, the first stream is left
+// to the caller that provided it
+func (this *restoreJob) Close() error {
+	var err error
+	for i := len(this.closers) - 1; i >= 0; i-- {
+		if closeErr := this.closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	this.closers = nil
+	return err
+}
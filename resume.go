@@ -0,0 +1,78 @@
+package pmigrate
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/resume"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//receiveResumable spools a resumable transfer, accepting reconnections of the
+// same session for up to opts.resumeTimeout after each broken connection. The
+// returned spool holds the complete snapshot, it and the connection that
+// completed it must be closed by the caller.
+func receiveResumable(conn net.Conn, acceptor streamAcceptor, first transpenc.TranportEncoding, inStrm *bufio.Reader, opts srcOptions) (*resume.Spool, net.Conn, error) {
+	spool, err := resume.NewSpool(opts.spoolDir, first.SessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		complete, err := receiveSpooled(conn, inStrm, spool)
+		if complete {
+			return spool, conn, nil
+		}
+		conn.Close()
+		log.Printf("Transfer interrupted after %d memory spans, waiting %s for the source to reconnect; Details:\n\t%s", spool.Spans(), opts.resumeTimeout, err)
+
+		if conn, inStrm, err = awaitReconnect(acceptor, first.SessionID, opts); err != nil {
+			spool.Close()
+			return nil, nil, err
+		}
+	}
+}
+
+//receiveSpooled tells the source where to continue from, then spools its
+// stream and acknowledges it once complete
+func receiveSpooled(conn net.Conn, inStrm *bufio.Reader, spool *resume.Spool) (bool, error) {
+	if err := resume.WriteAck(conn, spool.Spans()); err != nil {
+		return false, err
+	}
+	complete, err := spool.Receive(inStrm)
+	if err != nil {
+		return false, err
+	}
+	//The snapshot is complete either way, but without this the source can't
+	// know and will report a failure
+	if ackErr := resume.WriteAck(conn, spool.Spans()); ackErr != nil {
+		log.Printf("Could not acknowledge completed transfer; Details:\n\t%s", ackErr)
+	}
+	return complete, nil
+}
+
+//awaitReconnect accepts streams until one continues session sessionID, giving
+// up after opts.resumeTimeout
+func awaitReconnect(acceptor streamAcceptor, sessionID string, opts srcOptions) (net.Conn, *bufio.Reader, error) {
+	deadline := time.Now().Add(opts.resumeTimeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil, errs.New("The source did not reconnect within %s", opts.resumeTimeout)
+		}
+		conn, inStrm, transpEnc, err := acceptor.acceptStream(remaining)
+		if err == nil {
+			if transpEnc.Resumable && transpEnc.SessionID == sessionID {
+				return conn, inStrm, nil
+			}
+			conn.Close()
+			err = errs.New("Connection does not belong to session: %q", sessionID)
+		}
+		if time.Now().Before(deadline) {
+			log.Printf("Rejected connection while waiting for the source to reconnect; Details:\n\t%s", err)
+		}
+	}
+}
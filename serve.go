@@ -0,0 +1,316 @@
+package pmigrate
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+const (
+	//setupTimeout bounds how long a new connection may take to authenticate and
+	// describe its stream, and how long streams of a session wait for its first
+	setupTimeout = time.Minute
+	//acceptRetryDelay slows the accept loop down on errors such as running out
+	// of file descriptors
+	acceptRetryDelay = 100 * time.Millisecond
+)
+
+//Server restores every snapshot sent to its listeners, each in its own
+// goroutine, and keeps a registry of them
+type Server struct {
+	opts     RestoreOptions
+	srcOpts  srcOptions
+	registry *registry
+	slots    chan struct{} //Held by each restore while receiving and loading
+
+	lock     sync.Mutex
+	sessions map[string]*sessionAcceptor //Sessions that may still receive streams
+}
+
+//NewServer returns a server restoring up to maxRestores snapshots at once,
+// further sources are turned away until one of them runs
+func NewServer(opts RestoreOptions, maxRestores int) (*Server, error) {
+	if maxRestores < 1 {
+		return nil, optionsError("The number of concurrent restores must be at least 1, not: %d", maxRestores)
+	} else if opts.LoaderPath == "" {
+		return nil, optionsError("The path of the loader executable is required")
+	}
+	return &Server{
+		opts:     opts,
+		srcOpts:  opts.srcOptions(),
+		registry: newRegistry(),
+		slots:    make(chan struct{}, maxRestores),
+		sessions: make(map[string]*sessionAcceptor),
+	}, nil
+}
+
+//Serve restores the snapshots sent to listener until ctx is done or listener is
+// closed. Restored processes keep running, supervised by the server.
+func (this *Server) Serve(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Accept: %s failed; Details:\n\t%s", listener.Addr(), err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		go this.handleConn(conn)
+	}
+}
+
+//Restores returns every restore since the server started, until pruned, in
+// the order they began
+func (this *Server) Restores() []RestoreEntry {
+	return this.registry.list()
+}
+
+//Running returns how many restored processes are running
+func (this *Server) Running() int {
+	return this.registry.running()
+}
+
+//Kill terminates the restored process of the restore with id
+func (this *Server) Kill(id int) error {
+	return this.registry.kill(id)
+}
+
+//Prune forgets every restore that has exited or failed, returning how many
+func (this *Server) Prune() int {
+	return this.registry.prune()
+}
+
+//handleConn reads the transport encoding of a new connection, then either
+// starts restoring the session it begins or hands it to the session it joins
+func (this *Server) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(setupTimeout))
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with: %s failed; Details:\n\t%s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	inStrm, transpEnc, err := openSrcStream(conn, this.srcOpts)
+	if err != nil {
+		log.Printf("Could not open source stream from: %s; Details:\n\t%s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	stream := acceptedStream{conn: conn, inStrm: inStrm, transpEnc: transpEnc}
+	acceptor, begins := this.route(transpEnc)
+	if !begins {
+		acceptor.deliver(stream)
+		return
+	}
+
+	select {
+	case this.slots <- struct{}{}:
+		this.restore(conn, conn.RemoteAddr().String(), inStrm, transpEnc, acceptor)
+	default:
+		err = errs.New("%d restores are already in progress", cap(this.slots))
+		log.Printf("Turned away source: %s; Details:\n\t%s", conn.RemoteAddr(), err)
+		if transpEnc.ReportRestore {
+			newRestoreReporter(conn).fail("Destination is busy", err)
+		}
+		this.endSession(transpEnc.SessionID, acceptor)
+		conn.Close()
+	}
+}
+
+//route finds the session a stream belongs to, and reports if the stream begins
+// it. Other streams of a parallel transfer may arrive before the first one, so
+// whichever arrives first registers the session.
+func (this *Server) route(transpEnc transpenc.TranportEncoding) (*sessionAcceptor, bool) {
+	if transpEnc.SessionID == "" { //Sources predating sessions send a single stream
+		return newSessionAcceptor(), true
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	acceptor := this.sessions[transpEnc.SessionID]
+	if acceptor == nil {
+		acceptor = newSessionAcceptor()
+		this.sessions[transpEnc.SessionID] = acceptor
+		if transpEnc.StreamIndex != 0 {
+			time.AfterFunc(setupTimeout, func() {
+				this.lock.Lock()
+				defer this.lock.Unlock()
+				if !acceptor.owned {
+					log.Printf("The first stream of session: %q never arrived", transpEnc.SessionID)
+					this.endSessionLocked(transpEnc.SessionID, acceptor)
+				}
+			})
+		}
+	}
+	//Resumable sessions reconnect with stream index 0, once owned those are
+	// delivered like any other stream
+	if transpEnc.StreamIndex == 0 && !acceptor.owned {
+		acceptor.owned = true
+		return acceptor, true
+	}
+	return acceptor, false
+}
+
+//endSession stops a session from receiving further streams
+func (this *Server) endSession(sessionID string, acceptor *sessionAcceptor) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.endSessionLocked(sessionID, acceptor)
+}
+
+func (this *Server) endSessionLocked(sessionID string, acceptor *sessionAcceptor) {
+	if this.sessions[sessionID] == acceptor {
+		delete(this.sessions, sessionID)
+	}
+	acceptor.Close()
+}
+
+//restore receives and restores the snapshot of a session, whose first stream
+// arrived on src from remote, supervising the restored process until it exits.
+// The caller's slot is released once the process runs or the restore fails.
+func (this *Server) restore(src io.ReadCloser, remote string, inStrm *bufio.Reader, transpEnc transpenc.TranportEncoding, acceptor *sessionAcceptor) {
+	//PTRACE events are only delivered to the thread that attached, which the
+	// supervisor keeps using for as long as the process runs. The thread is not
+	// unlocked so it exits with this goroutine.
+	runtime.LockOSThread()
+	defer src.Close()
+
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			<-this.slots
+		}
+	}
+	defer release()
+
+	id := this.registry.add(transpEnc.SessionID, remote)
+	fail := func(reporter *restoreReporter, msg string, err error) {
+		log.Printf("Restore %d from: %s failed, %s; Details:\n\t%s", id, remote, msg, err)
+		reporter.fail(msg, err)
+		this.registry.update(id, func(entry *RestoreEntry) {
+			entry.State, entry.Error = StateFailed, msg+": "+err.Error()
+		})
+	}
+
+	job := newRestoreJob(src, transpEnc, acceptor, this.srcOpts)
+	defer job.Close()
+	snapshotRdr, err := job.receive(src, inStrm, transpEnc)
+	this.endSession(transpEnc.SessionID, acceptor)
+	if err != nil {
+		fail(job.reporter, "Could not receive process state", err)
+		return
+	}
+	defer snapshotRdr.Close()
+	this.registry.update(id, func(entry *RestoreEntry) {
+		entry.Name, entry.OrigPID, entry.State = snapshotRdr.GetName(), snapshotRdr.GetPID(), StateLoading
+	})
+
+	//Restored processes don't share the daemon's input
+	procWriter := this.opts.newProcWriter(pwriter.StdioSinks{Stdout: os.Stdout, Stderr: os.Stderr})
+	procWriter.SetPhaseFunc(func(phase pwriter.RestorePhase) {
+		job.reporter.reportPhase(phase)
+		if phase == pwriter.RestoreRunning {
+			pid := procWriter.GetPID()
+			this.registry.update(id, func(entry *RestoreEntry) {
+				entry.PID, entry.State = pid, StateRunning
+			})
+			log.Printf("Restore %d from: %s is running %q as PID: %d", id, remote, snapshotRdr.GetName(), pid)
+			if this.opts.Running != nil {
+				this.opts.Running(pid)
+			}
+			release()
+		}
+	})
+	err = procWriter.Consume(snapshotRdr)
+	if !released {
+		if err == nil {
+			err = errs.New("The restore ended before the process ran")
+		}
+		fail(job.reporter, "Could not consume process snapshot", err)
+		return
+	}
+	//Supervision only ends when the process does
+	this.registry.update(id, func(entry *RestoreEntry) {
+		entry.State = StateExited
+		if err != nil {
+			entry.Error = err.Error()
+		}
+	})
+	log.Printf("Restored process %d (PID: %d) exited", id, procWriter.GetPID())
+}
+
+//acceptedStream is a connection whose transport encoding has been read
+type acceptedStream struct {
+	conn      net.Conn
+	inStrm    *bufio.Reader
+	transpEnc transpenc.TranportEncoding
+}
+
+//sessionAcceptor hands the streams a Server routes to a session to its
+// restore, it implements streamAcceptor
+type sessionAcceptor struct {
+	streams   chan acceptedStream
+	done      chan struct{}
+	closeOnce sync.Once
+	owned     bool //Guarded by server.lock, set once the first stream arrived
+}
+
+func newSessionAcceptor() *sessionAcceptor {
+	return &sessionAcceptor{
+		streams: make(chan acceptedStream),
+		done:    make(chan struct{}),
+	}
+}
+
+func (this *sessionAcceptor) acceptStream(timeout time.Duration) (net.Conn, *bufio.Reader, transpenc.TranportEncoding, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case stream := <-this.streams:
+		return stream.conn, stream.inStrm, stream.transpEnc, nil
+	case <-expired:
+		return nil, nil, transpenc.TranportEncoding{}, errs.New("No further stream of the session arrived within %s", timeout)
+	case <-this.done:
+		return nil, nil, transpenc.TranportEncoding{}, errs.New("The session is over")
+	}
+}
+
+//deliver waits for the session's restore to take stream, closing it if the
+// session ends first
+func (this *sessionAcceptor) deliver(stream acceptedStream) {
+	select {
+	case this.streams <- stream:
+	case <-this.done:
+		log.Printf("Closed stream from: %s, its session is over", stream.conn.RemoteAddr())
+		stream.conn.Close()
+	}
+}
+
+func (this *sessionAcceptor) Close() error {
+	this.closeOnce.Do(func() { close(this.done) })
+	return nil
+}
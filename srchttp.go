@@ -0,0 +1,182 @@
+package pmigrate
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/endpoint"
+	"github.com/tarndt/pmigrate/lib/migration"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//httpStream is a snapshot carried by the body of an HTTP request or response.
+// Its transport encoding is read from the headers, when sent there.
+type httpStream struct {
+	io.ReadCloser
+	transpEnc *transpenc.TranportEncoding
+	remote    string
+	reply     chan httpReply //Answers a request once the restore runs or fails
+}
+
+//httpReply is the outcome of a restore an HTTP request is answered with
+type httpReply struct {
+	status migration.Status
+	detail string
+}
+
+//isHTTPSrc reports if src is an http:// or https:// URL
+func isHTTPSrc(src string) bool {
+	lower := strings.ToLower(src)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+//newHTTPStream reads the transport encoding from header, if present, for body
+func newHTTPStream(body io.ReadCloser, header http.Header, remote string) (*httpStream, error) {
+	this := &httpStream{ReadCloser: body, remote: remote}
+	var transpEnc transpenc.TranportEncoding
+	if present, err := transpenc.ReadTranportEncodingHeader(header, &transpEnc); err != nil {
+		return nil, err
+	} else if present {
+		this.transpEnc = &transpEnc
+	}
+	return this, nil
+}
+
+//pullHTTP downloads the snapshot at the URL ep, such as a snapshot file on a
+// web server, authenticating with a bearer token if one is given, until ctx is
+// done
+func pullHTTP(ctx context.Context, ep *endpoint.Endpoint, opts endpoint.Options) (io.ReadCloser, error) {
+	tlsCfg, err := tlscfg.ClientConfig(opts.TLS)
+	if err != nil {
+		return nil, errs.Append(err, "Could not configure TLS")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.String(), nil)
+	if err != nil {
+		return nil, errs.Append(err, "Invalid HTTP source: %q", ep)
+	}
+	if opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.Token)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsCfg,
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errs.Append(err, "HTTP request to: %s failed", req.URL.Redacted())
+	}
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPReply))
+		resp.Body.Close()
+		return nil, errs.New("HTTP source: %s responded: %s; %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(reply)))
+	}
+	stream, err := newHTTPStream(resp.Body, resp.Header, req.URL.Host)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+//ListenHTTP listens on addr for HTTP requests, or HTTPS if a TLS certificate
+// is configured, for Server.ServeRequests
+func ListenHTTP(addr string, tlsOpts tlscfg.Options) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errs.Append(err, "Listen: tcp/%s failed", addr)
+	}
+	if tlsOpts.CertFile == "" {
+		return listener, nil
+	}
+	cfg, err := tlscfg.ServerConfig(tlsOpts)
+	if err != nil {
+		listener.Close()
+		return nil, errs.Append(err, "Could not configure TLS")
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+	return tls.NewListener(listener, cfg), nil
+}
+
+//ServeRequests restores the snapshots sent to listener with POST or PUT
+// requests until ctx is done or listener is closed, see ServeHTTP
+func (this *Server) ServeRequests(ctx context.Context, listener net.Listener) error {
+	srv := &http.Server{
+		Handler:           this,
+		ReadHeaderTimeout: setupTimeout,
+	}
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		return errs.Append(err, "HTTP server on: %s failed", listener.Addr())
+	}
+	return nil
+}
+
+//ServeHTTP restores the snapshot sent as the body of a POST or PUT request,
+// which must carry the server's bearer token if it has one. The request is
+// answered once the restore runs, or with the reason it failed.
+func (this *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Snapshots are sent with POST or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	if token := this.opts.HTTPToken; token != "" {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			log.Printf("Turned away HTTP source: %s without a valid bearer token", req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pthaw"`)
+			http.Error(w, "A valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	stream, err := newHTTPStream(req.Body, req.Header, req.RemoteAddr)
+	var inStrm *bufio.Reader
+	var transpEnc transpenc.TranportEncoding
+	if err == nil {
+		inStrm, transpEnc, err = openSrcStream(stream, this.srcOpts)
+	}
+	if err == nil && (transpEnc.StreamCount > 1 || transpEnc.Resumable) {
+		err = errs.New("Snapshots sent over HTTP must be a single stream that is not resumable")
+	}
+	if err != nil {
+		log.Printf("Could not open source stream from: %s; Details:\n\t%s", req.RemoteAddr, err)
+		http.Error(w, "Could not open source stream: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stream.reply = make(chan httpReply, 1)
+	acceptor, _ := this.route(transpenc.TranportEncoding{}) //A session of its own
+	select {
+	case this.slots <- struct{}{}:
+		go this.restore(stream, req.RemoteAddr, inStrm, transpEnc, acceptor)
+	default:
+		log.Printf("Turned away HTTP source: %s; Details:\n\t%d restores are already in progress", req.RemoteAddr, cap(this.slots))
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Destination is busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case reply := <-stream.reply:
+		if reply.status == migration.StatusRunning {
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, "Restored process is running\n")
+		} else {
+			http.Error(w, reply.detail, http.StatusInternalServerError)
+		}
+	case <-req.Context().Done(): //The source went away, the restore continues
+	}
+}
@@ -0,0 +1,51 @@
+package pmigrate
+
+import (
+	"log"
+	"net"
+
+	"github.com/tarndt/pmigrate/lib/migration"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+)
+
+//restoreReporter tells the source of a two-phase migration how the restore is
+// progressing, so it only halts the original process once this one runs. A
+// reporter without a connection (the source did not ask) does nothing. HTTP
+// sources are instead answered once, when the process runs or the restore fails.
+type restoreReporter struct {
+	conn  net.Conn
+	reply chan<- httpReply
+}
+
+func newRestoreReporter(conn net.Conn) *restoreReporter {
+	return &restoreReporter{conn: conn}
+}
+
+func (this *restoreReporter) report(status migration.Status, detail string) {
+	if this.reply != nil && (status == migration.StatusRunning || status == migration.StatusFailed) {
+		this.reply <- httpReply{status: status, detail: detail}
+		this.reply = nil
+	}
+	if this.conn == nil {
+		return
+	}
+	if err := migration.WriteStatus(this.conn, status, detail); err != nil {
+		log.Printf("Could not report restore progress to the source, it will resume the original process; Details:\n\t%s", err)
+		this.conn = nil
+	}
+}
+
+//reportPhase is a pwriter.ProcWriter phase callback
+func (this *restoreReporter) reportPhase(phase pwriter.RestorePhase) {
+	switch phase {
+	case pwriter.RestoreLoaded:
+		this.report(migration.StatusLoaded, "")
+	case pwriter.RestoreRunning:
+		this.report(migration.StatusRunning, "")
+	}
+}
+
+//fail reports the restore failed, so the source resumes the original process
+func (this *restoreReporter) fail(msg string, err error) {
+	this.report(migration.StatusFailed, msg+": "+err.Error())
+}
@@ -0,0 +1,190 @@
+package pmigrate
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/iotimeout"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/progress"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//srcOptions collects everything needed to decode a source stream
+type srcOptions struct {
+	keyDir, dictDir          string
+	identity, authorizedKeys string
+	spoolDir                 string
+	readTimeout              time.Duration
+	resumeTimeout            time.Duration
+	allowLegacy              bool                 //Accept streams not encrypted with an AEAD mode
+	chunks                   lib.ChunkSource      //Of the source repository, for chunked snapshots
+	parents                  preader.ParentOpener //Opens the parents of incremental snapshots
+	limits                   preader.Limits       //Bound the snapshot read from the streams
+	mapFiles                 bool                 //Map memory from page aligned snapshot files
+	limiter                  *progress.Limiter    //Of the bytes received, shared by all sources
+	meter                    *progress.Meter
+}
+
+//openSrcStream authenticates srcRdr if requested, reads its transport encoding
+// and returns a reader of the decoded snapshot stream
+func openSrcStream(srcRdr io.Reader, opts srcOptions) (*bufio.Reader, transpenc.TranportEncoding, error) {
+	var transpEnc transpenc.TranportEncoding
+
+	httpSrc, isHTTP := srcRdr.(*httpStream)
+	var sessionKey []byte
+	if opts.identity != "" {
+		if isHTTP {
+			return nil, transpEnc, errs.New("HTTP sources can not take part in a key exchange, use https and -http-token instead of -identity")
+		}
+		session, err := getSrcSession(srcRdr, opts.identity, opts.authorizedKeys, opts.readTimeout)
+		if err != nil {
+			return nil, transpEnc, errs.Append(err, "Could not authenticate process state source")
+		}
+		sessionKey = session.RecvKey
+	}
+
+	var timeoutRdr io.Reader
+	if opts.readTimeout > 0 {
+		timeoutRdr = iotimeout.WrapReadTimeout(srcRdr, opts.readTimeout)
+	} else {
+		timeoutRdr = srcRdr
+	}
+
+	//Throughput is measured and limited in bytes received, before decompression
+	inStrm := bufio.NewReader(opts.limiter.Reader(opts.meter.Reader(timeoutRdr)))
+	if isHTTP && httpSrc.transpEnc != nil { //Sent in the HTTP headers
+		transpEnc = *httpSrc.transpEnc
+	} else if err := transpenc.ReadTranportEncoding(inStrm, &transpEnc); err != nil {
+		return nil, transpEnc, errs.Append(err, "Could not read transport encoding of source stream")
+	}
+
+	//The transport encoding itself is not authenticated, anyone on the path of a
+	// stream received could rewrite it to an unauthenticated mode and replace the
+	// data, so it is only trusted once it names an AEAD mode, which fails on any
+	// stream it did not seal. Sessions are always encrypted, so a stream that
+	// isn't was not sent by the peer.
+	if !transpEnc.IsAuthenticated() {
+		switch {
+		case sessionKey != nil:
+			return nil, transpEnc, errs.New("Source stream of an authenticated session is not encrypted with AES-GCM or CHACHA20-POLY1305")
+		case !opts.allowLegacy && !isLocalSource(srcRdr):
+			return nil, transpEnc, errs.New("Source stream is not encrypted with AES-GCM or CHACHA20-POLY1305, specify -allow-unauthenticated to accept it from older senders")
+		}
+	}
+	if algo := transpEnc.DeprecatedEncryption(); algo != "" {
+		log.Printf("Warning: Source stream is encrypted with the deprecated %s mode, its contents can not be authenticated.", algo)
+	}
+
+	decodeOpts := transpenc.DecodeOptions{KeyDir: opts.keyDir, DictDir: opts.dictDir, SessionKey: sessionKey}
+	srcDecoder, err := transpenc.NewDecoder(inStrm, transpEnc, decodeOpts)
+	if err != nil {
+		return nil, transpEnc, errs.Append(err, "Could not create source decoder")
+	}
+	return bufio.NewReader(srcDecoder), transpEnc, nil
+}
+
+//isLocalSource reports if srcRdr is a local file or repository snapshot, which
+// only those with access to the host could have altered, rather than a stream
+// received or read from stdin
+func isLocalSource(srcRdr io.Reader) bool {
+	file, isFile := srcRdr.(*os.File)
+	return isFile && file != os.Stdin
+}
+
+//streamAcceptor hands out the further streams of a session, such as the other
+// streams of a parallel transfer or the reconnections of a resumable one
+type streamAcceptor interface {
+	//acceptStream returns the next stream with its transport encoding read,
+	// giving up after timeout (0 waits indefinitely)
+	acceptStream(timeout time.Duration) (net.Conn, *bufio.Reader, transpenc.TranportEncoding, error)
+}
+
+//listenerAcceptor accepts streams from a listener dedicated to one session
+type listenerAcceptor struct {
+	listener net.Listener
+	opts     srcOptions
+}
+
+func newListenerAcceptor(listener net.Listener, opts srcOptions) *listenerAcceptor {
+	return &listenerAcceptor{listener: listener, opts: opts}
+}
+
+//acceptStream closes the listener if timeout passes, as there's no other way to
+// interrupt Accept
+func (this *listenerAcceptor) acceptStream(timeout time.Duration) (net.Conn, *bufio.Reader, transpenc.TranportEncoding, error) {
+	if this.listener == nil {
+		return nil, nil, transpenc.TranportEncoding{}, errs.New("The source can not accept further streams")
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { this.listener.Close() })
+		defer timer.Stop()
+	}
+	conn, err := acceptSrcConn(this.listener)
+	if err != nil {
+		return nil, nil, transpenc.TranportEncoding{}, err
+	}
+	if timeout > 0 { //Don't let a silent connection hold up the wait
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	inStrm, transpEnc, err := openSrcStream(conn, this.opts)
+	if err != nil {
+		conn.Close()
+		return nil, nil, transpEnc, errs.Append(err, "Could not open source stream from: %s", conn.RemoteAddr())
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, inStrm, transpEnc, nil
+}
+
+//acceptSrcStreams accepts the streams of a session beyond the first one (which
+// described the session in first) and returns all of them in stream order
+func acceptSrcStreams(acceptor streamAcceptor, first transpenc.TranportEncoding, firstStrm *bufio.Reader) ([]preader.FlexReader, []io.Closer, error) {
+	inStrms := make([]preader.FlexReader, first.StreamCount)
+	if first.StreamIndex != 0 {
+		return nil, nil, errs.New("The first source stream must carry stream index 0, not %d", first.StreamIndex)
+	}
+	inStrms[0] = firstStrm
+
+	var conns []io.Closer
+	for received := 1; received < first.StreamCount; received++ {
+		conn, inStrm, transpEnc, err := acceptor.acceptStream(0)
+		if err != nil {
+			return nil, conns, err
+		}
+		conns = append(conns, conn)
+
+		switch {
+		case transpEnc.SessionID != first.SessionID || transpEnc.StreamCount != first.StreamCount:
+			return nil, conns, errs.New("Source stream from: %s does not belong to session: %q", conn.RemoteAddr(), first.SessionID)
+		case transpEnc.StreamIndex < 1 || transpEnc.StreamIndex >= len(inStrms):
+			return nil, conns, errs.New("Source stream index %d is out of range for %d streams", transpEnc.StreamIndex, first.StreamCount)
+		case inStrms[transpEnc.StreamIndex] != nil:
+			return nil, conns, errs.New("Source stream index %d was received more than once", transpEnc.StreamIndex)
+		}
+		inStrms[transpEnc.StreamIndex] = inStrm
+	}
+	return inStrms, conns, nil
+}
+
+//acceptSrcConn waits for a connection, completing TLS handshakes immediately so
+// certificate problems are reported as such
+func acceptSrcConn(listener net.Listener) (net.Conn, error) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, errs.Append(err, "Accept: %s failed", listener.Addr())
+	}
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errs.Append(err, "TLS handshake with: %s failed", conn.RemoteAddr())
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,123 @@
+package pmigrate
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/endpoint"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/s3"
+	"github.com/tarndt/pmigrate/lib/tlscfg"
+)
+
+//getSourceReader opens src, for connection oriented sockets the listener is
+// also returned (and must be closed by the caller) so additional streams of a
+// parallel transfer can be accepted
+func getSourceReader(ctx context.Context, src, httpToken string, tlsOpts tlscfg.Options) (io.ReadCloser, net.Listener, error) {
+	ep, err := endpoint.Parse(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ep.Connected() {
+		srcRdr, err := ep.Open(ctx, endpoint.Options{NetOptions: endpoint.NetOptions{TLS: tlsOpts}, Token: httpToken})
+		return srcRdr, nil, err
+	}
+	//Network and unix sockets, wait for/build connection
+	listener, err := ep.Listen(endpoint.NetOptions{TLS: tlsOpts})
+	if err != nil {
+		return nil, nil, err
+	}
+	//Waiting for a source to connect ends with ctx
+	stopWait := context.AfterFunc(ctx, func() { listener.Close() })
+	conn, err := acceptSrcConn(listener)
+	stopWait()
+	if err != nil {
+		listener.Close()
+		return nil, nil, cause(ctx, err)
+	}
+	return conn, listener, nil
+}
+
+//getSourceSize returns the length of sources known in advance, that of files and
+// objects, or 0
+func getSourceSize(srcRdr io.Reader) int64 {
+	switch src := srcRdr.(type) {
+	case *os.File:
+		if info, err := src.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	case interface{ Size() int64 }:
+		return src.Size()
+	}
+	return 0
+}
+
+//openRepoSnapshot opens the snapshot a repo:/path[@ref] source names, the
+// reference being an ID or tag, without one the newest snapshot is restored
+func openRepoSnapshot(ctx context.Context, ep *endpoint.Endpoint, opts endpoint.Options) (io.ReadCloser, error) {
+	dir, ref, err := prepo.ParseTarget(ep.String())
+	if err != nil {
+		return nil, err
+	}
+	repo, err := prepo.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	file, snap, err := repo.OpenSnapshot(ref)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Restoring snapshot %s of %q (PID: %d on %s) taken %s", snap.ID, snap.Name, snap.OrigPID, snap.Host, snap.Created.Format(time.RFC3339))
+	return file, nil
+}
+
+//openObject downloads the s3://bucket/key object storage source a range at a
+// time as it is restored
+func openObject(ctx context.Context, ep *endpoint.Endpoint, opts endpoint.Options) (io.ReadCloser, error) {
+	bucket, key, err := s3.ParseURL(ep.String())
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := s3.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.Open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+//openRepoChunks opens the chunk store of the repository a repo:/path[@ref]
+// source names, from which chunked snapshots resolve their memory pages
+func openRepoChunks(src string) (lib.ChunkSource, error) {
+	dir, _, err := prepo.ParseTarget(src)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := prepo.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	return repo.Chunks()
+}
+
+//ListenSource listens on a socket source such as tcp://:9000, tcp:9000 or
+// unix:///run/pthaw.sock, for Server.Serve
+func ListenSource(src string, tlsOpts tlscfg.Options) (net.Listener, error) {
+	ep, err := endpoint.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return ep.Listen(endpoint.NetOptions{TLS: tlsOpts})
+}
@@ -0,0 +1,38 @@
+package pmigrate
+
+import (
+	"net"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib/peerauth"
+)
+
+func getSrcSession(srcRdr interface{}, identityPath, authorizedKeysPath string, timeout time.Duration) (*peerauth.Session, error) {
+	conn, isConn := srcRdr.(net.Conn)
+	if !isConn {
+		return nil, errs.New("Peer authentication requires a tcp, udp, tls or unix socket source")
+	}
+	if authorizedKeysPath == "" {
+		return nil, errs.New("An authorized keys file must be provided to authenticate the source")
+	}
+
+	identity, err := peerauth.LoadIdentity(identityPath)
+	if err != nil {
+		return nil, err
+	}
+	authorizedKeys, err := peerauth.LoadTrustedKeys(authorizedKeysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	session, err := peerauth.Server(conn, identity, authorizedKeys)
+	if err != nil {
+		return nil, errs.Append(err, "Handshake with source failed")
+	}
+	return session, nil
+}
@@ -0,0 +1,203 @@
+package pmigrate
+
+import (
+	"context"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//teeDest is one of several destinations a snapshot is written to at once, with
+// its own compression, encryption and failure policy
+type teeDest struct {
+	opts     destOptions
+	required bool
+	stream   *destStream
+	status   bool //Reports the outcome of its restore
+}
+
+//checkpointTee captures the target once and writes a snapshot of it to every
+// destination concurrently, each encoded on its own. The snapshot fails if a
+// required destination fails, best-effort ones are only reported. With halt,
+// the target is killed once every required socket destination reports it
+// restored, or resumed if any does not.
+func checkpointTee(ctx context.Context, pid int, opts CheckpointOptions) (*CheckpointResult, error) {
+	if opts.Streams != 1 || opts.ResumeTimeout > 0 {
+		return nil, optionsError("Multiple destinations can not be combined with multiple streams or resumable transfers")
+	}
+	var (
+		dests   = make([]*teeDest, len(opts.Dests))
+		stdouts = 0
+		hasRepo = false
+	)
+	for i, dest := range opts.Dests {
+		destOpts, err := opts.destOptions(dest, pid)
+		if err != nil {
+			return nil, err
+		}
+		destOpts.ctx = ctx
+		if destOpts.dest == "stdout" {
+			stdouts++
+		}
+		//Only repositories have a chunk store to deduplicate pages in
+		destOpts.dedup = opts.Dedup && prepo.IsRepo(destOpts.dest)
+		hasRepo = hasRepo || destOpts.dedup
+		dests[i] = &teeDest{
+			opts:     destOpts,
+			required: !dest.BestEffort,
+			//Halting the target only once they confirm its restore makes this a
+			// migration to the required socket destinations
+			status: !dest.BestEffort && opts.Halt && isSocketDest(destOpts.dest),
+		}
+	}
+	switch {
+	case stdouts > 1:
+		return nil, optionsError("Only one destination can be stdout")
+	case opts.Dedup && !hasRepo:
+		return nil, optionsError("Deduplication requires a repo: destination")
+	case opts.Dedup && opts.Parent != "":
+		return nil, optionsError("Incremental snapshots can not be combined with deduplication")
+	case opts.PageAlign && (opts.Dedup || opts.Parent != ""):
+		return nil, optionsError("Page aligned snapshots can not be combined with deduplication or incremental snapshots")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	//The parent is read before the target is frozen
+	if opts.Parent != "" {
+		parent, err := resolveParent(opts.Parent)
+		if err == nil {
+			var parentPages pwriter.PageIndex
+			if parentPages, err = indexParent(parent, opts.Decode); err == nil {
+				for _, dest := range dests {
+					dest.opts.parent, dest.opts.parentPages = parent, parentPages
+				}
+			}
+		}
+		if err != nil {
+			return nil, &OptionsError{Msg: errs.Append(err, "Could not read parent snapshot").Error()}
+		}
+	}
+
+	//Connect every destination before capture starts, so the target is not
+	// frozen any longer than necessary
+	var (
+		result  = new(CheckpointResult)
+		targets []pwriter.TeeTarget
+		open    []*teeDest
+	)
+	abortAll := func() {
+		for _, dest := range open {
+			dest.stream.abort() //Incomplete snapshots must not be stored
+		}
+	}
+	for _, dest := range dests {
+		err := dest.open()
+		if err == nil {
+			var wtr *pwriter.ProcSnapshotWriter
+			if wtr, err = newSnapshotWriter(dest.stream, dest.opts); err == nil {
+				targets, open = append(targets, pwriter.TeeTarget{Consumer: wtr, Required: dest.required}), append(open, dest)
+				continue
+			}
+			dest.stream.abort()
+		}
+		err = &DestinationError{Dest: dest.opts.dest, Err: errs.Append(err, "Could not open destination")}
+		if dest.required {
+			abortAll()
+			return nil, err
+		}
+		result.Failed = append(result.Failed, err)
+	}
+	if len(targets) == 0 {
+		return nil, &DestinationError{Dest: dests[0].opts.dest, Err: errs.New("None of the destinations could be opened")}
+	}
+
+	rdr, err := attach(ctx, pid)
+	if err != nil {
+		abortAll()
+		return nil, err
+	}
+	defer rdr.Close() //Resumes the target unless it is killed
+	result.Name = rdr.GetName()
+
+	tee := pwriter.NewTeeSnapshotWriter(targets)
+	target := newTargetProvider(rdr)
+	if err = lib.ConsumeContext(ctx, tee, opts.Meter.Provider(target)); err != nil {
+		abortAll()
+		return nil, target.consumeError(ctx, failedDest(open, tee.Errors()), err)
+	}
+
+	//Complete every destination, those awaiting a restore stay open for its status
+	var status []*teeDest
+	abortRest := func(i int) {
+		for _, dest := range append(status, open[i+1:]...) {
+			dest.stream.abort()
+		}
+	}
+	for i, dest := range open {
+		err := tee.Errors()[i]
+		if err == nil && dest.status {
+			if err = pwriter.WriteSpansEnd(dest.stream); err == nil {
+				if err = dest.stream.finish(); err == nil {
+					status = append(status, dest)
+					result.Written = append(result.Written, dest.opts.dest)
+					continue
+				}
+			}
+		} else if err == nil {
+			err = dest.stream.Close()
+		}
+		if err == nil {
+			result.Written = append(result.Written, describeDest(dest.opts.dest, dest.stream))
+			continue
+		}
+		dest.stream.abort()
+		err = &DestinationError{Dest: dest.opts.dest, Err: cause(ctx, errs.Append(err, "Could not complete transmission"))}
+		if dest.required {
+			abortRest(i)
+			return nil, err
+		}
+		result.Failed = append(result.Failed, err)
+	}
+
+	if !opts.Halt {
+		return result, nil
+	}
+	for i, dest := range status {
+		err := dest.stream.awaitRestore(opts.RestoreTimeout)
+		dest.stream.Close()
+		if err != nil {
+			for _, rest := range status[i+1:] {
+				rest.stream.abort()
+			}
+			return nil, &MigrationError{Dest: dest.opts.dest, PID: pid, Err: cause(ctx, err)}
+		}
+	}
+	result.Halted = halt(rdr)
+	return result, nil
+}
+
+//open connects the destination, each in a session of its own
+//failedDest returns the destination whose failure stopped a capture, the
+// first required one that failed, otherwise the first
+func failedDest(open []*teeDest, failures []error) string {
+	for i, dest := range open {
+		if dest.required && failures[i] != nil {
+			return dest.opts.dest
+		}
+	}
+	return open[0].opts.dest
+}
+
+func (this *teeDest) open() error {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	this.stream, err = openDestStream(this.opts, transpenc.TranportEncoding{SessionID: sessionID, ReportRestore: this.status})
+	return err
+}
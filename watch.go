@@ -0,0 +1,463 @@
+package pmigrate
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/errs"
+	"github.com/tarndt/pmigrate/lib"
+	"github.com/tarndt/pmigrate/lib/preader"
+	"github.com/tarndt/pmigrate/lib/prepo"
+	"github.com/tarndt/pmigrate/lib/pwriter"
+	"github.com/tarndt/pmigrate/lib/s3"
+	"github.com/tarndt/pmigrate/lib/transpenc"
+)
+
+//Checkpoints are named checkpoint-<pid>-<UTC timestamp>.snapshot, and carry an
+// additional .partial suffix until completely written
+const (
+	checkpointExt   = ".snapshot"
+	partialExt      = ".partial"
+	checkpointStamp = "20060102T150405.000Z"
+)
+
+//WatchOptions are the settings of a Watcher, whose CheckpointOptions have a
+// single destination and can not halt, use multiple streams, resumable
+// transfers, an identity, a parent or a meter
+type WatchOptions struct {
+	CheckpointOptions
+	Interval time.Duration //Optional: Write a checkpoint into the destination directory or repository this often
+	Keep     int           //Number of the newest checkpoints to keep in a destination directory or repository (0 keeps all)
+}
+
+//WatchRequest asks a Watcher for a checkpoint, the settings of Dest which are
+// set override those of the watcher for this checkpoint only
+type WatchRequest struct {
+	Dest Destination
+	Halt bool //Kill the target once checkpointed
+}
+
+//WatchResult describes a checkpoint a Watcher wrote
+type WatchResult struct {
+	Path   string        //Of the checkpoint, for repositories including its snapshot ID
+	Frozen time.Duration //How long the target was frozen
+}
+
+//trigger is a pending checkpoint, done (if any) receives its outcome
+type trigger struct {
+	req  WatchRequest
+	done chan watchResponse
+	tick bool //Of the interval, rather than requested
+}
+
+type watchResponse struct {
+	result WatchResult
+	err    error
+}
+
+//Watcher stays attached to a target, capturing it whenever triggered
+type Watcher struct {
+	rdr      *preader.ProcReader
+	opts     destOptions
+	interval time.Duration
+	keep     int
+	prefix   string
+	triggers chan trigger
+	stopping int32
+
+	lock    sync.Mutex
+	stopped bool //Set once no further triggers are served
+}
+
+//Watch attaches to the process with pid, which stays frozen until Run is
+// called. PTRACE requests are only accepted from the thread that attached, so
+// Watch locks the calling goroutine to its thread and Run must be called from
+// the same goroutine, it unlocks the thread when it returns.
+func Watch(pid int, opts WatchOptions) (*Watcher, error) {
+	if len(opts.Dests) != 1 {
+		return nil, optionsError("Checkpoints require a single destination")
+	}
+	dest, err := opts.destOptions(opts.Dests[0], pid)
+	if err != nil {
+		return nil, err
+	}
+	switch info, statErr := os.Stat(dest.dest); {
+	case opts.Interval > 0 && !prepo.IsRepo(dest.dest) && (statErr != nil || !info.IsDir()):
+		return nil, optionsError("Periodic checkpoints require the destination to be an existing directory or a repository, not: %q", dest.dest)
+	case dest.dest == "stdout":
+		return nil, optionsError("Checkpoints can not be written to stdout")
+	case opts.Halt || opts.Consumer != nil || opts.Streams > 1 || opts.ResumeTimeout > 0 || opts.Identity != "" || opts.Parent != "" || opts.Meter != nil:
+		return nil, optionsError("Checkpoints can not be combined with halting, a consumer, multiple streams, resumable transfers, an identity, a parent or a meter")
+	case opts.PageAlign && opts.Dedup:
+		return nil, optionsError("Page aligned snapshots can not be combined with deduplication")
+	case opts.Keep < 0:
+		return nil, optionsError("The number of checkpoints to keep can not be negative: %d", opts.Keep)
+	}
+
+	runtime.LockOSThread()
+	rdr, err := attach(context.Background(), pid)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	this := &Watcher{
+		rdr:      rdr,
+		opts:     dest,
+		interval: opts.Interval,
+		keep:     opts.Keep,
+		prefix:   fmt.Sprintf("checkpoint-%d-", pid),
+		triggers: make(chan trigger, 16),
+	}
+	if info, err := os.Stat(dest.dest); err == nil && info.IsDir() {
+		removePartials(dest.dest, this.prefix)
+	}
+	return this, nil
+}
+
+//Run stays attached to the target, writing a checkpoint every interval (if
+// any) and whenever triggered or requested. It returns once the target exits, a
+// checkpoint halts it or ctx is done, which detaches leaving the target running.
+func (this *Watcher) Run(ctx context.Context) error {
+	defer runtime.UnlockOSThread()
+	defer this.stop(errs.New("No longer watching the target process"))
+
+	//Interrupts a checkpoint being written too
+	this.opts.ctx = ctx
+	stopWatch := context.AfterFunc(ctx, func() {
+		log.Printf("Detaching from target process %d", this.rdr.GetPID())
+		atomic.StoreInt32(&this.stopping, 1)
+		this.rdr.Freeze()
+	})
+	defer stopWatch()
+	var ticker *time.Ticker
+	if this.interval > 0 {
+		ticker = time.NewTicker(this.interval)
+		defer ticker.Stop()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					this.request(trigger{tick: true})
+				case <-done: //Run has returned
+					return
+				}
+			}
+		}()
+		//The target is frozen on entry, so the first checkpoint is written now
+		this.triggers <- trigger{}
+	}
+
+	//The target is frozen on entry, and again each time around
+	for {
+		if atomic.LoadInt32(&this.stopping) != 0 {
+			this.stop(errs.New("Detaching from the target process"))
+			return this.rdr.Close()
+		}
+		captured, halted := this.serveTriggers()
+		if halted {
+			this.stop(errs.New("The target process was halted"))
+			this.rdr.Close()
+			return nil
+		}
+		//The next periodic checkpoint is due an interval after the last capture,
+		// rather than as soon as the target resumes from a long one
+		if captured && ticker != nil {
+			ticker.Reset(this.interval)
+		}
+		if err := this.rdr.Resume(); err != nil {
+			return err
+		}
+
+		if err := this.rdr.WaitFrozen(); err == preader.ErrExited {
+			log.Printf("Target process %d exited, no further checkpoints will be written", this.rdr.GetPID())
+			this.stop(err)
+			this.rdr.Close() //Only its files remain to be released
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//PID returns that of the target process
+func (this *Watcher) PID() int {
+	return this.rdr.GetPID()
+}
+
+//Trigger requests a checkpoint with the watcher's settings without waiting for
+// it, such as on a signal. Triggers that pile up are coalesced.
+func (this *Watcher) Trigger() {
+	this.request(trigger{})
+}
+
+//Checkpoint requests a checkpoint and waits until it is written
+func (this *Watcher) Checkpoint(req WatchRequest) (WatchResult, error) {
+	done := make(chan watchResponse, 1)
+	this.request(trigger{req: req, done: done})
+	resp := <-done
+	return resp.result, resp.err
+}
+
+//request queues a checkpoint, it may be called from any goroutine. Triggers
+// without a request are dropped while many are pending.
+func (this *Watcher) request(trig trigger) {
+	this.lock.Lock()
+	queued, stopped := false, this.stopped
+	if !stopped {
+		select {
+		case this.triggers <- trig:
+			queued = true
+		default:
+		}
+	}
+	this.lock.Unlock()
+	if !queued {
+		if trig.done != nil {
+			err := errs.New("Too many checkpoints are pending")
+			if stopped {
+				err = errs.New("No longer watching the target process")
+			}
+			trig.done <- watchResponse{err: err}
+		}
+		return
+	}
+	if err := this.rdr.Freeze(); err != nil {
+		log.Printf("Could not freeze target process for a checkpoint; Details:\n\t%s", err)
+	}
+}
+
+//serveTriggers writes a checkpoint for every pending trigger while the target
+// is frozen and reports if any was captured and if one of them halted it.
+// Triggers without a request (ticks & signals) that pile up are coalesced, and
+// ticks that came due during a capture are dropped.
+func (this *Watcher) serveTriggers() (captured, halted bool) {
+	defaulted := false
+	for {
+		var trig trigger
+		select {
+		case trig = <-this.triggers:
+		default:
+			return captured, false
+		}
+		if trig.done == nil {
+			if defaulted || (trig.tick && captured) {
+				continue
+			}
+			defaulted = true
+		}
+		captured = true
+
+		start := time.Now()
+		path, err := this.checkpoint(trig.req)
+		frozen := time.Since(start)
+		resp := watchResponse{result: WatchResult{Path: path, Frozen: frozen}, err: err}
+		if err != nil {
+			log.Printf("Could not write checkpoint (target frozen for %s); Details:\n\t%s", frozen, err)
+		} else {
+			log.Printf("Wrote checkpoint %s (target frozen for %s)", path, frozen)
+		}
+
+		if err == nil && trig.req.Halt {
+			if err = this.rdr.GetProcess().Kill(); err != nil {
+				resp.err = errs.Append(err, "Could not halt target process as requested")
+			} else {
+				log.Printf("Halted target process %d as requested", this.rdr.GetPID())
+				halted = true
+			}
+		}
+		if trig.done != nil {
+			trig.done <- resp
+		}
+		if halted {
+			return true, true
+		}
+	}
+}
+
+//stop fails every trigger still pending with err, and any requested later
+func (this *Watcher) stop(err error) {
+	this.lock.Lock()
+	this.stopped = true
+	this.lock.Unlock()
+	for {
+		select {
+		case trig := <-this.triggers:
+			if trig.done != nil {
+				trig.done <- watchResponse{err: err}
+			}
+		default:
+			return
+		}
+	}
+}
+
+//apply returns opts overridden by the settings of the request
+func (this WatchRequest) apply(opts destOptions) (destOptions, error) {
+	if this.Dest.URL != "" {
+		dest, err := normalizeDest(this.Dest.URL)
+		if err != nil {
+			return opts, err
+		}
+		opts.dest = dest
+	}
+	if this.Dest.Compress != "" {
+		opts.compress = this.Dest.Compress
+	}
+	if this.Dest.CompressLevel != 0 {
+		opts.compressLevel = this.Dest.CompressLevel
+	}
+	if this.Dest.CompressDict != "" {
+		opts.compressDict = this.Dest.CompressDict
+	}
+	if this.Dest.Encrypt != "" {
+		opts.encrypt = this.Dest.Encrypt
+	}
+	if this.Dest.Checksum != "" {
+		opts.checksum = this.Dest.Checksum
+	}
+	return opts, nil
+}
+
+//checkpoint captures the frozen target as req asks. Directories receive a newly
+// named checkpoint and are pruned, files and objects are replaced, sockets and
+// URLs sent to and repositories add a snapshot.
+func (this *Watcher) checkpoint(req WatchRequest) (string, error) {
+	opts, err := req.apply(this.opts)
+	if err != nil {
+		return "", err
+	} else if opts.dest == "stdout" {
+		return "", errs.New("Checkpoints can not be written to stdout")
+	}
+	if isSocketDest(opts.dest) || prepo.IsRepo(opts.dest) || s3.IsURL(opts.dest) || isHTTPDest(opts.dest) {
+		stream, err := openDestStream(opts, transpenc.TranportEncoding{})
+		if err != nil {
+			return "", err
+		}
+		var wtr *pwriter.ProcSnapshotWriter
+		if wtr, err = newSnapshotWriter(stream, opts); err == nil {
+			err = lib.ConsumeContext(opts.ctx, wtr, this.rdr)
+		}
+		if err == nil {
+			err = stream.finish()
+		}
+		if err != nil {
+			stream.abort()
+			return "", err
+		}
+		if err = stream.Close(); err != nil || !prepo.IsRepo(opts.dest) {
+			return opts.dest, err
+		}
+		if err = pruneRepoSnapshots(opts.dest, this.opts.pid, this.keep); err != nil {
+			log.Printf("Could not prune old snapshots; Details:\n\t%s", err)
+		}
+		return describeDest(opts.dest, stream), nil
+	}
+
+	info, err := os.Stat(opts.dest)
+	if err != nil || !info.IsDir() {
+		return opts.dest, writeCheckpoint(this.rdr, opts.dest, opts)
+	}
+	dir := opts.dest
+	path := filepath.Join(dir, this.prefix+time.Now().UTC().Format(checkpointStamp)+checkpointExt)
+	if err = writeCheckpoint(this.rdr, path, opts); err != nil {
+		return "", err
+	}
+	if err = pruneCheckpoints(dir, this.prefix, this.keep); err != nil {
+		log.Printf("Could not prune old checkpoints; Details:\n\t%s", err)
+	}
+	return path, nil
+}
+
+//writeCheckpoint writes a snapshot under a temporary name, syncs it and only
+// then renames it to path, so a checkpoint that exists is complete
+func writeCheckpoint(rdr *preader.ProcReader, path string, opts destOptions) error {
+	partialPath := path + partialExt
+	opts.dest = partialPath
+	stream, err := openDestStream(opts, transpenc.TranportEncoding{})
+	if err != nil {
+		return err
+	}
+
+	wtr := pwriter.NewProcSnapshotWriter(stream)
+	if opts.pageAlign {
+		wtr = pwriter.NewAlignedSnapshotWriter(stream)
+	}
+	if err = lib.ConsumeContext(opts.ctx, wtr, rdr); err == nil {
+		err = stream.finish()
+	}
+	if file, isFile := stream.dstWriter.(*os.File); isFile && err == nil {
+		if err = file.Sync(); err != nil {
+			err = errs.Append(err, "Could not sync checkpoint: %s", partialPath)
+		}
+	}
+	if closeErr := stream.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partialPath, path)
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+
+	//Persist the rename too
+	if dirFile, err := os.Open(filepath.Dir(path)); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
+
+//pruneCheckpoints removes all but the newest keep checkpoints, 0 keeps all
+func pruneCheckpoints(dir, prefix string, keep int) error {
+	if keep < 1 {
+		return nil
+	}
+	names, err := listCheckpoints(dir, prefix, checkpointExt)
+	if err != nil {
+		return err
+	}
+	//Timestamps sort chronologically
+	sort.Strings(names)
+	for _, name := range names[:max(len(names)-keep, 0)] {
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			return errs.Append(err, "Could not remove checkpoint: %s", name)
+		}
+	}
+	return nil
+}
+
+//removePartials cleans up after an earlier run that was interrupted mid write
+func removePartials(dir, prefix string) {
+	names, _ := listCheckpoints(dir, prefix, checkpointExt+partialExt)
+	for _, name := range names {
+		os.Remove(filepath.Join(dir, name))
+	}
+}
+
+func listCheckpoints(dir, prefix, ext string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errs.Append(err, "Could not list checkpoint directory: %s", dir)
+	}
+	var names []string
+	for _, info := range infos {
+		if name := info.Name(); info.Mode().IsRegular() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ext) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}